@@ -26,12 +26,22 @@ func main() {
 Usage:
     mrg
     mrg --reverse
+    mrg [--defaults=<file>] <pipeline> <params>
     mrg -h | --help | --version
 
+With no arguments, reads invocation data json from standard input.
+
+Given a pipeline or stage name and a params file, finds the pipeline in
+MROPATH and checks the parameter values against its input types before
+generating the invocation.  Params files ending in .yaml or .yml are read
+as yaml, and others as json.
+
 Options:
-    --reverse       Generate invocation data from mro source.
-    -h --help       Show this message.
-    --version       Show version.`
+    --reverse           Generate invocation data from mro source.
+    --defaults=<file>   Params file with values to use for parameters
+                            which are not given in <params>.
+    -h --help           Show this message.
+    --version           Show version.`
 	martianVersion := util.GetVersion()
 	opts, _ := docopt.Parse(doc, nil, true, martianVersion, false)
 
@@ -65,6 +75,13 @@ Options:
 			os.Stderr.WriteString("\n")
 			os.Exit(1)
 		}
+		os.Exit(0)
+	}
+
+	if name, ok := opts["<pipeline>"].(string); ok && name != "" {
+		defaults, _ := opts["--defaults"].(string)
+		os.Exit(generateFromParams(name, opts["<params>"].(string),
+			defaults, mroPaths))
 	}
 
 	// Read and parse JSON from stdin.
@@ -84,3 +101,60 @@ Options:
 	}
 	os.Exit(1)
 }
+
+// Generate an invocation of the given pipeline from params files, and return
+// the exit code.
+func generateFromParams(name, paramsFile, defaultsFile string, mroPaths []string) int {
+	params, err := readParams(paramsFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var defaults core.LazyArgumentMap
+	if defaultsFile != "" {
+		if defaults, err = readParams(defaultsFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	callable, lookup, err := core.GetCallable(mroPaths, name, true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	args, alarms, err := core.MergeInvocationArgs(callable, lookup,
+		params, defaults)
+	if alarms != "" {
+		fmt.Fprint(os.Stderr, alarms)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid parameters for %s: %v\n", name, err)
+		return 1
+	}
+	src, err := core.BuildCallSource(name, args.ToMarshalerMap(), nil,
+		callable, lookup, mroPaths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Print(src)
+	return 0
+}
+
+// Read a json or yaml params file.
+func readParams(fn string) (core.LazyArgumentMap, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if ext := filepath.Ext(fn); ext == ".yaml" || ext == ".yml" {
+		if b, err = yamlToJson(b); err != nil {
+			return nil, fmt.Errorf("%s: %w", fn, err)
+		}
+	}
+	var params core.LazyArgumentMap
+	if err := json.Unmarshal(b, &params); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return params, nil
+}
@@ -0,0 +1,649 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package main
+
+// A reader for the subset of YAML which is useful for writing pipeline
+// parameters.  It supports block mappings and sequences, single-line flow
+// collections, quoted and plain scalars, literal and folded block scalars,
+// and comments.  Anchors, aliases, tags, and multiple documents are not
+// supported.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// yamlToJson converts a YAML document to the equivalent JSON.  The order of
+// keys in mappings is preserved.
+func yamlToJson(src []byte) ([]byte, error) {
+	p := yamlParser{
+		lines: strings.Split(strings.ReplaceAll(string(src), "\r\n", "\n"), "\n"),
+	}
+	var buf bytes.Buffer
+	if err := p.parseValue(&buf, -1); err != nil {
+		return nil, err
+	}
+	if line, err := p.peek(); err != nil {
+		return nil, err
+	} else if line != nil {
+		return nil, fmt.Errorf("line %d: unexpected content", line.num)
+	}
+	return buf.Bytes(), nil
+}
+
+type yamlLine struct {
+	// The column at which the content starts.
+	indent int
+	// The content, without comments or trailing whitespace.
+	text string
+	// The 1-based line number.
+	num int
+}
+
+type yamlParser struct {
+	lines []string
+	pos   int
+
+	// The content of a sequence item which is on the same line as the
+	// item marker, which replaces the line at pos.
+	pending *yamlLine
+
+	started bool
+}
+
+// peek returns the next line with content, or nil at the end of the
+// document.
+func (self *yamlParser) peek() (*yamlLine, error) {
+	if self.pending != nil {
+		return self.pending, nil
+	}
+	for ; self.pos < len(self.lines); self.pos++ {
+		raw := self.lines[self.pos]
+		text := strings.TrimLeft(raw, " ")
+		indent := len(raw) - len(text)
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation",
+				self.pos+1)
+		}
+		text = strings.TrimRight(stripYamlComment(text), " \t")
+		if text == "" {
+			continue
+		}
+		if indent == 0 && (text == "---" || strings.HasPrefix(text, "--- ")) {
+			if self.started {
+				return nil, fmt.Errorf(
+					"line %d: multiple documents are not supported",
+					self.pos+1)
+			}
+			if text = strings.TrimLeft(text[3:], " "); text == "" {
+				continue
+			}
+			indent = len(raw) - len(strings.TrimLeft(raw[3:], " "))
+		} else if indent == 0 && (text == "..." || text[0] == '%') {
+			continue
+		}
+		self.started = true
+		self.pending = &yamlLine{
+			indent: indent,
+			text:   text,
+			num:    self.pos + 1,
+		}
+		return self.pending, nil
+	}
+	return nil, nil
+}
+
+// advance moves past the line most recently returned by peek.
+func (self *yamlParser) advance() {
+	self.pending = nil
+	self.pos++
+}
+
+// parseValue parses the node starting at the next line, which must be
+// indented more than the parent.  If it is not, the value is null.
+func (self *yamlParser) parseValue(buf *bytes.Buffer, parent int) error {
+	line, err := self.peek()
+	if err != nil {
+		return err
+	}
+	if line == nil || line.indent <= parent {
+		buf.WriteString("null")
+		return nil
+	}
+	if isYamlSeqItem(line.text) {
+		return self.parseSeq(buf, line.indent)
+	}
+	if _, _, ok, err := splitYamlKey(line.text, line.num); err != nil {
+		return err
+	} else if ok {
+		return self.parseMap(buf, line.indent)
+	}
+	self.advance()
+	return self.parseScalar(buf, line.text, parent, line.num)
+}
+
+// parseSeq parses a block sequence with items at the given indentation.
+func (self *yamlParser) parseSeq(buf *bytes.Buffer, indent int) error {
+	buf.WriteByte('[')
+	for i := 0; ; i++ {
+		line, err := self.peek()
+		if err != nil {
+			return err
+		}
+		if line == nil || line.indent < indent ||
+			line.indent == indent && !isYamlSeqItem(line.text) {
+			break
+		}
+		if line.indent > indent {
+			return fmt.Errorf("line %d: unexpected indentation", line.num)
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		content := strings.TrimLeft(line.text[1:], " ")
+		if content == "" {
+			self.advance()
+			if err := self.parseValue(buf, indent); err != nil {
+				return err
+			}
+		} else {
+			// Treat the rest of the line as though it were on its own line,
+			// so that a mapping in the item may continue on the next line.
+			self.pending = &yamlLine{
+				indent: line.indent + len(line.text) - len(content),
+				text:   content,
+				num:    line.num,
+			}
+			if err := self.parseValue(buf, indent); err != nil {
+				return err
+			}
+		}
+	}
+	buf.WriteByte(']')
+	return nil
+}
+
+// parseMap parses a block mapping with keys at the given indentation.
+func (self *yamlParser) parseMap(buf *bytes.Buffer, indent int) error {
+	buf.WriteByte('{')
+	seen := make(map[string]struct{})
+	for {
+		line, err := self.peek()
+		if err != nil {
+			return err
+		}
+		if line == nil || line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return fmt.Errorf("line %d: unexpected indentation", line.num)
+		}
+		key, rest, ok, err := splitYamlKey(line.text, line.num)
+		if err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("line %d: expected a key", line.num)
+		}
+		if _, dup := seen[key]; dup {
+			return fmt.Errorf("line %d: duplicate key %q", line.num, key)
+		}
+		seen[key] = struct{}{}
+		if len(seen) > 1 {
+			buf.WriteByte(',')
+		}
+		writeJsonString(buf, key)
+		buf.WriteByte(':')
+		self.advance()
+		if rest != "" {
+			err = self.parseScalar(buf, rest, indent, line.num)
+		} else if next, perr := self.peek(); perr != nil {
+			err = perr
+		} else if next != nil && next.indent == indent &&
+			isYamlSeqItem(next.text) {
+			// Sequences are allowed at the same indentation as their key.
+			err = self.parseSeq(buf, indent)
+		} else {
+			err = self.parseValue(buf, indent)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// parseScalar parses a value which starts on the same line as its key or
+// sequence item marker.
+func (self *yamlParser) parseScalar(buf *bytes.Buffer, text string,
+	parent, num int) error {
+	switch text[0] {
+	case '|', '>':
+		return self.parseBlockScalar(buf, text, parent, num)
+	case '&', '*', '!':
+		return fmt.Errorf("line %d: anchors, aliases, and tags are not supported",
+			num)
+	}
+	fp := yamlFlowParser{text: text, num: num}
+	if err := fp.parseValue(buf, false); err != nil {
+		return err
+	}
+	if fp.skipSpace(); fp.pos < len(fp.text) {
+		return fmt.Errorf("line %d: unexpected %q", num, fp.text[fp.pos:])
+	}
+	return nil
+}
+
+// parseBlockScalar parses a literal (|) or folded (>) block scalar, whose
+// content is on the following lines which are indented more than the parent.
+func (self *yamlParser) parseBlockScalar(buf *bytes.Buffer, header string,
+	parent, num int) error {
+	folded := header[0] == '>'
+	chomp := byte(0)
+	blockIndent := -1
+	for _, c := range []byte(header[1:]) {
+		switch {
+		case (c == '-' || c == '+') && chomp == 0:
+			chomp = c
+		case c >= '1' && c <= '9' && blockIndent < 0:
+			blockIndent = int(c - '0')
+			if parent > 0 {
+				blockIndent += parent
+			}
+		default:
+			return fmt.Errorf("line %d: invalid block scalar header %q",
+				num, header)
+		}
+	}
+	var lines []string
+	for ; self.pos < len(self.lines); self.pos++ {
+		raw := strings.TrimRight(self.lines[self.pos], " \t")
+		if raw == "" {
+			lines = append(lines, "")
+			continue
+		}
+		indent := len(raw) - len(strings.TrimLeft(raw, " "))
+		if indent <= parent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = indent
+		} else if indent < blockIndent {
+			break
+		}
+		lines = append(lines, raw[blockIndent:])
+	}
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+	var sb strings.Builder
+	for i, line := range lines {
+		if i > 0 {
+			if !folded || line == "" {
+				sb.WriteByte('\n')
+			} else if lines[i-1] != "" {
+				// Line breaks between non-empty lines are folded into spaces.
+				sb.WriteByte(' ')
+			}
+		}
+		sb.WriteString(line)
+	}
+	if len(lines) > 0 && chomp != '-' {
+		sb.WriteByte('\n')
+	}
+	if chomp == '+' {
+		sb.WriteString(strings.Repeat("\n", trailing))
+	}
+	writeJsonString(buf, sb.String())
+	return nil
+}
+
+// yamlFlowParser parses a value on a single line, including flow sequences
+// and mappings.
+type yamlFlowParser struct {
+	text string
+	pos  int
+	num  int
+}
+
+func (self *yamlFlowParser) skipSpace() {
+	for self.pos < len(self.text) && self.text[self.pos] == ' ' {
+		self.pos++
+	}
+}
+
+func (self *yamlFlowParser) errorf(msg string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", self.num, fmt.Sprintf(msg, args...))
+}
+
+// parseValue parses a flow value.  If inFlow is true, plain scalars end at
+// flow indicators.
+func (self *yamlFlowParser) parseValue(buf *bytes.Buffer, inFlow bool) error {
+	self.skipSpace()
+	if self.pos >= len(self.text) {
+		buf.WriteString("null")
+		return nil
+	}
+	switch self.text[self.pos] {
+	case '[':
+		return self.parseSeq(buf)
+	case '{':
+		return self.parseMap(buf)
+	case '"', '\'':
+		s, err := self.parseQuoted()
+		if err != nil {
+			return err
+		}
+		writeJsonString(buf, s)
+		return nil
+	case '&', '*', '!':
+		return self.errorf("anchors, aliases, and tags are not supported")
+	}
+	start := self.pos
+	if inFlow {
+		for self.pos < len(self.text) &&
+			strings.IndexByte(",]}", self.text[self.pos]) < 0 {
+			self.pos++
+		}
+	} else {
+		self.pos = len(self.text)
+	}
+	return self.writePlain(buf, strings.TrimRight(self.text[start:self.pos], " "))
+}
+
+func (self *yamlFlowParser) parseSeq(buf *bytes.Buffer) error {
+	self.pos++
+	buf.WriteByte('[')
+	for i := 0; ; i++ {
+		self.skipSpace()
+		if self.pos >= len(self.text) {
+			return self.errorf("unterminated flow sequence")
+		}
+		if self.text[self.pos] == ']' {
+			self.pos++
+			break
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := self.parseValue(buf, true); err != nil {
+			return err
+		}
+		if err := self.endItem(']'); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(']')
+	return nil
+}
+
+func (self *yamlFlowParser) parseMap(buf *bytes.Buffer) error {
+	self.pos++
+	buf.WriteByte('{')
+	seen := make(map[string]struct{})
+	for {
+		self.skipSpace()
+		if self.pos >= len(self.text) {
+			return self.errorf("unterminated flow mapping")
+		}
+		if self.text[self.pos] == '}' {
+			self.pos++
+			break
+		}
+		key, err := self.parseKey()
+		if err != nil {
+			return err
+		}
+		if _, dup := seen[key]; dup {
+			return self.errorf("duplicate key %q", key)
+		}
+		seen[key] = struct{}{}
+		if len(seen) > 1 {
+			buf.WriteByte(',')
+		}
+		writeJsonString(buf, key)
+		buf.WriteByte(':')
+		if err := self.parseValue(buf, true); err != nil {
+			return err
+		}
+		if err := self.endItem('}'); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// parseKey parses a key in a flow mapping, including the following colon.
+func (self *yamlFlowParser) parseKey() (string, error) {
+	var key string
+	if c := self.text[self.pos]; c == '"' || c == '\'' {
+		s, err := self.parseQuoted()
+		if err != nil {
+			return "", err
+		}
+		key = s
+		self.skipSpace()
+	} else {
+		start := self.pos
+		for self.pos < len(self.text) &&
+			strings.IndexByte(":,]}", self.text[self.pos]) < 0 {
+			self.pos++
+		}
+		key = strings.TrimRight(self.text[start:self.pos], " ")
+	}
+	if self.pos >= len(self.text) || self.text[self.pos] != ':' {
+		return "", self.errorf("expected ':' after key %q", key)
+	}
+	self.pos++
+	return key, nil
+}
+
+// endItem consumes the separator after an item in a flow collection, but
+// not the closing bracket.
+func (self *yamlFlowParser) endItem(end byte) error {
+	self.skipSpace()
+	if self.pos >= len(self.text) {
+		if end == ']' {
+			return self.errorf("unterminated flow sequence")
+		}
+		return self.errorf("unterminated flow mapping")
+	}
+	switch self.text[self.pos] {
+	case ',':
+		self.pos++
+		return nil
+	case end:
+		return nil
+	}
+	return self.errorf("expected ',' or '%c'", end)
+}
+
+// parseQuoted parses a single- or double-quoted string.
+func (self *yamlFlowParser) parseQuoted() (string, error) {
+	s, n, err := unquoteYaml(self.text[self.pos:])
+	if err != nil {
+		return "", self.errorf("%v", err)
+	}
+	self.pos += n
+	return s, nil
+}
+
+var (
+	yamlIntPattern   = regexp.MustCompile(`^[-+]?[0-9]+$`)
+	yamlFloatPattern = regexp.MustCompile(
+		`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+)
+
+// writePlain writes the JSON value for a plain (unquoted) scalar, following
+// the YAML 1.2 core schema.
+func (self *yamlFlowParser) writePlain(buf *bytes.Buffer, s string) error {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		buf.WriteString("null")
+		return nil
+	case "true", "True", "TRUE":
+		buf.WriteString("true")
+		return nil
+	case "false", "False", "FALSE":
+		buf.WriteString("false")
+		return nil
+	case ".inf", ".Inf", ".INF", "+.inf", "+.Inf", "+.INF",
+		"-.inf", "-.Inf", "-.INF", ".nan", ".NaN", ".NAN":
+		return self.errorf("%s cannot be represented in json", s)
+	}
+	if yamlIntPattern.MatchString(s) {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			buf.WriteString(strconv.FormatInt(i, 10))
+			return nil
+		}
+		return self.errorf("integer %s is out of range", s)
+	}
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0o") {
+		base := 16
+		if s[1] == 'o' {
+			base = 8
+		}
+		if i, err := strconv.ParseInt(s[2:], base, 64); err == nil {
+			buf.WriteString(strconv.FormatInt(i, 10))
+			return nil
+		}
+	}
+	if yamlFloatPattern.MatchString(s) {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsInf(f, 0) {
+			return self.errorf("number %s is out of range", s)
+		}
+		v := strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(v, ".e") {
+			v += ".0"
+		}
+		buf.WriteString(v)
+		return nil
+	}
+	writeJsonString(buf, s)
+	return nil
+}
+
+// unquoteYaml parses a quoted string at the start of s, returning the
+// string and the number of bytes consumed.
+func unquoteYaml(s string) (string, int, error) {
+	if s[0] == '\'' {
+		var sb strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\'' {
+				if i+1 < len(s) && s[i+1] == '\'' {
+					sb.WriteByte('\'')
+					i++
+				} else {
+					return sb.String(), i + 1, nil
+				}
+			} else {
+				sb.WriteByte(s[i])
+			}
+		}
+		return "", 0, fmt.Errorf("unterminated string")
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			v, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid string %s: %w", s[:i+1], err)
+			}
+			return v, i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// splitYamlKey splits a line of a block mapping into the key and the rest
+// of the line after the colon.  If the line is not a mapping entry, ok is
+// false.
+func splitYamlKey(text string, num int) (key, rest string, ok bool, err error) {
+	switch text[0] {
+	case '"', '\'':
+		key, n, err := unquoteYaml(text)
+		if err != nil {
+			// This could still be a valid multi-line string, but those
+			// aren't supported anyway.
+			return "", "", false, fmt.Errorf("line %d: %w", num, err)
+		}
+		after := strings.TrimLeft(text[n:], " ")
+		if after == ":" || strings.HasPrefix(after, ": ") {
+			return key, strings.TrimLeft(after[1:], " "), true, nil
+		}
+		return "", "", false, nil
+	case '[', '{', '|', '>':
+		return "", "", false, nil
+	}
+	if isYamlSeqItem(text) {
+		return "", "", false, nil
+	}
+	if strings.HasSuffix(text, ":") && !strings.Contains(text, ": ") {
+		return strings.TrimRight(text[:len(text)-1], " "), "", true, nil
+	}
+	if i := strings.Index(text, ": "); i > 0 {
+		return strings.TrimRight(text[:i], " "),
+			strings.TrimLeft(text[i+2:], " "), true, nil
+	}
+	return "", "", false, nil
+}
+
+func isYamlSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// stripYamlComment removes a comment from the end of a line.  Comments start
+// with a # at the start of the line or after whitespace, outside of quotes.
+func stripYamlComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		case (c == '"' || c == '\'') && startsYamlToken(text[:i]):
+			quote = c
+		}
+	}
+	return text
+}
+
+// startsYamlToken returns true if a quote following the given prefix would
+// start a quoted scalar.
+func startsYamlToken(prefix string) bool {
+	prefix = strings.TrimRight(prefix, " ")
+	if prefix == "" {
+		return true
+	}
+	switch prefix[len(prefix)-1] {
+	case ':', '-', '[', '{', ',', '?':
+		return true
+	}
+	return false
+}
+
+func writeJsonString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	// Encode never fails for strings.
+	_ = enc.Encode(s)
+	// Remove the trailing newline added by Encode.
+	buf.Truncate(buf.Len() - 1)
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestYamlToJson(t *testing.T) {
+	check := func(t *testing.T, src, expect string) {
+		t.Helper()
+		b, err := yamlToJson([]byte(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(b); s != expect {
+			t.Errorf("expected\n%s\ngot\n%s", expect, s)
+		}
+	}
+	t.Run("mapping", func(t *testing.T) {
+		check(t, `---
+# A comment
+sample_id: "ABC # 1"  # trailing comment
+threads: 4
+ratio: 1.5e3
+enabled: yes
+verbose: false
+reference: ~
+path: /data/it's here
+`,
+			`{"sample_id":"ABC # 1","threads":4,"ratio":1500.0,`+
+				`"enabled":"yes","verbose":false,"reference":null,`+
+				`"path":"/data/it's here"}`)
+	})
+	t.Run("nested", func(t *testing.T) {
+		check(t, `samples:
+- name: a
+  lanes: [1, 2]
+- name: 'b''s'
+  lanes:
+    - 3
+tags: {x: "1", y: [true, null]}
+empty:
+`,
+			`{"samples":[{"name":"a","lanes":[1,2]},{"name":"b's","lanes":[3]}],`+
+				`"tags":{"x":"1","y":[true,null]},"empty":null}`)
+	})
+	t.Run("block", func(t *testing.T) {
+		check(t, `literal: |
+  line one
+    indented
+
+folded: >-
+  one
+  two
+
+  three
+after: 0x10
+`,
+			`{"literal":"line one\n  indented\n","folded":"one two\nthree",`+
+				`"after":16}`)
+	})
+	t.Run("sequence", func(t *testing.T) {
+		check(t, "- 1\n- \"a\\tb\"\n-\n  - x\n", `[1,"a\tb",["x"]]`)
+	})
+}
+
+func TestYamlToJsonErrors(t *testing.T) {
+	for _, c := range []struct {
+		src    string
+		expect string
+	}{
+		{"a: 1\na: 2\n", `line 2: duplicate key "a"`},
+		{"a: 1\n   b: 2\n", "line 2: unexpected indentation"},
+		{"a: [1, 2\n", "line 1: unterminated flow sequence"},
+		{"a: &x 1\n", "line 1: anchors, aliases, and tags are not supported"},
+		{"a: .nan\n", "line 1: .nan cannot be represented in json"},
+		{"a: 1\n---\nb: 2\n", "line 2: multiple documents are not supported"},
+	} {
+		if _, err := yamlToJson([]byte(c.src)); err == nil {
+			t.Errorf("expected error for %q", c.src)
+		} else if err.Error() != c.expect {
+			t.Errorf("expected error %q, got %q", c.expect, err.Error())
+		}
+	}
+}
@@ -41,6 +41,9 @@ type runner struct {
 	start       time.Time
 	isDone      chan struct{}
 	perfDone    <-chan struct{}
+
+	// The kernel's out-of-memory kill count when the stage code started.
+	oomKills int64
 }
 
 func main() {
@@ -317,6 +320,7 @@ func (self *runner) StartJob(args []string) error {
 		util.EnterCriticalSection()
 		defer util.ExitCriticalSection()
 		self.job = cmd
+		self.oomKills = util.GetOOMKillCount()
 		return self.job.Start()
 	}(); err != nil {
 		self.errorReader.Close()
@@ -446,13 +450,21 @@ func externalSignal(sig syscall.Signal) bool {
 // Convert an exec.ExitError to a stageReturnedError if the failure was due to
 // one of the signals that we choose to handle.  This allows restart logic to
 // work correctly.
-func sigToErr(err error) error {
+func (self *runner) sigToErr(err error) error {
 	if err == nil {
 		return err
 	}
 	if exitErr, ok := err.(*exec.ExitError); ok {
 		if state, ok := exitErr.Sys().(*syscall.WaitStatus); ok &&
 			state.Signaled() && externalSignal(state.Signal()) {
+			if state.Signal() == syscall.SIGKILL && self.oomKills >= 0 &&
+				util.GetOOMKillCount() > self.oomKills {
+				// Distinguish this from other kills so that the memory
+				// reservation can be escalated on retry.
+				return &stageReturnedError{
+					message: "stage code was killed by the out-of-memory killer",
+				}
+			}
 			return &stageReturnedError{
 				message: fmt.Sprintf(
 					"stage code received signal: %v", state.Signal()),
@@ -481,7 +493,7 @@ func (self *runner) WaitLoop() {
 			wait <- &stageReturnedError{message: string(errorBytes)}
 		} else {
 			close(self.isDone)
-			wait <- sigToErr(self.job.Wait())
+			wait <- self.sigToErr(self.job.Wait())
 		}
 	}()
 	// Make sure we record at least one memory high-water mark, even
@@ -0,0 +1,177 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package cost
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/martian-lang/martian/martian/core"
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+// Prices used to compute the cost of a pipestance.
+type Rates struct {
+	// The cost of one core reserved for one hour.
+	CoreHour float64 `json:"core_hour"`
+
+	// The cost of one GB of memory reserved for one hour.
+	GBHour float64 `json:"gb_hour"`
+}
+
+// Thresholds for reporting memory reservations which were much larger than
+// the memory which was actually used.
+type OverRequest struct {
+	// The minimum ratio of requested to observed memory.
+	Ratio float64
+
+	// The minimum difference between requested and observed memory, in GB,
+	// so that stages which requested the minimum reservation are not
+	// reported.
+	SlackGB float64
+}
+
+// Resource usage and cost for a single stage, or for a whole pipestance.
+type Usage struct {
+	Name  string `json:"name"`
+	Forks int    `json:"forks"`
+	Jobs  int    `json:"jobs"`
+
+	CoreHours float64 `json:"core_hours"`
+
+	// The largest memory reservation for any job, in GB.
+	MemGBRequested float64 `json:"mem_gb_requested"`
+
+	// The largest peak RSS for any job, in GB.
+	MemGBObserved float64 `json:"mem_gb_observed"`
+
+	// Reserved memory multiplied by job duration.
+	MemGBHours float64 `json:"mem_gb_hours"`
+
+	// Seconds from the start of the first job to the end of the last one.
+	WallTime float64 `json:"walltime"`
+
+	InBytes  int64 `json:"in_bytes"`
+	OutBytes int64 `json:"out_bytes"`
+
+	// The largest amount of storage used by the node's files at any one
+	// time.
+	MaxBytes int64 `json:"max_bytes"`
+
+	Cost float64 `json:"cost"`
+
+	// True if the memory reservation was much larger than the observed peak.
+	OverRequested bool `json:"over_requested,omitempty"`
+}
+
+// The cost report for a single pipestance.
+type PipestanceReport struct {
+	Path   string   `json:"path"`
+	Stages []*Usage `json:"stages"`
+	Total  *Usage   `json:"total"`
+}
+
+// The cost report for a set of pipestances.
+type Report struct {
+	Rates       Rates               `json:"rates"`
+	Pipestances []*PipestanceReport `json:"pipestances"`
+}
+
+// Read the performance information for the pipestance in the given
+// directory.
+func loadPerf(psPath string) ([]*core.NodePerfInfo, error) {
+	b, err := ioutil.ReadFile(path.Join(psPath, core.Perf.FileName()))
+	if err != nil {
+		return nil, err
+	}
+	var perf []*core.NodePerfInfo
+	if err := json.Unmarshal(b, &perf); err != nil {
+		return nil, fmt.Errorf("reading performance info for %s: %v",
+			psPath, err)
+	}
+	return perf, nil
+}
+
+func (self *Usage) addStats(stats *core.PerfInfo, rates *Rates) {
+	self.Jobs = stats.NumJobs
+	self.CoreHours = stats.CoreHours
+	self.MemGBRequested = stats.MemGB
+	self.MemGBObserved = float64(stats.MaxRss) / (1024 * 1024)
+	self.MemGBHours = stats.MemGBHours
+	self.WallTime = stats.WallTime
+	self.InBytes = stats.InBytes
+	self.OutBytes = stats.OutBytes
+	self.Cost = self.CoreHours*rates.CoreHour + self.MemGBHours*rates.GBHour
+}
+
+func (self *Usage) checkMemory(thresholds *OverRequest) {
+	self.OverRequested = self.MemGBObserved > 0 &&
+		self.MemGBRequested >= thresholds.Ratio*self.MemGBObserved &&
+		self.MemGBRequested-self.MemGBObserved >= thresholds.SlackGB
+}
+
+// Compute the resource usage for each stage in a pipestance, from its
+// performance information.
+func computeUsage(psPath string, perf []*core.NodePerfInfo,
+	rates *Rates, thresholds *OverRequest) *PipestanceReport {
+	report := PipestanceReport{
+		Path:  psPath,
+		Total: new(Usage),
+	}
+	stats := make([]*core.PerfInfo, 0, len(perf))
+	for _, node := range perf {
+		if node.MaxBytes > report.Total.MaxBytes {
+			report.Total.MaxBytes = node.MaxBytes
+		}
+		if node.Type != syntax.KindStage {
+			if report.Total.Name == "" ||
+				len(node.Fqname) < len(report.Total.Name) {
+				report.Total.Name = node.Fqname
+			}
+			continue
+		}
+		forkStats := make([]*core.PerfInfo, 0, len(node.Forks))
+		for _, fork := range node.Forks {
+			if fork.ForkStats != nil && fork.ForkStats.NumJobs > 0 {
+				forkStats = append(forkStats, fork.ForkStats)
+			}
+		}
+		if len(forkStats) == 0 {
+			continue
+		}
+		usage := Usage{
+			Name:     core.PartiallyQualifiedName(node.Fqname),
+			Forks:    len(forkStats),
+			MaxBytes: node.MaxBytes,
+		}
+		stageStats := core.ComputeStats(forkStats, nil, nil)
+		usage.addStats(stageStats, rates)
+		usage.checkMemory(thresholds)
+		report.Stages = append(report.Stages, &usage)
+		report.Total.Forks += usage.Forks
+		stats = append(stats, stageStats)
+	}
+	report.Total.Name = core.PartiallyQualifiedName(report.Total.Name)
+	report.Total.addStats(core.ComputeStats(stats, nil, nil), rates)
+	return &report
+}
+
+// Generate a cost report for the given pipestance directories.
+func makeReport(psPaths []string, rates Rates,
+	thresholds *OverRequest) (*Report, error) {
+	report := Report{
+		Rates:       rates,
+		Pipestances: make([]*PipestanceReport, 0, len(psPaths)),
+	}
+	for _, psPath := range psPaths {
+		perf, err := loadPerf(psPath)
+		if err != nil {
+			return nil, err
+		}
+		report.Pipestances = append(report.Pipestances,
+			computeUsage(psPath, perf, &report.Rates, thresholds))
+	}
+	return &report, nil
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package cost
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/martian-lang/martian/martian/core"
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+func makeTestPerf() []*core.NodePerfInfo {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	job := func(threads, memGB, hours float64, rssGB int, offset time.Duration) *core.PerfInfo {
+		return &core.PerfInfo{
+			NumJobs:    1,
+			NumThreads: threads,
+			Duration:   hours * 3600,
+			CoreHours:  threads * hours,
+			MemGB:      memGB,
+			MemGBHours: memGB * hours,
+			MaxRss:     rssGB * 1024 * 1024,
+			InBytes:    1000,
+			OutBytes:   2000,
+			Start:      start.Add(offset),
+			End:        start.Add(offset + time.Duration(hours*float64(time.Hour))),
+		}
+	}
+	return []*core.NodePerfInfo{
+		{
+			Fqname:   "ID.ps.PIPE",
+			Type:     syntax.KindPipeline,
+			MaxBytes: 5000,
+		},
+		{
+			Fqname:   "ID.ps.PIPE.SPLIT_STAGE",
+			Type:     syntax.KindStage,
+			MaxBytes: 3000,
+			Forks: []*core.ForkPerfInfo{{
+				ForkStats: core.ComputeStats([]*core.PerfInfo{
+					job(1, 1, 0.5, 1, 0),
+					job(4, 16, 1, 2, 30*time.Minute),
+					job(4, 16, 1, 1, 30*time.Minute),
+				}, nil, nil),
+			}},
+		},
+		{
+			Fqname:   "ID.ps.PIPE.SMALL_STAGE",
+			Type:     syntax.KindStage,
+			MaxBytes: 100,
+			Forks: []*core.ForkPerfInfo{{
+				ForkStats: core.ComputeStats([]*core.PerfInfo{
+					job(1, 1.5, 0.5, 1, 90*time.Minute),
+				}, nil, nil),
+			}},
+		},
+		{
+			Fqname: "ID.ps.PIPE.DISABLED_STAGE",
+			Type:   syntax.KindStage,
+			Forks: []*core.ForkPerfInfo{{
+				ForkStats: new(core.PerfInfo),
+			}},
+		},
+	}
+}
+
+func TestComputeUsage(t *testing.T) {
+	report := computeUsage("/ps", makeTestPerf(),
+		&Rates{CoreHour: 0.5, GBHour: 0.25},
+		&OverRequest{Ratio: 2, SlackGB: 1})
+	if len(report.Stages) != 2 {
+		t.Fatalf("Expected 2 stages, got %d", len(report.Stages))
+	}
+	split := report.Stages[0]
+	if split.Name != "PIPE.SPLIT_STAGE" {
+		t.Errorf("Expected PIPE.SPLIT_STAGE, got %s", split.Name)
+	}
+	if split.Jobs != 3 {
+		t.Errorf("Expected 3 jobs, got %d", split.Jobs)
+	}
+	if split.CoreHours != 8.5 {
+		t.Errorf("Expected 8.5 core hours, got %g", split.CoreHours)
+	}
+	if split.MemGBRequested != 16 || split.MemGBObserved != 2 {
+		t.Errorf("Expected 16 GB requested and 2 observed, got %g and %g",
+			split.MemGBRequested, split.MemGBObserved)
+	}
+	if split.MemGBHours != 32.5 {
+		t.Errorf("Expected 32.5 GB-hours, got %g", split.MemGBHours)
+	}
+	if split.WallTime != 5400 {
+		t.Errorf("Expected 5400 seconds, got %g", split.WallTime)
+	}
+	if split.Cost != 8.5*0.5+32.5*0.25 {
+		t.Errorf("Incorrect cost %g", split.Cost)
+	}
+	if !split.OverRequested {
+		t.Error("Expected split stage to be over-requested.")
+	}
+	small := report.Stages[1]
+	if small.OverRequested {
+		t.Error("Expected small stage not to be over-requested.")
+	}
+	if small.MaxBytes != 100 {
+		t.Errorf("Expected 100 max bytes, got %d", small.MaxBytes)
+	}
+
+	total := report.Total
+	if total.Name != "PIPE" {
+		t.Errorf("Expected total for PIPE, got %s", total.Name)
+	}
+	if total.Forks != 2 || total.Jobs != 4 {
+		t.Errorf("Expected 2 forks and 4 jobs, got %d and %d",
+			total.Forks, total.Jobs)
+	}
+	if total.CoreHours != 9 {
+		t.Errorf("Expected 9 core hours, got %g", total.CoreHours)
+	}
+	if total.WallTime != 7200 {
+		t.Errorf("Expected 7200 seconds, got %g", total.WallTime)
+	}
+	if total.MaxBytes != 5000 {
+		t.Errorf("Expected 5000 max bytes, got %d", total.MaxBytes)
+	}
+	if total.Cost != split.Cost+small.Cost {
+		t.Errorf("Expected total cost %g, got %g",
+			split.Cost+small.Cost, total.Cost)
+	}
+}
+
+func TestWriteCsv(t *testing.T) {
+	report := Report{
+		Pipestances: []*PipestanceReport{computeUsage("/ps", makeTestPerf(),
+			new(Rates), &OverRequest{Ratio: 2, SlackGB: 1})},
+	}
+	var buf bytes.Buffer
+	if err := report.writeCsv(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 lines, got\n%s", buf.String())
+	}
+	if lines[0] != strings.Join(csvHeader, ",") {
+		t.Errorf("Incorrect header %s", lines[0])
+	}
+	if expect := "/ps,PIPE.SPLIT_STAGE,1,3,8.5,16,2,32.5,5400,3000,6000,3000,0,true"; lines[1] != expect {
+		t.Errorf("Expected\n%s\ngot\n%s", expect, lines[1])
+	}
+	if !strings.HasPrefix(lines[3], "/ps,PIPE,2,4,9,") {
+		t.Errorf("Incorrect total line %s", lines[3])
+	}
+	buf.Reset()
+	report.writeOverRequests(&buf)
+	if expect := "/ps: PIPE.SPLIT_STAGE requested 16 GB of memory " +
+		"but used at most 2.00 GB.\n"; buf.String() != expect {
+		t.Errorf("Expected %q, got %q", expect, buf.String())
+	}
+}
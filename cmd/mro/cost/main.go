@@ -0,0 +1,157 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+// Package cost implements the command line interface for reporting the
+// resources used by completed pipestances, and what they cost.
+package cost
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/martian-lang/martian/martian/util"
+)
+
+func Main(argv []string) {
+	util.SetPrintLogger(os.Stderr)
+
+	var flags flag.FlagSet
+	flags.Init("mro cost", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(),
+			"Usage: mro cost [options] <pipestance>...")
+		fmt.Fprintln(flags.Output())
+		fmt.Fprintln(flags.Output(),
+			"Reports the resources used by each stage of the given pipestances,")
+		fmt.Fprintln(flags.Output(),
+			"and their cost.  Each pipestance is followed by a row for its")
+		fmt.Fprintln(flags.Output(),
+			"top-level pipeline with the totals.  Stages which reserved much more")
+		fmt.Fprintln(flags.Output(),
+			"memory than they used are listed on standard error.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+
+	var asJson bool
+	flags.BoolVar(&asJson, "json", false,
+		"Render the report as json rather than csv.")
+	var rates Rates
+	flags.Float64Var(&rates.CoreHour, "core-hour-rate", 0,
+		"The `COST` of reserving one core for one hour.")
+	flags.Float64Var(&rates.GBHour, "gb-hour-rate", 0,
+		"The `COST` of reserving one GB of memory for one hour.")
+	var thresholds OverRequest
+	flags.Float64Var(&thresholds.Ratio, "mem-ratio", 2,
+		"Report stages which requested at least this `RATIO` "+
+			"times their peak memory usage.")
+	flags.Float64Var(&thresholds.SlackGB, "mem-slack", 1,
+		"Only report stages which requested at least this many `GB` "+
+			"more than their peak memory usage.")
+	if err := flags.Parse(argv); err != nil {
+		panic(err)
+	}
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	report, err := makeReport(flags.Args(), rates, &thresholds)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not load pipestance:", err)
+		os.Exit(2)
+	}
+	if asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(report)
+	} else {
+		err = report.writeCsv(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	report.writeOverRequests(os.Stderr)
+	os.Exit(0)
+}
+
+var csvHeader = []string{
+	"pipestance",
+	"name",
+	"forks",
+	"jobs",
+	"core_hours",
+	"mem_gb_requested",
+	"mem_gb_observed",
+	"mem_gb_hours",
+	"walltime",
+	"in_bytes",
+	"out_bytes",
+	"max_bytes",
+	"cost",
+	"over_requested",
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func (self *Usage) csvRecord(psPath string) []string {
+	return []string{
+		psPath,
+		self.Name,
+		strconv.Itoa(self.Forks),
+		strconv.Itoa(self.Jobs),
+		formatFloat(self.CoreHours),
+		formatFloat(self.MemGBRequested),
+		formatFloat(self.MemGBObserved),
+		formatFloat(self.MemGBHours),
+		formatFloat(self.WallTime),
+		strconv.FormatInt(self.InBytes, 10),
+		strconv.FormatInt(self.OutBytes, 10),
+		strconv.FormatInt(self.MaxBytes, 10),
+		formatFloat(self.Cost),
+		strconv.FormatBool(self.OverRequested),
+	}
+}
+
+// Write the report with one row per stage, followed by a row for the
+// totals of each pipestance.
+func (self *Report) writeCsv(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, ps := range self.Pipestances {
+		for _, stage := range ps.Stages {
+			if err := cw.Write(stage.csvRecord(ps.Path)); err != nil {
+				return err
+			}
+		}
+		if err := cw.Write(ps.Total.csvRecord(ps.Path)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Write a human-readable list of the stages which requested much more
+// memory than they used.
+func (self *Report) writeOverRequests(w io.Writer) {
+	for _, ps := range self.Pipestances {
+		for _, stage := range ps.Stages {
+			if stage.OverRequested {
+				fmt.Fprintf(w,
+					"%s: %s requested %g GB of memory but used at most %.2f GB.\n",
+					ps.Path, stage.Name,
+					stage.MemGBRequested, stage.MemGBObserved)
+			}
+		}
+	}
+}
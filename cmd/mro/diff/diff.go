@@ -0,0 +1,316 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/martian-lang/martian/martian/core"
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+// The serialized state of a completed pipestance.
+type pipestance struct {
+	// The directory the pipestance was loaded from.
+	Path string
+
+	// The directory the pipestance ran in, which may be different from Path
+	// if the pipestance was moved after it completed.
+	Root string
+
+	Invocation string
+	Versions   core.VersionInfo
+	Nodes      []*core.NodeInfo
+	Perf       map[string]*core.NodePerfInfo
+}
+
+func readMetadata(psPath string, name core.MetadataFileName, target interface{}) error {
+	b, err := ioutil.ReadFile(path.Join(psPath, name.FileName()))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, target)
+}
+
+// Load the final state of the pipestance in the given directory.
+func loadPipestance(psPath string) (*pipestance, error) {
+	ps := pipestance{
+		Path: psPath,
+		Perf: make(map[string]*core.NodePerfInfo),
+	}
+	if b, err := ioutil.ReadFile(path.Join(psPath,
+		core.InvocationFile.FileName())); err != nil {
+		return nil, err
+	} else {
+		ps.Invocation = string(b)
+	}
+	if err := readMetadata(psPath, core.FinalState, &ps.Nodes); err != nil {
+		return nil, fmt.Errorf("reading final state of %s: %v", psPath, err)
+	}
+	if len(ps.Nodes) == 0 {
+		return nil, fmt.Errorf("%s has no nodes in its final state", psPath)
+	}
+	ps.Root = ps.Nodes[0].Path
+	// Versions and performance information are not required, as the
+	// pipestance may have been generated by an older version of martian.
+	readMetadata(psPath, core.VersionsFile, &ps.Versions)
+	var perf []*core.NodePerfInfo
+	if err := readMetadata(psPath, core.Perf, &perf); err == nil {
+		for _, node := range perf {
+			ps.Perf[core.PartiallyQualifiedName(node.Fqname)] = node
+		}
+	}
+	return &ps, nil
+}
+
+// A pair of differing values.
+type ValueDiff struct {
+	A interface{} `json:"a"`
+	B interface{} `json:"b"`
+}
+
+// A pair of differing numeric values.
+type NumberDiff struct {
+	Name string  `json:"name"`
+	A    float64 `json:"a"`
+	B    float64 `json:"b"`
+}
+
+// The differences between a stage fork in two pipestances.
+type StageDiff struct {
+	// The partially qualified name of the stage.
+	Name string `json:"name"`
+
+	// The fork index.
+	Fork int `json:"fork"`
+
+	// Set to "a" or "b" if the fork only exists in that pipestance, for
+	// example because the two pipestances split over different inputs.
+	Only string `json:"only,omitempty"`
+
+	State     *ValueDiff `json:"state,omitempty"`
+	Disabled  *ValueDiff `json:"disabled,omitempty"`
+	StageCode *ValueDiff `json:"stagecode,omitempty"`
+
+	// The names of input arguments which differed.
+	Args []string `json:"args,omitempty"`
+
+	// The names of outputs which differed.
+	Outs []string `json:"outs,omitempty"`
+
+	// Resource usage and wall time which differed by more than the
+	// tolerance.
+	Perf []NumberDiff `json:"perf,omitempty"`
+}
+
+func (self *StageDiff) empty() bool {
+	return self.Only == "" && self.State == nil && self.Disabled == nil &&
+		self.StageCode == nil && len(self.Args) == 0 &&
+		len(self.Outs) == 0 && len(self.Perf) == 0
+}
+
+// The differences between two pipestances.
+type PipestanceDiff struct {
+	A string `json:"a"`
+	B string `json:"b"`
+
+	Invocation bool       `json:"invocation_differs"`
+	Martian    *ValueDiff `json:"martian_version,omitempty"`
+	Pipelines  *ValueDiff `json:"pipelines_version,omitempty"`
+
+	// Stages which differ between the two pipestances.
+	Stages []*StageDiff `json:"stages"`
+
+	// Stages which are only present in one of the pipestances.
+	OnlyA []string `json:"only_a,omitempty"`
+	OnlyB []string `json:"only_b,omitempty"`
+}
+
+// Returns true if any differences were found.
+func (self *PipestanceDiff) Differs() bool {
+	return self.Invocation || self.Martian != nil || self.Pipelines != nil ||
+		len(self.Stages) > 0 || len(self.OnlyA) > 0 || len(self.OnlyB) > 0
+}
+
+func diffString(a, b string) *ValueDiff {
+	if a == b {
+		return nil
+	}
+	return &ValueDiff{A: a, B: b}
+}
+
+// Compare two pipestances.  Numeric performance statistics are only reported
+// if they differ by more than the given relative tolerance.
+func comparePipestances(a, b *pipestance, tolerance float64) *PipestanceDiff {
+	result := PipestanceDiff{
+		A:          a.Path,
+		B:          b.Path,
+		Invocation: strings.TrimSpace(a.Invocation) != strings.TrimSpace(b.Invocation),
+		Martian:    diffString(a.Versions.Martian, b.Versions.Martian),
+		Pipelines:  diffString(a.Versions.Pipelines, b.Versions.Pipelines),
+		Stages:     make([]*StageDiff, 0),
+	}
+	bNodes := make(map[string]*core.NodeInfo, len(b.Nodes))
+	for _, node := range b.Nodes {
+		if node.Type == syntax.KindStage {
+			bNodes[core.PartiallyQualifiedName(node.Fqname)] = node
+		}
+	}
+	for _, aNode := range a.Nodes {
+		if aNode.Type != syntax.KindStage {
+			continue
+		}
+		name := core.PartiallyQualifiedName(aNode.Fqname)
+		bNode := bNodes[name]
+		if bNode == nil {
+			result.OnlyA = append(result.OnlyA, name)
+			continue
+		}
+		delete(bNodes, name)
+		result.Stages = append(result.Stages,
+			compareNodes(name, a, b, aNode, bNode, tolerance)...)
+	}
+	for name := range bNodes {
+		result.OnlyB = append(result.OnlyB, name)
+	}
+	sort.Strings(result.OnlyA)
+	sort.Strings(result.OnlyB)
+	return &result
+}
+
+func compareNodes(name string, a, b *pipestance,
+	aNode, bNode *core.NodeInfo, tolerance float64) []*StageDiff {
+	var result []*StageDiff
+	aPerf, bPerf := a.Perf[name], b.Perf[name]
+	for i, aFork := range aNode.Forks {
+		if i >= len(bNode.Forks) {
+			result = append(result, &StageDiff{
+				Name: name,
+				Fork: aFork.Index,
+				Only: "a",
+			})
+			continue
+		}
+		bFork := bNode.Forks[i]
+		diff := StageDiff{
+			Name:      name,
+			Fork:      aFork.Index,
+			StageCode: diffString(aNode.StagecodeCmd, bNode.StagecodeCmd),
+		}
+		if aFork.State != bFork.State {
+			diff.State = &ValueDiff{A: aFork.State, B: bFork.State}
+		}
+		if ad, bd := aFork.State == core.DisabledState,
+			bFork.State == core.DisabledState; ad != bd {
+			diff.Disabled = &ValueDiff{A: ad, B: bd}
+		}
+		if aFork.Bindings != nil && bFork.Bindings != nil {
+			diff.Args = compareBindings(a.Root, b.Root,
+				aFork.Bindings.Argument, bFork.Bindings.Argument)
+			diff.Outs = compareBindings(a.Root, b.Root,
+				aFork.Bindings.Return, bFork.Bindings.Return)
+		}
+		diff.Perf = comparePerf(forkStats(aPerf, i), forkStats(bPerf, i), tolerance)
+		if !diff.empty() {
+			result = append(result, &diff)
+		}
+	}
+	for i := len(aNode.Forks); i < len(bNode.Forks); i++ {
+		result = append(result, &StageDiff{
+			Name: name,
+			Fork: bNode.Forks[i].Index,
+			Only: "b",
+		})
+	}
+	return result
+}
+
+// Returns the names of bindings which have different values.  File paths
+// inside each pipestance are compared relative to the pipestance root.
+func compareBindings(aRoot, bRoot string, a, b []core.BindingInfo) []string {
+	bValues := make(map[string]interface{}, len(b))
+	for _, binding := range b {
+		bValues[binding.Id] = relativize(bRoot, binding.Value)
+	}
+	var result []string
+	for _, binding := range a {
+		bValue, ok := bValues[binding.Id]
+		if !ok || !reflect.DeepEqual(relativize(aRoot, binding.Value), bValue) {
+			result = append(result, binding.Id)
+		}
+		delete(bValues, binding.Id)
+	}
+	for id := range bValues {
+		result = append(result, id)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Strip the pipestance root from any strings in the value.
+func relativize(root string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if root != "" && strings.HasPrefix(v, root+"/") {
+			return v[len(root)+1:]
+		}
+		return v
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, e := range v {
+			result[i] = relativize(root, e)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			result[k] = relativize(root, e)
+		}
+		return result
+	}
+	return value
+}
+
+func forkStats(perf *core.NodePerfInfo, i int) *core.PerfInfo {
+	if perf == nil || i >= len(perf.Forks) || perf.Forks[i] == nil {
+		return nil
+	}
+	return perf.Forks[i].ForkStats
+}
+
+func comparePerf(a, b *core.PerfInfo, tolerance float64) []NumberDiff {
+	if a == nil || b == nil {
+		return nil
+	}
+	var result []NumberDiff
+	check := func(name string, a, b float64) {
+		if differs(a, b, tolerance) {
+			result = append(result, NumberDiff{Name: name, A: a, B: b})
+		}
+	}
+	check("walltime", a.WallTime, b.WallTime)
+	check("core_hours", a.CoreHours, b.CoreHours)
+	check("num_threads", a.NumThreads, b.NumThreads)
+	check("maxrss", float64(a.MaxRss), float64(b.MaxRss))
+	check("maxvmem", float64(a.MaxVmem), float64(b.MaxVmem))
+	check("in_bytes", float64(a.InBytes), float64(b.InBytes))
+	check("out_bytes", float64(a.OutBytes), float64(b.OutBytes))
+	check("total_bytes", float64(a.TotalBytes), float64(b.TotalBytes))
+	return result
+}
+
+// Returns true if the values differ by more than the given fraction of the
+// larger of the two.
+func differs(a, b, tolerance float64) bool {
+	if a == b {
+		return false
+	}
+	return math.Abs(a-b) > tolerance*math.Max(math.Abs(a), math.Abs(b))
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package diff
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/martian-lang/martian/martian/core"
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+func makeTestPipestance(root string, state core.MetadataState,
+	out string, walltime float64) *pipestance {
+	return &pipestance{
+		Path:       root,
+		Root:       root,
+		Invocation: "call PIPE()\n",
+		Versions:   core.VersionInfo{Martian: "v4"},
+		Nodes: []*core.NodeInfo{
+			{
+				Fqname: "ID.ps.PIPE",
+				Type:   syntax.KindPipeline,
+				Path:   root,
+			},
+			{
+				Fqname: "ID.ps.PIPE.STAGE",
+				Type:   syntax.KindStage,
+				Forks: []*core.ForkInfo{{
+					State: state,
+					Bindings: &core.ForkBindingsInfo{
+						Argument: []core.BindingInfo{{
+							Id:    "input",
+							Value: map[string]interface{}{"x": 1.0},
+						}},
+						Return: []core.BindingInfo{{
+							Id:    "output",
+							Value: out,
+						}},
+					},
+				}},
+			},
+		},
+		Perf: map[string]*core.NodePerfInfo{
+			"PIPE.STAGE": {
+				Forks: []*core.ForkPerfInfo{{
+					ForkStats: &core.PerfInfo{WallTime: walltime},
+				}},
+			},
+		},
+	}
+}
+
+func TestComparePipestancesSame(t *testing.T) {
+	a := makeTestPipestance("/a/ps", core.Complete, "/a/ps/PIPE/STAGE/fork0/files/out.txt", 100)
+	b := makeTestPipestance("/b/ps", core.Complete, "/b/ps/PIPE/STAGE/fork0/files/out.txt", 105)
+	if diff := comparePipestances(a, b, 0.1); diff.Differs() {
+		t.Errorf("Expected no differences, got %#v", diff)
+	}
+}
+
+func TestComparePipestancesDiffer(t *testing.T) {
+	a := makeTestPipestance("/a/ps", core.Complete, "/a/ps/PIPE/STAGE/fork0/files/out.txt", 100)
+	b := makeTestPipestance("/b/ps", core.DisabledState, "", 200)
+	b.Versions.Martian = "v5"
+	b.Nodes = append(b.Nodes, &core.NodeInfo{
+		Fqname: "ID.ps.PIPE.OTHER",
+		Type:   syntax.KindStage,
+	})
+	diff := comparePipestances(a, b, 0.1)
+	if !diff.Differs() {
+		t.Fatal("Expected differences.")
+	}
+	if diff.Invocation {
+		t.Error("Expected invocations to match.")
+	}
+	if diff.Martian == nil {
+		t.Error("Expected martian version difference.")
+	}
+	if !reflect.DeepEqual(diff.OnlyB, []string{"PIPE.OTHER"}) {
+		t.Errorf("Expected PIPE.OTHER only in b, got %v", diff.OnlyB)
+	}
+	if len(diff.Stages) != 1 {
+		t.Fatalf("Expected 1 stage difference, got %d", len(diff.Stages))
+	}
+	stage := diff.Stages[0]
+	if stage.Name != "PIPE.STAGE" {
+		t.Errorf("Expected PIPE.STAGE, got %s", stage.Name)
+	}
+	if stage.Disabled == nil || stage.State == nil {
+		t.Error("Expected state and disabled differences.")
+	}
+	if len(stage.Args) != 0 {
+		t.Errorf("Expected no argument differences, got %v", stage.Args)
+	}
+	if !reflect.DeepEqual(stage.Outs, []string{"output"}) {
+		t.Errorf("Expected output difference, got %v", stage.Outs)
+	}
+	if len(stage.Perf) != 1 || stage.Perf[0].Name != "walltime" {
+		t.Errorf("Expected walltime difference, got %v", stage.Perf)
+	}
+}
+
+// Set the number of forks of the stage in a test pipestance.
+func setForks(ps *pipestance, n int) {
+	node := ps.Nodes[1]
+	for i := len(node.Forks); i < n; i++ {
+		fork := *node.Forks[0]
+		fork.Index = i
+		node.Forks = append(node.Forks, &fork)
+	}
+}
+
+func TestComparePipestancesForkCount(t *testing.T) {
+	a := makeTestPipestance("/a/ps", core.Complete, "", 100)
+	b := makeTestPipestance("/b/ps", core.Complete, "", 100)
+	setForks(a, 2)
+	setForks(b, 3)
+	check := func(diff *PipestanceDiff, only string) {
+		t.Helper()
+		if len(diff.Stages) != 1 {
+			t.Fatalf("Expected 1 stage difference, got %d", len(diff.Stages))
+		}
+		if stage := diff.Stages[0]; stage.Name != "PIPE.STAGE" {
+			t.Errorf("Expected PIPE.STAGE, got %s", stage.Name)
+		} else if stage.Fork != 2 {
+			t.Errorf("Expected fork 2, got %d", stage.Fork)
+		} else if stage.Only != only {
+			t.Errorf("Expected fork only in %s, got %q", only, stage.Only)
+		}
+	}
+	check(comparePipestances(a, b, 0.1), "b")
+	check(comparePipestances(b, a, 0.1), "a")
+}
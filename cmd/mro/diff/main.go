@@ -0,0 +1,140 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+// Package diff implements the command line interface for comparing two
+// completed pipestances stage by stage.
+package diff
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/martian-lang/martian/martian/util"
+)
+
+func Main(argv []string) {
+	util.SetPrintLogger(os.Stderr)
+
+	var flags flag.FlagSet
+	flags.Init("mro diff", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(),
+			"Usage: mro diff [options] <pipestance1> <pipestance2>")
+		fmt.Fprintln(flags.Output())
+		fmt.Fprintln(flags.Output(),
+			"Compares the final state of two pipestances, matching stages by name.")
+		fmt.Fprintln(flags.Output(),
+			"Exits with status 1 if any differences were found.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+
+	var asJson bool
+	flags.BoolVar(&asJson, "json", false,
+		"Render the differences as json.")
+	var tolerance float64
+	flags.Float64Var(&tolerance, "tolerance", 0.1,
+		"Only report resource usage and wall time which differ by more "+
+			"than this `FRACTION` of the larger value.")
+	if err := flags.Parse(argv); err != nil {
+		panic(err)
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	a, err := loadPipestance(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not load pipestance:", err)
+		os.Exit(2)
+	}
+	b, err := loadPipestance(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not load pipestance:", err)
+		os.Exit(2)
+	}
+	diff := comparePipestances(a, b, tolerance)
+	if asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(diff); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	} else {
+		diff.format(os.Stdout)
+	}
+	if diff.Differs() {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Write a human-readable description of the differences.
+func (self *PipestanceDiff) format(w io.Writer) {
+	fmt.Fprintln(w, "a:", self.A)
+	fmt.Fprintln(w, "b:", self.B)
+	if !self.Differs() {
+		fmt.Fprintln(w, "No differences found.")
+		return
+	}
+	if self.Invocation {
+		fmt.Fprintln(w, "Invocations differ.")
+	}
+	if self.Martian != nil {
+		fmt.Fprintf(w, "Martian version: %v -> %v\n",
+			self.Martian.A, self.Martian.B)
+	}
+	if self.Pipelines != nil {
+		fmt.Fprintf(w, "Pipelines version: %v -> %v\n",
+			self.Pipelines.A, self.Pipelines.B)
+	}
+	for _, stage := range self.Stages {
+		fmt.Fprintf(w, "\n%s (fork %d):\n", stage.Name, stage.Fork)
+		if stage.Only != "" {
+			fmt.Fprintf(w, "    only in %s\n", stage.Only)
+		}
+		if stage.State != nil {
+			fmt.Fprintf(w, "    state:     %v -> %v\n",
+				stage.State.A, stage.State.B)
+		}
+		if stage.Disabled != nil {
+			fmt.Fprintf(w, "    disabled:  %v -> %v\n",
+				stage.Disabled.A, stage.Disabled.B)
+		}
+		if stage.StageCode != nil {
+			fmt.Fprintf(w, "    stagecode: %v -> %v\n",
+				stage.StageCode.A, stage.StageCode.B)
+		}
+		if len(stage.Args) > 0 {
+			fmt.Fprintf(w, "    args:      %s\n", strings.Join(stage.Args, ", "))
+		}
+		if len(stage.Outs) > 0 {
+			fmt.Fprintf(w, "    outs:      %s\n", strings.Join(stage.Outs, ", "))
+		}
+		for _, p := range stage.Perf {
+			change := "new"
+			if p.A != 0 {
+				change = fmt.Sprintf("%+.0f%%", 100*(p.B-p.A)/p.A)
+			}
+			fmt.Fprintf(w, "    %s: %g -> %g (%s)\n",
+				p.Name, p.A, p.B, change)
+		}
+	}
+	if len(self.OnlyA) > 0 {
+		fmt.Fprintln(w, "\nOnly in a:")
+		for _, name := range self.OnlyA {
+			fmt.Fprintln(w, "   ", name)
+		}
+	}
+	if len(self.OnlyB) > 0 {
+		fmt.Fprintln(w, "\nOnly in b:")
+		for _, name := range self.OnlyB {
+			fmt.Fprintln(w, "   ", name)
+		}
+	}
+}
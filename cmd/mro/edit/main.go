@@ -61,6 +61,24 @@ func (s stringListValue) Set(v string) error {
 	return nil
 }
 
+// repeatedValue implements flag.Value for flags which may be given more than
+// once, for values which may themselves contain commas.
+type repeatedValue struct {
+	list *[]string
+}
+
+func (s repeatedValue) String() string {
+	if s.list == nil {
+		return ""
+	}
+	return strings.Join(*s.list, " ")
+}
+
+func (s repeatedValue) Set(v string) error {
+	*s.list = append(*s.list, v)
+	return nil
+}
+
 func Main(argv []string) {
 	util.SetPrintLogger(os.Stderr)
 	util.SetupSignalHandlers()
@@ -77,6 +95,8 @@ func Main(argv []string) {
 	var conf refactoring.RefactorConfig
 	var removeParams, removeOutputs, topCalls refactoring.StringSet
 	var rename, renameInput, renameOutput refactoring.StringSet
+	var inline refactoring.StringSet
+	var extract, addInput, addOutput []string
 	var listUnusedCallables, noRemoveUnusedOuts, rewrite bool
 	flags.Var(stringListValue{set: &removeParams}, "remove-input",
 		"Remove an input parameter from a stage, e.g. `STAGE.input_name`."+
@@ -110,6 +130,24 @@ func Main(argv []string) {
 	flags.Var(stringListValue{set: &renameOutput}, "rename-output",
 		"Rename the given stage or pipeline outputs.  "+
 			"Comma-separated list of `STAGE.oldname=newName`.")
+	flags.Var(repeatedValue{list: &addInput}, "add-input",
+		"Add an input parameter to a stage or pipeline, e.g. "+
+			"`STAGE.name:type=DEFAULT`.  Calls to the stage or pipeline "+
+			"bind the new input to the calling pipeline's input of the same "+
+			"name, if it has one, or else to the default value.  "+
+			"May be given more than once.")
+	flags.Var(repeatedValue{list: &addOutput}, "add-output",
+		"Add an output parameter to a stage or pipeline, e.g. "+
+			"`STAGE.name:type[=VALUE]`.  Pipelines return the input of the "+
+			"same name, if there is one, or else the given value.  "+
+			"May be given more than once.")
+	flags.Var(repeatedValue{list: &extract}, "extract",
+		"Move calls from a pipeline into a new pipeline, which is called "+
+			"in their place, e.g. `PIPE.CALL1,CALL2:NEW_PIPELINE`.  "+
+			"May be given more than once.")
+	flags.Var(stringListValue{set: &inline}, "inline",
+		"Replace a call to a pipeline with the calls made by that "+
+			"pipeline.  Comma-separated list of `PIPE.SUBCALL`.")
 	version := flags.Bool("v", false, "Print the version and exit.")
 	if err := flags.Parse(argv); err != nil {
 		panic(err)
@@ -141,6 +179,10 @@ func Main(argv []string) {
 	conf.Rename = validateRename(rename, &flags)
 	conf.RenameInParam = validateParamRename(renameInput, &flags)
 	conf.RenameOutParam = validateParamRename(renameOutput, &flags)
+	conf.AddInParam = validateAddParams(addInput, &parser, &flags)
+	conf.AddOutParam = validateAddParams(addOutput, &parser, &flags)
+	conf.Extract = validateExtract(extract, &flags)
+	conf.Inline = validateInline(inline, &flags)
 
 	edit, err := refactoring.Refactor(compiledAsts, conf)
 	if err != nil {
@@ -327,6 +369,93 @@ func validateParamRename(params refactoring.StringSet, flags *flag.FlagSet) []re
 	return result
 }
 
+func validateAddParams(specs []string, parser *syntax.Parser,
+	flags *flag.FlagSet) []refactoring.AddParam {
+	if len(specs) == 0 {
+		return nil
+	}
+	result := make([]refactoring.AddParam, 0, len(specs))
+	for _, spec := range specs {
+		i := strings.IndexByte(spec, '.')
+		j := strings.IndexByte(spec, ':')
+		if i < 1 || j < i+2 {
+			fmt.Fprintln(flags.Output(),
+				"Parameter must be specified as STAGE.name:type=DEFAULT")
+			flags.Usage()
+			os.Exit(4)
+		}
+		param := refactoring.AddParam{
+			CallableParam: refactoring.CallableParam{
+				Callable: spec[:i],
+				Param:    spec[i+1 : j],
+			},
+		}
+		tname := spec[j+1:]
+		if k := strings.IndexByte(tname, '='); k >= 0 {
+			def, err := parser.ParseValExp([]byte(tname[k+1:]))
+			if err != nil {
+				fmt.Fprintf(flags.Output(),
+					"Invalid default value for %s: %v\n",
+					param.Param, err)
+				os.Exit(4)
+			}
+			param.Default = def
+			tname = tname[:k]
+		}
+		if err := param.Type.UnmarshalText([]byte(tname)); err != nil {
+			fmt.Fprintf(flags.Output(),
+				"Invalid type for %s: %v\n", param.Param, err)
+			os.Exit(4)
+		}
+		result = append(result, param)
+	}
+	return result
+}
+
+func validateExtract(specs []string, flags *flag.FlagSet) []refactoring.ExtractCalls {
+	if len(specs) == 0 {
+		return nil
+	}
+	result := make([]refactoring.ExtractCalls, 0, len(specs))
+	for _, spec := range specs {
+		i := strings.IndexByte(spec, '.')
+		j := strings.LastIndexByte(spec, ':')
+		if i < 1 || j < i+2 || j == len(spec)-1 {
+			fmt.Fprintln(flags.Output(),
+				"Extracted calls must be specified as PIPE.CALL1,CALL2:NEW_PIPELINE")
+			flags.Usage()
+			os.Exit(4)
+		}
+		result = append(result, refactoring.ExtractCalls{
+			Pipeline: spec[:i],
+			Calls:    strings.Split(spec[i+1:j], ","),
+			NewName:  spec[j+1:],
+		})
+	}
+	return result
+}
+
+func validateInline(calls refactoring.StringSet, flags *flag.FlagSet) []refactoring.PipelineCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	result := make([]refactoring.PipelineCall, 0, len(calls))
+	for call := range calls {
+		i := strings.IndexByte(call, '.')
+		if i < 1 || i == len(call)-1 {
+			fmt.Fprintln(flags.Output(),
+				"Inlined calls must be specified as PIPE.SUBCALL")
+			flags.Usage()
+			os.Exit(4)
+		}
+		result = append(result, refactoring.PipelineCall{
+			Pipeline: call[:i],
+			Call:     call[i+1:],
+		})
+	}
+	return result
+}
+
 func editFile(data []byte, filename string, mroPaths []string,
 	edit refactoring.Edit, rewrite bool, parser *syntax.Parser) {
 	ast, err := parser.UncheckedParse(data, filename)
@@ -0,0 +1,314 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package lsp
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/martian-lang/martian/martian/syntax"
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// Parse and compile the document, and convert any errors to diagnostics.
+func (self *server) diagnose(doc *document) []Diagnostic {
+	_, _, ast, err := self.parser.ParseSourceBytes([]byte(doc.text),
+		doc.path, self.mroPaths, false)
+	if ast != nil {
+		doc.ast = ast
+	}
+	lines := doc.lines()
+	diags := make([]Diagnostic, 0, 1)
+	for _, d := range syntax.Diagnostics(err) {
+		diag := Diagnostic{
+			Severity: severityError,
+			Source:   "mro",
+			Message:  d.Msg,
+		}
+		if loc, ok := locInFile(d.Loc, doc.path, 0); ok {
+			if d.Loc.File != nil && d.Loc.File.FullPath != doc.path {
+				diag.Message = "In " + d.Loc.File.FileName + ": " + d.Msg
+			}
+			diag.Range = wordRange(lines, loc.Line-1, loc.Col-1)
+		}
+		diags = append(diags, diag)
+	}
+	return diags
+}
+
+// Find the location in the given file which the given location is in or
+// was included from.
+func locInFile(loc syntax.SourceLoc, path string, depth int) (syntax.SourceLoc, bool) {
+	if loc.File == nil || depth > 100 {
+		return loc, false
+	}
+	if loc.File.FullPath == path {
+		return loc, true
+	}
+	for _, inc := range loc.File.IncludedFrom {
+		if l, ok := locInFile(*inc, path, depth+1); ok {
+			return l, true
+		}
+	}
+	return loc, false
+}
+
+// Convert a byte offset within a line to a UTF-16 offset.
+func utf16Offset(line string, offset int) int {
+	if offset > len(line) {
+		offset = len(line)
+	}
+	n := 0
+	for _, r := range line[:offset] {
+		n += len(utf16.Encode([]rune{r}))
+	}
+	return n
+}
+
+// Convert a UTF-16 offset within a line to a byte offset.
+func byteOffset(line string, character int) int {
+	n := 0
+	for i, r := range line {
+		if n >= character {
+			return i
+		}
+		n += len(utf16.Encode([]rune{r}))
+	}
+	return len(line)
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' || b >= 'a' && b <= 'z' ||
+		b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+}
+
+// Returns the start and end byte offsets of the identifier containing the
+// given byte offset in the line.
+func wordBounds(line string, offset int) (int, int) {
+	if offset < 0 || offset > len(line) {
+		return 0, 0
+	}
+	start, end := offset, offset
+	for start > 0 && isIdentByte(line[start-1]) {
+		start--
+	}
+	for end < len(line) && isIdentByte(line[end]) {
+		end++
+	}
+	return start, end
+}
+
+// Returns the range of the word starting at the given zero-based line and
+// byte offset.  If there is no word there, the range covers one character.
+func wordRange(lines []string, line, offset int) Range {
+	if line < 0 || line >= len(lines) {
+		return Range{}
+	}
+	text := lines[line]
+	if offset < 0 {
+		offset = 0
+	} else if offset > len(text) {
+		offset = len(text)
+	}
+	end := offset
+	for end < len(text) && isIdentByte(text[end]) {
+		end++
+	}
+	if end == offset && end < len(text) {
+		_, size := utf8.DecodeRuneInString(text[end:])
+		end += size
+	}
+	return Range{
+		Start: Position{Line: line, Character: utf16Offset(text, offset)},
+		End:   Position{Line: line, Character: utf16Offset(text, end)},
+	}
+}
+
+// Get the text of a line, from an open document if there is one, or else
+// from disk.
+func (self *server) lineText(path string, line int) string {
+	var text string
+	for _, doc := range self.docs {
+		if doc.path == path {
+			text = doc.text
+			break
+		}
+	}
+	if text == "" {
+		if b, err := ioutil.ReadFile(path); err == nil {
+			text = string(b)
+		}
+	}
+	lines := strings.Split(text, "\n")
+	if line < 0 || line >= len(lines) {
+		return ""
+	}
+	return lines[line]
+}
+
+// Convert an ast location into a protocol location.
+func (self *server) location(loc *syntax.SourceLoc) *Location {
+	if loc.File == nil || loc.File.FullPath == "" {
+		return nil
+	}
+	lines := []string{self.lineText(loc.File.FullPath, loc.Line-1)}
+	r := wordRange(lines, 0, loc.Col-1)
+	r.Start.Line = loc.Line - 1
+	r.End.Line = loc.Line - 1
+	return &Location{
+		URI:   pathToURI(loc.File.FullPath),
+		Range: r,
+	}
+}
+
+// Get the line of text and byte offset within it for a position.
+func (doc *document) lineAt(pos Position) (string, int) {
+	lines := doc.lines()
+	if pos.Line < 0 || pos.Line >= len(lines) {
+		return "", 0
+	}
+	line := lines[pos.Line]
+	return line, byteOffset(line, pos.Character)
+}
+
+// Returns the identifier at the given position, if any.
+func (doc *document) wordAt(pos Position) (string, int, int) {
+	line, offset := doc.lineAt(pos)
+	start, end := wordBounds(line, offset)
+	return line[start:end], start, end
+}
+
+func findCallable(ast *syntax.Ast, id string) syntax.Callable {
+	if ast == nil || ast.Callables == nil {
+		return nil
+	}
+	if ast.Callables.Table != nil {
+		return ast.Callables.Table[id]
+	}
+	for _, c := range ast.Callables.List {
+		if c.GetId() == id {
+			return c
+		}
+	}
+	return nil
+}
+
+func findStruct(ast *syntax.Ast, id string) *syntax.StructType {
+	for _, t := range ast.StructTypes {
+		if t.Id == id {
+			return t
+		}
+	}
+	return nil
+}
+
+func findUserType(ast *syntax.Ast, id string) *syntax.UserType {
+	for _, t := range ast.UserTypes {
+		if t.Id == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// Find the pipeline in the given file which contains the given one-based
+// line.
+func enclosingPipeline(ast *syntax.Ast, path string, line int) *syntax.Pipeline {
+	var result *syntax.Pipeline
+	for _, p := range ast.Pipelines {
+		if p.Node.Loc.File != nil && p.Node.Loc.File.FullPath == path &&
+			p.Node.Loc.Line <= line &&
+			(result == nil || p.Node.Loc.Line > result.Node.Loc.Line) {
+			result = p
+		}
+	}
+	if result != nil {
+		// Make sure there isn't another declaration between the pipeline and
+		// the line.
+		for _, c := range ast.Callables.List {
+			if f := c.File(); f != nil && f.FullPath == path &&
+				c.Line() > result.Node.Loc.Line && c.Line() <= line {
+				return nil
+			}
+		}
+	}
+	return result
+}
+
+// Find the call statement in the given file which contains the given
+// one-based line.
+func enclosingCall(ast *syntax.Ast, path string, line int) *syntax.CallStm {
+	var calls []*syntax.CallStm
+	if p := enclosingPipeline(ast, path, line); p != nil {
+		calls = p.Calls
+	}
+	if ast.Call != nil && ast.Call.Node.Loc.File != nil &&
+		ast.Call.Node.Loc.File.FullPath == path {
+		calls = append(calls, ast.Call)
+	}
+	var result *syntax.CallStm
+	for _, c := range calls {
+		if c.Node.Loc.Line <= line &&
+			(result == nil || c.Node.Loc.Line > result.Node.Loc.Line) {
+			result = c
+		}
+	}
+	return result
+}
+
+var includeRe = regexp.MustCompile(`^\s*@include\s+"([^"]*)"`)
+
+// Find the definition of the symbol or include at the given position.
+func (self *server) definition(doc *document, pos Position) *Location {
+	line, _ := doc.lineAt(pos)
+	if m := includeRe.FindStringSubmatch(line); m != nil {
+		paths := append(self.mroPaths[:len(self.mroPaths):len(self.mroPaths)],
+			filepath.Dir(doc.path))
+		if p, err := util.FindUniquePath(m[1], paths); err == nil {
+			p, _ = filepath.Abs(p)
+			return &Location{URI: pathToURI(p)}
+		}
+		return nil
+	}
+	ast := doc.ast
+	word, _, end := doc.wordAt(pos)
+	if ast == nil || word == "" {
+		return nil
+	}
+	// A reference to the output of a call within a pipeline, for example
+	// STAGE.output, goes to the call.
+	if end < len(line) && line[end] == '.' {
+		if p := enclosingPipeline(ast, doc.path, pos.Line+1); p != nil {
+			for _, c := range p.Calls {
+				if c.Id == word {
+					return self.location(&c.Node.Loc)
+				}
+			}
+		}
+	}
+	if loc := declarationLoc(ast, word); loc != nil {
+		return self.location(loc)
+	}
+	return nil
+}
+
+// Find the declaration of a callable or type with the given name.
+func declarationLoc(ast *syntax.Ast, id string) *syntax.SourceLoc {
+	switch c := findCallable(ast, id).(type) {
+	case *syntax.Stage:
+		return &c.Node.Loc
+	case *syntax.Pipeline:
+		return &c.Node.Loc
+	}
+	if t := findStruct(ast, id); t != nil {
+		return &t.Node.Loc
+	}
+	if t := findUserType(ast, id); t != nil {
+		return &t.Node.Loc
+	}
+	return nil
+}
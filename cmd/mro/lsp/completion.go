@@ -0,0 +1,175 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package lsp
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+var (
+	// Matches a partial call statement up to the callable name.
+	callNameRe = regexp.MustCompile(
+		`\bcall\s+(?:(?:local|preflight|volatile)\s+)*\w*$`)
+
+	// Matches a call statement up to the opening parenthesis, capturing the
+	// callable name.
+	callOpenRe = regexp.MustCompile(
+		`\bcall\s+(?:(?:local|preflight|volatile)\s+)*(\w+)(?:\s+as\s+\w+)?\s*$`)
+
+	// Matches the start of a binding.
+	boundIdRe = regexp.MustCompile(`(?m)^\s*(\w+)\s*=`)
+)
+
+// Offer completions for the callable name in a call statement, or for the
+// unbound arguments of a call.
+func (self *server) completion(doc *document, pos Position) *CompletionList {
+	result := &CompletionList{Items: []CompletionItem{}}
+	ast := doc.ast
+	if ast == nil || ast.Callables == nil {
+		return result
+	}
+	line, offset := doc.lineAt(pos)
+	prefix := line[:offset]
+	if callNameRe.MatchString(prefix) {
+		for _, c := range ast.Callables.List {
+			result.Items = append(result.Items, CompletionItem{
+				Label:  c.GetId(),
+				Kind:   completionKindFunction,
+				Detail: c.Type(),
+			})
+		}
+		return result
+	}
+	if strings.Contains(prefix, "=") {
+		return result
+	}
+	lines := doc.lines()
+	cursor := len(prefix)
+	for _, l := range lines[:pos.Line] {
+		cursor += len(l) + 1
+	}
+	open := unclosedParen(doc.text[:cursor])
+	if open < 0 {
+		return result
+	}
+	m := callOpenRe.FindStringSubmatch(doc.text[:open])
+	if m == nil {
+		return result
+	}
+	c := findCallable(ast, m[1])
+	if c == nil || c.GetInParams() == nil {
+		return result
+	}
+	bound := make(map[string]bool)
+	body := doc.text[open+1:]
+	if end := closingParen(body); end >= 0 {
+		body = body[:end]
+	}
+	for _, b := range boundIdRe.FindAllStringSubmatch(body, -1) {
+		bound[b[1]] = true
+	}
+	for _, param := range c.GetInParams().List {
+		if bound[param.Id] {
+			continue
+		}
+		item := CompletionItem{
+			Label:      param.Id,
+			Kind:       completionKindField,
+			Detail:     param.Tname.String(),
+			InsertText: param.Id + " = ",
+		}
+		if doc := paramDoc(param); doc != "" {
+			item.Documentation = &MarkupContent{
+				Kind:  "plaintext",
+				Value: doc,
+			}
+		}
+		result.Items = append(result.Items, item)
+	}
+	sort.SliceStable(result.Items, func(i, j int) bool {
+		return result.Items[i].Label < result.Items[j].Label
+	})
+	return result
+}
+
+func paramDoc(param *syntax.InParam) string {
+	var buf strings.Builder
+	for _, c := range syntax.GetComments(param) {
+		buf.WriteString(strings.TrimSpace(strings.TrimPrefix(c, "#")))
+		buf.WriteRune('\n')
+	}
+	buf.WriteString(param.Help)
+	return strings.TrimSpace(buf.String())
+}
+
+// Scan the given mro source, skipping strings and comments, and return the
+// offset of the innermost parenthesis which has not been closed, or -1.
+func unclosedParen(src string) int {
+	var stack []int
+	scanCode(src, func(i int, b byte) bool {
+		switch b {
+		case '(':
+			stack = append(stack, i)
+		case ')':
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+		return true
+	})
+	if len(stack) == 0 {
+		return -1
+	}
+	return stack[len(stack)-1]
+}
+
+// Returns the offset of the parenthesis closing one which was opened just
+// before the start of src, or -1.
+func closingParen(src string) int {
+	depth, result := 0, -1
+	scanCode(src, func(i int, b byte) bool {
+		switch b {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				result = i
+				return false
+			}
+			depth--
+		}
+		return true
+	})
+	return result
+}
+
+// Call f for each byte of src which is not part of a string or comment,
+// until f returns false.
+func scanCode(src string, f func(int, byte) bool) {
+	inString, inComment := false, false
+	for i := 0; i < len(src); i++ {
+		b := src[i]
+		switch {
+		case inComment:
+			inComment = b != '\n'
+		case inString:
+			if b == '\\' {
+				i++
+			} else if b == '"' || b == '\n' {
+				inString = false
+			}
+		case b == '#':
+			inComment = true
+		case b == '"':
+			inString = true
+		default:
+			if !f(i, b) {
+				return
+			}
+		}
+	}
+}
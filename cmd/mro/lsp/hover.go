@@ -0,0 +1,163 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package lsp
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+// Show information about the callable, type, or call binding at the given
+// position.
+func (self *server) hover(doc *document, pos Position) *Hover {
+	ast := doc.ast
+	word, start, end := doc.wordAt(pos)
+	if ast == nil || word == "" {
+		return nil
+	}
+	var buf strings.Builder
+	line, _ := doc.lineAt(pos)
+	if param := boundParam(ast, doc.path, pos.Line+1, line, word, end); param != nil {
+		writeComments(&buf, syntax.GetComments(param))
+		buf.WriteString("in ")
+		buf.WriteString(param.Tname.String())
+		buf.WriteRune(' ')
+		buf.WriteString(param.Id)
+		if param.Help != "" {
+			buf.WriteRune(' ')
+			buf.WriteString(strconv.Quote(param.Help))
+		}
+		buf.WriteRune('\n')
+	} else if c := findCallable(ast, word); c != nil {
+		writeCallable(&buf, c)
+	} else if t := findStruct(ast, word); t != nil {
+		writeComments(&buf, syntax.GetComments(t))
+		buf.WriteString("struct ")
+		buf.WriteString(t.Id)
+		buf.WriteString("(\n")
+		params := make([]paramInfo, len(t.Members))
+		for i, m := range t.Members {
+			params[i] = paramInfo{tname: m.Tname.String(), id: m.Id, help: m.Help}
+		}
+		writeParams(&buf, params)
+		buf.WriteString(")\n")
+	} else if t := findUserType(ast, word); t != nil {
+		writeComments(&buf, syntax.GetComments(t))
+		buf.WriteString("filetype ")
+		buf.WriteString(t.Id)
+		buf.WriteString(";\n")
+	} else {
+		return nil
+	}
+	r := Range{
+		Start: Position{Line: pos.Line, Character: utf16Offset(line, start)},
+		End:   Position{Line: pos.Line, Character: utf16Offset(line, end)},
+	}
+	return &Hover{
+		Contents: MarkupContent{
+			Kind:  "markdown",
+			Value: "```mro\n" + buf.String() + "```",
+		},
+		Range: &r,
+	}
+}
+
+var bindingRe = regexp.MustCompile(`^\s*=`)
+
+// If the word ending at the given offset in the line is the name of an
+// argument being bound in a call statement, returns the input parameter of
+// the called stage or pipeline.
+func boundParam(ast *syntax.Ast, path string, lineNum int,
+	line, word string, end int) *syntax.InParam {
+	if !bindingRe.MatchString(line[end:]) {
+		return nil
+	}
+	call := enclosingCall(ast, path, lineNum)
+	if call == nil {
+		return nil
+	}
+	c := findCallable(ast, call.DecId)
+	if c == nil || c.GetInParams() == nil {
+		return nil
+	}
+	for _, param := range c.GetInParams().List {
+		if param.Id == word {
+			return param
+		}
+	}
+	return nil
+}
+
+func writeComments(buf *strings.Builder, comments []string) {
+	for _, c := range comments {
+		buf.WriteString(c)
+		buf.WriteRune('\n')
+	}
+}
+
+// Write the signature of a stage or pipeline.
+func writeCallable(buf *strings.Builder, c syntax.Callable) {
+	if node, ok := c.(syntax.AstNodable); ok {
+		writeComments(buf, syntax.GetComments(node))
+	}
+	buf.WriteString(c.Type())
+	buf.WriteRune(' ')
+	buf.WriteString(c.GetId())
+	buf.WriteString("(\n")
+	var params []paramInfo
+	if ins := c.GetInParams(); ins != nil {
+		for _, p := range ins.List {
+			params = append(params, paramInfo{
+				mode:  "in  ",
+				tname: p.Tname.String(),
+				id:    p.Id,
+				help:  p.Help,
+			})
+		}
+	}
+	if outs := c.GetOutParams(); outs != nil {
+		for _, p := range outs.List {
+			params = append(params, paramInfo{
+				mode:  "out ",
+				tname: p.Tname.String(),
+				id:    p.Id,
+				help:  p.Help,
+			})
+		}
+	}
+	writeParams(buf, params)
+	buf.WriteString(")\n")
+}
+
+type paramInfo struct {
+	mode, tname, id, help string
+}
+
+// Write a list of parameters with their types and help text, aligned into
+// columns.
+func writeParams(buf *strings.Builder, params []paramInfo) {
+	typeWidth, idWidth := 0, 0
+	for _, p := range params {
+		if len(p.tname) > typeWidth {
+			typeWidth = len(p.tname)
+		}
+		if len(p.id) > idWidth {
+			idWidth = len(p.id)
+		}
+	}
+	for _, p := range params {
+		buf.WriteString("    ")
+		buf.WriteString(p.mode)
+		buf.WriteString(p.tname)
+		buf.WriteString(strings.Repeat(" ", typeWidth-len(p.tname)+1))
+		buf.WriteString(p.id)
+		if p.help != "" {
+			buf.WriteString(strings.Repeat(" ", idWidth-len(p.id)+1))
+			buf.WriteString(strconv.Quote(p.help))
+		}
+		buf.WriteString(",\n")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package lsp
+
+// A minimal implementation of the JSON-RPC 2.0 framing used by the language
+// server protocol.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// JSON-RPC error codes.
+const (
+	codeParseError     = -32700
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeNotInitialized = -32002
+	codeRequestFailed  = -32803
+)
+
+// A request or notification received from the client.  Notifications have
+// no ID.
+type rpcRequest struct {
+	Version string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *rpcError) Error() string {
+	return err.Message
+}
+
+type rpcResponse struct {
+	Version string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+	Error   *rpcError        `json:"error,omitempty"`
+}
+
+type rpcNotification struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// A connection reads messages from the client and writes messages back.
+type connection struct {
+	reader *textproto.Reader
+	writer io.Writer
+	lock   sync.Mutex
+}
+
+func newConnection(r io.Reader, w io.Writer) *connection {
+	return &connection{
+		reader: textproto.NewReader(bufio.NewReader(r)),
+		writer: w,
+	}
+}
+
+// Read the next message from the client.
+func (self *connection) read() (*rpcRequest, error) {
+	header, err := self.reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Length header: %v", err)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(self.reader.R, body); err != nil {
+		return nil, err
+	}
+	var req rpcRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, &rpcError{Code: codeParseError, Message: err.Error()}
+	}
+	return &req, nil
+}
+
+func (self *connection) write(msg interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, err := fmt.Fprintf(self.writer,
+		"Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = self.writer.Write(body)
+	return err
+}
+
+// Send a response to a request.  If err is not nil, it is sent instead of
+// the result.
+func (self *connection) reply(id *json.RawMessage,
+	result interface{}, err error) error {
+	resp := rpcResponse{
+		Version: "2.0",
+		Id:      id,
+		Result:  result,
+	}
+	if err != nil {
+		resp.Result = nil
+		if e, ok := err.(*rpcError); ok {
+			resp.Error = e
+		} else {
+			resp.Error = &rpcError{
+				Code:    codeRequestFailed,
+				Message: err.Error(),
+			}
+		}
+	}
+	return self.write(&resp)
+}
+
+// Send a notification to the client.
+func (self *connection) notify(method string, params interface{}) error {
+	return self.write(&rpcNotification{
+		Version: "2.0",
+		Method:  method,
+		Params:  params,
+	})
+}
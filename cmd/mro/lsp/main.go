@@ -0,0 +1,48 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+// Package lsp implements a language server for mro files, communicating
+// with an editor using the language server protocol over stdin and stdout.
+package lsp
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/martian-lang/martian/martian/util"
+)
+
+func Main(argv []string) {
+	// stdout is reserved for the protocol.
+	util.SetPrintLogger(os.Stderr)
+
+	var flags flag.FlagSet
+	flags.Init("mro lsp", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: mro lsp [options]")
+		fmt.Fprintln(flags.Output())
+		fmt.Fprintln(flags.Output(),
+			"Runs a language server for mro files, communicating over stdin and stdout.")
+		fmt.Fprintln(flags.Output(),
+			"Includes are resolved using MROPATH if it is set, or else the workspace root.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+	// Many editors pass this flag by default.
+	flags.Bool("stdio", true, "Communicate over stdin and stdout.  "+
+		"This is the only supported mode.")
+	if err := flags.Parse(argv); err != nil {
+		panic(err)
+	}
+
+	cwd, _ := os.Getwd()
+	mroPaths := util.ParseMroPath(cwd)
+	envMroPath := false
+	if value := os.Getenv("MROPATH"); len(value) > 0 {
+		mroPaths = util.ParseMroPath(value)
+		envMroPath = true
+	}
+	if !newServer(os.Stdin, os.Stdout, mroPaths, envMroPath).run() {
+		os.Exit(1)
+	}
+}
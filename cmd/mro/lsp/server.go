@@ -0,0 +1,305 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package lsp
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/martian-lang/martian/martian/syntax"
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// An open text document.
+type document struct {
+	uri  string
+	path string
+	text string
+
+	// The most recent ast which could be parsed from the document, used for
+	// navigation while the document has syntax errors.  This may not have
+	// been successfully compiled.
+	ast *syntax.Ast
+}
+
+func (self *document) lines() []string {
+	return strings.Split(self.text, "\n")
+}
+
+type server struct {
+	conn *connection
+
+	// The search path for includes.
+	mroPaths []string
+
+	// True if mroPaths came from the MROPATH environment variable, rather
+	// than the working directory.
+	envMroPath bool
+
+	docs        map[string]*document
+	parser      syntax.Parser
+	initialized bool
+	shutdown    bool
+}
+
+func newServer(r io.Reader, w io.Writer, mroPaths []string, envMroPath bool) *server {
+	return &server{
+		conn:       newConnection(r, w),
+		mroPaths:   mroPaths,
+		envMroPath: envMroPath,
+		docs:       make(map[string]*document),
+	}
+}
+
+// Process messages until the client sends an exit notification or closes
+// the connection.  Returns true if the client requested shutdown before
+// exiting.
+func (self *server) run() bool {
+	for {
+		req, err := self.conn.read()
+		if err != nil {
+			if e, ok := err.(*rpcError); ok {
+				self.conn.reply(nil, nil, e)
+				continue
+			}
+			if err != io.EOF {
+				util.PrintError(err, "lsp", "Error reading from client.")
+			}
+			return false
+		}
+		if req.Method == "exit" {
+			return self.shutdown
+		}
+		result, err := self.handle(req)
+		if req.Id != nil {
+			if err := self.conn.reply(req.Id, result, err); err != nil {
+				util.PrintError(err, "lsp", "Error writing to client.")
+				return false
+			}
+		} else if err != nil {
+			util.LogError(err, "lsp", "Error handling %s", req.Method)
+		}
+	}
+}
+
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return &rpcError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func (self *server) handle(req *rpcRequest) (interface{}, error) {
+	if !self.initialized && req.Method != "initialize" {
+		return nil, &rpcError{
+			Code:    codeNotInitialized,
+			Message: "server not initialized",
+		}
+	}
+	switch req.Method {
+	case "initialize":
+		var params InitializeParams
+		if err := decodeParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return self.initialize(&params), nil
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		self.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params DidOpenTextDocumentParams
+		if err := decodeParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return nil, self.didOpen(&params)
+	case "textDocument/didChange":
+		var params DidChangeTextDocumentParams
+		if err := decodeParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return nil, self.didChange(&params)
+	case "textDocument/didSave":
+		var params DidSaveTextDocumentParams
+		if err := decodeParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		if doc := self.docs[params.TextDocument.URI]; doc != nil {
+			return nil, self.publishDiagnostics(doc)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		if err := decodeParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		delete(self.docs, params.TextDocument.URI)
+		return nil, self.conn.notify("textDocument/publishDiagnostics",
+			&PublishDiagnosticsParams{
+				URI:         params.TextDocument.URI,
+				Diagnostics: []Diagnostic{},
+			})
+	case "textDocument/definition":
+		var params TextDocumentPositionParams
+		if err := decodeParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		if doc, err := self.getDocument(params.TextDocument.URI); err != nil {
+			return nil, err
+		} else if loc := self.definition(doc, params.Position); loc != nil {
+			return loc, nil
+		}
+		return nil, nil
+	case "textDocument/hover":
+		var params TextDocumentPositionParams
+		if err := decodeParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		if doc, err := self.getDocument(params.TextDocument.URI); err != nil {
+			return nil, err
+		} else if hover := self.hover(doc, params.Position); hover != nil {
+			return hover, nil
+		}
+		return nil, nil
+	case "textDocument/completion":
+		var params TextDocumentPositionParams
+		if err := decodeParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		if doc, err := self.getDocument(params.TextDocument.URI); err != nil {
+			return nil, err
+		} else {
+			return self.completion(doc, params.Position), nil
+		}
+	case "textDocument/formatting":
+		var params DocumentFormattingParams
+		if err := decodeParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		if doc, err := self.getDocument(params.TextDocument.URI); err != nil {
+			return nil, err
+		} else {
+			return self.format(doc)
+		}
+	}
+	if strings.HasPrefix(req.Method, "$/") || req.Id == nil {
+		// Notifications which are not understood may be ignored.
+		return nil, nil
+	}
+	return nil, &rpcError{
+		Code:    codeMethodNotFound,
+		Message: "method not supported: " + req.Method,
+	}
+}
+
+func (self *server) initialize(params *InitializeParams) *InitializeResult {
+	self.initialized = true
+	if !self.envMroPath && params.RootURI != "" {
+		if root, err := uriToPath(params.RootURI); err == nil {
+			self.mroPaths = util.ParseMroPath(root)
+		}
+	}
+	return &InitializeResult{
+		Capabilities: ServerCapabilities{
+			TextDocumentSync:   textDocumentSyncFull,
+			DefinitionProvider: true,
+			HoverProvider:      true,
+			CompletionProvider: &CompletionOptions{
+				TriggerCharacters: []string{"("},
+			},
+			DocumentFormattingProvider: true,
+		},
+		ServerInfo: ServerInfo{
+			Name:    "mro lsp",
+			Version: util.GetVersion(),
+		},
+	}
+}
+
+func (self *server) getDocument(uri string) (*document, error) {
+	if doc := self.docs[uri]; doc != nil {
+		return doc, nil
+	}
+	return nil, &rpcError{
+		Code:    codeInvalidParams,
+		Message: "document not open: " + uri,
+	}
+}
+
+func (self *server) didOpen(params *DidOpenTextDocumentParams) error {
+	p, err := uriToPath(params.TextDocument.URI)
+	if err != nil {
+		return err
+	}
+	doc := &document{
+		uri:  params.TextDocument.URI,
+		path: p,
+		text: params.TextDocument.Text,
+	}
+	self.docs[doc.uri] = doc
+	return self.publishDiagnostics(doc)
+}
+
+func (self *server) didChange(params *DidChangeTextDocumentParams) error {
+	doc, err := self.getDocument(params.TextDocument.URI)
+	if err != nil {
+		return err
+	}
+	if n := len(params.ContentChanges); n > 0 {
+		// Only full document sync is supported, so the last change
+		// contains the full text.
+		doc.text = params.ContentChanges[n-1].Text
+	}
+	return self.publishDiagnostics(doc)
+}
+
+func (self *server) publishDiagnostics(doc *document) error {
+	return self.conn.notify("textDocument/publishDiagnostics",
+		&PublishDiagnosticsParams{
+			URI:         doc.uri,
+			Diagnostics: self.diagnose(doc),
+		})
+}
+
+func (self *server) format(doc *document) ([]TextEdit, error) {
+	formatted, err := self.parser.FormatSrcBytes([]byte(doc.text),
+		doc.path, false, self.mroPaths)
+	if err != nil {
+		return nil, err
+	}
+	if formatted == doc.text {
+		return []TextEdit{}, nil
+	}
+	return []TextEdit{{
+		Range: Range{
+			End: Position{Line: len(doc.lines())},
+		},
+		NewText: formatted,
+	}}, nil
+}
+
+func uriToPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", &rpcError{
+			Code:    codeInvalidParams,
+			Message: "unsupported uri scheme " + u.Scheme,
+		}
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+func pathToURI(p string) string {
+	u := url.URL{
+		Scheme: "file",
+		Path:   filepath.ToSlash(p),
+	}
+	return u.String()
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package lsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testTypes = `# A matrix of counts.
+filetype h5;
+
+struct COUNTS(
+    h5  matrix "The counts",
+    int total,
+)
+`
+
+const testSrc = `@include "types.mro"
+
+# Adds up some counts.
+stage SUM_COUNTS(
+    in  COUNTS[] counts   "The counts to add",
+    # The number of threads.
+    in  int      threads,
+    out COUNTS   sum,
+    src py       "stages/sum_counts",
+)
+
+pipeline SUM(
+    in  COUNTS[] counts,
+    out COUNTS   sum,
+)
+{
+    call SUM_COUNTS(
+        counts = self.counts,
+    )
+
+    return (
+        sum = SUM_COUNTS.sum,
+    )
+}
+`
+
+// Run the server over a sequence of requests, returning the responses and
+// notifications keyed by request id or method name.
+func runRequests(t *testing.T, dir string, reqs ...string) map[string]json.RawMessage {
+	t.Helper()
+	var in bytes.Buffer
+	for _, req := range reqs {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(req), req)
+	}
+	var out bytes.Buffer
+	srv := newServer(&in, &out, []string{dir}, true)
+	if !srv.run() {
+		t.Error("Expected clean shutdown.")
+	}
+	conn := newConnection(&out, nil)
+	result := make(map[string]json.RawMessage)
+	for {
+		msg, err := conn.reader.ReadMIMEHeader()
+		if err != nil {
+			break
+		}
+		var n int
+		fmt.Sscan(msg.Get("Content-Length"), &n)
+		body := make([]byte, n)
+		if _, err := io.ReadFull(conn.reader.R, body); err != nil {
+			t.Fatal(err)
+		}
+		var resp struct {
+			Id     *int            `json:"id"`
+			Method string          `json:"method"`
+			Result json.RawMessage `json:"result"`
+			Params json.RawMessage `json:"params"`
+			Error  *rpcError       `json:"error"`
+		}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error != nil {
+			t.Errorf("Request %d failed: %s", *resp.Id, resp.Error.Message)
+		}
+		if resp.Id != nil {
+			result[fmt.Sprint(*resp.Id)] = resp.Result
+		} else {
+			result[resp.Method] = resp.Params
+		}
+	}
+	return result
+}
+
+func positionRequest(id int, method, uri string, line, char int) string {
+	return fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":%q,`+
+		`"params":{"textDocument":{"uri":%q},`+
+		`"position":{"line":%d,"character":%d}}}`,
+		id, method, uri, line, char)
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mro-lsp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "types.mro"),
+		[]byte(testTypes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "sum.mro")
+	uri := pathToURI(fn)
+	src, _ := json.Marshal(testSrc)
+	// Leave a binding open for completion, and misalign the formatting.
+	incomplete, _ := json.Marshal(strings.Replace(testSrc,
+		"        counts = self.counts,\n",
+		"        counts  = self.counts,\n        \n", 1))
+
+	results := runRequests(t, dir,
+		`{"jsonrpc":"2.0","id":0,"method":"initialize","params":{}}`,
+		`{"jsonrpc":"2.0","method":"initialized","params":{}}`,
+		fmt.Sprintf(`{"jsonrpc":"2.0","method":"textDocument/didOpen",`+
+			`"params":{"textDocument":{"uri":%q,"languageId":"mro",`+
+			`"version":1,"text":%s}}}`, uri, src),
+		positionRequest(1, "textDocument/definition", uri, 16, 11),
+		positionRequest(2, "textDocument/definition", uri, 4, 10),
+		positionRequest(3, "textDocument/definition", uri, 0, 12),
+		positionRequest(4, "textDocument/hover", uri, 16, 11),
+		positionRequest(5, "textDocument/hover", uri, 17, 9),
+		fmt.Sprintf(`{"jsonrpc":"2.0","method":"textDocument/didChange",`+
+			`"params":{"textDocument":{"uri":%q,"version":2},`+
+			`"contentChanges":[{"text":%s}]}}`, uri, incomplete),
+		positionRequest(6, "textDocument/completion", uri, 18, 8),
+		fmt.Sprintf(`{"jsonrpc":"2.0","id":7,"method":"textDocument/formatting",`+
+			`"params":{"textDocument":{"uri":%q}}}`, uri),
+		`{"jsonrpc":"2.0","id":8,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","method":"exit"}`)
+
+	var diags PublishDiagnosticsParams
+	if err := json.Unmarshal(results["textDocument/publishDiagnostics"],
+		&diags); err != nil {
+		t.Error(err)
+	} else if len(diags.Diagnostics) != 1 {
+		t.Errorf("Expected 1 diagnostic, got %v", diags.Diagnostics)
+	} else if d := diags.Diagnostics[0]; d.Range.Start.Line != 16 ||
+		!strings.Contains(d.Message, "'threads'") {
+		t.Errorf("Expected missing argument on line 16, got %v", d)
+	}
+
+	checkLocation := func(id, file string, line int) {
+		t.Helper()
+		var loc Location
+		if err := json.Unmarshal(results[id], &loc); err != nil {
+			t.Error(err)
+		} else if loc.URI != pathToURI(filepath.Join(dir, file)) {
+			t.Errorf("Expected definition in %s, got %s", file, loc.URI)
+		} else if loc.Range.Start.Line != line {
+			t.Errorf("Expected definition on line %d, got %d",
+				line, loc.Range.Start.Line)
+		}
+	}
+	checkLocation("1", "sum.mro", 3)
+	checkLocation("2", "types.mro", 3)
+	checkLocation("3", "types.mro", 0)
+
+	checkHover := func(id string, expect ...string) {
+		t.Helper()
+		var hover Hover
+		if err := json.Unmarshal(results[id], &hover); err != nil {
+			t.Error(err)
+			return
+		}
+		for _, s := range expect {
+			if !strings.Contains(hover.Contents.Value, s) {
+				t.Errorf("Expected hover to contain %q, got\n%s",
+					s, hover.Contents.Value)
+			}
+		}
+	}
+	checkHover("4", "# Adds up some counts.\nstage SUM_COUNTS(\n",
+		"    in  COUNTS[] counts  \"The counts to add\",\n",
+		"    out COUNTS   sum,\n")
+	checkHover("5", "in COUNTS[] counts \"The counts to add\"")
+
+	var completion CompletionList
+	if err := json.Unmarshal(results["6"], &completion); err != nil {
+		t.Error(err)
+	} else if len(completion.Items) != 1 {
+		t.Errorf("Expected 1 completion, got %v", completion.Items)
+	} else if item := completion.Items[0]; item.InsertText != "threads = " {
+		t.Errorf("Expected completion for threads, got %q", item.InsertText)
+	} else if item.Documentation == nil ||
+		item.Documentation.Value != "The number of threads." {
+		t.Errorf("Expected documentation from comments, got %v",
+			item.Documentation)
+	}
+
+	var edits []TextEdit
+	if err := json.Unmarshal(results["7"], &edits); err != nil {
+		t.Error(err)
+	} else if len(edits) != 1 {
+		t.Errorf("Expected 1 edit, got %d", len(edits))
+	} else if edits[0].NewText != testSrc {
+		t.Errorf("Expected formatted source, got\n%s", edits[0].NewText)
+	}
+}
@@ -11,13 +11,18 @@ import (
 	"runtime/trace"
 
 	"github.com/martian-lang/martian/cmd/mro/check"
+	"github.com/martian-lang/martian/cmd/mro/cost"
+	"github.com/martian-lang/martian/cmd/mro/diff"
 	"github.com/martian-lang/martian/cmd/mro/edit"
 	"github.com/martian-lang/martian/cmd/mro/format"
 	"github.com/martian-lang/martian/cmd/mro/graph"
+	"github.com/martian-lang/martian/cmd/mro/lsp"
+	"github.com/martian-lang/martian/cmd/mro/test"
+	"github.com/martian-lang/martian/cmd/mro/timeline"
 	"github.com/martian-lang/martian/martian/util"
 )
 
-const usage = "Usage: mro [help] [check | edit | format | graph] ..."
+const usage = "Usage: mro [help] [check | cost | diff | edit | format | graph | lsp | test | timeline] ..."
 
 func main() {
 	if len(os.Args) < 2 {
@@ -44,6 +49,12 @@ func main() {
 	check:
 		Perform static analysis tasks.
 
+	cost:
+		Report the resources used by pipestances, and their cost.
+
+	diff:
+		Compare two pipestances stage by stage.
+
 	edit:
 		Perform various refactoring tasks.
 
@@ -53,6 +64,15 @@ func main() {
 	graph:
 		Render a call graph, or query information about it.
 
+	lsp:
+		Run a language server for mro files over stdio.
+
+	test:
+		Run a single stage with given arguments, and check its outputs.
+
+	timeline:
+		Report the critical path of a pipestance, and chart its jobs.
+
 	version:
 		Print the version and exit.
 `)
@@ -72,12 +92,22 @@ func delegateMain(argv []string) {
 	switch argv[0] {
 	case "check":
 		check.Main(argv[1:])
+	case "cost":
+		cost.Main(argv[1:])
+	case "diff":
+		diff.Main(argv[1:])
 	case "edit":
 		edit.Main(argv[1:])
 	case "format":
 		format.Main(argv[1:])
 	case "graph":
 		graph.Main(argv[1:])
+	case "lsp":
+		lsp.Main(argv[1:])
+	case "test":
+		test.Main(argv[1:])
+	case "timeline":
+		timeline.Main(argv[1:])
 	case "-cpuprofile":
 		cpuProfile(argv[1], argv[2:])
 	case "-memprofile":
@@ -0,0 +1,136 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+// Package test implements the command line interface for running a single
+// stage outside of a pipestance, for testing.
+package test
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/martian-lang/martian/martian/core"
+	"github.com/martian-lang/martian/martian/stagetest"
+	"github.com/martian-lang/martian/martian/util"
+)
+
+func Main(argv []string) {
+	util.SetPrintLogger(os.Stderr)
+
+	var flags flag.FlagSet
+	flags.Init("mro test", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(),
+			"Usage: mro test [options] <STAGE> <args.json> [expected_outs.json]")
+		fmt.Fprintln(flags.Output())
+		fmt.Fprintln(flags.Output(),
+			"Runs the split, chunks, and join of a stage from $MROPATH with the")
+		fmt.Fprintln(flags.Output(),
+			"given arguments, using the local job manager, and prints the outputs.")
+		fmt.Fprintln(flags.Output(),
+			"If expected outputs are given, the outputs are compared to them.")
+		fmt.Fprintln(flags.Output(),
+			"Files are compared by content, with relative paths in the expected")
+		fmt.Fprintln(flags.Output(),
+			"outputs interpreted relative to the expected outputs file.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+
+	var dir string
+	flags.StringVar(&dir, "dir", "",
+		"The `DIRECTORY` in which to run the stage.  "+
+			"By default, a temporary directory is used and removed "+
+			"if the test passes.")
+	var keep bool
+	flags.BoolVar(&keep, "keep", false,
+		"Do not remove the temporary directory.")
+	config := core.DefaultRuntimeOptions()
+	flags.IntVar(&config.LocalCores, "localcores", 0,
+		"Set max cores the stage may request.")
+	flags.IntVar(&config.LocalMem, "localmem", 0,
+		"Set max GB the stage may request.")
+	var timeout time.Duration
+	flags.DurationVar(&timeout, "timeout", 0,
+		"The maximum time to wait for each job.")
+	if err := flags.Parse(argv); err != nil {
+		panic(err)
+	}
+	if flags.NArg() < 2 || flags.NArg() > 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cwd, _ := os.Getwd()
+	mroPaths := util.ParseMroPath(cwd)
+	if value := os.Getenv("MROPATH"); len(value) > 0 {
+		mroPaths = util.ParseMroPath(value)
+	}
+	args, err := readArgs(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not read arguments:", err)
+		os.Exit(2)
+	}
+	var expected core.LazyArgumentMap
+	if flags.NArg() > 2 {
+		if expected, err = readArgs(flags.Arg(2)); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not read expected outputs:", err)
+			os.Exit(2)
+		}
+	}
+
+	util.SetupSignalHandlers()
+	h, err := stagetest.Load(config.NewRuntime(), flags.Arg(0), mroPaths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	h.Timeout = timeout
+
+	if dir == "" {
+		if dir, err = ioutil.TempDir("", "mro_test"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	} else {
+		keep = true
+	}
+	outs, err := h.Run(dir, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "Stage metadata is in", dir)
+		os.Exit(1)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(outs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if expected != nil {
+		if err := h.CompareOutputs(outs, expected,
+			filepath.Dir(flags.Arg(2))); err != nil {
+			fmt.Fprintln(os.Stderr, "Outputs differ from expected:")
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, "Stage metadata is in", dir)
+			os.Exit(1)
+		}
+	}
+	if !keep {
+		os.RemoveAll(dir)
+	}
+	os.Exit(0)
+}
+
+func readArgs(fn string) (core.LazyArgumentMap, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var args core.LazyArgumentMap
+	return args, json.Unmarshal(b, &args)
+}
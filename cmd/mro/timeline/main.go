@@ -0,0 +1,123 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+// Package timeline implements the command line interface for analyzing
+// where the wall time of a completed pipestance went.
+package timeline
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/martian-lang/martian/martian/util"
+)
+
+func Main(argv []string) {
+	util.SetPrintLogger(os.Stderr)
+
+	var flags flag.FlagSet
+	flags.Init("mro timeline", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(),
+			"Usage: mro timeline [options] <pipestance>")
+		fmt.Fprintln(flags.Output())
+		fmt.Fprintln(flags.Output(),
+			"Reports the critical path of a completed pipestance: the chain of")
+		fmt.Fprintln(flags.Output(),
+			"stages which determined its wall time, and how much of that time")
+		fmt.Fprintln(flags.Output(),
+			"each stage spent queued and running.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+
+	var asJson bool
+	flags.BoolVar(&asJson, "json", false,
+		"Render the report, including every job, as json.")
+	var svgFile string
+	flags.StringVar(&svgFile, "svg", "",
+		"Write a Gantt chart of every job to `FILE`.")
+	if err := flags.Parse(argv); err != nil {
+		panic(err)
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	tl, err := Load(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not load pipestance:", err)
+		os.Exit(2)
+	}
+	if svgFile != "" {
+		if err := writeSvgFile(tl, svgFile); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not write chart:", err)
+			os.Exit(2)
+		}
+	}
+	if asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(tl)
+	} else {
+		err = tl.writeReport(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func writeSvgFile(tl *Timeline, fn string) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err := tl.WriteSvg(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func formatSeconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Millisecond).String()
+}
+
+func percent(part, total float64) string {
+	if total <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*part/total)
+}
+
+// Write a human-readable summary of the timeline and its critical path.
+func (self *Timeline) writeReport(w io.Writer) error {
+	var queued, running float64
+	for _, sf := range self.CriticalPath {
+		queued += sf.Queued
+		running += sf.Running
+	}
+	fmt.Fprintf(w, "Wall time:      %s\n", formatSeconds(self.WallTime))
+	fmt.Fprintf(w, "All jobs:       %d jobs, %s running, %s queued\n",
+		len(self.Jobs), formatSeconds(self.Running), formatSeconds(self.Queued))
+	fmt.Fprintf(w, "Critical path:  %d stages, %s running, %s queued\n\n",
+		len(self.CriticalPath), formatSeconds(running), formatSeconds(queued))
+	tw := tabwriter.NewWriter(w, 2, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "stage\tfork\tready\tqueued\trunning\tshare")
+	for _, sf := range self.CriticalPath {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n",
+			sf.Stage, sf.Fork,
+			formatSeconds(sf.Ready.Sub(self.Start).Seconds()),
+			formatSeconds(sf.Queued),
+			formatSeconds(sf.Running),
+			percent(sf.WallTime(), self.WallTime))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package timeline
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	svgLabelWidth = 320
+	svgPlotWidth  = 1000
+	svgLaneHeight = 10
+	svgAxisHeight = 30
+	svgMargin     = 10
+)
+
+var phaseColors = map[string]string{
+	"split": "#8da0cb",
+	"chunk": "#66c2a5",
+	"join":  "#fc8d62",
+}
+
+// A set of jobs drawn on one row of the chart.
+type lane struct {
+	label string
+	jobs  []*Job
+}
+
+// Pack the jobs of each stage fork into as few lanes as possible, so that
+// jobs in a lane do not overlap.
+func (self *Timeline) lanes() []lane {
+	stages := make([]*StageFork, 0, len(self.stages))
+	for _, sf := range self.stages {
+		if len(sf.jobs) > 0 {
+			stages = append(stages, sf)
+		}
+	}
+	sort.SliceStable(stages, func(i, j int) bool {
+		return stages[i].Start.Before(stages[j].Start)
+	})
+	var lanes []lane
+	for _, sf := range stages {
+		jobs := append([]*Job(nil), sf.jobs...)
+		sort.SliceStable(jobs, func(i, j int) bool {
+			return jobs[i].Start.Before(jobs[j].Start)
+		})
+		label := sf.Stage
+		if sf.Fork > 0 {
+			label = fmt.Sprintf("%s (fork %d)", sf.Stage, sf.Fork)
+		}
+		first := len(lanes)
+		for _, job := range jobs {
+			placed := false
+			for i := first; i < len(lanes) && !placed; i++ {
+				l := lanes[i].jobs
+				if !l[len(l)-1].End.After(job.Start) {
+					lanes[i].jobs = append(l, job)
+					placed = true
+				}
+			}
+			if !placed {
+				lanes = append(lanes, lane{jobs: []*Job{job}})
+			}
+		}
+		lanes[first].label = label
+	}
+	return lanes
+}
+
+// Choose an interval between axis ticks which gives at most 10 ticks.
+func tickInterval(span time.Duration) time.Duration {
+	for _, d := range [...]time.Duration{
+		time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+		time.Minute, 5 * time.Minute, 10 * time.Minute, 30 * time.Minute,
+		time.Hour, 2 * time.Hour, 6 * time.Hour, 12 * time.Hour,
+	} {
+		if span/d <= 10 {
+			return d
+		}
+	}
+	return 24 * time.Hour
+}
+
+// WriteSvg renders a Gantt chart of every job in the pipestance.  Each stage
+// gets one or more rows.  The time each job spent queued is drawn as a thin
+// line before it, and jobs on the critical path are outlined.
+func (self *Timeline) WriteSvg(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	lanes := self.lanes()
+	span := self.End.Sub(self.Start)
+	if span <= 0 {
+		span = time.Second
+	}
+	x := func(t time.Time) float64 {
+		return svgLabelWidth + svgPlotWidth*
+			float64(t.Sub(self.Start))/float64(span)
+	}
+	width := svgLabelWidth + svgPlotWidth + svgMargin
+	height := svgAxisHeight + len(lanes)*svgLaneHeight + svgMargin
+	fmt.Fprintf(bw,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" `+
+			`font-family="sans-serif" font-size="9">`+"\n",
+		width, height)
+	if self.Path != "" {
+		fmt.Fprintf(bw, "<title>%s</title>\n", html.EscapeString(self.Path))
+	}
+
+	// Time axis.
+	interval := tickInterval(span)
+	for t := time.Duration(0); t <= span; t += interval {
+		tx := x(self.Start.Add(t))
+		fmt.Fprintf(bw,
+			`<line x1="%.1f" y1="%d" x2="%.1f" y2="%d" stroke="#ddd"/>`+"\n",
+			tx, svgAxisHeight-5, tx, height-svgMargin)
+		fmt.Fprintf(bw,
+			`<text x="%.1f" y="%d" text-anchor="middle">%s</text>`+"\n",
+			tx, svgAxisHeight-10, t)
+	}
+
+	for i, l := range lanes {
+		y := svgAxisHeight + i*svgLaneHeight
+		if l.label != "" {
+			fmt.Fprintf(bw,
+				`<text x="%d" y="%d" text-anchor="end">%s</text>`+"\n",
+				svgLabelWidth-5, y+svgLaneHeight-2,
+				html.EscapeString(l.label))
+		}
+		for _, job := range l.jobs {
+			if job.Queued() > 0 {
+				fmt.Fprintf(bw,
+					`<line x1="%.1f" y1="%d" x2="%.1f" y2="%d" stroke="#bbb"/>`+"\n",
+					x(job.Ready), y+svgLaneHeight/2,
+					x(job.Start), y+svgLaneHeight/2)
+			}
+		}
+		for _, job := range l.jobs {
+			jw := x(job.End) - x(job.Start)
+			if jw < 0.5 {
+				jw = 0.5
+			}
+			stroke := ""
+			if job.Critical {
+				stroke = ` stroke="#d62728" stroke-width="1"`
+			}
+			fmt.Fprintf(bw,
+				`<rect x="%.1f" y="%d" width="%.1f" height="%d" fill="%s"%s>`+
+					`<title>%s</title></rect>`+"\n",
+				x(job.Start), y+1, jw, svgLaneHeight-2,
+				phaseColors[job.Phase], stroke,
+				html.EscapeString(job.describe()))
+		}
+	}
+	fmt.Fprintln(bw, "</svg>")
+	return bw.Flush()
+}
+
+func (self *Job) describe() string {
+	name := self.Stage + " " + self.Phase
+	if self.Phase == "chunk" {
+		name = fmt.Sprintf("%s %d", name, self.Chunk)
+	}
+	if self.Fork > 0 {
+		name = fmt.Sprintf("%s (fork %d)", name, self.Fork)
+	}
+	return fmt.Sprintf("%s: queued %s, ran %s, %g threads, %g GB",
+		name, formatSeconds(self.Queued()), formatSeconds(self.Running()),
+		self.Threads, self.MemGB)
+}
@@ -0,0 +1,396 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package timeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/martian-lang/martian/martian/core"
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+// A single split, chunk, or join job.
+type Job struct {
+	// The partially qualified name of the stage.
+	Stage string `json:"stage"`
+	Fork  int    `json:"fork"`
+
+	// One of split, chunk, or join.
+	Phase string `json:"phase"`
+	Chunk int    `json:"chunk,omitempty"`
+
+	// The time at which all of the jobs this job depends on had finished.
+	Ready time.Time `json:"ready"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	Threads float64 `json:"threads"`
+	MemGB   float64 `json:"mem_gb"`
+
+	// True if this job is on the critical path of the pipestance.
+	Critical bool `json:"critical,omitempty"`
+}
+
+// Seconds between when the job's dependencies finished and when it started.
+// This includes time waiting for resources, time waiting in a cluster queue,
+// and time for mrp to notice that the dependencies had finished.
+func (self *Job) Queued() float64 {
+	if self.Start.Before(self.Ready) {
+		return 0
+	}
+	return self.Start.Sub(self.Ready).Seconds()
+}
+
+// Seconds for which the job ran.
+func (self *Job) Running() float64 {
+	return self.End.Sub(self.Start).Seconds()
+}
+
+// The timing of one fork of a stage.
+type StageFork struct {
+	// The partially qualified name of the stage.
+	Stage string `json:"stage"`
+	Fork  int    `json:"fork"`
+
+	// The time at which all of the stages this stage depends on had
+	// finished.
+	Ready time.Time `json:"ready"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Seconds spent queued and running by the chain of jobs which
+	// determined when the stage finished: the split, the last chunk to
+	// finish, and the join.
+	Queued  float64 `json:"queued"`
+	Running float64 `json:"running"`
+
+	// Jobs, in order of split, chunks, and join.
+	jobs    []*Job
+	prereqs []*StageFork
+
+	// Set while computing the ready time, to detect cycles.
+	visiting bool
+	computed bool
+}
+
+// Seconds between when the stage was ready and when it finished.
+func (self *StageFork) WallTime() float64 {
+	return self.End.Sub(self.Ready).Seconds()
+}
+
+// The timing analysis of a pipestance.
+type Timeline struct {
+	Path  string    `json:"path"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Seconds from the start of the first job to the end of the last one.
+	WallTime float64 `json:"walltime"`
+
+	// Total seconds spent by all jobs waiting to start after their
+	// dependencies finished.
+	Queued float64 `json:"queued"`
+
+	// Total seconds spent by all jobs running.
+	Running float64 `json:"running"`
+
+	// The chain of stages which determined when the pipestance finished,
+	// in the order in which they ran.
+	CriticalPath []*StageFork `json:"critical_path"`
+
+	// All jobs, in order of start time.
+	Jobs []*Job `json:"jobs"`
+
+	stages []*StageFork
+}
+
+func readMetadata(psPath string, name core.MetadataFileName,
+	target interface{}) error {
+	b, err := ioutil.ReadFile(path.Join(psPath, name.FileName()))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, target)
+}
+
+// Load the performance information and final state for the pipestance in
+// the given directory, and analyze them.
+func Load(psPath string) (*Timeline, error) {
+	var perf []*core.NodePerfInfo
+	if err := readMetadata(psPath, core.Perf, &perf); err != nil {
+		return nil, fmt.Errorf("reading performance info for %s: %v",
+			psPath, err)
+	}
+	var nodes []*core.NodeInfo
+	if err := readMetadata(psPath, core.FinalState, &nodes); err != nil {
+		return nil, fmt.Errorf("reading final state of %s: %v", psPath, err)
+	}
+	tl, err := Build(perf, nodes)
+	if err != nil {
+		return nil, err
+	}
+	tl.Path = psPath
+	return tl, nil
+}
+
+func addJob(sf *StageFork, phase string, chunk int, stats *core.PerfInfo) *Job {
+	if stats == nil || stats.Start.IsZero() || stats.End.IsZero() {
+		return nil
+	}
+	job := &Job{
+		Stage:   sf.Stage,
+		Fork:    sf.Fork,
+		Phase:   phase,
+		Chunk:   chunk,
+		Start:   stats.Start,
+		End:     stats.End,
+		Threads: stats.NumThreads,
+		MemGB:   stats.MemGB,
+	}
+	sf.jobs = append(sf.jobs, job)
+	if sf.Start.IsZero() || job.Start.Before(sf.Start) {
+		sf.Start = job.Start
+	}
+	if sf.End.Before(job.End) {
+		sf.End = job.End
+	}
+	return job
+}
+
+func makeStageFork(name string, fork *core.ForkPerfInfo) *StageFork {
+	sf := &StageFork{
+		Stage: name,
+		Fork:  fork.Index,
+	}
+	addJob(sf, core.STAGE_TYPE_SPLIT, 0, fork.SplitStats)
+	for _, chunk := range fork.Chunks {
+		addJob(sf, core.STAGE_TYPE_CHUNK, chunk.Index, chunk.ChunkStats)
+	}
+	addJob(sf, core.STAGE_TYPE_JOIN, 0, fork.JoinStats)
+	return sf
+}
+
+// Get the fully qualified names of the stages and pipelines which the given
+// node depends on, either directly or through its enclosing pipelines.
+//
+// Pipelines also have edges from the stages inside them which are bound to
+// their outputs.  Those are not dependencies of the stages in the pipeline.
+func dependencies(fqname string, nodes map[string]*core.NodeInfo) []string {
+	var deps []string
+	for name := fqname; name != ""; {
+		if node := nodes[name]; node != nil {
+			for _, edge := range node.Edges {
+				if !strings.HasPrefix(edge.From, name+".") {
+					deps = append(deps, edge.From)
+				}
+			}
+		}
+		if i := strings.LastIndexByte(name, '.'); i > 0 {
+			name = name[:i]
+		} else {
+			name = ""
+		}
+	}
+	return deps
+}
+
+// Build analyzes the timing of a pipestance from its performance
+// information and final state.
+func Build(perf []*core.NodePerfInfo, nodes []*core.NodeInfo) (*Timeline, error) {
+	nodeMap := make(map[string]*core.NodeInfo, len(nodes))
+	for _, node := range nodes {
+		nodeMap[node.Fqname] = node
+	}
+	stageForks := make(map[string][]*StageFork, len(perf))
+	stageNames := make([]string, 0, len(perf))
+	var tl Timeline
+	for _, node := range perf {
+		if node.Type != syntax.KindStage {
+			continue
+		}
+		name := core.PartiallyQualifiedName(node.Fqname)
+		forks := make([]*StageFork, 0, len(node.Forks))
+		for _, fork := range node.Forks {
+			sf := makeStageFork(name, fork)
+			forks = append(forks, sf)
+			tl.stages = append(tl.stages, sf)
+		}
+		stageForks[node.Fqname] = forks
+		stageNames = append(stageNames, node.Fqname)
+	}
+	sort.Strings(stageNames)
+
+	// Resolve dependencies on pipelines to the stages in them.
+	stagesIn := func(fqname string) []string {
+		if _, ok := stageForks[fqname]; ok {
+			return []string{fqname}
+		}
+		prefix := fqname + "."
+		i := sort.SearchStrings(stageNames, prefix)
+		j := i
+		for j < len(stageNames) && strings.HasPrefix(stageNames[j], prefix) {
+			j++
+		}
+		return stageNames[i:j]
+	}
+	for _, fqname := range stageNames {
+		forks := stageForks[fqname]
+		for _, dep := range dependencies(fqname, nodeMap) {
+			for _, stage := range stagesIn(dep) {
+				depForks := stageForks[stage]
+				for i, sf := range forks {
+					if len(depForks) == len(forks) {
+						// Assume forks correspond, as they do when both
+						// stages are mapped over the same collection.
+						sf.prereqs = append(sf.prereqs, depForks[i])
+					} else {
+						sf.prereqs = append(sf.prereqs, depForks...)
+					}
+				}
+			}
+		}
+	}
+
+	for _, sf := range tl.stages {
+		if !sf.Start.IsZero() &&
+			(tl.Start.IsZero() || sf.Start.Before(tl.Start)) {
+			tl.Start = sf.Start
+		}
+		if tl.End.Before(sf.End) {
+			tl.End = sf.End
+		}
+	}
+	if tl.Start.IsZero() {
+		return nil, fmt.Errorf("no jobs have timing information")
+	}
+	tl.WallTime = tl.End.Sub(tl.Start).Seconds()
+	for _, sf := range tl.stages {
+		if err := sf.computeReady(tl.Start); err != nil {
+			return nil, err
+		}
+	}
+	for _, sf := range tl.stages {
+		for _, job := range sf.jobs {
+			tl.Jobs = append(tl.Jobs, job)
+			tl.Queued += job.Queued()
+			tl.Running += job.Running()
+		}
+	}
+	sort.SliceStable(tl.Jobs, func(i, j int) bool {
+		return tl.Jobs[i].Start.Before(tl.Jobs[j].Start)
+	})
+	tl.computeCriticalPath()
+	return &tl, nil
+}
+
+// Compute the ready time for the stage and each of its jobs.
+//
+// Stages without jobs, for example because they were disabled, finish as
+// soon as they are ready.
+func (self *StageFork) computeReady(start time.Time) error {
+	if self.computed {
+		return nil
+	}
+	if self.visiting {
+		return fmt.Errorf("dependency cycle at %s", self.Stage)
+	}
+	self.visiting = true
+	self.Ready = start
+	for _, pre := range self.prereqs {
+		if err := pre.computeReady(start); err != nil {
+			return err
+		}
+		if self.Ready.Before(pre.End) {
+			self.Ready = pre.End
+		}
+	}
+	self.visiting = false
+	self.computed = true
+	if len(self.jobs) == 0 {
+		self.Start = self.Ready
+		self.End = self.Ready
+		return nil
+	}
+	ready := self.Ready
+	var chunksEnd time.Time
+	for _, job := range self.jobs {
+		switch job.Phase {
+		case core.STAGE_TYPE_SPLIT:
+			job.Ready = ready
+			ready = job.End
+		case core.STAGE_TYPE_CHUNK:
+			job.Ready = ready
+			if chunksEnd.Before(job.End) {
+				chunksEnd = job.End
+			}
+		case core.STAGE_TYPE_JOIN:
+			if chunksEnd.IsZero() {
+				job.Ready = ready
+			} else {
+				job.Ready = chunksEnd
+			}
+		}
+	}
+	return nil
+}
+
+// Get the job in the given phase which finished last, or nil.
+func lastJob(jobs []*Job, phase string) *Job {
+	var last *Job
+	for _, job := range jobs {
+		if job.Phase == phase && (last == nil || last.End.Before(job.End)) {
+			last = job
+		}
+	}
+	return last
+}
+
+// Mark the chain of jobs in the stage which determined when it finished,
+// and total up their queued and running time.
+func (self *StageFork) markCritical() {
+	for _, phase := range [...]string{
+		core.STAGE_TYPE_SPLIT,
+		core.STAGE_TYPE_CHUNK,
+		core.STAGE_TYPE_JOIN,
+	} {
+		if job := lastJob(self.jobs, phase); job != nil {
+			job.Critical = true
+			self.Queued += job.Queued()
+			self.Running += job.Running()
+		}
+	}
+}
+
+// Walk back from the stage which finished last, through the prerequisite
+// which finished last, until reaching a stage with no prerequisites.
+func (self *Timeline) computeCriticalPath() {
+	var last *StageFork
+	for _, sf := range self.stages {
+		if len(sf.jobs) > 0 && (last == nil || last.End.Before(sf.End)) {
+			last = sf
+		}
+	}
+	for sf := last; sf != nil; {
+		if len(sf.jobs) > 0 {
+			sf.markCritical()
+			self.CriticalPath = append(self.CriticalPath, sf)
+		}
+		var next *StageFork
+		for _, pre := range sf.prereqs {
+			if next == nil || next.End.Before(pre.End) {
+				next = pre
+			}
+		}
+		sf = next
+	}
+	for i, j := 0, len(self.CriticalPath)-1; i < j; i, j = i+1, j-1 {
+		self.CriticalPath[i], self.CriticalPath[j] =
+			self.CriticalPath[j], self.CriticalPath[i]
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package timeline
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/martian-lang/martian/martian/core"
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+var testStart = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func job(start, end int) *core.PerfInfo {
+	return &core.PerfInfo{
+		NumJobs:    1,
+		NumThreads: 1,
+		MemGB:      1,
+		Start:      testStart.Add(time.Duration(start) * time.Second),
+		End:        testStart.Add(time.Duration(end) * time.Second),
+	}
+}
+
+func makeTestPipestance() ([]*core.NodePerfInfo, []*core.NodeInfo) {
+	stage := func(name string, fork *core.ForkPerfInfo) *core.NodePerfInfo {
+		return &core.NodePerfInfo{
+			Fqname: "ID.ps." + name,
+			Type:   syntax.KindStage,
+			Forks:  []*core.ForkPerfInfo{fork},
+		}
+	}
+	perf := []*core.NodePerfInfo{
+		{
+			Fqname: "ID.ps.PIPE",
+			Type:   syntax.KindPipeline,
+		},
+		stage("PIPE.A", &core.ForkPerfInfo{
+			SplitStats: job(0, 60),
+			Chunks: []*core.ChunkPerfInfo{
+				{Index: 0, ChunkStats: job(60, 600)},
+				{Index: 1, ChunkStats: job(70, 300)},
+			},
+			JoinStats: job(610, 700),
+		}),
+		stage("PIPE.B", &core.ForkPerfInfo{
+			Chunks: []*core.ChunkPerfInfo{
+				{Index: 0, ChunkStats: job(720, 1000)},
+			},
+		}),
+		stage("PIPE.C", &core.ForkPerfInfo{
+			Chunks: []*core.ChunkPerfInfo{
+				{Index: 0, ChunkStats: job(705, 800)},
+			},
+		}),
+		{
+			Fqname: "ID.ps.PIPE.SUB",
+			Type:   syntax.KindPipeline,
+		},
+		stage("PIPE.SUB.D", &core.ForkPerfInfo{
+			Chunks: []*core.ChunkPerfInfo{
+				{Index: 0, ChunkStats: job(1010, 1100)},
+			},
+		}),
+	}
+	edge := func(from, to string) core.EdgeInfo {
+		return core.EdgeInfo{From: "ID.ps." + from, To: "ID.ps." + to}
+	}
+	nodes := []*core.NodeInfo{
+		{Fqname: "ID.ps.PIPE", Type: syntax.KindPipeline},
+		{Fqname: "ID.ps.PIPE.A", Type: syntax.KindStage},
+		{
+			Fqname: "ID.ps.PIPE.B",
+			Type:   syntax.KindStage,
+			Edges:  []core.EdgeInfo{edge("PIPE.A", "PIPE.B")},
+		},
+		{
+			Fqname: "ID.ps.PIPE.C",
+			Type:   syntax.KindStage,
+			Edges:  []core.EdgeInfo{edge("PIPE.A", "PIPE.C")},
+		},
+		{
+			Fqname: "ID.ps.PIPE.SUB",
+			Type:   syntax.KindPipeline,
+			Edges: []core.EdgeInfo{
+				edge("PIPE.B", "PIPE.SUB"),
+				edge("PIPE.C", "PIPE.SUB"),
+			},
+		},
+		{Fqname: "ID.ps.PIPE.SUB.D", Type: syntax.KindStage},
+	}
+	return perf, nodes
+}
+
+func TestCriticalPath(t *testing.T) {
+	tl, err := Build(makeTestPipestance())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tl.WallTime != 1100 {
+		t.Errorf("Expected 1100s wall time, got %g", tl.WallTime)
+	}
+	if len(tl.Jobs) != 7 {
+		t.Errorf("Expected 7 jobs, got %d", len(tl.Jobs))
+	}
+	// Only A's second chunk and the join wait: 10s each.  B waits 20s, C
+	// 5s and D 10s.
+	if tl.Queued != 55 {
+		t.Errorf("Expected 55s queued, got %g", tl.Queued)
+	}
+	expect := []struct {
+		stage           string
+		ready           int
+		queued, running float64
+	}{
+		{"A", 0, 10, 690},
+		{"B", 700, 20, 280},
+		{"SUB.D", 1000, 10, 90},
+	}
+	if len(tl.CriticalPath) != len(expect) {
+		t.Fatalf("Expected %d stages on the critical path, got %d",
+			len(expect), len(tl.CriticalPath))
+	}
+	for i, e := range expect {
+		sf := tl.CriticalPath[i]
+		if sf.Stage != "PIPE."+e.stage {
+			t.Errorf("Expected PIPE.%s, got %s", e.stage, sf.Stage)
+		}
+		if ready := int(sf.Ready.Sub(testStart).Seconds()); ready != e.ready {
+			t.Errorf("Expected %s to be ready at %d, got %d",
+				sf.Stage, e.ready, ready)
+		}
+		if sf.Queued != e.queued {
+			t.Errorf("Expected %s to have queued %gs, got %g",
+				sf.Stage, e.queued, sf.Queued)
+		}
+		if sf.Running != e.running {
+			t.Errorf("Expected %s to have run %gs, got %g",
+				sf.Stage, e.running, sf.Running)
+		}
+	}
+	var critical int
+	for _, job := range tl.Jobs {
+		if job.Critical {
+			critical++
+			if job.Stage == "PIPE.A" && job.Phase == "chunk" && job.Chunk != 0 {
+				t.Errorf("Expected only chunk 0 of A to be critical.")
+			}
+		}
+	}
+	if critical != 5 {
+		t.Errorf("Expected 5 critical jobs, got %d", critical)
+	}
+
+	var buf bytes.Buffer
+	if err := tl.writeReport(&buf); err != nil {
+		t.Error(err)
+	}
+	if report := buf.String(); !strings.Contains(report,
+		"Critical path:  3 stages, 17m40s running, 40s queued") {
+		t.Errorf("Unexpected report:\n%s", report)
+	}
+}
+
+func TestWriteSvg(t *testing.T) {
+	tl, err := Build(makeTestPipestance())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := tl.WriteSvg(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dec := xml.NewDecoder(&buf)
+	var rects int
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if el, ok := tok.(xml.StartElement); ok && el.Name.Local == "rect" {
+			rects++
+		}
+	}
+	if rects != len(tl.Jobs) {
+		t.Errorf("Expected %d jobs in the chart, got %d",
+			len(tl.Jobs), rects)
+	}
+}
+
+func TestFormatSeconds(t *testing.T) {
+	for _, c := range []struct {
+		s      float64
+		expect string
+	}{
+		{0, "0s"},
+		{0.25, "250ms"},
+		{1.5, "1.5s"},
+		{3725.0004, "1h2m5s"},
+	} {
+		if s := formatSeconds(c.s); s != c.expect {
+			t.Errorf("Expected %s for %g, got %s", c.expect, c.s, s)
+		}
+	}
+}
@@ -7,6 +7,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+
 	"github.com/martian-lang/martian/martian/syntax"
 )
 
@@ -33,10 +34,10 @@ func (def *%sChunkDef) ArgsMap() (core.LazyArgumentMap, error) {
 		return m, err
 	} else {
 		m["%s"] = b
-	}
-	return m, nil`, GoName(param.GetId()), param.GetId())
+	}`, GoName(param.GetId()), param.GetId())
 		}
 		fmt.Fprintf(buffer, `
+	return m, nil
 }
 
 func (def *%sChunkDef) ToChunkDef() (*core.ChunkDef, error) {
@@ -66,7 +67,7 @@ func (def *%sChunkDef) ArgsMap() (core.LazyArgumentMap, error) {
 
 func (def *%sChunkDef) ToChunkDef() (*core.ChunkDef, error) {
 	return &core.ChunkDef{
-		Resources: def.JobResources,
+		Resources: (*core.JobResources)(def),
 	}, nil
 }
 
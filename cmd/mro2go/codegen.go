@@ -14,7 +14,8 @@ import (
 	"github.com/martian-lang/martian/martian/syntax"
 )
 
-func makeGoRaw(ast *syntax.Ast, pkg, mroName, stageName string) string {
+func makeGoRaw(ast *syntax.Ast, pkg, mroName, stageName string,
+	handlers bool) string {
 	var buffer bytes.Buffer
 	buffer.WriteString("// Code generated by mro2go ")
 	buffer.WriteString(mroName)
@@ -25,35 +26,60 @@ func makeGoRaw(ast *syntax.Ast, pkg, mroName, stageName string) string {
 		buffer.WriteString("package ")
 		buffer.WriteString(pkg)
 		buffer.WriteRune('\n')
-		for i, stage := range stages {
-			if stage.Split {
-				buffer.WriteString(`
-import (
-`)
-				for _, stage := range stages[i:] {
-					if stage.Split &&
-						len(stage.OutParams.List) > 0 &&
-						len(stage.ChunkOuts.List) > 0 {
-						buffer.WriteString("\t\"bytes\"\n")
-						buffer.WriteString("\t\"encoding/json\"")
-						break
-					}
-				}
-				buffer.WriteString(`
-	"github.com/martian-lang/martian/martian/core"
-)
-
-`)
-				break
-			}
-		}
+		writeImports(&buffer, stages, handlers)
 	}
 	for _, stage := range stages {
 		writeStageStructs(&buffer, stage)
+		if handlers {
+			writeStageHandler(&buffer, GoName(stage.Id), stage)
+		}
 	}
 	return buffer.String()
 }
 
+// Write the imports required by the generated code for the given stages.
+func writeImports(buffer *bytes.Buffer, stages []*syntax.Stage, handlers bool) {
+	var needBytes, needJson, needCore bool
+	for _, stage := range stages {
+		if stage.Split {
+			needCore = true
+			if len(stage.ChunkIns.List) > 0 {
+				// Needed for ArgsMap.
+				needJson = true
+			}
+			if len(stage.OutParams.List) > 0 &&
+				len(stage.ChunkOuts.List) > 0 {
+				needBytes = true
+				needJson = true
+			}
+		}
+	}
+	needHandlers := handlers && len(stages) > 0
+	if !needBytes && !needJson && !needCore && !needHandlers {
+		return
+	}
+	buffer.WriteString("\nimport (\n")
+	if needBytes {
+		buffer.WriteString("\t\"bytes\"\n")
+	}
+	if needHandlers {
+		buffer.WriteString("\t\"context\"\n")
+	}
+	if needJson {
+		buffer.WriteString("\t\"encoding/json\"\n")
+	}
+	if needBytes || needJson || needHandlers {
+		buffer.WriteRune('\n')
+	}
+	if needHandlers {
+		buffer.WriteString("\t\"github.com/martian-lang/martian/martian/adapter\"\n")
+	}
+	if needCore || needHandlers {
+		buffer.WriteString("\t\"github.com/martian-lang/martian/martian/core\"\n")
+	}
+	buffer.WriteString(")\n\n")
+}
+
 // Use gofmt to ensure proper formatting.
 func gofmt(dest io.Writer, goSrc, outName string) error {
 	fset := token.NewFileSet()
@@ -4,14 +4,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
 	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/martian-lang/martian/martian/adapter"
 	"github.com/martian-lang/martian/martian/core"
 )
 
@@ -46,22 +49,29 @@ func ExampleGoName() {
 // Test that the go output is the same as what is being tested
 // for functionality elsewhere.
 func TestMroToGo(t *testing.T) {
-	mrosrc, err := ioutil.ReadFile(path.Join("testdata", "pipeline_stages.mro"))
-	if err != nil {
-		t.Fatal(err)
-	}
-	var dest bytes.Buffer
-	if err := MroToGo(&dest,
-		mrosrc, "testdata/pipeline_stages.mro", "",
-		nil,
-		"main", "split_test.go"); err != nil {
-		t.Fatal(err)
-	}
-	goSrc := dest.String()
-	if expectedSrc, err := ioutil.ReadFile("split_test.go"); err != nil {
-		t.Fatal(err)
-	} else if string(expectedSrc) != goSrc {
-		t.Errorf("Expected:\n%s\n\nGot:\n%s", expectedSrc, goSrc)
+	for _, c := range []struct {
+		mro, goFile string
+	}{
+		{"pipeline_stages.mro", "split_test.go"},
+		{"file_stages.mro", "files_test.go"},
+	} {
+		mrosrc, err := ioutil.ReadFile(path.Join("testdata", c.mro))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dest bytes.Buffer
+		if err := MroToGo(&dest,
+			mrosrc, "testdata/"+c.mro, "",
+			nil,
+			"main", c.goFile, true); err != nil {
+			t.Fatal(err)
+		}
+		goSrc := dest.String()
+		if expectedSrc, err := ioutil.ReadFile(c.goFile); err != nil {
+			t.Fatal(err)
+		} else if string(expectedSrc) != goSrc {
+			t.Errorf("Expected:\n%s\n\nGot:\n%s", expectedSrc, goSrc)
+		}
 	}
 }
 
@@ -141,3 +151,122 @@ func TestToChunkDef(t *testing.T) {
 		t.Errorf("Incorrect result: %v", cd)
 	}
 }
+
+type sumSquares struct{}
+
+func (sumSquares) Split(ctx context.Context,
+	args *SumSquaresArgs) ([]*SumSquaresChunkDef, *core.JobResources, error) {
+	if adapter.GetMetadata(ctx) == nil {
+		return nil, nil, fmt.Errorf("no metadata in context")
+	}
+	defs := make([]*SumSquaresChunkDef, len(args.Values))
+	for i, v := range args.Values {
+		defs[i] = &SumSquaresChunkDef{
+			JobResources: &core.JobResources{Threads: 1},
+			Value:        v,
+		}
+	}
+	return defs, &core.JobResources{Threads: 2}, nil
+}
+
+func (sumSquares) Main(ctx context.Context,
+	args *SumSquaresChunkArgs, outs *SumSquaresChunkOuts) error {
+	if len(args.Values) == 0 {
+		return fmt.Errorf("stage args were not passed to the chunk")
+	}
+	outs.Square = args.Value * args.Value
+	return nil
+}
+
+func (sumSquares) Join(ctx context.Context, args *SumSquaresJoinArgs,
+	defs []*SumSquaresChunkDef, chunkOuts []*SumSquaresChunkOuts,
+	outs *SumSquaresOuts) error {
+	if args.Threads != 2 {
+		return fmt.Errorf("expected 2 join threads, got %g", args.Threads)
+	}
+	if len(defs) != len(chunkOuts) {
+		return fmt.Errorf("%d chunk defs but %d chunk outs",
+			len(defs), len(chunkOuts))
+	}
+	for i, out := range chunkOuts {
+		if out.Square != defs[i].Value*defs[i].Value {
+			return fmt.Errorf("incorrect square %g for %g",
+				out.Square, defs[i].Value)
+		}
+		outs.Sum += out.Square
+	}
+	return nil
+}
+
+func TestRunInDir(t *testing.T) {
+	outs, err := RunSumSquaresInDir("", sumSquares{},
+		&SumSquaresArgs{Values: []float64{1, 2, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outs.Sum != 14 {
+		t.Errorf("Expected 14, got %g", outs.Sum)
+	}
+}
+
+type writeValues struct{}
+
+func (writeValues) Split(ctx context.Context,
+	args *WriteValuesArgs) ([]*WriteValuesChunkDef, *core.JobResources, error) {
+	defs := make([]*WriteValuesChunkDef, len(args.Values))
+	for i, v := range args.Values {
+		defs[i] = &WriteValuesChunkDef{Value: v}
+	}
+	return defs, nil, nil
+}
+
+func (writeValues) Main(ctx context.Context,
+	args *WriteValuesChunkArgs, outs *WriteValuesChunkOuts) error {
+	if outs.ValueFile == "" {
+		return fmt.Errorf("no path for the chunk file output")
+	}
+	return ioutil.WriteFile(outs.ValueFile,
+		[]byte(fmt.Sprintln(args.Value)), 0644)
+}
+
+func (writeValues) Join(ctx context.Context, args *WriteValuesJoinArgs,
+	defs []*WriteValuesChunkDef, chunkOuts []*WriteValuesChunkOuts,
+	outs *WriteValuesOuts) error {
+	if outs.Summary == "" {
+		return fmt.Errorf("no path for the file output")
+	}
+	var buf bytes.Buffer
+	for _, out := range chunkOuts {
+		b, err := ioutil.ReadFile(out.ValueFile)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	outs.Count = len(chunkOuts)
+	return ioutil.WriteFile(outs.Summary, buf.Bytes(), 0644)
+}
+
+func TestRunInDirFileOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRunInDirFileOutputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outs, err := RunWriteValuesInDir(dir, writeValues{},
+		&WriteValuesArgs{Values: []int{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outs.Count != 2 {
+		t.Errorf("Expected 2, got %d", outs.Count)
+	}
+	if expect := path.Join(dir, "join", "files", "summary.txt"); outs.Summary != expect {
+		t.Errorf("Expected %q, got %q", expect, outs.Summary)
+	}
+	if b, err := ioutil.ReadFile(outs.Summary); err != nil {
+		t.Error(err)
+	} else if string(b) != "1\n2\n" {
+		t.Errorf("Expected values in the summary, got %q", b)
+	}
+}
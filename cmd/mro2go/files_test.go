@@ -0,0 +1,205 @@
+// Code generated by mro2go testdata/file_stages.mro; DO NOT EDIT.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/martian-lang/martian/martian/adapter"
+	"github.com/martian-lang/martian/martian/core"
+)
+
+//
+// WRITE_VALUES
+//
+
+// A structure to encode and decode args to the WRITE_VALUES stage.
+type WriteValuesArgs struct {
+	Values []int `json:"values"`
+}
+
+// A structure to encode and decode outs from the WRITE_VALUES stage.
+type WriteValuesOuts struct {
+	// txt file
+	Summary string `json:"summary"`
+	Count   int    `json:"count"`
+}
+
+// A structure to encode chunk definitions for WRITE_VALUES.
+// Defines the resources and chunk-specific arguments.
+type WriteValuesChunkDef struct {
+	*core.JobResources `json:",omitempty"`
+	Value              int `json:"value"`
+}
+
+func (def *WriteValuesChunkDef) ArgsMap() (core.LazyArgumentMap, error) {
+	m := make(core.LazyArgumentMap, 1)
+	if b, err := json.Marshal(def.Value); err != nil {
+		return m, err
+	} else {
+		m["value"] = b
+	}
+	return m, nil
+}
+
+func (def *WriteValuesChunkDef) ToChunkDef() (*core.ChunkDef, error) {
+	args, err := def.ArgsMap()
+	return &core.ChunkDef{
+		Resources: def.JobResources,
+		Args:      args,
+	}, err
+}
+
+// A structure to decode args to the chunks for WRITE_VALUES
+type WriteValuesChunkArgs struct {
+	WriteValuesChunkDef
+	WriteValuesArgs
+}
+
+// A structure to decode args to the join method for WRITE_VALUES
+type WriteValuesJoinArgs struct {
+	core.JobResources
+	WriteValuesArgs
+}
+
+// A structure to encode outs from the chunks for WRITE_VALUES.
+type WriteValuesChunkOuts struct {
+	WriteValuesOuts
+	// txt file
+	ValueFile string `json:"value_file"`
+}
+
+func (def *WriteValuesChunkOuts) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteRune('{')
+	if b, err := json.Marshal(&def.Summary); err != nil {
+		return nil, err
+	} else {
+		buf.WriteString("\"summary\":")
+		buf.Write(b)
+	}
+	if b, err := json.Marshal(&def.Count); err != nil {
+		return nil, err
+	} else {
+		buf.WriteString(",\"count\":")
+		buf.Write(b)
+	}
+	if b, err := json.Marshal(&def.ValueFile); err != nil {
+		return nil, err
+	} else {
+		buf.WriteString(",\"value_file\":")
+		buf.Write(b)
+	}
+	buf.WriteRune('}')
+	return buf.Bytes(), nil
+}
+
+// WriteValuesHandler implements the phases of the WRITE_VALUES stage.
+type WriteValuesHandler interface {
+	// Split returns the definitions of the chunks to run, and optionally the
+	// resources required by the join.
+	Split(ctx context.Context, args *WriteValuesArgs) ([]*WriteValuesChunkDef, *core.JobResources, error)
+
+	// Main runs a single chunk.  The outs are initialized with the values
+	// provided by Martian, which include the paths for file outputs.
+	Main(ctx context.Context, args *WriteValuesChunkArgs, outs *WriteValuesChunkOuts) error
+
+	// Join combines the outputs of the chunks into the stage outputs.  The
+	// chunk definitions and outputs are in the same order.
+	Join(ctx context.Context, args *WriteValuesJoinArgs,
+		defs []*WriteValuesChunkDef, chunkOuts []*WriteValuesChunkOuts,
+		outs *WriteValuesOuts) error
+}
+
+// WriteValuesPhases returns the adapter functions for each phase of the WRITE_VALUES
+// stage, which read the stage metadata and write the results using the typed
+// structures.
+func WriteValuesPhases(h WriteValuesHandler) (adapter.SplitFunc, adapter.MainFunc, adapter.MainFunc) {
+	split := func(metadata *core.Metadata) (*core.StageDefs, error) {
+		var args WriteValuesArgs
+		if err := metadata.ReadInto(core.ArgsFile, &args); err != nil {
+			return nil, err
+		}
+		ctx := adapter.WithMetadata(context.Background(), metadata)
+		defs, joinDef, err := h.Split(ctx, &args)
+		if err != nil {
+			return nil, err
+		}
+		result := &core.StageDefs{
+			ChunkDefs: make([]*core.ChunkDef, len(defs)),
+			JoinDef:   joinDef,
+		}
+		for i, def := range defs {
+			if result.ChunkDefs[i], err = def.ToChunkDef(); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	chunk := func(metadata *core.Metadata) (interface{}, error) {
+		var args WriteValuesChunkArgs
+		if err := metadata.ReadInto(core.ArgsFile, &args); err != nil {
+			return nil, err
+		}
+		var outs WriteValuesChunkOuts
+		if err := adapter.ReadOuts(metadata, &outs); err != nil {
+			return nil, err
+		}
+		ctx := adapter.WithMetadata(context.Background(), metadata)
+		if err := h.Main(ctx, &args, &outs); err != nil {
+			return nil, err
+		}
+		return &outs, nil
+	}
+	join := func(metadata *core.Metadata) (interface{}, error) {
+		var args WriteValuesJoinArgs
+		if err := metadata.ReadInto(core.ArgsFile, &args); err != nil {
+			return nil, err
+		}
+		var defs []*WriteValuesChunkDef
+		if err := metadata.ReadInto(core.ChunkDefsFile, &defs); err != nil {
+			return nil, err
+		}
+		var chunkOuts []*WriteValuesChunkOuts
+		if err := metadata.ReadInto(core.ChunkOutsFile, &chunkOuts); err != nil {
+			return nil, err
+		}
+		var outs WriteValuesOuts
+		if err := adapter.ReadOuts(metadata, &outs); err != nil {
+			return nil, err
+		}
+		ctx := adapter.WithMetadata(context.Background(), metadata)
+		if err := h.Join(ctx, &args, defs, chunkOuts, &outs); err != nil {
+			return nil, err
+		}
+		return &outs, nil
+	}
+	return split, chunk, join
+}
+
+// RunWriteValues runs the current phase of the WRITE_VALUES stage with the given handler.
+// It is intended to be called from the main function of the stage executable.
+func RunWriteValues(h WriteValuesHandler) {
+	adapter.RunStage(WriteValuesPhases(h))
+}
+
+// RunWriteValuesInDir runs every phase of the WRITE_VALUES stage in the current process,
+// with metadata directories created under the given directory.  If dir is
+// empty, a temporary directory is used and removed afterwards.
+//
+// This is intended for testing.
+func RunWriteValuesInDir(dir string, h WriteValuesHandler, args *WriteValuesArgs) (*WriteValuesOuts, error) {
+	split, chunk, join := WriteValuesPhases(h)
+	var outs WriteValuesOuts
+	if err := adapter.RunStageInDir(dir, split, chunk, join,
+		adapter.OutFiles{
+			"summary": "summary.txt",
+		}, adapter.OutFiles{
+			"value_file": "value_file.txt",
+		}, args, &outs); err != nil {
+		return nil, err
+	}
+	return &outs, nil
+}
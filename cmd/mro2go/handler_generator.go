@@ -0,0 +1,191 @@
+//
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+// Write the handler interface for a stage, along with the functions which
+// connect it to the go adapter.
+func writeStageHandler(buffer *bytes.Buffer, prefix string, stage *syntax.Stage) {
+	if stage.Split {
+		writeSplitHandler(buffer, prefix, stage)
+	} else {
+		writeMainHandler(buffer, prefix, stage)
+	}
+	fmt.Fprintf(buffer, `
+// Run%[1]s runs the current phase of the %[2]s stage with the given handler.
+// It is intended to be called from the main function of the stage executable.
+func Run%[1]s(h %[1]sHandler) {
+	adapter.RunStage(%[1]sPhases(h))
+}
+
+// Run%[1]sInDir runs every phase of the %[2]s stage in the current process,
+// with metadata directories created under the given directory.  If dir is
+// empty, a temporary directory is used and removed afterwards.
+//
+// This is intended for testing.
+func Run%[1]sInDir(dir string, h %[1]sHandler, args *%[1]sArgs) (*%[1]sOuts, error) {
+	split, chunk, join := %[1]sPhases(h)
+	var outs %[1]sOuts
+	if err := adapter.RunStageInDir(dir, split, chunk, join,
+		%[3]s, %[4]s, args, &outs); err != nil {
+		return nil, err
+	}
+	return &outs, nil
+}
+`, prefix, stage.Id,
+		outFilesLiteral(stage.OutParams),
+		outFilesLiteral(stage.ChunkOuts))
+}
+
+// Returns the source for an adapter.OutFiles with the default file names
+// of the file-typed outputs in params, or nil if there are none.  Arrays and
+// maps of files are not included, as the runtime does not assign file names
+// for them.
+func outFilesLiteral(params *syntax.OutParams) string {
+	if params == nil {
+		return "nil"
+	}
+	var buf bytes.Buffer
+	for _, param := range params.List {
+		if param.IsFile() != syntax.KindIsFile ||
+			param.Tname.ArrayDim > 0 || param.Tname.MapDim > 0 {
+			continue
+		}
+		if fn := param.GetOutFilename(); fn != "" {
+			fmt.Fprintf(&buf, "\t\t\t%s: %s,\n",
+				strconv.Quote(param.Id), strconv.Quote(fn))
+		}
+	}
+	if buf.Len() == 0 {
+		return "nil"
+	}
+	return "adapter.OutFiles{\n" + buf.String() + "\t\t}"
+}
+
+func writeMainHandler(buffer *bytes.Buffer, prefix string, stage *syntax.Stage) {
+	fmt.Fprintf(buffer, `
+// %[1]sHandler implements the %[2]s stage.
+type %[1]sHandler interface {
+	// Main runs the stage.  The outs are initialized with the values
+	// provided by Martian, which include the paths for file outputs.
+	Main(ctx context.Context, args *%[1]sArgs, outs *%[1]sOuts) error
+}
+
+// %[1]sPhases returns the adapter functions for the %[2]s stage, which
+// read the stage arguments and write the outputs using the typed structures.
+// The stage does not split, so the split and join functions are nil.
+func %[1]sPhases(h %[1]sHandler) (adapter.SplitFunc, adapter.MainFunc, adapter.MainFunc) {
+	return nil, func(metadata *core.Metadata) (interface{}, error) {
+		var args %[1]sArgs
+		if err := metadata.ReadInto(core.ArgsFile, &args); err != nil {
+			return nil, err
+		}
+		var outs %[1]sOuts
+		if err := adapter.ReadOuts(metadata, &outs); err != nil {
+			return nil, err
+		}
+		ctx := adapter.WithMetadata(context.Background(), metadata)
+		if err := h.Main(ctx, &args, &outs); err != nil {
+			return nil, err
+		}
+		return &outs, nil
+	}, nil
+}
+`, prefix, stage.Id)
+}
+
+func writeSplitHandler(buffer *bytes.Buffer, prefix string, stage *syntax.Stage) {
+	fmt.Fprintf(buffer, `
+// %[1]sHandler implements the phases of the %[2]s stage.
+type %[1]sHandler interface {
+	// Split returns the definitions of the chunks to run, and optionally the
+	// resources required by the join.
+	Split(ctx context.Context, args *%[1]sArgs) ([]*%[1]sChunkDef, *core.JobResources, error)
+
+	// Main runs a single chunk.  The outs are initialized with the values
+	// provided by Martian, which include the paths for file outputs.
+	Main(ctx context.Context, args *%[1]sChunkArgs, outs *%[1]sChunkOuts) error
+
+	// Join combines the outputs of the chunks into the stage outputs.  The
+	// chunk definitions and outputs are in the same order.
+	Join(ctx context.Context, args *%[1]sJoinArgs,
+		defs []*%[1]sChunkDef, chunkOuts []*%[1]sChunkOuts,
+		outs *%[1]sOuts) error
+}
+
+// %[1]sPhases returns the adapter functions for each phase of the %[2]s
+// stage, which read the stage metadata and write the results using the typed
+// structures.
+func %[1]sPhases(h %[1]sHandler) (adapter.SplitFunc, adapter.MainFunc, adapter.MainFunc) {
+	split := func(metadata *core.Metadata) (*core.StageDefs, error) {
+		var args %[1]sArgs
+		if err := metadata.ReadInto(core.ArgsFile, &args); err != nil {
+			return nil, err
+		}
+		ctx := adapter.WithMetadata(context.Background(), metadata)
+		defs, joinDef, err := h.Split(ctx, &args)
+		if err != nil {
+			return nil, err
+		}
+		result := &core.StageDefs{
+			ChunkDefs: make([]*core.ChunkDef, len(defs)),
+			JoinDef:   joinDef,
+		}
+		for i, def := range defs {
+			if result.ChunkDefs[i], err = def.ToChunkDef(); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	chunk := func(metadata *core.Metadata) (interface{}, error) {
+		var args %[1]sChunkArgs
+		if err := metadata.ReadInto(core.ArgsFile, &args); err != nil {
+			return nil, err
+		}
+		var outs %[1]sChunkOuts
+		if err := adapter.ReadOuts(metadata, &outs); err != nil {
+			return nil, err
+		}
+		ctx := adapter.WithMetadata(context.Background(), metadata)
+		if err := h.Main(ctx, &args, &outs); err != nil {
+			return nil, err
+		}
+		return &outs, nil
+	}
+	join := func(metadata *core.Metadata) (interface{}, error) {
+		var args %[1]sJoinArgs
+		if err := metadata.ReadInto(core.ArgsFile, &args); err != nil {
+			return nil, err
+		}
+		var defs []*%[1]sChunkDef
+		if err := metadata.ReadInto(core.ChunkDefsFile, &defs); err != nil {
+			return nil, err
+		}
+		var chunkOuts []*%[1]sChunkOuts
+		if err := metadata.ReadInto(core.ChunkOutsFile, &chunkOuts); err != nil {
+			return nil, err
+		}
+		var outs %[1]sOuts
+		if err := adapter.ReadOuts(metadata, &outs); err != nil {
+			return nil, err
+		}
+		ctx := adapter.WithMetadata(context.Background(), metadata)
+		if err := h.Join(ctx, &args, defs, chunkOuts, &outs); err != nil {
+			return nil, err
+		}
+		return &outs, nil
+	}
+	return split, chunk, join
+}
+`, prefix, stage.Id)
+}
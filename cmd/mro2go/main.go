@@ -49,6 +49,35 @@ A stage without a split will look like the following simple example:
 Stages with splits will be more complex and should use the corresponding
 datastructures.
 
+If '-handlers' is specified, then for each stage a <stageName>Handler
+interface is also generated, with methods which take the typed structures
+described above, along with <stageName>Phases, which wraps a handler in the
+functions expected by the go adapter, and Run<stageName>, which runs it.  The
+example above then becomes
+
+	type stageName struct{}
+
+	func (stageName) Main(ctx context.Context,
+		args *StageNameArgs, outs *StageNameOuts) error {
+		outs.Arg1 = value1
+		outs.Arg2 = value2
+		return nil
+	}
+
+	func main() {
+		RunStageName(stageName{})
+	}
+
+For a stage which splits, the handler has Split, Main, and Join methods.  The
+generated code reads the args, chunk defs, chunk outs, and the outs
+pre-populated by Martian before calling the handler, and writes the results
+afterwards.  The metadata for the job is available from the context through
+adapter.GetMetadata.
+
+Run<stageName>InDir runs all phases of a stage in-process, using metadata
+directories under a given or temporary directory, which is useful for testing
+stage code without running mrp.
+
 Leading underscores are stripped from the stage.  The stage name is converted
 to camelCase unless '-public' is specified on the command line, in which case
 it is converted to PascalCase.
@@ -185,6 +214,9 @@ func main() {
 		"Only generate code for the given stage.")
 	stdout := flags.Bool("stdout", false,
 		"Write the go source to standard out.")
+	handlers := flags.Bool("handlers", false,
+		"Also generate typed handler interfaces for each stage, and "+
+			"functions to run them with the go adapter.")
 	if err := flags.Parse(os.Args[1:]); err != nil {
 		// ExitOnError should mean that it never returns an error.
 		panic(err)
@@ -246,12 +278,12 @@ func main() {
 				thisPackage = path.Base(path.Dir(p))
 			}
 		}
-		processFile(f, mrofile, *stageName, thisPackage, mroPaths)
+		processFile(f, mrofile, *stageName, thisPackage, mroPaths, *handlers)
 	}
 }
 
 func processFile(dest *os.File, mrofile, stageName, packageName string,
-	mroPaths []string) {
+	mroPaths []string, handlers bool) {
 	if dest == nil {
 		thisOut := path.Base(strings.TrimSuffix(mrofile, ".mro")) + ".go"
 		if t, err := os.Create(thisOut); err != nil {
@@ -276,7 +308,7 @@ func processFile(dest *os.File, mrofile, stageName, packageName string,
 		os.Exit(1)
 	} else if err := MroToGo(dest, src,
 		mrofile, stageName, mroPaths,
-		packageName, dest.Name()); err != nil {
+		packageName, dest.Name(), handlers); err != nil {
 		fmt.Fprintf(os.Stderr, "Error generating go source for %s\n%s\n",
 			mrofile, err.Error())
 		os.Exit(1)
@@ -304,11 +336,13 @@ func readSrc(mrofile string, mroPaths []string) ([]byte, string, error) {
 
 func MroToGo(dest io.Writer,
 	src []byte, mrofile, stageName string, mroPaths []string,
-	pkg, outName string) error {
+	pkg, outName string, handlers bool) error {
 	if ast, err := parseMro(src, mrofile, mroPaths); err != nil {
 		return err
 	} else {
-		return gofmt(dest, makeGoRaw(ast, pkg, mrofile, stageName), outName)
+		return gofmt(dest,
+			makeGoRaw(ast, pkg, mrofile, stageName, handlers),
+			outName)
 	}
 }
 
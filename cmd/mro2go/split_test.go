@@ -4,7 +4,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+
+	"github.com/martian-lang/martian/martian/adapter"
 	"github.com/martian-lang/martian/martian/core"
 )
 
@@ -88,6 +91,110 @@ func (def *SumSquaresChunkOuts) MarshalJSON() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// SumSquaresHandler implements the phases of the SUM_SQUARES stage.
+type SumSquaresHandler interface {
+	// Split returns the definitions of the chunks to run, and optionally the
+	// resources required by the join.
+	Split(ctx context.Context, args *SumSquaresArgs) ([]*SumSquaresChunkDef, *core.JobResources, error)
+
+	// Main runs a single chunk.  The outs are initialized with the values
+	// provided by Martian, which include the paths for file outputs.
+	Main(ctx context.Context, args *SumSquaresChunkArgs, outs *SumSquaresChunkOuts) error
+
+	// Join combines the outputs of the chunks into the stage outputs.  The
+	// chunk definitions and outputs are in the same order.
+	Join(ctx context.Context, args *SumSquaresJoinArgs,
+		defs []*SumSquaresChunkDef, chunkOuts []*SumSquaresChunkOuts,
+		outs *SumSquaresOuts) error
+}
+
+// SumSquaresPhases returns the adapter functions for each phase of the SUM_SQUARES
+// stage, which read the stage metadata and write the results using the typed
+// structures.
+func SumSquaresPhases(h SumSquaresHandler) (adapter.SplitFunc, adapter.MainFunc, adapter.MainFunc) {
+	split := func(metadata *core.Metadata) (*core.StageDefs, error) {
+		var args SumSquaresArgs
+		if err := metadata.ReadInto(core.ArgsFile, &args); err != nil {
+			return nil, err
+		}
+		ctx := adapter.WithMetadata(context.Background(), metadata)
+		defs, joinDef, err := h.Split(ctx, &args)
+		if err != nil {
+			return nil, err
+		}
+		result := &core.StageDefs{
+			ChunkDefs: make([]*core.ChunkDef, len(defs)),
+			JoinDef:   joinDef,
+		}
+		for i, def := range defs {
+			if result.ChunkDefs[i], err = def.ToChunkDef(); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	chunk := func(metadata *core.Metadata) (interface{}, error) {
+		var args SumSquaresChunkArgs
+		if err := metadata.ReadInto(core.ArgsFile, &args); err != nil {
+			return nil, err
+		}
+		var outs SumSquaresChunkOuts
+		if err := adapter.ReadOuts(metadata, &outs); err != nil {
+			return nil, err
+		}
+		ctx := adapter.WithMetadata(context.Background(), metadata)
+		if err := h.Main(ctx, &args, &outs); err != nil {
+			return nil, err
+		}
+		return &outs, nil
+	}
+	join := func(metadata *core.Metadata) (interface{}, error) {
+		var args SumSquaresJoinArgs
+		if err := metadata.ReadInto(core.ArgsFile, &args); err != nil {
+			return nil, err
+		}
+		var defs []*SumSquaresChunkDef
+		if err := metadata.ReadInto(core.ChunkDefsFile, &defs); err != nil {
+			return nil, err
+		}
+		var chunkOuts []*SumSquaresChunkOuts
+		if err := metadata.ReadInto(core.ChunkOutsFile, &chunkOuts); err != nil {
+			return nil, err
+		}
+		var outs SumSquaresOuts
+		if err := adapter.ReadOuts(metadata, &outs); err != nil {
+			return nil, err
+		}
+		ctx := adapter.WithMetadata(context.Background(), metadata)
+		if err := h.Join(ctx, &args, defs, chunkOuts, &outs); err != nil {
+			return nil, err
+		}
+		return &outs, nil
+	}
+	return split, chunk, join
+}
+
+// RunSumSquares runs the current phase of the SUM_SQUARES stage with the given handler.
+// It is intended to be called from the main function of the stage executable.
+func RunSumSquares(h SumSquaresHandler) {
+	adapter.RunStage(SumSquaresPhases(h))
+}
+
+// RunSumSquaresInDir runs every phase of the SUM_SQUARES stage in the current process,
+// with metadata directories created under the given directory.  If dir is
+// empty, a temporary directory is used and removed afterwards.
+//
+// This is intended for testing.
+func RunSumSquaresInDir(dir string, h SumSquaresHandler, args *SumSquaresArgs) (*SumSquaresOuts, error) {
+	split, chunk, join := SumSquaresPhases(h)
+	var outs SumSquaresOuts
+	if err := adapter.RunStageInDir(dir, split, chunk, join,
+		nil, nil, args, &outs); err != nil {
+		return nil, err
+	}
+	return &outs, nil
+}
+
 //
 // REPORT
 //
@@ -101,3 +208,52 @@ type ReportArgs struct {
 // A structure to encode and decode outs from the REPORT stage.
 type ReportOuts struct {
 }
+
+// ReportHandler implements the REPORT stage.
+type ReportHandler interface {
+	// Main runs the stage.  The outs are initialized with the values
+	// provided by Martian, which include the paths for file outputs.
+	Main(ctx context.Context, args *ReportArgs, outs *ReportOuts) error
+}
+
+// ReportPhases returns the adapter functions for the REPORT stage, which
+// read the stage arguments and write the outputs using the typed structures.
+// The stage does not split, so the split and join functions are nil.
+func ReportPhases(h ReportHandler) (adapter.SplitFunc, adapter.MainFunc, adapter.MainFunc) {
+	return nil, func(metadata *core.Metadata) (interface{}, error) {
+		var args ReportArgs
+		if err := metadata.ReadInto(core.ArgsFile, &args); err != nil {
+			return nil, err
+		}
+		var outs ReportOuts
+		if err := adapter.ReadOuts(metadata, &outs); err != nil {
+			return nil, err
+		}
+		ctx := adapter.WithMetadata(context.Background(), metadata)
+		if err := h.Main(ctx, &args, &outs); err != nil {
+			return nil, err
+		}
+		return &outs, nil
+	}, nil
+}
+
+// RunReport runs the current phase of the REPORT stage with the given handler.
+// It is intended to be called from the main function of the stage executable.
+func RunReport(h ReportHandler) {
+	adapter.RunStage(ReportPhases(h))
+}
+
+// RunReportInDir runs every phase of the REPORT stage in the current process,
+// with metadata directories created under the given directory.  If dir is
+// empty, a temporary directory is used and removed afterwards.
+//
+// This is intended for testing.
+func RunReportInDir(dir string, h ReportHandler, args *ReportArgs) (*ReportOuts, error) {
+	split, chunk, join := ReportPhases(h)
+	var outs ReportOuts
+	if err := adapter.RunStageInDir(dir, split, chunk, join,
+		nil, nil, args, &outs); err != nil {
+		return nil, err
+	}
+	return &outs, nil
+}
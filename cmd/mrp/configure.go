@@ -39,7 +39,11 @@ type mrpConfiguration struct {
 	authKey        string
 	requireAuth    bool
 	noExit         bool
+	pollJournal    bool
 	cert           *tls.Config
+	invalidate     string
+	invalidateFork string
+	dryRun         bool
 }
 
 func parseMroFlags(opts map[string]interface{}, doc string, martianOptions []string, martianArguments []string) {
@@ -102,6 +106,7 @@ Options:
     --jobmode=MODE      Job manager to use. Valid options:
                             local (default)
                             A cluster job mode listed such as sge, lsf, or slurm
+                            kubernetes, to run jobs as Kubernetes Jobs
                             A file <jobmode>.template
     --localcores=NUM    Set max cores the pipeline may request at one time.
                             Only applies to local jobs.
@@ -119,6 +124,10 @@ Options:
                             Only applies in cluster jobmodes.
     --limit-loadavg     Avoid scheduling jobs when the system loadavg is high.
                             Only applies to local jobs.
+    --schedule=POLICY   Order in which to start local jobs waiting for
+                        resources. Valid options:
+                            fifo (default), priority, or backfill
+                            Only applies to local jobs.
 
     --vdrmode=MODE      Enables Volatile Data Removal. Valid options:
                             post, rolling (default), strict, or disable
@@ -141,8 +150,18 @@ Options:
     --https-key=FILE    Set the path to the file containing the private key for
                         serving the UI over https.
     --noexit            Keep UI running after pipestance completes or fails.
+    --poll-journal      Check for job updates periodically instead of watching
+                        the journal directory for changes.
     --onfinish=EXEC     Run this when pipeline finishes, success or fail.
     --zip               Zip metadata files after pipestance completes.
+    --metadata-store=NAME
+                        Where to keep node and fork metadata for new
+                        pipestances. Valid options:
+                            files (default), or kv, to use a single file
+                            instead of many small ones.
+    --output-hash=ALG   Checksum to record for each file in outs/_manifest.json
+                        when the pipestance completes. Valid options:
+                            xxhash (default), sha256, or none
     --tags=TAGS         Tag pipestance with comma-separated key:value pairs.
 
     --profile=MODE      Enables stage performance profiling.  Configurable.
@@ -151,6 +170,12 @@ Options:
     --stackvars         Print local variables in stage code stack trace.
     --monitor           Kill jobs that exceed requested memory resources.
     --inspect           Inspect pipestance without resetting failed stages.
+    --invalidate=STAGE  When reattaching, re-run the given stage and every
+                        stage which depends on it.
+    --invalidate-fork=FORK
+                        Only re-run the given fork of the invalidated stage.
+    --dry-run           Print the stages, resources, and job scripts which
+                        would be run, without running anything.
     --debug             Enable debug logging for local job manager.
     --stest             Substitute real stages with stress-testing stage.
     --autoretry=NUM     Automatically retry failed runs up to NUM times.
@@ -160,6 +185,9 @@ Options:
     --psdir=PATH        The path to the pipestance directory.  The default is
                         to use <pipestance_name>.
     --never-local       Ignore 'local' modifiers on non-preflight stages.
+    --cache-dir=PATH    Reuse outputs of stages which completed with identical
+                        code, arguments, and versions in any pipestance run
+                        with the same cache directory.
 
     -h --help           Show this message.
     --version           Show version.`
@@ -293,6 +321,17 @@ Options:
 		util.LogInfo("options", "--jobinterval=%d", config.JobFreqMillis)
 	}
 
+	if value := opts["--cache-dir"]; value != nil {
+		if p, ok := value.(string); ok && p != "" {
+			if ap, err := filepath.Abs(p); err == nil {
+				config.CacheDir = ap
+			} else {
+				config.CacheDir = p
+			}
+			util.LogInfo("options", "--cache-dir=%s", config.CacheDir)
+		}
+	}
+
 	// Compute vdrMode.
 	if value := opts["--vdrmode"]; value != nil {
 		config.VdrMode = core.VdrMode(value.(string))
@@ -380,9 +419,30 @@ Options:
 	config.LimitLoadavg = opts["--limit-loadavg"].(bool)
 	util.LogInfo("options", "--limit-loadavg=%v", config.LimitLoadavg)
 
+	if value := opts["--metadata-store"]; value != nil {
+		config.MetadataStore = core.MetadataStoreType(value.(string))
+		util.LogInfo("options", "--metadata-store=%s", config.MetadataStore)
+		core.VerifyMetadataStore(config.MetadataStore)
+	}
+
+	if value := opts["--output-hash"]; value != nil {
+		config.OutputHash = core.OutputHashType(value.(string))
+		util.LogInfo("options", "--output-hash=%s", config.OutputHash)
+		core.VerifyOutputHash(config.OutputHash)
+	}
+
+	if value := opts["--schedule"]; value != nil {
+		config.SchedulePolicy = core.SchedulePolicy(value.(string))
+		util.LogInfo("options", "--schedule=%s", config.SchedulePolicy)
+		core.VerifySchedulePolicy(config.SchedulePolicy)
+	}
+
 	c.noExit = opts["--noexit"].(bool)
 	util.LogInfo("options", "--noexit=%v", c.noExit)
 
+	c.pollJournal = opts["--poll-journal"].(bool)
+	util.LogInfo("options", "--poll-journal=%v", c.pollJournal)
+
 	config.SkipPreflight = opts["--nopreflight"].(bool)
 	util.LogInfo("options", "--nopreflight=%v", config.SkipPreflight)
 
@@ -401,6 +461,28 @@ Options:
 	}
 	config.Monitor = opts["--monitor"].(bool)
 	c.readOnly = opts["--inspect"].(bool)
+	if value := opts["--invalidate"]; value != nil {
+		if c.readOnly {
+			util.PrintInfo("options",
+				"--invalidate cannot be used with --inspect.")
+			os.Exit(1)
+		}
+		c.invalidate = value.(string)
+		util.LogInfo("options", "--invalidate=%s", c.invalidate)
+		if value := opts["--invalidate-fork"]; value != nil {
+			c.invalidateFork = value.(string)
+			util.LogInfo("options", "--invalidate-fork=%s", c.invalidateFork)
+		}
+	}
+	c.dryRun = opts["--dry-run"].(bool)
+	if c.dryRun {
+		if c.readOnly || c.invalidate != "" {
+			util.PrintInfo("options",
+				"--dry-run cannot be used with --inspect or --invalidate.")
+			os.Exit(1)
+		}
+		util.LogInfo("options", "--dry-run")
+	}
 	config.Debug = opts["--debug"].(bool)
 	config.StressTest = opts["--stest"].(bool)
 	if value := opts["--autoretry"]; value != nil {
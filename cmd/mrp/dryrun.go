@@ -0,0 +1,95 @@
+//
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/martian-lang/martian/martian/core"
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// Invoke the pipestance in a scratch directory and print the jobs which
+// would be run, without running them.  Returns the exit code.
+func dryRun(c *mrpConfiguration, invocationSrc string) int {
+	rt := c.config.NewRuntime()
+	scratch, err := ioutil.TempDir("", "mrp-dry-run-")
+	if err != nil {
+		util.PrintError(err, "runtime", "Could not create scratch directory.")
+		return 1
+	}
+	defer os.RemoveAll(scratch)
+	c.pipestancePath = path.Join(scratch, c.psid)
+	factory := core.NewRuntimePipestanceFactory(rt,
+		invocationSrc, c.invocationPath, c.psid, c.mroPaths,
+		c.pipestancePath, c.mroVersion, nil, true, false, c.tags)
+	pipestance, err := factory.InvokePipeline()
+	if err != nil {
+		util.PrintError(err, "runtime", "Could not invoke pipeline.")
+		return 1
+	}
+	writePlan(os.Stdout, pipestance.Plan())
+	return 0
+}
+
+func formatResources(res *core.JobResources) string {
+	s := strconv.FormatFloat(res.Threads, 'g', -1, 64) + " threads, " +
+		strconv.FormatFloat(res.MemGB, 'g', -1, 64) + " GB mem, " +
+		strconv.FormatFloat(res.VMemGB, 'g', -1, 64) + " GB vmem"
+	if res.Special != "" {
+		s += ", special " + res.Special
+	}
+	return s
+}
+
+func formatFork(fork *core.ForkPlan) string {
+	s := fork.Id
+	if fork.Undetermined {
+		s += " (forks determined at runtime)"
+	}
+	if fork.Error != "" {
+		s += " (error: " + fork.Error + ")"
+	} else if fork.Disabled == nil {
+		s += " (disabled state determined at runtime)"
+	} else if *fork.Disabled {
+		s += " (disabled)"
+	}
+	return s
+}
+
+// Write a human-readable description of the plan.
+func writePlan(w io.Writer, plan *core.PipestancePlan) {
+	fmt.Fprintf(w, "Dry run of %s with jobmode %s.\n", plan.Pipeline, plan.JobMode)
+	fmt.Fprintln(w, "Nothing was submitted.")
+	for _, stage := range plan.Stages {
+		fmt.Fprintf(w, "\n%s (%s)\n", stage.Fqname, stage.JobMode)
+		if stage.Skipped {
+			fmt.Fprintln(w, "    skipped preflight")
+			continue
+		}
+		for _, fork := range stage.Forks {
+			fmt.Fprintf(w, "    fork:  %s\n", formatFork(fork))
+		}
+		for _, job := range stage.Jobs {
+			fmt.Fprintf(w, "    %-6s %s\n", job.Type+":",
+				formatResources(&job.Resources))
+		}
+		for _, job := range stage.Jobs {
+			if job.Script == "" {
+				continue
+			}
+			fmt.Fprintf(w, "    %s job script:\n", job.Type)
+			for _, line := range strings.Split(strings.TrimRight(job.Script, "\n"), "\n") {
+				fmt.Fprintln(w, "        "+line)
+			}
+		}
+	}
+}
@@ -37,6 +37,7 @@ type pipestanceHolder struct {
 	info             *api.PipestanceInfo
 	maxRetries       int
 	remainingRetries int
+	totalRetries     int
 	authKey          string
 	enableUI         bool
 	showedFailed     bool
@@ -48,6 +49,7 @@ type pipestanceHolder struct {
 	retryWait        time.Duration
 	server           *http.Server
 	lastLogCheck     time.Time
+	events           *core.EventLog
 }
 
 func (self *pipestanceHolder) getPipestance() *core.Pipestance {
@@ -56,6 +58,15 @@ func (self *pipestanceHolder) getPipestance() *core.Pipestance {
 	return self.pipestance
 }
 
+// Collect monitoring statistics for the current pipestance.
+func (self *pipestanceHolder) getMetrics() *core.PipestanceMetrics {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	metrics := self.pipestance.CollectMetrics()
+	metrics.Retries = self.totalRetries
+	return metrics
+}
+
 func (self *pipestanceHolder) setPipestance(newPipe *core.Pipestance) {
 	self.pipestance = newPipe
 }
@@ -68,6 +79,7 @@ func (self *pipestanceHolder) consumeRetry() bool {
 		return false
 	} else {
 		self.remainingRetries--
+		self.totalRetries++
 		return true
 	}
 }
@@ -103,6 +115,34 @@ func (self *pipestanceHolder) restart(outerCtx context.Context) error {
 	return err
 }
 
+// Invalidate a stage of a failed pipestance and everything downstream
+// of it, and then restart the pipestance.
+func (self *pipestanceHolder) invalidate(outerCtx context.Context,
+	stage, fork string) error {
+	ctx, task := trace.NewTask(outerCtx, "invalidate")
+	defer task.End()
+	if self.readOnly {
+		return fmt.Errorf("mrp instances started with --inspect cannot invalidate stages.")
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ps, err := self.factory.ReattachToPipestance(ctx)
+	if err == nil {
+		if err = ps.Invalidate(stage, fork); err == nil {
+			err = ps.Reset()
+		}
+		if err != nil {
+			ps.Unlock()
+			return err
+		}
+		ps.LoadMetadata(ctx)
+		self.remainingRetries = self.maxRetries
+		self.showedFailed = false
+		self.setPipestance(ps)
+	}
+	return err
+}
+
 func (self *pipestanceHolder) UpdateState(state core.MetadataState) chan struct{} {
 	oldState := self.info.State
 	self.info.State = state
@@ -217,6 +257,13 @@ func (pipestanceBox *pipestanceHolder) Configure(c *mrpConfiguration, invocation
 	pipestanceBox.readOnly = c.readOnly
 	pipestanceBox.retryWait = c.retryWait
 	pipestanceBox.https = c.cert != nil
+	pipestanceBox.events = rt.Events
+	if !c.readOnly {
+		if err := rt.Events.OpenFile(path.Join(c.pipestancePath,
+			core.EventsFile.FileName())); err != nil {
+			util.PrintError(err, "runtime", "Could not open event log.")
+		}
+	}
 
 	return reattaching, rt
 }
@@ -336,6 +383,10 @@ func main() {
 	util.DieIf(err)
 	invocationSrc := string(data)
 
+	if c.dryRun {
+		os.Exit(dryRun(&c, invocationSrc))
+	}
+
 	// Attempt to reattach to the pipestance.
 	var pipestanceBox pipestanceHolder
 	reattaching, rt := pipestanceBox.Configure(&c, invocationSrc)
@@ -383,12 +434,20 @@ func main() {
 	if reattaching {
 		// If it already exists, try to reattach to it.
 		if !c.readOnly {
+			if c.invalidate != "" {
+				err = pipestance.Invalidate(c.invalidate, c.invalidateFork)
+				util.DieIf(err)
+			}
 			if err = pipestance.Reset(); err == nil {
 				err = pipestance.RestartLocalJobs(c.config.JobMode)
 			}
 			util.DieIf(err)
 		}
-	} else if !c.config.SkipPreflight && !c.readOnly {
+	} else if c.invalidate != "" {
+		util.PrintInfo("runtime",
+			"Ignoring --invalidate because the pipestance is new.")
+	}
+	if !reattaching && !c.config.SkipPreflight && !c.readOnly {
 		util.Println("Running preflight checks (please wait)...")
 	}
 
@@ -404,7 +463,7 @@ func main() {
 	//=========================================================================
 	stepSecs := 3 * time.Second
 	go runLoop(&pipestanceBox, stepSecs, c.config.VdrMode, c.noExit,
-		rt.LocalJobManager.Done())
+		rt.LocalJobManager.Done(), !c.pollJournal)
 
 	// Let daemons take over.
 	runtime.Goexit()
@@ -31,30 +31,97 @@ func flushChannel(c <-chan struct{}) {
 	}
 }
 
+// When the journal is being watched for updates, the run loop only needs to
+// poll occasionally, for things like heartbeat checks.
+const watchedStepFactor = 10
+
+// Watches the pipestance journal directory, if enabled.
+type journalWatch struct {
+	enabled bool
+	watcher core.JournalWatcher
+}
+
+// Returns a channel which receives a value when there are new journal
+// entries, starting the watcher if required, or nil if the journal must be
+// polled instead.
+func (self *journalWatch) updates(pipestance *core.Pipestance) <-chan struct{} {
+	if !self.enabled {
+		return nil
+	}
+	if self.watcher == nil {
+		w, err := pipestance.WatchJournal()
+		if err != nil {
+			util.LogInfo("runtime",
+				"Polling for journal updates: %v", err)
+			self.enabled = false
+			return nil
+		}
+		self.watcher = w
+	}
+	return self.watcher.Updates()
+}
+
+// Consume any pending update notification.  If the watcher stopped, it will
+// be restarted on the next call to updates.
+func (self *journalWatch) flush() {
+	if self.watcher == nil {
+		return
+	}
+	select {
+	case _, ok := <-self.watcher.Updates():
+		if !ok {
+			self.stopped()
+		}
+	default:
+	}
+}
+
+// Release a watcher which stopped working.
+func (self *journalWatch) stopped() {
+	self.watcher.Close()
+	self.watcher = nil
+}
+
 //=============================================================================
 // Pipestance runner.
 //=============================================================================
 func runLoop(pipestanceBox *pipestanceHolder, stepSecs time.Duration,
-	vdrMode core.VdrMode, noExit bool, localJobDone <-chan struct{}) {
+	vdrMode core.VdrMode, noExit bool, localJobDone <-chan struct{},
+	watchJournal bool) {
 	pipestanceBox.getPipestance().LoadMetadata(context.Background())
 
+	journal := journalWatch{enabled: watchJournal}
 	t := time.NewTimer(0)
 	if !t.Stop() {
 		<-t.C
 	}
 	for {
 		flushChannel(localJobDone)
+		journal.flush()
 		hadProgress := loopBody(pipestanceBox, vdrMode, noExit)
 
 		if !hadProgress {
-			// Wait for a either stepSecs or until a local job finishes.
-			t.Reset(stepSecs)
+			// Wait for either stepSecs, until a local job finishes, or
+			// until a job writes to the journal.
+			updates := journal.updates(pipestanceBox.getPipestance())
+			if updates != nil {
+				t.Reset(watchedStepFactor * stepSecs)
+			} else {
+				t.Reset(stepSecs)
+			}
 			select {
 			case <-t.C:
 			case <-localJobDone:
 				if !t.Stop() {
 					<-t.C
 				}
+			case _, ok := <-updates:
+				if !t.Stop() {
+					<-t.C
+				}
+				if !ok {
+					journal.stopped()
+				}
 			}
 			if !pipestanceBox.lastLogCheck.IsZero() &&
 				time.Since(pipestanceBox.lastLogCheck) > time.Minute {
@@ -158,6 +225,13 @@ func attemptRetry(pipestance *core.Pipestance, pipestanceBox *pipestanceHolder,
 				transient_log)
 		}
 		util.LogInfo("runtime", "Attempting retry.")
+		pipestanceBox.events.Emit(&core.Event{
+			Type:    core.EventRetry,
+			Kind:    core.EventKindPipestance,
+			Fqname:  pipestance.GetFQName(),
+			State:   core.Failed.Prefixed(core.RetryPrefix),
+			Message: transient_log,
+		})
 		if err := pipestanceBox.restart(ctx); err != nil {
 			util.LogInfo("runtime", "Retry failed:\n%v\n", err)
 			// Let the next loop around actually handle the failure.
@@ -216,12 +216,15 @@ func (self *mrpWebServer) handleApi(sm *http.ServeMux) {
 	sm.HandleFunc(api.QueryGetMetadata+"/", self.getMetadata)
 	sm.HandleFunc(api.QueryRestart, self.restart)
 	sm.HandleFunc(api.QueryRestart+"/", self.restart)
+	sm.HandleFunc(api.QueryInvalidate, self.invalidate)
 	p := self.pipestanceBox.getPipestance().GetPath()
 	sm.Handle(api.QueryGetMetadataTop, self.authorize(pathToMetadata(
 		http.FileServer(http.Dir(p)))))
 	sm.HandleFunc(api.QueryListMetadataTop, self.listMetadataTop)
 	sm.HandleFunc(api.QueryListMetadataTop+"/", self.listMetadataTop)
 	sm.HandleFunc(api.QueryKill, self.kill)
+	sm.HandleFunc(api.QueryEvents, self.streamEvents)
+	sm.HandleFunc(api.QueryMetrics, self.getMetrics)
 	sm.Handle(api.QueryExtras, self.authorize(noDot(
 		http.FileServer(http.Dir(path.Join(p, "extras"))))))
 }
@@ -288,6 +291,23 @@ func (self *mrpWebServer) getInfo(w http.ResponseWriter, req *http.Request) {
 	w.Write(bytes)
 }
 
+// Stream pipestance events to the client as server-sent events.
+func (self *mrpWebServer) streamEvents(w http.ResponseWriter, req *http.Request) {
+	if self.readAuth && !self.verifyAuth(w, req) {
+		return
+	}
+	api.ServeEvents(w, req, self.pipestanceBox.events)
+}
+
+// Get pipestance monitoring statistics in the Prometheus text format.
+func (self *mrpWebServer) getMetrics(w http.ResponseWriter, req *http.Request) {
+	if self.readAuth && !self.verifyAuth(w, req) {
+		return
+	}
+	api.ServeMetrics(w, self.pipestanceBox.getPipestance().GetPsid(),
+		self.pipestanceBox.getMetrics())
+}
+
 // Get pipestance state: nodes and fatal error (if any).
 func (self *mrpWebServer) getState(w http.ResponseWriter, req *http.Request) {
 	if self.readAuth && !self.verifyAuth(w, req) {
@@ -377,7 +397,7 @@ func (self *mrpWebServer) getMetadata(w http.ResponseWriter, req *http.Request)
 		http.Error(w, "'..' not allowed in path.", http.StatusBadRequest)
 		return
 	}
-	data, err := self.rt.GetMetadata(pipestance.GetPath(),
+	data, err := pipestance.GetMetadata(
 		path.Join(p, core.MetadataFilePrefix+name))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -426,6 +446,36 @@ func (self *mrpWebServer) restart(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Invalidate a stage of a failed pipestance, given by the "stage" and
+// optionally "fork" form values, and restart it.
+func (self *mrpWebServer) invalidate(w http.ResponseWriter, req *http.Request) {
+	if !self.verifyAuth(w, req) {
+		return
+	}
+	if self.pipestanceBox.readOnly {
+		http.Error(w, "mrp is in read-only mode.", http.StatusBadRequest)
+		return
+	}
+	stage := req.FormValue("stage")
+	if stage == "" {
+		http.Error(w, "No stage specified.", http.StatusBadRequest)
+		return
+	}
+	self.pipestanceBox.cleanupLock.Lock()
+	defer self.pipestanceBox.cleanupLock.Unlock()
+	if st := self.pipestanceBox.getPipestance().GetState(req.Context()); st != core.Failed {
+		http.Error(w,
+			"Only failed pipestances can be invalidated.  "+
+				"Use mrp --invalidate for completed pipestances.",
+			http.StatusBadRequest)
+		return
+	}
+	if err := self.pipestanceBox.invalidate(req.Context(),
+		stage, req.FormValue("fork")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
 // Kill the pipestance.
 func (self *mrpWebServer) kill(w http.ResponseWriter, req *http.Request) {
 	if !self.verifyAuth(w, req) {
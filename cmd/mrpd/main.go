@@ -0,0 +1,253 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+// Martian pipeline runner daemon.
+//
+// mrpd runs many pipestances at once, sharing one set of job managers, so
+// that the local cores and memory, or the cluster job limit, are shared
+// between all of them.  Runs are submitted, listed, killed and restarted
+// through an HTTP API.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/martian-lang/docopt.go"
+	"github.com/martian-lang/martian/martian/api"
+	"github.com/martian-lang/martian/martian/core"
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// The lock file which prevents two instances of mrpd from using the same
+// state directory.
+type stateLock string
+
+func (self stateLock) HandleSignal(os.Signal) {
+	os.Remove(string(self))
+}
+
+func intOpt(opts map[string]interface{}, name string, def int) int {
+	value, ok := opts[name].(string)
+	if !ok {
+		return def
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		util.PrintError(err, "options",
+			"Could not parse %s value \"%s\"", name, value)
+		os.Exit(1)
+	}
+	util.LogInfo("options", "%s=%d", name, v)
+	return v
+}
+
+func main() {
+	util.SetupSignalHandlers()
+	doc := `Martian Pipeline Runner Daemon.
+
+Usage:
+    mrpd <state_dir> [options]
+    mrpd -h | --help | --version
+
+Runs many pipestances at once, sharing one job manager between them.
+Runs are submitted, listed, killed, and restarted through an HTTP API at
+` + api.QueryRuns + `.  The queue of runs is saved in <state_dir>, so that
+queued and running pipestances are resumed if mrpd is restarted.
+
+Options:
+    --port=NUM          Serve the API at http://<hostname>:NUM.  By default
+                            a port is chosen automatically.
+    --auth-key=KEY      Set the authentication key required for the API.
+                            By default a random key is generated.
+    --disable-auth      Do not require authentication for the API.
+    --max-running=NUM   Set the maximum number of pipestances to run at once.
+                            Further runs are queued.  Defaults to 8.
+    --max-jobs-per-run=NUM
+                        Set the maximum number of jobs each pipestance may
+                        have queued or running at once.  By default, the
+                        local cores, or --maxjobs in cluster modes, are
+                        divided evenly between the running pipestances.
+
+    --jobmode=MODE      Job manager to use. Valid options:
+                            local (default)
+                            A cluster job mode listed such as sge, lsf, or slurm
+                            kubernetes, to run jobs as Kubernetes Jobs
+                            A file <jobmode>.template
+    --localcores=NUM    Set max cores all pipelines may request at one time.
+                            Only applies to local jobs.
+    --localmem=NUM      Set max GB all pipelines may request at one time.
+                            Only applies to local jobs.
+    --mempercore=NUM    Reserve enough threads for each job to ensure enough
+                        memory will be available, assuming each core on your
+                        cluster has at least this much memory available.
+                            Only applies in cluster jobmodes.
+    --maxjobs=NUM       Set max jobs submitted to cluster at one time, for
+                        all pipelines.
+                            Only applies in cluster jobmodes.
+    --jobinterval=NUM   Set delay between submitting jobs to cluster, in ms.
+                            Only applies in cluster jobmodes.
+    --limit-loadavg     Avoid scheduling jobs when the system loadavg is high.
+                            Only applies to local jobs.
+    --schedule=POLICY   Order in which to start local jobs waiting for
+                        resources. Valid options:
+                            fifo (default), priority, or backfill
+                            Only applies to local jobs.
+    --vdrmode=MODE      Enables Volatile Data Removal. Valid options:
+                            post, rolling (default), strict, or disable
+    --profile=MODE      Enables stage performance profiling.
+    --metadata-store=NAME
+                        Where to keep node and fork metadata for new
+                        pipestances. Valid options:
+                            files (default), or kv, to use a single file
+                            instead of many small ones.
+    --output-hash=ALG   Checksum to record for each file in outs/_manifest.json
+                        when a pipestance completes. Valid options:
+                            xxhash (default), sha256, or none
+    --autoretry=NUM     Automatically retry failed runs up to NUM times.
+    --debug             Enable debug logging for local job manager.
+
+    -h --help           Show this message.
+    --version           Show version.`
+	config := core.DefaultRuntimeOptions()
+	opts, _ := docopt.Parse(doc, nil, true, config.MartianVersion, false)
+
+	stateDir, err := filepath.Abs(opts["<state_dir>"].(string))
+	util.DieIf(err)
+	util.DieIf(os.MkdirAll(stateDir, 0777))
+	lock := stateLock(path.Join(stateDir, "_lock"))
+	if f, err := os.OpenFile(string(lock),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err != nil {
+		if os.IsExist(err) {
+			util.PrintInfo("mrpd",
+				"%s is in use by another instance of mrpd.  "+
+					"If that is not true, delete %s.",
+				stateDir, lock)
+			os.Exit(1)
+		}
+		util.DieIf(err)
+	} else {
+		f.WriteString(util.Timestamp())
+		f.Close()
+	}
+	util.RegisterSignalHandler(lock)
+	util.LogTee(path.Join(stateDir, "mrpd.log"))
+
+	if value := opts["--jobmode"]; value != nil {
+		config.JobMode = value.(string)
+	}
+	util.LogInfo("options", "--jobmode=%s", config.JobMode)
+	config.LocalCores = intOpt(opts, "--localcores", config.LocalCores)
+	config.LocalMem = intOpt(opts, "--localmem", config.LocalMem)
+	config.MemPerCore = intOpt(opts, "--mempercore", config.MemPerCore)
+	if config.JobMode != "local" {
+		config.MaxJobs = intOpt(opts, "--maxjobs", 64)
+		config.JobFreqMillis = intOpt(opts, "--jobinterval", 100)
+	}
+	config.LimitLoadavg = opts["--limit-loadavg"].(bool)
+	if value := opts["--schedule"]; value != nil {
+		config.SchedulePolicy = core.SchedulePolicy(value.(string))
+		util.LogInfo("options", "--schedule=%s", config.SchedulePolicy)
+		core.VerifySchedulePolicy(config.SchedulePolicy)
+	}
+	if value := opts["--vdrmode"]; value != nil {
+		config.VdrMode = core.VdrMode(value.(string))
+	}
+	util.LogInfo("options", "--vdrmode=%s", config.VdrMode)
+	core.VerifyVDRMode(config.VdrMode)
+	if value := opts["--profile"]; value != nil {
+		config.ProfileMode = core.ProfileMode(value.(string))
+	}
+	if value := opts["--metadata-store"]; value != nil {
+		config.MetadataStore = core.MetadataStoreType(value.(string))
+		util.LogInfo("options", "--metadata-store=%s", config.MetadataStore)
+		core.VerifyMetadataStore(config.MetadataStore)
+	}
+	if value := opts["--output-hash"]; value != nil {
+		config.OutputHash = core.OutputHashType(value.(string))
+		util.LogInfo("options", "--output-hash=%s", config.OutputHash)
+		core.VerifyOutputHash(config.OutputHash)
+	}
+	config.Debug = opts["--debug"].(bool)
+	maxRunning := intOpt(opts, "--max-running", 8)
+	maxJobs := intOpt(opts, "--max-jobs-per-run", 0)
+	retries := intOpt(opts, "--autoretry", core.DefaultRetries())
+
+	authKey := ""
+	if value := opts["--auth-key"]; value != nil {
+		authKey = value.(string)
+	} else if !opts["--disable-auth"].(bool) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			util.PrintError(err, "mrpd",
+				"Failed to generate an authentication key.")
+			os.Exit(1)
+		}
+		authKey = base64.RawURLEncoding.EncodeToString(key)
+	}
+
+	cwd, _ := os.Getwd()
+	mroPaths := util.ParseMroPath(cwd)
+	if value := os.Getenv("MROPATH"); len(value) > 0 {
+		mroPaths = util.ParseMroPath(value)
+	}
+	util.LogInfo("environ", "MROPATH=%s", util.FormatMroPath(mroPaths))
+
+	rt := config.NewRuntime()
+	sup := newSupervisor(rt, stateDir, mroPaths, maxRunning, maxJobs, retries)
+	util.DieIf(sup.load())
+
+	port := "0"
+	if value := opts["--port"]; value != nil {
+		port = value.(string)
+	}
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		util.PrintError(err, "mrpd", "Cannot open port %s", port)
+		os.Exit(1)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	u := url.URL{
+		Scheme: "http",
+		Host:   listener.Addr().String(),
+		Path:   api.QueryRuns,
+	}
+	u.Host = net.JoinHostPort(hostname, u.Port())
+	if authKey != "" {
+		q := u.Query()
+		q.Set("auth", authKey)
+		u.RawQuery = q.Encode()
+	}
+	util.Println("Serving API at %s\n", u.String())
+
+	server := &http.Server{
+		Handler: (&daemonServer{
+			sup:     sup,
+			authKey: authKey,
+		}).handler(),
+		ReadTimeout:  time.Minute,
+		WriteTimeout: time.Minute,
+		IdleTimeout:  time.Minute,
+	}
+	server.ErrorLog, _ = util.GetLogger("mrpd")
+	go func() {
+		if err := server.Serve(listener); err != nil &&
+			err != http.ErrServerClosed {
+			fmt.Fprintln(os.Stderr, err)
+			util.Suicide(false)
+		}
+	}()
+
+	sup.runLoop(3*time.Second, rt.LocalJobManager.Done())
+}
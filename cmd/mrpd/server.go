@@ -0,0 +1,148 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/martian-lang/martian/martian/api"
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// Serves the mrpd API.
+//
+//	GET  /api/runs[?state=STATE]   List runs, optionally in the given state.
+//	POST /api/runs                 Submit a run, with a SubmitForm body.
+//	GET  /api/runs/<id>            Get a run.
+//	POST /api/runs/<id>/kill       Kill a run.
+//	POST /api/runs/<id>/restart    Restart a failed or killed run.
+type daemonServer struct {
+	sup *supervisor
+
+	// If set, every request must include this key as the "auth" query
+	// parameter.
+	authKey string
+}
+
+func (self *daemonServer) handler() http.Handler {
+	sm := http.NewServeMux()
+	sm.HandleFunc(api.QueryRuns, self.runs)
+	sm.HandleFunc(api.QueryRuns+"/", self.run)
+	return sm
+}
+
+// Checks that the request includes a valid authentication token, if required.
+// If it does not, it writes an error to the response and returns false.
+//
+// Only the query string is checked, so that the request body is left for the
+// handler to read.
+func (self *daemonServer) verifyAuth(w http.ResponseWriter, req *http.Request) bool {
+	if self.authKey == "" {
+		return true
+	}
+	if subtle.ConstantTimeCompare([]byte(req.URL.Query().Get("auth")),
+		[]byte(self.authKey)) != 1 {
+		http.Error(w, "This API requires authentication.", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		http.Error(w, reqErr.msg, reqErr.status)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// List or submit runs.
+func (self *daemonServer) runs(w http.ResponseWriter, req *http.Request) {
+	if !self.verifyAuth(w, req) {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK,
+			self.sup.list(api.RunState(req.URL.Query().Get("state"))))
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var form api.SubmitForm
+		if err := json.Unmarshal(body, &form); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if info, err := self.sup.submit(&form); err != nil {
+			writeError(w, err)
+		} else {
+			writeJson(w, http.StatusCreated, &info)
+		}
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// Get, kill, or restart a run.
+func (self *daemonServer) run(w http.ResponseWriter, req *http.Request) {
+	if !self.verifyAuth(w, req) {
+		return
+	}
+	id := strings.TrimPrefix(req.URL.Path, api.QueryRuns+"/")
+	var action string
+	if i := strings.IndexByte(id, '/'); i >= 0 {
+		id, action = id[:i], id[i+1:]
+	}
+	if action == "" {
+		if req.Method != http.MethodGet {
+			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		} else if _, info, err := self.sup.get(id); err != nil {
+			writeError(w, err)
+		} else {
+			writeJson(w, http.StatusOK, &info)
+		}
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	var info api.RunInfo
+	var err error
+	switch action {
+	case "kill":
+		util.LogInfo("mrpd", "Got API request to kill %s.", id)
+		info, err = self.sup.kill(id,
+			"Pipestance was killed by API call from "+req.RemoteAddr)
+	case "restart":
+		info, err = self.sup.restart(id)
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+	} else {
+		writeJson(w, http.StatusOK, &info)
+	}
+}
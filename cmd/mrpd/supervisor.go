@@ -0,0 +1,583 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"runtime/trace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/martian-lang/martian/martian/api"
+	"github.com/martian-lang/martian/martian/core"
+	"github.com/martian-lang/martian/martian/syntax"
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// The name of the file in the state directory where the queue is saved.
+const queueFileName = "runs.json"
+
+// An error with the http status which should be returned for it.
+type requestError struct {
+	status int
+	msg    string
+}
+
+func (err *requestError) Error() string {
+	return err.msg
+}
+
+func requestErrorf(status int, format string, args ...interface{}) error {
+	return &requestError{
+		status: status,
+		msg:    fmt.Sprintf(format, args...),
+	}
+}
+
+// A pipestance managed by the supervisor.
+type run struct {
+	// Protected by the supervisor's lock.
+	info api.RunInfo
+
+	mroPaths []string
+
+	// Serializes operations on the pipestance.  The fields below are
+	// protected by this lock.
+	stepLock         sync.Mutex
+	factory          core.PipestanceFactory
+	pipestance       *core.Pipestance
+	remainingRetries int
+	killed           bool
+}
+
+// The supervisor runs many pipestances at once, sharing one runtime, and
+// therefore one set of job managers, between them.
+type supervisor struct {
+	rt         *core.Runtime
+	stateDir   string
+	mroPaths   []string
+	maxRunning int
+	retries    int
+
+	// The maximum number of jobs each run may have queued or running at
+	// once.  If zero, the running pipestances get equal shares of
+	// jobCapacity.
+	maxJobs     int
+	jobCapacity int
+
+	mu   sync.Mutex
+	runs []*run
+	byId map[string]*run
+
+	// The index into the running runs of the one to step first in the next
+	// iteration of the run loop.
+	turn int
+
+	// Signaled when the set of runs changes.
+	wake chan struct{}
+}
+
+func newSupervisor(rt *core.Runtime, stateDir string, mroPaths []string,
+	maxRunning, maxJobs, retries int) *supervisor {
+	self := &supervisor{
+		rt:         rt,
+		stateDir:   stateDir,
+		mroPaths:   mroPaths,
+		maxRunning: maxRunning,
+		retries:    retries,
+		maxJobs:    maxJobs,
+		byId:       make(map[string]*run),
+		wake:       make(chan struct{}, 1),
+	}
+	if rt != nil {
+		if rt.Config.JobMode == "local" {
+			self.jobCapacity = rt.LocalJobManager.GetMaxCores()
+		} else {
+			self.jobCapacity = rt.Config.MaxJobs
+		}
+	}
+	return self
+}
+
+// Get the maximum number of jobs each of the given number of running
+// pipestances may have queued or running at once, or 0 for no limit.
+func (self *supervisor) jobShare(running int) int {
+	if self.maxJobs > 0 {
+		return self.maxJobs
+	}
+	if self.jobCapacity <= 0 || running <= 1 {
+		return 0
+	}
+	return (self.jobCapacity + running - 1) / running
+}
+
+// Wake up the run loop.
+func (self *supervisor) notify() {
+	select {
+	case self.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Load the saved queue from the state directory.  Runs which were running
+// when the queue was saved are queued again, and will reattach to their
+// pipestances when they start.
+func (self *supervisor) load() error {
+	b, err := ioutil.ReadFile(path.Join(self.stateDir, queueFileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var infos []api.RunInfo
+	if err := json.Unmarshal(b, &infos); err != nil {
+		return fmt.Errorf("reading %s: %w", queueFileName, err)
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, info := range infos {
+		if info.State == api.RunRunning {
+			info.State = api.RunQueued
+		}
+		self.add(&run{
+			info:             info,
+			mroPaths:         util.ParseMroPath(info.MroPath),
+			remainingRetries: self.retries,
+		})
+	}
+	return nil
+}
+
+// Add a run.  Must be called with the lock held.
+func (self *supervisor) add(r *run) {
+	self.runs = append(self.runs, r)
+	self.byId[r.info.Id] = r
+}
+
+// Save the queue to the state directory.  Must be called with the lock held.
+func (self *supervisor) save() {
+	infos := make([]*api.RunInfo, len(self.runs))
+	for i, r := range self.runs {
+		infos[i] = &r.info
+	}
+	b, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		util.LogError(err, "mrpd", "Could not serialize the run queue.")
+		return
+	}
+	// Write to a temporary file and rename it, so that the queue is never
+	// left partially written.
+	fn := path.Join(self.stateDir, queueFileName)
+	if err := ioutil.WriteFile(fn+".tmp", b, 0644); err != nil {
+		util.LogError(err, "mrpd", "Could not save the run queue.")
+	} else if err := os.Rename(fn+".tmp", fn); err != nil {
+		util.LogError(err, "mrpd", "Could not save the run queue.")
+	}
+}
+
+// Submit a new run.  The invocation is checked for errors before the run is
+// queued.
+func (self *supervisor) submit(form *api.SubmitForm) (api.RunInfo, error) {
+	if err := util.ValidateID(form.Id); err != nil {
+		return api.RunInfo{}, requestErrorf(http.StatusBadRequest, "%v", err)
+	}
+	if _, _, err := self.get(form.Id); err == nil {
+		return api.RunInfo{}, requestErrorf(http.StatusConflict,
+			"a run with id %s already exists", form.Id)
+	}
+	if strings.TrimSpace(form.Invocation) == "" {
+		return api.RunInfo{}, requestErrorf(http.StatusBadRequest,
+			"no invocation was given")
+	}
+	psPath := form.Path
+	if psPath == "" {
+		psPath = form.Id
+	}
+	psPath, err := filepath.Abs(psPath)
+	if err != nil {
+		return api.RunInfo{}, requestErrorf(http.StatusBadRequest, "%v", err)
+	}
+	mroPaths := self.mroPaths
+	if form.MroPath != "" {
+		mroPaths = util.ParseMroPath(form.MroPath)
+	}
+	_, _, ast, err := syntax.ParseSource(form.Invocation,
+		path.Join(psPath, core.InvocationFile.FileName()), mroPaths, true)
+	if err != nil {
+		return api.RunInfo{}, requestErrorf(http.StatusBadRequest,
+			"invalid invocation: %v", err)
+	}
+	if ast.Call == nil {
+		return api.RunInfo{}, requestErrorf(http.StatusBadRequest,
+			"the invocation has no call statement")
+	}
+	r := &run{
+		info: api.RunInfo{
+			Id:         form.Id,
+			State:      api.RunQueued,
+			Path:       psPath,
+			Invocation: form.Invocation,
+			MroPath:    util.FormatMroPath(mroPaths),
+			Tags:       form.Tags,
+			Pname:      ast.Call.DecId,
+			Submitted:  util.Timestamp(),
+		},
+		mroPaths:         mroPaths,
+		remainingRetries: self.retries,
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	// Check again, in case another run was submitted while this one was
+	// being parsed.
+	if _, ok := self.byId[form.Id]; ok {
+		return api.RunInfo{}, requestErrorf(http.StatusConflict,
+			"a run with id %s already exists", form.Id)
+	}
+	for _, other := range self.runs {
+		if other.info.Path == psPath && !other.info.State.Done() {
+			return api.RunInfo{}, requestErrorf(http.StatusConflict,
+				"run %s is already using %s", other.info.Id, psPath)
+		}
+	}
+	self.add(r)
+	self.save()
+	self.notify()
+	util.LogInfo("mrpd", "Queued %s (%s).", r.info.Id, r.info.Pname)
+	return r.info, nil
+}
+
+// Get the runs, in the order they were submitted, optionally only those in
+// the given state.
+func (self *supervisor) list(state api.RunState) []api.RunInfo {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	infos := make([]api.RunInfo, 0, len(self.runs))
+	for _, r := range self.runs {
+		if state == "" || r.info.State == state {
+			infos = append(infos, r.info)
+		}
+	}
+	return infos
+}
+
+func (self *supervisor) get(id string) (*run, api.RunInfo, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if r := self.byId[id]; r != nil {
+		return r, r.info, nil
+	}
+	return nil, api.RunInfo{}, requestErrorf(http.StatusNotFound,
+		"no run with id %s", id)
+}
+
+// Kill a run.  A queued run is removed from the queue.  A running
+// pipestance's running stages are marked as failed, after which the run
+// loop finishes it.
+func (self *supervisor) kill(id, message string) (api.RunInfo, error) {
+	r, _, err := self.get(id)
+	if err != nil {
+		return api.RunInfo{}, err
+	}
+	r.stepLock.Lock()
+	defer r.stepLock.Unlock()
+	self.mu.Lock()
+	state := r.info.State
+	// A run which is about to start does not have a pipestance yet.
+	queued := state == api.RunQueued ||
+		state == api.RunRunning && r.pipestance == nil
+	if queued {
+		r.info.State = api.RunKilled
+		r.info.Finished = util.Timestamp()
+		r.info.Error = message
+		self.save()
+	}
+	info := r.info
+	self.mu.Unlock()
+	switch {
+	case queued:
+		util.LogInfo("mrpd", "Killed queued run %s.", id)
+	case state == api.RunRunning:
+		util.LogInfo("mrpd", "Killing %s.", id)
+		r.killed = true
+		r.pipestance.KillWithMessage(message)
+		self.notify()
+	default:
+		return info, requestErrorf(http.StatusConflict,
+			"run %s is already %s", id, state)
+	}
+	return info, nil
+}
+
+// Restart a failed or killed run.  The run is queued again, and reattaches
+// to its pipestance when it starts.
+func (self *supervisor) restart(id string) (api.RunInfo, error) {
+	r, _, err := self.get(id)
+	if err != nil {
+		return api.RunInfo{}, err
+	}
+	r.stepLock.Lock()
+	defer r.stepLock.Unlock()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if st := r.info.State; st != api.RunFailed && st != api.RunKilled {
+		return r.info, requestErrorf(http.StatusConflict,
+			"only failed or killed runs can be restarted, but %s is %s",
+			id, st)
+	}
+	r.info.State = api.RunQueued
+	r.info.Finished = ""
+	r.info.Error = ""
+	r.killed = false
+	r.remainingRetries = self.retries
+	self.save()
+	self.notify()
+	util.LogInfo("mrpd", "Queued %s for restart.", id)
+	return r.info, nil
+}
+
+// Run the supervisor.  This never returns.
+func (self *supervisor) runLoop(stepSecs time.Duration,
+	localJobDone <-chan struct{}) {
+	t := time.NewTimer(0)
+	if !t.Stop() {
+		<-t.C
+	}
+	for {
+		self.startQueued()
+		if !self.stepAll() {
+			// Wait for stepSecs, a local job to finish, or a change to
+			// the queue.
+			t.Reset(stepSecs)
+			select {
+			case <-t.C:
+			case <-localJobDone:
+				if !t.Stop() {
+					<-t.C
+				}
+			case <-self.wake:
+				if !t.Stop() {
+					<-t.C
+				}
+			}
+			runtime.GC()
+		}
+	}
+}
+
+// Start queued runs, in the order they were submitted, until the maximum
+// number of pipestances are running.
+func (self *supervisor) startQueued() {
+	var starting []*run
+	self.mu.Lock()
+	running := 0
+	for _, r := range self.runs {
+		if r.info.State == api.RunRunning {
+			running++
+		}
+	}
+	for _, r := range self.runs {
+		if self.maxRunning > 0 && running >= self.maxRunning {
+			break
+		}
+		if r.info.State == api.RunQueued {
+			r.info.State = api.RunRunning
+			r.info.Started = util.Timestamp()
+			starting = append(starting, r)
+			running++
+		}
+	}
+	if len(starting) > 0 {
+		self.save()
+	}
+	self.mu.Unlock()
+
+	for _, r := range starting {
+		r.stepLock.Lock()
+		self.mu.Lock()
+		killed := r.info.State != api.RunRunning
+		self.mu.Unlock()
+		// Skip runs which were killed before they could start.
+		if !killed {
+			if err := self.start(r); err != nil {
+				util.PrintError(err, "mrpd", "Could not start %s.", r.info.Id)
+				self.finish(r, api.RunFailed, err.Error())
+			}
+		}
+		r.stepLock.Unlock()
+	}
+}
+
+// Invoke or reattach to the pipestance for a run.  Must be called with the
+// run's step lock held.
+func (self *supervisor) start(r *run) error {
+	ctx, task := trace.NewTask(context.Background(), "start")
+	defer task.End()
+	mroVersion, _ := util.GetMroVersion(r.mroPaths)
+	r.factory = core.NewRuntimePipestanceFactory(self.rt,
+		r.info.Invocation,
+		path.Join(r.info.Path, core.InvocationFile.FileName()),
+		r.info.Id, r.mroPaths, r.info.Path, mroVersion,
+		nil, true, false, r.info.Tags)
+	ps, err := r.factory.InvokePipeline()
+	if _, ok := err.(*core.PipestanceExistsError); ok {
+		util.LogInfo("mrpd", "Reattaching to %s.", r.info.Id)
+		if ps, err = r.factory.ReattachToPipestance(ctx); err == nil {
+			if err = ps.Reset(); err == nil {
+				err = ps.RestartLocalJobs(self.rt.Config.JobMode)
+			}
+			if err != nil {
+				ps.Unlock()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	ps.LoadMetadata(ctx)
+	r.pipestance = ps
+	util.LogInfo("mrpd", "Started %s.", r.info.Id)
+	return nil
+}
+
+// Step every running pipestance once.  Returns true if any pipestance made
+// progress.
+//
+// Each pipestance is limited to its share of the jobs, so that one with many
+// ready jobs cannot starve the others.  Pipestances also take turns being
+// stepped first, so that none of them consistently gets the first chance to
+// claim resources as they become available.
+func (self *supervisor) stepAll() bool {
+	var running []*run
+	self.mu.Lock()
+	for _, r := range self.runs {
+		if r.info.State == api.RunRunning {
+			running = append(running, r)
+		}
+	}
+	if len(running) > 0 {
+		self.turn = (self.turn + 1) % len(running)
+		running = append(running[self.turn:], running[:self.turn]...)
+	}
+	self.mu.Unlock()
+
+	share := self.jobShare(len(running))
+	progress := false
+	for _, r := range running {
+		r.stepLock.Lock()
+		if r.pipestance != nil {
+			r.pipestance.SetMaxJobs(share)
+			if self.step(r) {
+				progress = true
+			}
+		}
+		r.stepLock.Unlock()
+	}
+	return progress
+}
+
+// Step a running pipestance.  Must be called with the run's step lock held.
+func (self *supervisor) step(r *run) bool {
+	ctx, task := trace.NewTask(context.Background(), "update")
+	defer task.End()
+	ps := r.pipestance
+	ps.RefreshState(ctx)
+	switch ps.GetState(ctx) {
+	case core.Complete, core.DisabledState:
+		self.cleanupCompleted(r, ctx)
+		return true
+	case core.Failed:
+		return self.handleFailure(r, ctx)
+	default:
+		ps.CheckHeartbeats(ctx)
+		return ps.StepNodes(ctx)
+	}
+}
+
+func (self *supervisor) cleanupCompleted(r *run, ctx context.Context) {
+	ps := r.pipestance
+	if self.rt.Config.VdrMode == core.VdrDisable {
+		util.LogInfo("runtime", "VDR disabled. No files killed in %s.",
+			r.info.Id)
+	} else {
+		killReport := ps.VDRKill()
+		util.LogInfo("runtime", "VDR killed %d files, %s, in %s.",
+			killReport.Count, humanize.Bytes(killReport.Size), r.info.Id)
+	}
+	trace.WithRegion(ctx, "PostProcess", ps.PostProcess)
+	ps.Unlock()
+	ps.OnFinishHook(ctx)
+	self.finish(r, api.RunComplete, "")
+	util.LogInfo("mrpd", "%s completed successfully.", r.info.Id)
+}
+
+// Retry a failed pipestance if the error was transient and it has retries
+// remaining, or otherwise finish it.  Returns true if it was retried.
+func (self *supervisor) handleFailure(r *run, ctx context.Context) bool {
+	ps := r.pipestance
+	if !r.killed && r.remainingRetries > 0 {
+		if transient, log := ps.IsErrorTransient(); transient {
+			r.remainingRetries--
+			util.LogInfo("mrpd",
+				"Transient error in %s; attempting retry.  Log content:\n\n%s\n",
+				r.info.Id, log)
+			ps.Unlock()
+			newPs, err := r.factory.ReattachToPipestance(ctx)
+			if err == nil {
+				if err = newPs.Reset(); err != nil {
+					newPs.Unlock()
+				}
+			}
+			if err != nil {
+				util.PrintError(err, "mrpd", "Retry of %s failed.", r.info.Id)
+				self.finish(r, api.RunFailed, err.Error())
+				return false
+			}
+			newPs.LoadMetadata(ctx)
+			r.pipestance = newPs
+			self.mu.Lock()
+			r.info.Retries++
+			self.save()
+			self.mu.Unlock()
+			return true
+		}
+	}
+	ps.Unlock()
+	ps.OnFinishHook(ctx)
+	if r.killed {
+		_, _, _, log, _, _ := ps.GetFatalError()
+		self.finish(r, api.RunKilled, log)
+		util.LogInfo("mrpd", "%s was killed.", r.info.Id)
+		return false
+	}
+	_, _, _, log, _, errPaths := ps.GetFatalError()
+	if log == "" && len(errPaths) > 0 {
+		log = "See logs at:\n" + strings.Join(errPaths, "\n")
+	}
+	self.finish(r, api.RunFailed, log)
+	util.LogInfo("mrpd", "%s failed.", r.info.Id)
+	return false
+}
+
+// Record that a run has finished.  Must be called with the run's step lock
+// held.
+func (self *supervisor) finish(r *run, state api.RunState, message string) {
+	r.pipestance = nil
+	self.mu.Lock()
+	r.info.State = state
+	r.info.Finished = util.Timestamp()
+	r.info.Error = message
+	self.save()
+	self.mu.Unlock()
+	// A slot may be available for a queued run.
+	self.notify()
+}
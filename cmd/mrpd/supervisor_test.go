@@ -0,0 +1,130 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/martian-lang/martian/martian/api"
+)
+
+func TestSupervisorQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSupervisorQueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(path.Join(dir, "stages.mro"), []byte(`
+stage GREET(
+    in  string name,
+    src exec   "greet.sh",
+)
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "greet.sh"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	sup := newSupervisor(nil, dir, []string{dir}, 1, 0, 0)
+	submit := func(id, src string) (api.RunInfo, error) {
+		return sup.submit(&api.SubmitForm{
+			Id:         id,
+			Invocation: src,
+			Path:       path.Join(dir, id),
+		})
+	}
+	checkStatus := func(err error, status int) {
+		t.Helper()
+		var reqErr *requestError
+		if !errors.As(err, &reqErr) {
+			t.Errorf("expected a request error, got %v", err)
+		} else if reqErr.status != status {
+			t.Errorf("expected status %d, got %d: %v",
+				status, reqErr.status, err)
+		}
+	}
+	const src = `@include "stages.mro"
+
+call GREET(
+    name = "world",
+)
+`
+	if info, err := submit("first", src); err != nil {
+		t.Fatal(err)
+	} else if info.State != api.RunQueued || info.Pname != "GREET" {
+		t.Errorf("unexpected run info %v", info)
+	}
+	if _, err := submit("second", src); err != nil {
+		t.Fatal(err)
+	}
+	_, err = submit("first", src)
+	checkStatus(err, http.StatusConflict)
+	_, err = submit("bad", "call NOPE()")
+	checkStatus(err, http.StatusBadRequest)
+	_, err = submit("bad id", src)
+	checkStatus(err, http.StatusBadRequest)
+
+	if info, err := sup.kill("first", "killed"); err != nil {
+		t.Error(err)
+	} else if info.State != api.RunKilled {
+		t.Errorf("expected killed, got %s", info.State)
+	}
+	_, err = sup.kill("first", "killed")
+	checkStatus(err, http.StatusConflict)
+	_, err = sup.kill("third", "killed")
+	checkStatus(err, http.StatusNotFound)
+	_, err = sup.restart("second")
+	checkStatus(err, http.StatusConflict)
+
+	// The queue should be restored by a new supervisor.
+	sup = newSupervisor(nil, dir, []string{dir}, 1, 0, 0)
+	if err := sup.load(); err != nil {
+		t.Fatal(err)
+	}
+	if runs := sup.list(""); len(runs) != 2 {
+		t.Fatalf("expected 2 runs, got %d", len(runs))
+	} else if runs[0].Id != "first" || runs[0].State != api.RunKilled ||
+		runs[1].Id != "second" || runs[1].State != api.RunQueued {
+		t.Errorf("unexpected runs %v", runs)
+	}
+	if info, err := sup.restart("first"); err != nil {
+		t.Error(err)
+	} else if info.State != api.RunQueued || info.Error != "" {
+		t.Errorf("unexpected run info %v", info)
+	}
+	if runs := sup.list(api.RunQueued); len(runs) != 2 {
+		t.Errorf("expected 2 queued runs, got %d", len(runs))
+	}
+}
+
+func TestJobShare(t *testing.T) {
+	sup := newSupervisor(nil, "", nil, 8, 0, 0)
+	if n := sup.jobShare(4); n != 0 {
+		t.Errorf("expected no limit without a capacity, got %d", n)
+	}
+	sup.jobCapacity = 10
+	for _, c := range []struct {
+		running, expect int
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 5},
+		{3, 4},
+		{4, 3},
+		{20, 1},
+	} {
+		if n := sup.jobShare(c.running); n != c.expect {
+			t.Errorf("expected a share of %d for %d runs, got %d",
+				c.expect, c.running, n)
+		}
+	}
+	sup.maxJobs = 2
+	if n := sup.jobShare(1); n != 2 {
+		t.Errorf("expected the configured limit of 2, got %d", n)
+	}
+}
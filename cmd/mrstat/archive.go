@@ -0,0 +1,65 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/martian-lang/martian/martian/core"
+	"github.com/martian-lang/martian/martian/util"
+)
+
+func archivePipestance(psdir, archivePath string, retained bool) {
+	var extraFiles []string
+	if retained {
+		var err error
+		extraFiles, err = findRetainedFiles(psdir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot load", psdir, ":", err)
+			os.Exit(3)
+		}
+	}
+	manifest, err := core.ArchivePipestance(psdir, archivePath, extraFiles)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot archive", psdir, ":", err)
+		os.Remove(archivePath)
+		os.Exit(3)
+	}
+	fmt.Println("Archived", len(manifest.Files), "files from", psdir,
+		"to", archivePath)
+	os.Exit(0)
+}
+
+// Load the pipestance in read-only mode to find the files referenced by
+// retained outputs.
+func findRetainedFiles(psdir string) ([]string, error) {
+	absPath, err := filepath.Abs(psdir)
+	if err != nil {
+		return nil, err
+	}
+	util.SetupSignalHandlers()
+	config := core.DefaultRuntimeOptions()
+	rt := config.NewRuntime()
+	pipestance, err := rt.ReattachToPipestanceWithMroSrc(
+		filepath.Base(absPath), absPath, "", "", nil,
+		"", nil, false, true,
+		context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return pipestance.RetainedFiles(), nil
+}
+
+func restorePipestance(archivePath, psdir string) {
+	manifest, err := core.RestorePipestance(archivePath, psdir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot restore", archivePath, ":", err)
+		os.Exit(3)
+	}
+	fmt.Println("Restored", len(manifest.Files), "files from", archivePath,
+		"to", psdir)
+	os.Exit(0)
+}
@@ -16,6 +16,22 @@ pipestances, this forces the pipestance into a failed state, and mrp to
 terminate.  For completed mrp instances launched with the --noexit option,
 it causes mrp to terminate.
 
+The outputs command lists problems found while validating the outputs of
+stages in the pipestance, such as values of the wrong type or files which
+do not exist.  It reads the pipestance directory directly, and so does not
+require mrp to be running.
+
+The archive command packs a completed pipestance, including its metadata and
+outs directory, into a zip file with a manifest of checksums.  The restore
+command extracts such an archive to a new location.
+
+The relocate command moves a pipestance which is not running to a new
+location, updating the absolute paths in its metadata and symlinks so that it
+can still be inspected or restarted.
+
+The verify command checks the outputs of a completed pipestance against the
+manifest of sizes and checksums which mrp writes to outs/_manifest.json.
+
 */
 package main
 
@@ -46,6 +62,11 @@ func main() {
 
 Usage:
     mrstat <pipestance_name> [options]
+    mrstat outputs <pipestance_name> [--json]
+    mrstat archive <pipestance_name> <archive> [--retained]
+    mrstat restore <archive> <pipestance_name>
+    mrstat relocate <pipestance_name> <new_path>
+    mrstat verify <pipestance_name>
     mrstat -h | --help | --version
 
 Options:
@@ -53,6 +74,9 @@ Options:
                 If the pipestance is running, this will cause it to fail.
     --restart   If mrp was launched with --noexit, and the pipeline failed,
                 attempt to retry the run.
+    --json      Print output violations as json.
+    --retained  Also archive files retained by the pipeline, in addition to
+                metadata and files in outs.
 
     -h --help   Show this message.
     --version   Show version.`
@@ -64,6 +88,24 @@ Options:
 
 	psid := opts["<pipestance_name>"].(string)
 
+	if outputs, _ := opts["outputs"].(bool); outputs {
+		asJson, _ := opts["--json"].(bool)
+		listOutputViolations(psid, asJson)
+	}
+	if archive, _ := opts["archive"].(bool); archive {
+		retained, _ := opts["--retained"].(bool)
+		archivePipestance(psid, opts["<archive>"].(string), retained)
+	}
+	if restore, _ := opts["restore"].(bool); restore {
+		restorePipestance(opts["<archive>"].(string), psid)
+	}
+	if relocate, _ := opts["relocate"].(bool); relocate {
+		relocatePipestance(psid, opts["<new_path>"].(string))
+	}
+	if verify, _ := opts["verify"].(bool); verify {
+		verifyPipestance(psid)
+	}
+
 	var mrpUrl *url.URL
 	if urlBytes, err := ioutil.ReadFile(path.Join(psid, core.UiPort.FileName())); err != nil {
 		if os.IsNotExist(err) {
@@ -0,0 +1,125 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/martian-lang/martian/martian/core"
+)
+
+// The output violations recorded for a chunk or stage fork.
+type violationRecord struct {
+	// The metadata directory, relative to the pipestance.
+	Location   string                `json:"location"`
+	Violations core.OutputViolations `json:"violations"`
+}
+
+// Find all of the output violation files in the pipestance.
+func findOutputViolations(psid string) ([]violationRecord, error) {
+	fn := core.OutsViolations.FileName()
+	var records []violationRecord
+	err := filepath.Walk(psid, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == psid {
+				return err
+			}
+			// Skip unreadable directories.
+			return nil
+		}
+		if info.IsDir() {
+			if p != psid {
+				switch info.Name() {
+				case "files", "journal", "outs", "tmp":
+					// These can be large, and never contain metadata.
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if info.Name() != fn {
+			return nil
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var violations core.OutputViolations
+		if err := json.Unmarshal(b, &violations); err != nil {
+			return fmt.Errorf("parsing %s: %v", p, err)
+		}
+		rel, err := filepath.Rel(psid, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		records = append(records, violationRecord{
+			Location:   rel,
+			Violations: violations,
+		})
+		return nil
+	})
+	if err != nil {
+		return records, err
+	}
+	// Fork-level violations may be kept in the key-value metadata store.
+	err = core.WalkMetadataStore(psid, func(dir string,
+		name core.MetadataFileName, b []byte) error {
+		if name != core.OutsViolations {
+			return nil
+		}
+		var violations core.OutputViolations
+		if err := json.Unmarshal(b, &violations); err != nil {
+			return fmt.Errorf("parsing %s in %s: %v",
+				name.FileName(), dir, err)
+		}
+		records = append(records, violationRecord{
+			Location:   dir,
+			Violations: violations,
+		})
+		return nil
+	})
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Location < records[j].Location
+	})
+	return records, err
+}
+
+func listOutputViolations(psid string, asJson bool) {
+	records, err := findOutputViolations(psid)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot read", psid, ":", err)
+		os.Exit(3)
+	}
+	if asJson {
+		if records == nil {
+			records = []violationRecord{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(records); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(7)
+		}
+		os.Exit(0)
+	}
+	if len(records) == 0 {
+		fmt.Println("No output violations found in", psid)
+		os.Exit(0)
+	}
+	for _, record := range records {
+		fmt.Printf("%s:\n", record.Location)
+		for _, v := range record.Violations {
+			level := "warning"
+			if v.Fatal {
+				level = "error"
+			}
+			fmt.Printf("    %s: %s\n", level, v.String())
+		}
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,19 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/martian-lang/martian/martian/core"
+)
+
+func relocatePipestance(psdir, newPath string) {
+	if err := core.RelocatePipestance(psdir, newPath); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot relocate", psdir, ":", err)
+		os.Exit(3)
+	}
+	fmt.Println("Relocated", psdir, "to", newPath)
+	os.Exit(0)
+}
@@ -0,0 +1,24 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/martian-lang/martian/martian/core"
+)
+
+func verifyPipestance(psdir string) {
+	manifest, err := core.VerifyOutputManifest(psdir)
+	if manifest == nil {
+		fmt.Fprintln(os.Stderr, "Cannot read output manifest for", psdir, ":", err)
+		os.Exit(3)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Outputs of", psdir,
+			"do not match the manifest:", err)
+		os.Exit(8)
+	}
+	fmt.Println("Verified", len(manifest.Files), "output files in", psdir)
+	os.Exit(0)
+}
@@ -0,0 +1,167 @@
+//
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+//
+
+package adapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/martian-lang/martian/martian/core"
+)
+
+// OutFiles maps the names of file-typed outputs of a stage to the file names
+// which the runtime assigns to them in the files directory of each job.
+type OutFiles map[string]string
+
+// Set the file outputs in outs to paths in the given files directory, as the
+// runtime does before starting a job.
+func (files OutFiles) makeOuts(filesPath string, outs core.LazyArgumentMap) error {
+	for id, fn := range files {
+		b, err := json.Marshal(path.Join(filesPath, fn))
+		if err != nil {
+			return err
+		}
+		outs[id] = b
+	}
+	return nil
+}
+
+// RunStageInDir runs every phase of a stage in the current process, using
+// metadata directories created under dir, or under a temporary directory
+// which is removed afterwards if dir is empty.  split and join may be nil
+// if the stage does not split.
+//
+// The args are serialized as the stage arguments, and the outputs of the
+// final phase are deserialized into outs.  The outs of each job are
+// initialized with paths for the file outputs given in outFiles, and for
+// chunks also those given in chunkOutFiles.
+//
+// This is intended for testing stage code.  Jobs do not run in separate
+// processes, and profiling and resource limits are not applied.
+func RunStageInDir(dir string, split SplitFunc, main, join MainFunc,
+	outFiles, chunkOutFiles OutFiles, args, outs interface{}) error {
+	if dir == "" {
+		tmp, err := ioutil.TempDir("", "martian_stage")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+	var stageArgs core.LazyArgumentMap
+	if b, err := json.Marshal(args); err != nil {
+		return err
+	} else if err := json.Unmarshal(b, &stageArgs); err != nil {
+		return err
+	}
+	if split == nil {
+		metadata, err := localMetadata(dir, "main", "main")
+		if err != nil {
+			return err
+		}
+		return runLocalJob(main, metadata, stageArgs, outs, outFiles)
+	}
+
+	metadata, err := localMetadata(dir, "split", "split")
+	if err != nil {
+		return err
+	}
+	if err := metadata.Write(core.ArgsFile, stageArgs); err != nil {
+		return err
+	}
+	stageDefs, err := split(metadata)
+	if err != nil {
+		return err
+	} else if stageDefs == nil {
+		return fmt.Errorf("split returned nil")
+	}
+	chunkOuts := make([]json.RawMessage, len(stageDefs.ChunkDefs))
+	for i, def := range stageDefs.ChunkDefs {
+		metadata, err := localMetadata(dir, fmt.Sprintf("chnk%d", i), "main")
+		if err != nil {
+			return err
+		}
+		chunkArgs := mergeArgs(stageArgs, def.Resources)
+		for k, v := range def.Args {
+			chunkArgs[k] = v
+		}
+		if err := runLocalJob(main, metadata, chunkArgs, &chunkOuts[i],
+			outFiles, chunkOutFiles); err != nil {
+			return fmt.Errorf("chunk %d: %w", i, err)
+		}
+	}
+
+	metadata, err = localMetadata(dir, "join", "join")
+	if err != nil {
+		return err
+	}
+	if err := metadata.Write(core.ChunkDefsFile, stageDefs.ChunkDefs); err != nil {
+		return err
+	}
+	if err := metadata.Write(core.ChunkOutsFile, chunkOuts); err != nil {
+		return err
+	}
+	return runLocalJob(join, metadata,
+		mergeArgs(stageArgs, stageDefs.JoinDef), outs, outFiles)
+}
+
+// Create the metadata directory for a job.
+func localMetadata(dir, name, runType string) (*core.Metadata, error) {
+	p := path.Join(dir, name)
+	files := path.Join(p, "files")
+	journal := path.Join(dir, "journal")
+	if err := os.MkdirAll(files, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(journal, 0755); err != nil {
+		return nil, err
+	}
+	return core.NewMetadataRunWithJournalPath(name, p, files, journal, runType), nil
+}
+
+// Returns a copy of the stage arguments with the given resources added.
+func mergeArgs(args core.LazyArgumentMap,
+	res *core.JobResources) core.LazyArgumentMap {
+	result := make(core.LazyArgumentMap, len(args)+4)
+	for k, v := range args {
+		result[k] = v
+	}
+	if res != nil {
+		for k, v := range res.ToLazyMap() {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// Run a chunk or join phase and deserialize the outputs.
+func runLocalJob(f MainFunc, metadata *core.Metadata,
+	args core.LazyArgumentMap, outs interface{}, files ...OutFiles) error {
+	if err := metadata.Write(core.ArgsFile, args); err != nil {
+		return err
+	}
+	initialOuts := make(core.LazyArgumentMap)
+	for _, of := range files {
+		if err := of.makeOuts(metadata.FilesPath(), initialOuts); err != nil {
+			return err
+		}
+	}
+	if err := metadata.Write(core.OutsFile, initialOuts); err != nil {
+		return err
+	}
+	result, err := f(metadata)
+	if err != nil {
+		return err
+	}
+	if result != nil {
+		if err := metadata.Write(core.OutsFile, result); err != nil {
+			return err
+		}
+	}
+	return metadata.ReadInto(core.OutsFile, outs)
+}
@@ -0,0 +1,39 @@
+//
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+//
+
+package adapter
+
+import (
+	"context"
+	"os"
+
+	"github.com/martian-lang/martian/martian/core"
+)
+
+// Support for the typed stage handlers generated by mro2go.
+
+type metadataKey struct{}
+
+// WithMetadata returns a context which carries the metadata for a stage job.
+func WithMetadata(ctx context.Context, metadata *core.Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, metadata)
+}
+
+// GetMetadata returns the metadata for the stage job running with the given
+// context, or nil if there is none.
+func GetMetadata(ctx context.Context) *core.Metadata {
+	m, _ := ctx.Value(metadataKey{}).(*core.Metadata)
+	return m
+}
+
+// ReadOuts reads the initial outputs which Martian writes for a job, which
+// include the paths to use for file outputs.  A missing outs file is not an
+// error.
+func ReadOuts(metadata *core.Metadata, outs interface{}) error {
+	if err := metadata.ReadInto(core.OutsFile, outs); err != nil &&
+		!os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
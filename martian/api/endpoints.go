@@ -21,6 +21,10 @@ const (
 	// Restarts a failed pipestance.
 	QueryRestart = "/api/restart"
 
+	// Re-run a stage of a failed pipestance, along with everything which
+	// depends on it.
+	QueryInvalidate = "/api/invalidate"
+
 	// Get the contents of a pipestance's top-level metadata.
 	QueryGetMetadataTop = "/api/get-metadata-top/"
 
@@ -36,6 +40,17 @@ const (
 	// Get the list of valid top-level metadata files.
 	QueryListMetadataTop = "/api/list-metadata-top"
 
+	// Stream pipestance events as server-sent events.
+	QueryEvents = "/api/events"
+
+	// Pipestance monitoring statistics in the Prometheus text format.
+	QueryMetrics = "/metrics"
+
 	// Gets the content of files in the pipestance extras directory.
 	QueryExtras = "/extras/"
+
+	// Lists the runs managed by mrpd, or submits a new one.  Individual
+	// runs are at QueryRuns/<id>, and may be killed or restarted by posting
+	// to QueryRuns/<id>/kill or QueryRuns/<id>/restart.
+	QueryRuns = "/api/runs"
 )
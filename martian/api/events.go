@@ -0,0 +1,98 @@
+//
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+//
+// Server-sent event stream of pipestance events.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/martian-lang/martian/martian/core"
+)
+
+// How long to keep an event stream open before asking the client to
+// reconnect.  This must be less than the server's write timeout.
+const EventStreamDuration = 55 * time.Second
+
+// How long clients should wait before reconnecting, in milliseconds.
+const eventStreamRetryMillis = 1000
+
+// Serve the event log as a stream of server-sent events.
+//
+// Each event is sent with its sequence number as the event ID and its
+// type as the event name, with the JSON-encoded event as the data.
+// Clients may resume a stream by sending the last ID they received in the
+// Last-Event-ID header, or in the "since" query parameter.  Events from
+// before the most recent few thousand are not available for replay.
+//
+// The stream is closed after EventStreamDuration, and clients are expected
+// to reconnect.
+func ServeEvents(w http.ResponseWriter, req *http.Request, log *core.EventLog) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	var since int64
+	if id := req.Header.Get("Last-Event-ID"); id != "" {
+		if i, err := strconv.ParseInt(id, 10, 64); err == nil {
+			since = i
+		}
+	} else if id := req.FormValue("since"); id != "" {
+		if i, err := strconv.ParseInt(id, 10, 64); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else {
+			since = i
+		}
+	}
+	backlog, events := log.Subscribe(since)
+	defer log.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", eventStreamRetryMillis); err != nil {
+		return
+	}
+	for _, ev := range backlog {
+		if err := writeEvent(w, ev); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	timeout := time.NewTimer(EventStreamDuration)
+	defer timeout.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-timeout.C:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev *core.Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n",
+		ev.Seq, ev.Type, b)
+	return err
+}
@@ -0,0 +1,184 @@
+//
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+//
+// Prometheus text exposition of pipestance metrics.
+
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/martian-lang/martian/martian/core"
+)
+
+// Node states which are always reported, even if no node is in that state,
+// so that alerting rules don't see missing series.
+var metricsNodeStates = [...]core.MetadataState{
+	core.Waiting,
+	core.Running,
+	core.Complete,
+	core.Failed,
+	core.DisabledState,
+}
+
+type metricsWriter struct {
+	w      *bufio.Writer
+	labels string
+}
+
+func (self *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(self.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (self *metricsWriter) value(name, labels string, value float64) {
+	self.w.WriteString(name)
+	self.w.WriteByte('{')
+	self.w.WriteString(self.labels)
+	if labels != "" {
+		self.w.WriteByte(',')
+		self.w.WriteString(labels)
+	}
+	self.w.WriteString("} ")
+	self.w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	self.w.WriteByte('\n')
+}
+
+func (self *metricsWriter) metric(name, typ, help string, value float64) {
+	self.header(name, typ, help)
+	self.value(name, "", value)
+}
+
+// A local job manager resource, and the scale factor to convert its
+// semaphore values to the reported unit.
+type semaphoreMetric struct {
+	resource string
+	scale    float64
+	usage    *core.SemaphoreUsage
+}
+
+// Write one metric family for each of the semaphore usage values, with a
+// sample for each resource.
+func (self *metricsWriter) semaphores(sems []semaphoreMetric) {
+	for _, family := range [...]struct {
+		name, help string
+		value      func(*core.SemaphoreUsage) int64
+	}{
+		{
+			"martian_local_reserved",
+			"Local job manager resources reserved by jobs.",
+			func(u *core.SemaphoreUsage) int64 { return u.Reserved },
+		},
+		{
+			"martian_local_in_use",
+			"Local job manager resources in use, including unaccounted usage.",
+			func(u *core.SemaphoreUsage) int64 { return u.InUse },
+		},
+		{
+			"martian_local_size",
+			"Local job manager resources currently available for reservation.",
+			func(u *core.SemaphoreUsage) int64 { return u.Size },
+		},
+	} {
+		self.header(family.name, "gauge", family.help)
+		for _, sem := range sems {
+			if sem.usage != nil {
+				self.value(family.name,
+					"resource="+strconv.Quote(sem.resource),
+					float64(family.value(sem.usage))*sem.scale)
+			}
+		}
+	}
+}
+
+// Write metrics in the Prometheus text exposition format.  All series are
+// labeled with the given pipestance ID.
+func WriteMetrics(w io.Writer, psid string, metrics *core.PipestanceMetrics) error {
+	mw := metricsWriter{
+		w:      bufio.NewWriter(w),
+		labels: "psid=" + strconv.Quote(psid),
+	}
+
+	mw.header("martian_nodes", "gauge", "Number of pipeline and stage nodes by state.")
+	for _, state := range metricsNodeStates {
+		mw.value("martian_nodes",
+			"state="+strconv.Quote(nodeStateLabel(state)),
+			float64(metrics.Nodes[state]))
+	}
+	other := make([]string, 0, len(metrics.Nodes))
+	for state := range metrics.Nodes {
+		known := false
+		for _, s := range metricsNodeStates {
+			if s == state {
+				known = true
+				break
+			}
+		}
+		if !known {
+			other = append(other, string(state))
+		}
+	}
+	sort.Strings(other)
+	for _, state := range other {
+		mw.value("martian_nodes",
+			"state="+strconv.Quote(nodeStateLabel(core.MetadataState(state))),
+			float64(metrics.Nodes[core.MetadataState(state)]))
+	}
+
+	mw.header("martian_jobs", "gauge", "Number of queued or running jobs by job mode.")
+	modes := make([]string, 0, len(metrics.Jobs))
+	for mode := range metrics.Jobs {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	for _, mode := range modes {
+		for _, state := range [...]core.MetadataState{core.Queued, core.Running} {
+			mw.value("martian_jobs",
+				"mode="+strconv.Quote(mode)+",state="+strconv.Quote(string(state)),
+				float64(metrics.Jobs[mode][state]))
+		}
+	}
+
+	if metrics.Threads != nil || metrics.Mem != nil {
+		mw.semaphores([]semaphoreMetric{
+			{"cores", 0.01, metrics.Threads},
+			{"mem_bytes", 1024 * 1024, metrics.Mem},
+			{"vmem_bytes", 1024 * 1024, metrics.VMem},
+		})
+	}
+
+	mw.metric("martian_vdr_reclaimed_bytes_total", "counter",
+		"Bytes removed by volatile data removal.",
+		float64(metrics.VdrBytes))
+	mw.metric("martian_vdr_reclaimed_files_total", "counter",
+		"Files removed by volatile data removal.",
+		float64(metrics.VdrFiles))
+	mw.metric("martian_retries_total", "counter",
+		"Automatic retries of the pipestance after transient failures.",
+		float64(metrics.Retries))
+	mw.metric("martian_heartbeat_failures_total", "counter",
+		"Jobs failed due to missing heartbeats.",
+		float64(metrics.HeartbeatFailures))
+	return mw.w.Flush()
+}
+
+func nodeStateLabel(state core.MetadataState) string {
+	if state == core.Waiting {
+		return "waiting"
+	}
+	return strings.ToLower(string(state))
+}
+
+// Content type for the Prometheus text exposition format.
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Serve metrics in the Prometheus text exposition format.
+func ServeMetrics(w http.ResponseWriter, psid string, metrics *core.PipestanceMetrics) {
+	w.Header().Set("Content-Type", MetricsContentType)
+	WriteMetrics(w, psid, metrics)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package api
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/martian-lang/martian/martian/core"
+)
+
+func testMetrics() *core.PipestanceMetrics {
+	return &core.PipestanceMetrics{
+		Nodes: map[core.MetadataState]int{
+			core.Running:  2,
+			core.Complete: 5,
+			"queued":      1,
+		},
+		Jobs: map[string]map[core.MetadataState]int{
+			"local": {core.Running: 2},
+		},
+		Threads:  &core.SemaphoreUsage{Reserved: 200, InUse: 250, Size: 400},
+		Mem:      &core.SemaphoreUsage{Reserved: 1024, InUse: 2048, Size: 4096},
+		VdrBytes: 1000,
+		VdrFiles: 3,
+		Retries:  1,
+	}
+}
+
+const expectMetrics = `# HELP martian_nodes Number of pipeline and stage nodes by state.
+# TYPE martian_nodes gauge
+martian_nodes{psid="PS",state="waiting"} 0
+martian_nodes{psid="PS",state="running"} 2
+martian_nodes{psid="PS",state="complete"} 5
+martian_nodes{psid="PS",state="failed"} 0
+martian_nodes{psid="PS",state="disabled"} 0
+martian_nodes{psid="PS",state="queued"} 1
+# HELP martian_jobs Number of queued or running jobs by job mode.
+# TYPE martian_jobs gauge
+martian_jobs{psid="PS",mode="local",state="queued"} 0
+martian_jobs{psid="PS",mode="local",state="running"} 2
+# HELP martian_local_reserved Local job manager resources reserved by jobs.
+# TYPE martian_local_reserved gauge
+martian_local_reserved{psid="PS",resource="cores"} 2
+martian_local_reserved{psid="PS",resource="mem_bytes"} 1.073741824e+09
+# HELP martian_local_in_use Local job manager resources in use, including unaccounted usage.
+# TYPE martian_local_in_use gauge
+martian_local_in_use{psid="PS",resource="cores"} 2.5
+martian_local_in_use{psid="PS",resource="mem_bytes"} 2.147483648e+09
+# HELP martian_local_size Local job manager resources currently available for reservation.
+# TYPE martian_local_size gauge
+martian_local_size{psid="PS",resource="cores"} 4
+martian_local_size{psid="PS",resource="mem_bytes"} 4.294967296e+09
+# HELP martian_vdr_reclaimed_bytes_total Bytes removed by volatile data removal.
+# TYPE martian_vdr_reclaimed_bytes_total counter
+martian_vdr_reclaimed_bytes_total{psid="PS"} 1000
+# HELP martian_vdr_reclaimed_files_total Files removed by volatile data removal.
+# TYPE martian_vdr_reclaimed_files_total counter
+martian_vdr_reclaimed_files_total{psid="PS"} 3
+# HELP martian_retries_total Automatic retries of the pipestance after transient failures.
+# TYPE martian_retries_total counter
+martian_retries_total{psid="PS"} 1
+# HELP martian_heartbeat_failures_total Jobs failed due to missing heartbeats.
+# TYPE martian_heartbeat_failures_total counter
+martian_heartbeat_failures_total{psid="PS"} 0
+`
+
+func TestWriteMetrics(t *testing.T) {
+	var buf strings.Builder
+	if err := WriteMetrics(&buf, "PS", testMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	if s := buf.String(); s != expectMetrics {
+		t.Errorf("Expected\n%s\ngot\n%s", expectMetrics, s)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	w := httptest.NewRecorder()
+	ServeMetrics(w, "PS", testMetrics())
+	if ct := w.Header().Get("Content-Type"); ct != MetricsContentType {
+		t.Errorf("Expected content type %q, got %q", MetricsContentType, ct)
+	}
+	if s := w.Body.String(); s != expectMetrics {
+		t.Errorf("Expected\n%s\ngot\n%s", expectMetrics, s)
+	}
+}
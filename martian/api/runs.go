@@ -0,0 +1,73 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package api
+
+// The state of a run managed by mrpd.
+type RunState string
+
+const (
+	// The run is waiting for a slot to start.
+	RunQueued RunState = "queued"
+
+	// The pipestance is running.
+	RunRunning RunState = "running"
+
+	// The pipestance completed successfully.
+	RunComplete RunState = "complete"
+
+	// The pipestance failed, and any automatic retries were exhausted.
+	RunFailed RunState = "failed"
+
+	// The run was killed through the API.
+	RunKilled RunState = "killed"
+)
+
+// Done returns true if the run is not queued or running.
+func (s RunState) Done() bool {
+	return s == RunComplete || s == RunFailed || s == RunKilled
+}
+
+// The body of a request to submit a new run to mrpd.
+type SubmitForm struct {
+	// The pipestance id.
+	Id string `json:"id"`
+
+	// The mro source for the invocation.
+	Invocation string `json:"invocation"`
+
+	// The pipestance directory.  Relative paths are relative to the working
+	// directory of mrpd.  The default is the pipestance id.
+	Path string `json:"path,omitempty"`
+
+	// The MROPATH for the run.  The default is the MROPATH of mrpd.
+	MroPath string `json:"mropath,omitempty"`
+
+	// Tags for the pipestance, as key:value pairs.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// Information about a run managed by mrpd.  This is also the record which
+// mrpd saves for each run, so that the queue persists if mrpd is restarted.
+type RunInfo struct {
+	Id         string   `json:"id"`
+	State      RunState `json:"state"`
+	Path       string   `json:"path"`
+	Invocation string   `json:"invocation"`
+	MroPath    string   `json:"mropath"`
+	Tags       []string `json:"tags,omitempty"`
+
+	// The name of the pipeline, once the pipestance has started.
+	Pname string `json:"pname,omitempty"`
+
+	// Timestamps for when the run was submitted, last started, and
+	// finished.
+	Submitted string `json:"submitted"`
+	Started   string `json:"started,omitempty"`
+	Finished  string `json:"finished,omitempty"`
+
+	// The number of automatic retries which have been attempted.
+	Retries int `json:"retries,omitempty"`
+
+	// The reason for the most recent failure, if any.
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,456 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Archival and restoration of completed pipestances.
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// The name of the manifest entry in a pipestance archive.
+const archiveManifestName = "_archive_manifest.json"
+
+// An ArchiveEntry describes a file or symlink in a pipestance archive.
+type ArchiveEntry struct {
+	// The path to the file, relative to the pipestance directory.
+	Path string `json:"path"`
+
+	// The size of the file, in bytes.
+	Size int64 `json:"size,omitempty"`
+
+	// The hex-encoded sha256 checksum of the file content.
+	Sha256 string `json:"sha256,omitempty"`
+
+	// If the entry is a symlink, its target.
+	Link string `json:"link,omitempty"`
+}
+
+// An ArchiveManifest lists the content of a pipestance archive.
+type ArchiveManifest struct {
+	// The absolute path to the pipestance when it was archived.  Absolute
+	// symlinks to locations inside this directory are rewritten when the
+	// archive is restored.
+	Path string `json:"path"`
+
+	MartianVersion string `json:"martian_version"`
+
+	// The time at which the archive was created.
+	Created string `json:"created"`
+
+	Files []ArchiveEntry `json:"files"`
+}
+
+// ArchivePipestance packs a completed pipestance into a zip file, along with
+// a manifest of file checksums.
+//
+// The archive includes all of the metadata and the top-level outs
+// directory, including any files inside the pipestance which are the
+// targets of symlinks in outs.  Other files created by stages are only
+// included if they are in extraFiles, for example to preserve files retained
+// by the pipeline.
+func ArchivePipestance(pipestancePath, archivePath string,
+	extraFiles []string) (*ArchiveManifest, error) {
+	root, err := filepath.Abs(pipestancePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path.Join(root, Lock.FileName())); err == nil {
+		return nil, &RuntimeError{"pipestance " + root + " is still running"}
+	}
+	if _, err := os.Stat(path.Join(root, FinalState.FileName())); err != nil {
+		if os.IsNotExist(err) {
+			return nil, &RuntimeError{"pipestance " + root + " has not completed"}
+		}
+		return nil, err
+	}
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	self := pipestanceArchiver{
+		root: root,
+		zw:   zip.NewWriter(f),
+		manifest: ArchiveManifest{
+			Path:           root,
+			MartianVersion: util.GetVersion(),
+			Created:        util.Timestamp(),
+		},
+		added: make(map[string]struct{}),
+	}
+	if absArchive, err := filepath.Abs(archivePath); err == nil {
+		// Don't try to archive the archive.
+		self.added[absArchive] = struct{}{}
+	}
+	if err := self.addMetadata(); err != nil {
+		return nil, err
+	}
+	for _, p := range extraFiles {
+		if !filepath.IsAbs(p) {
+			p = path.Join(root, p)
+		}
+		if err := self.addPath(p); err != nil {
+			return nil, err
+		}
+	}
+	if err := self.writeManifest(); err != nil {
+		return nil, err
+	}
+	if err := self.zw.Close(); err != nil {
+		return nil, err
+	}
+	return &self.manifest, f.Close()
+}
+
+type pipestanceArchiver struct {
+	root     string
+	zw       *zip.Writer
+	manifest ArchiveManifest
+
+	// The absolute paths which have already been added.
+	added map[string]struct{}
+}
+
+// Add everything in the pipestance except for the journal and temporary
+// directories, and the content of stage files directories.
+func (self *pipestanceArchiver) addMetadata() error {
+	outs := path.Join(self.root, "outs")
+	return filepath.Walk(self.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == outs && info.IsDir() {
+			if err := self.addTree(p); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		if dir := path.Dir(p); dir == self.root {
+			switch info.Name() {
+			case "journal", "tmp",
+				Lock.FileName(), UiPort.FileName():
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if err := self.add(p, info, false); err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == "files" {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// Add the given path, and if it is a directory, everything inside it,
+// including the targets of any symlinks.
+func (self *pipestanceArchiver) addTree(root string) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return self.add(p, info, true)
+	})
+}
+
+// Add the given path, which may be a file, directory, or symlink, along
+// with the targets of any symlinks.
+func (self *pipestanceArchiver) addPath(p string) error {
+	p = filepath.Clean(p)
+	if _, ok := self.added[p]; ok || !pathIsInside(p, self.root) {
+		return nil
+	}
+	info, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return self.addTree(p)
+	}
+	return self.add(p, info, true)
+}
+
+// Add an entry to the archive.  For symlinks, if follow is true, the link
+// target is also added if it is inside the pipestance.
+func (self *pipestanceArchiver) add(p string, info os.FileInfo, follow bool) error {
+	if _, ok := self.added[p]; ok {
+		return nil
+	}
+	self.added[p] = struct{}{}
+	rel, err := filepath.Rel(self.root, p)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(rel)
+	switch {
+	case info.IsDir():
+		header.Name += "/"
+		_, err := self.zw.CreateHeader(header)
+		return err
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		header.Method = zip.Store
+		out, err := self.zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(out, link); err != nil {
+			return err
+		}
+		self.manifest.Files = append(self.manifest.Files, ArchiveEntry{
+			Path: header.Name,
+			Link: link,
+		})
+		if !follow {
+			return nil
+		} else if !filepath.IsAbs(link) {
+			link = path.Join(path.Dir(p), link)
+		}
+		return self.addPath(link)
+	case info.Mode().IsRegular():
+		header.Method = zip.Deflate
+		out, err := self.zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		sum := sha256.New()
+		n, err := io.Copy(io.MultiWriter(out, sum), in)
+		if err != nil {
+			return err
+		}
+		self.manifest.Files = append(self.manifest.Files, ArchiveEntry{
+			Path:   header.Name,
+			Size:   n,
+			Sha256: hex.EncodeToString(sum.Sum(nil)),
+		})
+		return nil
+	default:
+		// Skip sockets, pipes, and the like.
+		return nil
+	}
+}
+
+func (self *pipestanceArchiver) writeManifest() error {
+	sort.Slice(self.manifest.Files, func(i, j int) bool {
+		return self.manifest.Files[i].Path < self.manifest.Files[j].Path
+	})
+	out, err := self.zw.CreateHeader(&zip.FileHeader{
+		Name:     archiveManifestName,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "\t")
+	return enc.Encode(&self.manifest)
+}
+
+// Find and parse the manifest in a pipestance archive.
+func readArchiveManifest(zr *zip.Reader, archivePath string) (*ArchiveManifest, error) {
+	for _, f := range zr.File {
+		if f.Name != archiveManifestName {
+			continue
+		}
+		in, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer in.Close()
+		var manifest ArchiveManifest
+		if err := json.NewDecoder(in).Decode(&manifest); err != nil {
+			return nil, fmt.Errorf("parsing manifest: %v", err)
+		}
+		return &manifest, nil
+	}
+	return nil, &util.ZipError{
+		ZipPath:  archivePath,
+		FilePath: archiveManifestName,
+	}
+}
+
+// RestorePipestance extracts a pipestance archive to the given directory,
+// which must not already exist, verifying the content against the checksums
+// in the archive manifest.
+//
+// Absolute symlinks which pointed to locations inside the original
+// pipestance directory are replaced with relative symlinks, so that they
+// point to the corresponding location in the restored pipestance.  Absolute
+// paths embedded in the pipestance metadata are updated in the same way as
+// by RelocatePipestance.
+func RestorePipestance(archivePath, pipestancePath string) (*ArchiveManifest, error) {
+	dest, err := filepath.Abs(pipestancePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		return nil, &RuntimeError{dest + " already exists"}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	manifest, err := readArchiveManifest(&zr.Reader, archivePath)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*ArchiveEntry, len(manifest.Files))
+	for i := range manifest.Files {
+		entries[manifest.Files[i].Path] = &manifest.Files[i]
+	}
+	if err := os.MkdirAll(dest, 0777); err != nil {
+		return nil, err
+	}
+	var links []*ArchiveEntry
+	for _, f := range zr.File {
+		if f.Name == archiveManifestName {
+			continue
+		}
+		name := strings.TrimSuffix(f.Name, "/")
+		if p := path.Clean(name); p != name || path.IsAbs(p) ||
+			p == ".." || strings.HasPrefix(p, "../") {
+			return manifest, fmt.Errorf("invalid path %q in archive", f.Name)
+		}
+		p := path.Join(dest, filepath.FromSlash(name))
+		if f.Mode().IsDir() {
+			if err := os.MkdirAll(p, 0777); err != nil {
+				return manifest, err
+			}
+			continue
+		}
+		entry := entries[name]
+		if entry == nil {
+			return manifest, fmt.Errorf("%s is not in the archive manifest", name)
+		}
+		delete(entries, name)
+		if f.Mode()&os.ModeSymlink != 0 {
+			links = append(links, entry)
+		} else if err := restoreArchiveFile(f, p, entry); err != nil {
+			return manifest, err
+		}
+	}
+	for _, entry := range links {
+		link := entry.Link
+		if filepath.IsAbs(link) && pathIsInside(link, manifest.Path) {
+			orig := path.Join(manifest.Path, path.Dir(entry.Path))
+			if rel, err := filepath.Rel(orig, link); err == nil {
+				link = rel
+			}
+		}
+		p := path.Join(dest, filepath.FromSlash(entry.Path))
+		if err := os.MkdirAll(path.Dir(p), 0777); err != nil {
+			return manifest, err
+		}
+		if err := os.Symlink(link, p); err != nil {
+			return manifest, err
+		}
+	}
+	for _, entry := range manifest.Files {
+		if _, ok := entries[entry.Path]; ok {
+			return manifest, fmt.Errorf("%s is missing from the archive", entry.Path)
+		}
+	}
+	if manifest.Path != "" && manifest.Path != dest {
+		return manifest, relocatePipestancePaths(manifest.Path, dest)
+	}
+	return manifest, nil
+}
+
+func restoreArchiveFile(f *zip.File, p string, entry *ArchiveEntry) error {
+	if err := os.MkdirAll(path.Dir(p), 0777); err != nil {
+		return err
+	}
+	in, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_EXCL, f.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, sum), in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if n != entry.Size {
+		return fmt.Errorf("size of %s is %d, expected %d", entry.Path, n, entry.Size)
+	}
+	if s := hex.EncodeToString(sum.Sum(nil)); s != entry.Sha256 {
+		return fmt.Errorf("checksum mismatch for %s", entry.Path)
+	}
+	return nil
+}
+
+// RetainedFiles returns the paths to the files referenced by stage outputs
+// which were marked to be retained, either by the stage or by a pipeline.
+func (self *Pipestance) RetainedFiles() []string {
+	var files []string
+	seen := make(map[string]struct{})
+	readSize := self.node.top.rt.FreeMemBytes() / 2
+	for _, node := range self.allNodes() {
+		for _, r := range node.call.Retained() {
+			target := self.node.top.allNodes[r.Id]
+			if target == nil {
+				continue
+			}
+			for _, fork := range target.forks {
+				outs, err := fork.metadata.read(OutsFile, readSize)
+				if err != nil {
+					continue
+				}
+				for _, name := range getMaybeFileNames(outs.jsonPath(r.OutputId)) {
+					if _, ok := seen[name]; !ok {
+						seen[name] = struct{}{}
+						files = append(files, name)
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestArchivePipestance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestArchivePipestance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ps := path.Join(dir, "ps")
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(name, content string) {
+		t.Helper()
+		p := path.Join(ps, name)
+		check(os.MkdirAll(path.Dir(p), 0755))
+		check(ioutil.WriteFile(p, []byte(content), 0644))
+	}
+	write("_invocation", "call PIPE()")
+	write("_lock", "")
+	write("journal/PIPE.STAGE.fork0.u1.complete", "")
+	write("PIPE/STAGE/fork0/_outs",
+		`{"out": "`+path.Join(ps, "PIPE/STAGE/fork0/files/out.txt")+`"}`)
+	write("PIPE/STAGE/fork0/files/out.txt", "output")
+	write("PIPE/STAGE/fork0/files/temp.txt", "temp")
+	write("PIPE/STAGE/fork0/files/retained.txt", "retained")
+	check(os.MkdirAll(path.Join(ps, "outs"), 0755))
+	check(os.Symlink(path.Join(ps, "PIPE/STAGE/fork0/files/out.txt"),
+		path.Join(ps, "outs/out.txt")))
+	check(os.Symlink("out.txt", path.Join(ps, "outs/rel.txt")))
+
+	archive := path.Join(dir, "ps.zip")
+	if _, err := ArchivePipestance(ps, archive, nil); err == nil {
+		t.Error("Expected archiving a locked pipestance to fail.")
+	}
+	check(os.Remove(path.Join(ps, "_lock")))
+	if _, err := ArchivePipestance(ps, archive, nil); err == nil {
+		t.Error("Expected archiving an incomplete pipestance to fail.")
+	}
+	write("_finalstate", `[{"path": "`+path.Join(ps, "PIPE")+`"}]`)
+	manifest, err := ArchivePipestance(ps, archive, []string{
+		path.Join(ps, "PIPE/STAGE/fork0/files/retained.txt"),
+	})
+	check(err)
+	expect := []string{
+		"PIPE/STAGE/fork0/_outs",
+		"PIPE/STAGE/fork0/files/out.txt",
+		"PIPE/STAGE/fork0/files/retained.txt",
+		"_finalstate",
+		"_invocation",
+		"outs/out.txt",
+		"outs/rel.txt",
+	}
+	if len(manifest.Files) != len(expect) {
+		t.Errorf("Expected %d files, got %d", len(expect), len(manifest.Files))
+	} else {
+		for i, e := range expect {
+			if p := manifest.Files[i].Path; p != e {
+				t.Errorf("Expected %s, got %s", e, p)
+			}
+		}
+	}
+
+	// Move the original so that a symlink which was not correctly rewritten
+	// would be broken.
+	check(os.Rename(ps, path.Join(dir, "old")))
+	restored := path.Join(dir, "restored")
+	_, err = RestorePipestance(archive, restored)
+	check(err)
+	for _, name := range []string{"outs/out.txt", "outs/rel.txt"} {
+		if b, err := ioutil.ReadFile(path.Join(restored, name)); err != nil {
+			t.Error(err)
+		} else if s := string(b); s != "output" {
+			t.Errorf("Expected %s to contain output, got %q", name, s)
+		}
+	}
+	if link, err := os.Readlink(path.Join(restored, "outs/out.txt")); err != nil {
+		t.Error(err)
+	} else if link != "../PIPE/STAGE/fork0/files/out.txt" {
+		t.Errorf("Expected a relative symlink, got %s", link)
+	}
+	// Paths in the metadata refer to the restored pipestance.
+	for name, expect := range map[string]string{
+		"PIPE/STAGE/fork0/_outs": `{"out": "` +
+			path.Join(restored, "PIPE/STAGE/fork0/files/out.txt") + `"}`,
+		"_finalstate": `[{"path": "` + path.Join(restored, "PIPE") + `"}]`,
+		"_psdir":      restored,
+	} {
+		if b, err := ioutil.ReadFile(path.Join(restored, name)); err != nil {
+			t.Error(err)
+		} else if s := string(b); s != expect {
+			t.Errorf("Expected %s to contain\n%s\ngot\n%s", name, expect, s)
+		}
+	}
+	if _, err := os.Stat(path.Join(restored, "journal")); !os.IsNotExist(err) {
+		t.Error("Expected the journal to be excluded.")
+	}
+	if _, err := RestorePipestance(archive, restored); err == nil {
+		t.Error("Expected restoring over an existing directory to fail.")
+	}
+
+	// Corrupt the archive.
+	zr, err := zip.OpenReader(archive)
+	check(err)
+	corrupt := path.Join(dir, "corrupt.zip")
+	f, err := os.Create(corrupt)
+	check(err)
+	zw := zip.NewWriter(f)
+	for _, file := range zr.File {
+		out, err := zw.CreateHeader(&file.FileHeader)
+		check(err)
+		if file.Name == "_invocation" {
+			_, err = out.Write([]byte("call OTHER()"))
+			check(err)
+		} else {
+			in, err := file.Open()
+			check(err)
+			b, err := ioutil.ReadAll(in)
+			check(err)
+			in.Close()
+			_, err = out.Write(b)
+			check(err)
+		}
+	}
+	check(zw.Close())
+	check(f.Close())
+	zr.Close()
+	if _, err := RestorePipestance(corrupt, path.Join(dir, "corrupt")); err == nil {
+		t.Error("Expected a checksum mismatch.")
+	}
+}
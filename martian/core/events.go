@@ -0,0 +1,284 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Structured log of pipestance events, for consumption by external
+// monitoring tools.
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/martian-lang/martian/martian/util"
+)
+
+type EventType string
+
+const (
+	// A node, fork, or job changed state.
+	EventState EventType = "state"
+
+	// A job was submitted to a job manager and given an ID.
+	EventJob EventType = "job"
+
+	// Files were removed by volatile data removal.
+	EventVdr EventType = "vdr"
+
+	// The pipestance is being retried after a transient failure.
+	EventRetry EventType = "retry"
+)
+
+// Kinds of objects for which events are emitted.
+const (
+	EventKindPipestance = "pipestance"
+	EventKindNode       = "node"
+	EventKindFork       = "fork"
+	EventKindSplit      = "split"
+	EventKindChunk      = "chunk"
+	EventKindJoin       = "join"
+)
+
+// The number of recent events kept in memory for replay to new subscribers.
+const eventLogHistory = 4096
+
+// The maximum number of bytes of an error log to include in an event.
+const eventErrorLimit = 4096
+
+// An event in the life of a pipestance.
+type Event struct {
+	// Sequence number for this event.  Sequence numbers are strictly
+	// increasing for the lifetime of an mrp process.
+	Seq       int64         `json:"seq"`
+	Timestamp time.Time     `json:"ts"`
+	Type      EventType     `json:"type"`
+	Kind      string        `json:"kind,omitempty"`
+	Fqname    string        `json:"fqname,omitempty"`
+	State     MetadataState `json:"state"`
+	Previous  MetadataState `json:"prev"`
+	JobId     string        `json:"jobid,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	VdrFiles  uint          `json:"vdr_files,omitempty"`
+	VdrBytes  uint64        `json:"vdr_bytes,omitempty"`
+	Message   string        `json:"message,omitempty"`
+}
+
+// Records events to a JSON-lines file and distributes them to subscribers.
+//
+// All methods are safe to call on a nil EventLog, in which case they do
+// nothing.
+type EventLog struct {
+	mutex       sync.Mutex
+	out         io.WriteCloser
+	seq         int64
+	history     []*Event
+	subscribers map[chan *Event]struct{}
+}
+
+func NewEventLog() *EventLog {
+	return &EventLog{
+		subscribers: make(map[chan *Event]struct{}),
+	}
+}
+
+// Append events to the given file, as JSON lines.
+func (self *EventLog) OpenFile(fn string) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	self.SetOutput(f)
+	return nil
+}
+
+// Set the destination for the event log, closing the previous destination
+// if there was one.
+func (self *EventLog) SetOutput(w io.WriteCloser) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.out != nil {
+		self.out.Close()
+	}
+	self.out = w
+}
+
+// Close the output and all subscriptions.
+func (self *EventLog) Close() {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.out != nil {
+		self.out.Close()
+		self.out = nil
+	}
+	for ch := range self.subscribers {
+		close(ch)
+		delete(self.subscribers, ch)
+	}
+}
+
+// Returns true if there is an output or any subscribers.
+func (self *EventLog) active() bool {
+	if self == nil {
+		return false
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.out != nil || len(self.subscribers) > 0
+}
+
+// Record an event.  The sequence number and timestamp are filled in
+// automatically.
+func (self *EventLog) Emit(ev *Event) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.out == nil && len(self.subscribers) == 0 {
+		return
+	}
+	self.seq++
+	ev.Seq = self.seq
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now()
+	}
+	if len(self.history) >= eventLogHistory {
+		copy(self.history, self.history[1:])
+		self.history[len(self.history)-1] = ev
+	} else {
+		self.history = append(self.history, ev)
+	}
+	if self.out != nil {
+		if b, err := json.Marshal(ev); err != nil {
+			util.LogError(err, "events", "Could not serialize event.")
+		} else if _, err := self.out.Write(append(b, '\n')); err != nil {
+			util.LogError(err, "events", "Could not write event log.")
+			self.out.Close()
+			self.out = nil
+		}
+	}
+	for ch := range self.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			// Drop subscribers which are not keeping up.  They can
+			// resubscribe from their last-seen sequence number.
+			close(ch)
+			delete(self.subscribers, ch)
+		}
+	}
+}
+
+// Subscribe to events.  Returns the events from the history which have
+// sequence numbers greater than after, and a channel on which subsequent
+// events will be sent.  The channel is closed if the subscriber falls too
+// far behind or the log is closed.
+func (self *EventLog) Subscribe(after int64) ([]*Event, <-chan *Event) {
+	ch := make(chan *Event, 256)
+	if self == nil {
+		close(ch)
+		return nil, ch
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var backlog []*Event
+	for i, ev := range self.history {
+		if ev.Seq > after {
+			backlog = make([]*Event, len(self.history)-i)
+			copy(backlog, self.history[i:])
+			break
+		}
+	}
+	self.subscribers[ch] = struct{}{}
+	return backlog, ch
+}
+
+// Stop sending events to the given channel.
+func (self *EventLog) Unsubscribe(ch <-chan *Event) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for c := range self.subscribers {
+		if c == ch {
+			close(c)
+			delete(self.subscribers, c)
+			return
+		}
+	}
+}
+
+func (self *EventLog) emitVdr(fqname string, report *VDRKillReport) {
+	if report == nil || !self.active() {
+		return
+	}
+	self.Emit(&Event{
+		Type:     EventVdr,
+		Kind:     EventKindFork,
+		Fqname:   fqname,
+		VdrFiles: report.Count,
+		VdrBytes: report.Size,
+	})
+}
+
+// Associate this metadata object with an event log.
+func (self *Metadata) setEvents(log *EventLog, kind string) {
+	self.events = log
+	self.eventKind = kind
+}
+
+// Emit an event if the state is different than the given state.  Must be
+// called with the lock held.
+func (self *Metadata) _notifyNoLock(name MetadataFileName, before MetadataState) {
+	after, _ := self._peekStateNoLock()
+	if name == JobId && self._existsNoLock(JobId) {
+		if b, err := self.readRawBytes(JobId); err == nil && len(b) > 0 {
+			self.events.Emit(&Event{
+				Type:   EventJob,
+				Kind:   self.eventKind,
+				Fqname: self.fqname,
+				State:  after,
+				JobId:  string(b),
+			})
+		}
+	}
+	if after == before {
+		return
+	}
+	ev := Event{
+		Type:     EventState,
+		Kind:     self.eventKind,
+		Fqname:   self.fqname,
+		State:    after,
+		Previous: before,
+	}
+	if after == Failed {
+		for _, fn := range [...]MetadataFileName{Errors, Assert} {
+			if self._existsNoLock(fn) {
+				if f, err := self.openFile(fn); err == nil {
+					var buf [eventErrorLimit]byte
+					n, _ := io.ReadFull(f, buf[:])
+					f.Close()
+					ev.Error = string(buf[:n])
+				}
+				break
+			}
+		}
+	} else if after == Queued || after == Running {
+		if self._existsNoLock(JobId) {
+			if b, err := self.readRawBytes(JobId); err == nil {
+				ev.JobId = string(b)
+			}
+		}
+	}
+	self.events.Emit(&ev)
+}
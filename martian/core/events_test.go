@@ -0,0 +1,107 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type nopCloseBuffer struct {
+	bytes.Buffer
+}
+
+func (*nopCloseBuffer) Close() error { return nil }
+
+func TestEventLogSubscribe(t *testing.T) {
+	t.Parallel()
+	log := NewEventLog()
+	// Without an output or subscriber, events are discarded.
+	log.Emit(&Event{Type: EventState, Fqname: "dropped"})
+	var buf nopCloseBuffer
+	log.SetOutput(&buf)
+	log.Emit(&Event{Type: EventState, Fqname: "a", State: Running})
+	log.Emit(&Event{Type: EventRetry, Fqname: "b"})
+	backlog, ch := log.Subscribe(1)
+	if len(backlog) != 1 || backlog[0].Fqname != "b" || backlog[0].Seq != 2 {
+		t.Errorf("incorrect backlog %v", backlog)
+	}
+	log.Emit(&Event{Type: EventVdr, Fqname: "c", VdrBytes: 10})
+	if ev := <-ch; ev.Fqname != "c" || ev.Seq != 3 {
+		t.Errorf("incorrect event %v", ev)
+	}
+	log.Unsubscribe(ch)
+	if _, ok := <-ch; ok {
+		t.Error("channel not closed by Unsubscribe")
+	}
+
+	dec := json.NewDecoder(&buf)
+	var names []string
+	for dec.More() {
+		var ev Event
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, ev.Fqname)
+	}
+	if len(names) != 3 || names[0] != "a" || names[2] != "c" {
+		t.Errorf("incorrect log contents %v", names)
+	}
+}
+
+func TestMetadataEvents(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "testMetadataEvents")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(dir)
+	log := NewEventLog()
+	_, ch := log.Subscribe(0)
+	md := NewMetadata("ID.ps.STAGE.fork0.chnk0", dir)
+	md.setEvents(log, EventKindChunk)
+	if err := md.mkdirs(); err != nil {
+		t.Fatal(err)
+	}
+	expect := func(t *testing.T, typ EventType, state, prev MetadataState) *Event {
+		t.Helper()
+		select {
+		case ev := <-ch:
+			if ev.Type != typ || ev.State != state || ev.Previous != prev ||
+				ev.Kind != EventKindChunk || ev.Fqname != md.fqname {
+				t.Errorf("expected %s %s -> %s, got %v",
+					typ, prev, state, ev)
+			}
+			return ev
+		default:
+			t.Fatalf("expected %s %s -> %s, got nothing", typ, prev, state)
+		}
+		return nil
+	}
+	md.WriteRaw(JobId, "1234")
+	if ev := expect(t, EventJob, Waiting, ""); ev.JobId != "1234" {
+		t.Errorf("incorrect job id %q", ev.JobId)
+	}
+	md.WriteRaw(JobInfoFile, "{}")
+	expect(t, EventState, Queued, Waiting)
+	md.WriteRaw(LogFile, "")
+	if ev := expect(t, EventState, Running, Queued); ev.JobId != "1234" {
+		t.Errorf("incorrect job id %q", ev.JobId)
+	}
+	md.WriteRaw(Errors, "oh no")
+	if ev := expect(t, EventState, Failed, Running); ev.Error != "oh no" {
+		t.Errorf("incorrect error %q", ev.Error)
+	}
+	if err := md.removeAll(); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, EventState, Waiting, Failed)
+	select {
+	case ev := <-ch:
+		t.Errorf("unexpected event %v", ev)
+	default:
+	}
+}
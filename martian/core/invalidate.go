@@ -0,0 +1,216 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Invalidation of completed stages so that they, and everything downstream of
+// them, are re-run.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/martian-lang/martian/martian/syntax"
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// Find a node by either its fully qualified name or its name relative to
+// the pipestance, e.g. PIPELINE.STAGE.
+func (self *Pipestance) findNode(fqname string) *Node {
+	if node := self.node.top.allNodes[fqname]; node != nil {
+		return node
+	}
+	return self.node.top.allNodes[self.node.top.fqname+"."+fqname]
+}
+
+// Add all nodes which transitively depend on this one to the given set.
+func (self *Node) collectPostNodes(nodes map[*Node]struct{}) {
+	for _, post := range self.postnodes {
+		node := post.getNode()
+		if _, ok := nodes[node]; !ok {
+			nodes[node] = struct{}{}
+			node.collectPostNodes(nodes)
+		}
+	}
+}
+
+// Add all pipelines which contain this node to the given set.
+func (self *Node) collectAncestors(nodes map[*Node]struct{}) {
+	for p := self.parent; p != nil; {
+		parent, ok := p.(*Node)
+		if !ok || parent.call == nil {
+			return
+		}
+		nodes[parent] = struct{}{}
+		p = parent.parent
+	}
+}
+
+// Returns an error if any of this node's jobs are queued or running.
+func (self *Node) checkNotRunning() error {
+	for _, metadata := range self.collectMetadatas() {
+		if st, _ := metadata.getState(); st == Queued || st == Running {
+			return &RuntimeError{fmt.Sprintf(
+				"cannot invalidate %s while it is %s",
+				metadata.fqname, st)}
+		}
+	}
+	return nil
+}
+
+// Returns an error if any of this node's inputs, other than those from the
+// given set of nodes which are going to be re-run, were removed by VDR.
+func (self *Node) checkInputsNotVdr(rerun map[*Node]struct{}) error {
+	for _, pre := range self.prenodes {
+		node := pre.getNode()
+		if _, ok := rerun[node]; ok || node.call == nil ||
+			node.call.Kind() != syntax.KindStage {
+			continue
+		}
+		for _, fork := range node.forks {
+			var report VDRKillReport
+			if err := fork.metadata.ReadInto(VdrKill, &report); err == nil &&
+				report.Count > 0 {
+				return &RuntimeError{fmt.Sprintf(
+					"cannot re-run %s because files output by %s were "+
+						"removed by VDR.  Invalidate %s instead.",
+					self.GetFQName(), node.GetFQName(), node.GetFQName())}
+			}
+		}
+	}
+	return nil
+}
+
+// Remove all state for a stage fork so that it will be re-run.
+func (self *Fork) invalidate() error {
+	util.PrintInfo("runtime", "(invalidate)      %s", self.fqname)
+	if err := self.metadata.store.RemoveAll(self.path); err != nil {
+		return err
+	}
+	if files, err := filepath.Glob(self.split_metadata.journalPath + ".*"); err == nil {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}
+	self.reset()
+	self.stageDefs = &StageDefs{ChunkDefs: []*ChunkDef{new(ChunkDef)}}
+	self.perfCache = nil
+	self.storageLock.Lock()
+	self.fileParamMap = nil
+	self.storageLock.Unlock()
+	self.eventState = ""
+	// Recreate the metadata objects to discard any cached state.
+	self.updateId(self.forkId)
+	self.mkdirs()
+	return nil
+}
+
+// Remove the completion state of a pipeline fork, leaving the forks of its
+// child nodes untouched.
+func (self *Fork) invalidatePipeline() error {
+	for _, name := range [...]MetadataFileName{
+		CompleteFile,
+		OutsFile,
+		DisabledFile,
+		VdrKill,
+		PartialVdr,
+	} {
+		if err := self.metadata.remove(name); err != nil {
+			return err
+		}
+	}
+	self.perfCache = nil
+	return nil
+}
+
+// Invalidate a stage so that it is re-run, along with every node which
+// transitively depends on it.  The stage may be given by fully qualified name
+// or by name relative to the pipestance.  If fork is not empty, only that
+// fork of the stage is invalidated, though all forks of downstream stages
+// still are.  Nodes upstream of the stage are not modified.
+//
+// None of the affected nodes may be running.
+func (self *Pipestance) Invalidate(fqname, fork string) error {
+	if self.readOnly() {
+		return &RuntimeError{"Pipestance is in read only mode."}
+	}
+	node := self.findNode(fqname)
+	if node == nil {
+		return &RuntimeError{fmt.Sprintf("no node named %s", fqname)}
+	}
+	if node.call.Kind() != syntax.KindStage {
+		return &RuntimeError{fmt.Sprintf("%s is not a stage", fqname)}
+	}
+	forks := node.forks
+	if fork != "" {
+		if f := node.getFork(fork); f == nil {
+			return &RuntimeError{fmt.Sprintf("%s has no fork %s", fqname, fork)}
+		} else {
+			forks = []*Fork{f}
+		}
+	}
+
+	stages := map[*Node]struct{}{node: {}}
+	node.collectPostNodes(stages)
+	pipelines := make(map[*Node]struct{})
+	for n := range stages {
+		n.collectAncestors(pipelines)
+	}
+	for n := range stages {
+		if n.call.Kind() == syntax.KindPipeline {
+			delete(stages, n)
+			pipelines[n] = struct{}{}
+		}
+	}
+	affected := make([]*Node, 0, len(stages)+len(pipelines))
+	for n := range stages {
+		affected = append(affected, n)
+	}
+	for n := range pipelines {
+		affected = append(affected, n)
+	}
+	sort.Slice(affected, func(i, j int) bool {
+		return affected[i].GetFQName() < affected[j].GetFQName()
+	})
+	for n := range stages {
+		if err := n.checkNotRunning(); err != nil {
+			return err
+		}
+		if err := n.checkInputsNotVdr(stages); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range forks {
+		if err := f.invalidate(); err != nil {
+			return err
+		}
+	}
+	for _, n := range affected {
+		if n == node {
+			continue
+		}
+		for _, f := range n.forks {
+			var err error
+			if _, ok := pipelines[n]; ok {
+				err = f.invalidatePipeline()
+			} else {
+				err = f.invalidate()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// The final state and performance summary will need to be regenerated.
+	for _, name := range [...]MetadataFileName{FinalState, Perf} {
+		if err := self.metadata.remove(name); err != nil {
+			return err
+		}
+	}
+	for _, n := range affected {
+		n.loadMetadata()
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"os"
+	"testing"
+)
+
+func TestInvalidate(t *testing.T) {
+	invokeTestWith(`
+stage SUM_SQUARES(
+    in  float[] values,
+    out float   sum,
+    src comp    "stages/sum_squares",
+)
+
+stage REPORT(
+    in  float   sum,
+    src exec    "stages/report",
+)
+
+stage OTHER(
+    in  float[] values,
+    src exec    "stages/other",
+)
+
+pipeline SUM_SQUARE_PIPELINE(
+    in  float[] values,
+    out float   sum,
+)
+{
+    call SUM_SQUARES(
+        values = self.values,
+    )
+    call REPORT(
+        sum = SUM_SQUARES.sum,
+    )
+    call OTHER(
+        values = self.values,
+    )
+
+    return (
+        sum = SUM_SQUARES.sum,
+    )
+}
+
+call SUM_SQUARE_PIPELINE(
+    values = [1.0, 2.0, 3.0],
+)
+`, t, func(t *testing.T, ps *Pipestance) {
+		if err := ps.Invalidate("SUM_SQUARE_PIPELINE.MISSING", ""); err == nil {
+			t.Error("Expected error for missing stage.")
+		}
+		if err := ps.Invalidate("SUM_SQUARE_PIPELINE", ""); err == nil {
+			t.Error("Expected error for invalidating a pipeline.")
+		}
+		if err := ps.Invalidate("SUM_SQUARE_PIPELINE.SUM_SQUARES", "7"); err == nil {
+			t.Error("Expected error for missing fork.")
+		}
+		other := ps.findNode("SUM_SQUARE_PIPELINE.OTHER")
+		if err := other.mkdirs(); err != nil {
+			t.Fatal(err)
+		}
+		marker := other.forks[0].metadata.MetadataFilePath(CompleteFile)
+		other.forks[0].metadata.WriteTime(CompleteFile)
+		report := ps.findNode("SUM_SQUARE_PIPELINE.REPORT")
+		if err := report.mkdirs(); err != nil {
+			t.Fatal(err)
+		}
+		report.forks[0].metadata.WriteTime(CompleteFile)
+		if err := ps.Invalidate("SUM_SQUARE_PIPELINE.SUM_SQUARES", ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(marker); err != nil {
+			t.Error("Expected unrelated stage to be untouched:", err)
+		}
+		if report.forks[0].metadata.exists(CompleteFile) {
+			t.Error("Expected downstream stage to be reset.")
+		}
+		if st := report.forks[0].getState(); st == Complete {
+			t.Errorf("Expected downstream stage not complete, got %v", st)
+		}
+	})
+}
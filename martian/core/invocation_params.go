@@ -0,0 +1,67 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+// MergeInvocationArgs returns the argument values for a call to the given
+// pipeline or stage from a set of parameter values, such as might be read
+// from a json or yaml file.  Parameters which are not in params are taken
+// from defaults, if present there.  Values in defaults for parameters which
+// are not declared are ignored.
+//
+// Every input parameter must have a value, which may be null, of the correct
+// type, and every value must be for a declared input parameter.  Errors are
+// returned as a syntax.ErrorList in the order the parameters are declared,
+// and give the path to the offending value, for example
+//
+//     parameter samples: element 2: key read_path: expected a string
+//
+// Non-fatal errors, such as unexpected struct members, are returned in the
+// second return value.
+//
+// The callable and lookup must come from a compiled AST.
+func MergeInvocationArgs(callable syntax.Callable, lookup *syntax.TypeLookup,
+	params, defaults LazyArgumentMap) (LazyArgumentMap, string, error) {
+	inParams := callable.GetInParams()
+	args := make(LazyArgumentMap, len(inParams.List))
+	var errs syntax.ErrorList
+	var alarms strings.Builder
+	for _, param := range inParams.List {
+		val, ok := params[param.Id]
+		if !ok {
+			val, ok = defaults[param.Id]
+		}
+		if !ok {
+			errs = append(errs, &syntax.IncompatibleTypeError{
+				Message: "missing parameter " + param.Id,
+			})
+			continue
+		}
+		if err := checkJsonType(lookup, val, param.Tname, &alarms); err != nil {
+			errs = append(errs, &syntax.IncompatibleTypeError{
+				Message: "parameter " + param.Id,
+				Reason:  err,
+			})
+		}
+		args[param.Id] = val
+	}
+	unknown := make([]string, 0, len(params))
+	for key := range params {
+		if _, ok := inParams.Table[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		errs = append(errs, &syntax.IncompatibleTypeError{
+			Message: "unknown parameter " + key + " for " + callable.GetId(),
+		})
+	}
+	return args, alarms.String(), errs.If()
+}
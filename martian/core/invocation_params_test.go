@@ -0,0 +1,84 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+func TestMergeInvocationArgs(t *testing.T) {
+	_, _, ast, err := syntax.ParseSourceBytes([]byte(`
+struct SAMPLE(
+    string name,
+    int[]  lanes,
+)
+
+stage COUNT(
+    in  SAMPLE[] samples,
+    in  int      threads,
+    in  bool     verbose,
+    out int      total,
+    src comp     "count",
+)
+`), "example.mro", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callable := ast.Callables.Table["COUNT"]
+	parse := func(src string) LazyArgumentMap {
+		t.Helper()
+		var m LazyArgumentMap
+		if err := json.Unmarshal([]byte(src), &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	defaults := parse(`{"threads": 4, "verbose": false, "other": 1}`)
+
+	args, _, err := MergeInvocationArgs(callable, &ast.TypeTable,
+		parse(`{
+			"samples": [{"name": "a", "lanes": [1, 2]}],
+			"verbose": true
+		}`), defaults)
+	if err != nil {
+		t.Error(err)
+	}
+	if s := string(args["threads"]); s != "4" {
+		t.Errorf("expected default threads, got %s", s)
+	}
+	if s := string(args["verbose"]); s != "true" {
+		t.Errorf("expected verbose to be overridden, got %s", s)
+	}
+
+	_, _, err = MergeInvocationArgs(callable, &ast.TypeTable,
+		parse(`{
+			"samples": [{"name": "a", "lanes": [1]}, {"name": "b", "lanes": ["x"]}],
+			"threads": "many",
+			"bogus": null
+		}`), nil)
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	errs, ok := err.(syntax.ErrorList)
+	if !ok {
+		t.Fatalf("expected an error list, got %v", err)
+	}
+	expect := []string{
+		"parameter samples: element 1: key lanes: element 0: " +
+			`value '"x"' cannot be parsed as an integer`,
+		`parameter threads: value '"many"' cannot be parsed as an integer`,
+		"missing parameter verbose",
+		"unknown parameter bogus for COUNT",
+	}
+	if len(errs) != len(expect) {
+		t.Fatalf("expected %d errors, got %v", len(expect), err)
+	}
+	for i, e := range expect {
+		if errs[i].Error() != e {
+			t.Errorf("expected error %q, got %q", e, errs[i].Error())
+		}
+	}
+}
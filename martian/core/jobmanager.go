@@ -28,6 +28,7 @@ type JobManager interface {
 		env map[string]string,
 		md *Metadata,
 		res *JobResources,
+		priority JobPriority,
 		fqname, shellName string,
 		preflight bool)
 	endJob(*Metadata)
@@ -102,6 +103,7 @@ type JobManagerJson struct {
 	JobSettings *JobManagerSettings            `json:"settings"`
 	JobModes    map[string]*JobModeJson        `json:"jobmodes"`
 	ProfileMode map[ProfileMode]*ProfileConfig `json:"profiles"`
+	Kubernetes  *KubernetesJobModeJson         `json:"kubernetes,omitempty"`
 }
 
 type jobManagerConfig struct {
@@ -0,0 +1,573 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Job manager which runs each job as a Kubernetes Job through the API server.
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/martian-lang/martian/martian/util"
+)
+
+const kubernetesMode = "kubernetes"
+
+const (
+	defaultKubernetesApi       = "https://kubernetes.default.svc"
+	defaultKubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultKubernetesCaFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	kubernetesManagedByLabel   = "app.kubernetes.io/managed-by"
+	kubernetesFqnameAnnotation = "martian.io/fqname"
+)
+
+// Configuration for the kubernetes job mode, from the "kubernetes" section
+// of jobmanagers/config.json.
+type KubernetesJobModeJson struct {
+	// The base URL for the API server.  Defaults to the in-cluster address,
+	// or the value of MRO_K8S_API if set.
+	ApiServer string `json:"api_server,omitempty"`
+
+	// The namespace in which to create jobs.  Defaults to "default", or the
+	// value of MRO_K8S_NAMESPACE if set.
+	Namespace string `json:"namespace,omitempty"`
+
+	// The container image to run.  Must have martian and the pipeline code
+	// available at the same paths as they are for mrp.  May be overridden
+	// with MRO_K8S_IMAGE.
+	Image string `json:"image,omitempty"`
+
+	// Files containing the bearer token and CA certificate for the API
+	// server.  Default to the standard service account paths, if they exist.
+	TokenFile string `json:"token_file,omitempty"`
+	CaFile    string `json:"ca_file,omitempty"`
+
+	ServiceAccount string `json:"service_account,omitempty"`
+
+	// Additional resource requests to add for each __special value.
+	Special map[string]map[string]string `json:"special,omitempty"`
+
+	NodeSelector map[string]string `json:"node_selector,omitempty"`
+
+	// Passed through to the pod spec verbatim.  These must at least make the
+	// pipestance directory available at the same path in the container.
+	Volumes      json.RawMessage `json:"volumes,omitempty"`
+	VolumeMounts json.RawMessage `json:"volume_mounts,omitempty"`
+
+	// If nonzero, finished jobs will be deleted by the cluster after this
+	// many seconds.
+	TtlSeconds int `json:"ttl_seconds_after_finished,omitempty"`
+
+	QueueQueryGrace int `json:"queue_query_grace_secs,omitempty"`
+}
+
+type KubernetesJobManager struct {
+	config        *KubernetesJobModeJson
+	jobSettings   *JobManagerSettings
+	client        *http.Client
+	token         string
+	jobsUrl       string
+	queueGrace    time.Duration
+	maxJobs       int
+	jobFreqMillis int
+	jobSem        *MaxJobsSemaphore
+	limiter       *time.Ticker
+	debug         bool
+	queueMutex    sync.Mutex
+}
+
+func NewKubernetesJobManager(maxJobs int, jobFreqMillis int,
+	config *JobManagerJson, debug bool) *KubernetesJobManager {
+	conf := config.Kubernetes
+	if conf == nil {
+		conf = new(KubernetesJobModeJson)
+	}
+	self, err := newKubernetesJobManager(conf, config.JobSettings,
+		maxJobs, jobFreqMillis, debug)
+	if err != nil {
+		util.PrintError(err, "jobmngr",
+			"Could not configure kubernetes job mode.")
+		os.Exit(1)
+	}
+	return self
+}
+
+func newKubernetesJobManager(conf *KubernetesJobModeJson,
+	settings *JobManagerSettings,
+	maxJobs int, jobFreqMillis int,
+	debug bool) (*KubernetesJobManager, error) {
+	c := *conf
+	if v := os.Getenv("MRO_K8S_API"); v != "" {
+		c.ApiServer = v
+	} else if c.ApiServer == "" {
+		c.ApiServer = defaultKubernetesApi
+	}
+	if v := os.Getenv("MRO_K8S_NAMESPACE"); v != "" {
+		c.Namespace = v
+	} else if c.Namespace == "" {
+		c.Namespace = "default"
+	}
+	if v := os.Getenv("MRO_K8S_IMAGE"); v != "" {
+		c.Image = v
+	}
+	if c.Image == "" {
+		return nil, fmt.Errorf("no container image was specified")
+	}
+	self := &KubernetesJobManager{
+		config:        &c,
+		jobSettings:   settings,
+		maxJobs:       maxJobs,
+		jobFreqMillis: jobFreqMillis,
+		debug:         debug,
+		jobsUrl: strings.TrimSuffix(c.ApiServer, "/") +
+			"/apis/batch/v1/namespaces/" +
+			url.PathEscape(c.Namespace) + "/jobs",
+	}
+	util.LogInfo("jobmngr", "Kubernetes jobs API = %s", self.jobsUrl)
+	util.LogInfo("jobmngr", "Kubernetes image = %s", c.Image)
+
+	tokenFile := c.TokenFile
+	if tokenFile == "" {
+		if _, err := os.Stat(defaultKubernetesTokenFile); err == nil {
+			tokenFile = defaultKubernetesTokenFile
+		}
+	}
+	if tokenFile != "" {
+		if b, err := ioutil.ReadFile(tokenFile); err != nil {
+			return nil, err
+		} else {
+			self.token = string(bytes.TrimSpace(b))
+		}
+	}
+	var tlsConfig *tls.Config
+	caFile := c.CaFile
+	if caFile == "" {
+		if _, err := os.Stat(defaultKubernetesCaFile); err == nil {
+			caFile = defaultKubernetesCaFile
+		}
+	}
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig = &tls.Config{RootCAs: pool}
+	}
+	self.client = &http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	self.queueGrace = time.Duration(c.QueueQueryGrace) * time.Second
+	if self.queueGrace == 0 {
+		self.queueGrace = 5 * time.Minute
+	}
+	if self.maxJobs > 0 {
+		self.jobSem = NewMaxJobsSemaphore(self.maxJobs)
+	}
+	if self.jobFreqMillis > 0 {
+		self.limiter = time.NewTicker(time.Millisecond * time.Duration(self.jobFreqMillis))
+	}
+	return self, nil
+}
+
+func (self *KubernetesJobManager) refreshResources(bool) error {
+	if self.jobSem != nil {
+		self.jobSem.FindDone()
+	}
+	return nil
+}
+
+func (self *KubernetesJobManager) GetMaxCores() int {
+	return 0
+}
+
+func (self *KubernetesJobManager) GetMaxMemGB() int {
+	return 0
+}
+
+func (self *KubernetesJobManager) GetSettings() *JobManagerSettings {
+	return self.jobSettings
+}
+
+func (self *KubernetesJobManager) GetSystemReqs(resRequest *JobResources) JobResources {
+	res := *resRequest
+	if res.Threads == 0 {
+		res.Threads = float64(self.jobSettings.ThreadsPerJob)
+	} else if res.Threads < 0 {
+		res.Threads = -res.Threads
+	}
+	if res.MemGB < 0 {
+		res.MemGB = -res.MemGB
+	}
+	if res.MemGB == 0 {
+		res.MemGB = float64(self.jobSettings.MemGBPerJob)
+	}
+	if res.VMemGB < 1 {
+		res.VMemGB = res.MemGB + float64(self.jobSettings.ExtraVmemGB)
+	}
+	return res
+}
+
+func (self *KubernetesJobManager) execJob(shellCmd string, argv []string,
+	envs map[string]string, metadata *Metadata, resRequest *JobResources,
+	_ JobPriority, fqname string, shellName string, localpreflight bool) {
+	ctx, task := trace.NewTask(context.Background(), "queueKubernetes")
+
+	if self.jobSem == nil {
+		defer task.End()
+		self.sendJob(shellCmd, argv, envs,
+			metadata, resRequest,
+			fqname, shellName, ctx)
+		return
+	}
+	go func() {
+		defer task.End()
+		if self.debug {
+			util.LogInfo("jobmngr", "Waiting for job: %s", fqname)
+		}
+		if success := self.jobSem.Acquire(metadata); !success {
+			return
+		}
+		if self.debug {
+			util.LogInfo("jobmngr", "Job sent: %s", fqname)
+		}
+		self.sendJob(shellCmd, argv, envs,
+			metadata, resRequest,
+			fqname, shellName, ctx)
+	}()
+}
+
+func (self *KubernetesJobManager) endJob(metadata *Metadata) {
+	if self.jobSem != nil {
+		self.jobSem.Release(metadata)
+	}
+}
+
+// Convert a stage name into a valid kubernetes object name prefix.
+func kubernetesName(fqname, shellName string) string {
+	var buf strings.Builder
+	buf.Grow(len(fqname) + len(shellName) + 2)
+	dash := true
+	for _, c := range strings.ToLower(fqname + "." + shellName) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			buf.WriteRune(c)
+			dash = false
+		} else if !dash {
+			buf.WriteByte('-')
+			dash = true
+		}
+	}
+	name := strings.TrimRight(buf.String(), "-")
+	// Leave room in the 63 character limit for the generated suffix.
+	if len(name) > 52 {
+		name = strings.TrimRight(name[len(name)-52:], "-")
+		name = strings.TrimLeft(name, "-")
+	}
+	if name == "" {
+		name = "martian"
+	}
+	return name + "-"
+}
+
+// Format a quantity of memory in GB as a kubernetes quantity string.
+func kubernetesMemory(gb float64) string {
+	return strconv.FormatInt(int64(math.Ceil(gb*1024)), 10) + "Mi"
+}
+
+// Format a thread count as a kubernetes cpu quantity string.
+func kubernetesCpu(threads float64) string {
+	return strconv.FormatInt(int64(math.Ceil(threads*1000)), 10) + "m"
+}
+
+type kubernetesObjectMeta struct {
+	Name         string            `json:"name,omitempty"`
+	GenerateName string            `json:"generateName,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+type kubernetesEnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type kubernetesResources struct {
+	Requests map[string]string `json:"requests,omitempty"`
+	Limits   map[string]string `json:"limits,omitempty"`
+}
+
+type kubernetesContainer struct {
+	Name         string              `json:"name"`
+	Image        string              `json:"image"`
+	Command      []string            `json:"command"`
+	WorkingDir   string              `json:"workingDir,omitempty"`
+	Env          []kubernetesEnvVar  `json:"env,omitempty"`
+	Resources    kubernetesResources `json:"resources"`
+	VolumeMounts json.RawMessage     `json:"volumeMounts,omitempty"`
+}
+
+type kubernetesPodSpec struct {
+	RestartPolicy      string                `json:"restartPolicy"`
+	ServiceAccountName string                `json:"serviceAccountName,omitempty"`
+	NodeSelector       map[string]string     `json:"nodeSelector,omitempty"`
+	Containers         []kubernetesContainer `json:"containers"`
+	Volumes            json.RawMessage       `json:"volumes,omitempty"`
+}
+
+type kubernetesPodTemplate struct {
+	Metadata kubernetesObjectMeta `json:"metadata"`
+	Spec     kubernetesPodSpec    `json:"spec"`
+}
+
+type kubernetesJobSpec struct {
+	BackoffLimit            int                   `json:"backoffLimit"`
+	TtlSecondsAfterFinished *int                  `json:"ttlSecondsAfterFinished,omitempty"`
+	Template                kubernetesPodTemplate `json:"template"`
+}
+
+type kubernetesJobStatus struct {
+	Active    int `json:"active,omitempty"`
+	Succeeded int `json:"succeeded,omitempty"`
+	Failed    int `json:"failed,omitempty"`
+}
+
+type kubernetesJob struct {
+	ApiVersion string               `json:"apiVersion,omitempty"`
+	Kind       string               `json:"kind,omitempty"`
+	Metadata   kubernetesObjectMeta `json:"metadata"`
+	Spec       *kubernetesJobSpec   `json:"spec,omitempty"`
+	Status     *kubernetesJobStatus `json:"status,omitempty"`
+}
+
+type kubernetesJobList struct {
+	Items []kubernetesJob `json:"items"`
+}
+
+// The shell script used to redirect the job's output to the metadata
+// stdout and stderr files.
+const kubernetesRedirect = `out="$1"; err="$2"; shift 2; exec "$@" >>"$out" 2>>"$err"`
+
+func (self *KubernetesJobManager) jobSpec(
+	shellCmd string, argv []string, envs map[string]string,
+	metadata *Metadata,
+	resRequest *JobResources,
+	fqname, shellName string) *kubernetesJob {
+	res := self.GetSystemReqs(resRequest)
+	threads := int(math.Ceil(res.Threads))
+	envs = threadEnvs(self, threads, envs)
+	env := make([]kubernetesEnvVar, 0, len(envs))
+	for _, kv := range util.FormatEnv(envs) {
+		if i := strings.IndexRune(kv, '='); i > 0 {
+			env = append(env, kubernetesEnvVar{Name: kv[:i], Value: kv[i+1:]})
+		}
+	}
+	requests := map[string]string{
+		"cpu":    kubernetesCpu(res.Threads),
+		"memory": kubernetesMemory(res.MemGB),
+	}
+	limits := map[string]string{
+		"memory": kubernetesMemory(res.VMemGB),
+	}
+	if res.Special != "" {
+		if extra, ok := self.config.Special[res.Special]; ok {
+			for k, v := range extra {
+				requests[k] = v
+				limits[k] = v
+			}
+		} else {
+			util.LogInfo("jobmngr",
+				"No kubernetes resources defined for special %q",
+				res.Special)
+		}
+	}
+	command := make([]string, 0, len(argv)+6)
+	command = append(command, "/bin/sh", "-c", kubernetesRedirect, "sh",
+		metadata.MetadataFilePath(StdOut),
+		metadata.MetadataFilePath(StdErr),
+		shellCmd)
+	command = append(command, argv...)
+	var ttl *int
+	if self.config.TtlSeconds > 0 {
+		t := self.config.TtlSeconds
+		ttl = &t
+	}
+	labels := map[string]string{
+		kubernetesManagedByLabel: "martian",
+	}
+	return &kubernetesJob{
+		ApiVersion: "batch/v1",
+		Kind:       "Job",
+		Metadata: kubernetesObjectMeta{
+			GenerateName: kubernetesName(fqname, shellName),
+			Labels:       labels,
+			Annotations: map[string]string{
+				kubernetesFqnameAnnotation: fqname + "." + shellName,
+			},
+		},
+		Spec: &kubernetesJobSpec{
+			TtlSecondsAfterFinished: ttl,
+			Template: kubernetesPodTemplate{
+				Metadata: kubernetesObjectMeta{
+					Labels: labels,
+				},
+				Spec: kubernetesPodSpec{
+					RestartPolicy:      "Never",
+					ServiceAccountName: self.config.ServiceAccount,
+					NodeSelector:       self.config.NodeSelector,
+					Volumes:            self.config.Volumes,
+					Containers: []kubernetesContainer{{
+						Name:         "stage",
+						Image:        self.config.Image,
+						Command:      command,
+						WorkingDir:   metadata.curFilesPath,
+						Env:          env,
+						VolumeMounts: self.config.VolumeMounts,
+						Resources: kubernetesResources{
+							Requests: requests,
+							Limits:   limits,
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+func (self *KubernetesJobManager) newRequest(ctx context.Context,
+	method, u string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return req, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if self.token != "" {
+		req.Header.Set("Authorization", "Bearer "+self.token)
+	}
+	return req, nil
+}
+
+// Send a request and decode the response into result.
+func (self *KubernetesJobManager) do(req *http.Request, result interface{}) error {
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s\n%s",
+			req.Method, req.URL.Path, resp.Status, b)
+	}
+	return json.Unmarshal(b, result)
+}
+
+func (self *KubernetesJobManager) sendJob(shellCmd string, argv []string, envs map[string]string,
+	metadata *Metadata, resRequest *JobResources, fqname string, shellName string,
+	ctx context.Context) {
+	spec := self.jobSpec(shellCmd, argv, envs, metadata,
+		resRequest, fqname, shellName)
+	body, err := json.MarshalIndent(spec, "", "    ")
+	if err != nil {
+		metadata.WriteErrorString("Error serializing job spec: " + err.Error())
+		return
+	}
+	metadata.WriteRawBytes("jobscript", body)
+
+	// Only allow one pending submission at a time, as for RemoteJobManager.
+	self.queueMutex.Lock()
+	defer self.queueMutex.Unlock()
+	if self.limiter != nil {
+		<-(self.limiter.C)
+		if self.debug {
+			util.LogInfo("jobmngr", "Job rate-limit released: %s", fqname)
+		}
+	}
+
+	util.EnterCriticalSection()
+	defer util.ExitCriticalSection()
+	if err := metadata.remove("queued_locally"); err != nil {
+		util.LogError(err, "jobmngr", "Error removing queue sentinel file.")
+	}
+	req, err := self.newRequest(ctx, http.MethodPost, self.jobsUrl, body)
+	if err != nil {
+		metadata.WriteErrorString("jobcmd error (" + err.Error() + ")")
+		return
+	}
+	var created kubernetesJob
+	if err := self.do(req, &created); err != nil {
+		metadata.WriteErrorString("jobcmd error (" + err.Error() + ")")
+	} else if created.Metadata.Name != "" {
+		metadata.WriteRaw("jobid", created.Metadata.Name)
+		metadata.cache("jobid", metadata.uniquifier)
+	}
+}
+
+// Returns the subset of ids which are still pending or running according
+// to the API server.
+func (self *KubernetesJobManager) checkQueue(ids []string, ctx context.Context) ([]string, string) {
+	req, err := self.newRequest(ctx, http.MethodGet,
+		self.jobsUrl+"?labelSelector="+
+			url.QueryEscape(kubernetesManagedByLabel+"=martian"), nil)
+	if err != nil {
+		return ids, err.Error()
+	}
+	var list kubernetesJobList
+	if err := self.do(req, &list); err != nil {
+		return ids, err.Error()
+	}
+	alive := make(map[string]struct{}, len(list.Items))
+	for _, job := range list.Items {
+		if job.Status == nil ||
+			(job.Status.Succeeded == 0 && job.Status.Failed == 0) {
+			alive[job.Metadata.Name] = struct{}{}
+		}
+	}
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := alive[id]; ok {
+			result = append(result, id)
+		}
+	}
+	return result, ""
+}
+
+func (self *KubernetesJobManager) hasQueueCheck() bool {
+	return true
+}
+
+func (self *KubernetesJobManager) queueCheckGrace() time.Duration {
+	return self.queueGrace
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// A minimal stand-in for the kubernetes batch/v1 jobs API.
+type fakeJobsApi struct {
+	lock   sync.Mutex
+	jobs   map[string]*kubernetesJob
+	nextId int
+}
+
+func (api *fakeJobsApi) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/apis/batch/v1/namespaces/testns/jobs" {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer sekrit" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	switch req.Method {
+	case http.MethodPost:
+		var job kubernetesJob
+		if err := json.NewDecoder(req.Body).Decode(&job); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		api.nextId++
+		job.Metadata.Name = job.Metadata.GenerateName + strconv.Itoa(api.nextId)
+		job.Status = &kubernetesJobStatus{}
+		api.jobs[job.Metadata.Name] = &job
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&job)
+	case http.MethodGet:
+		if req.URL.Query().Get("labelSelector") != kubernetesManagedByLabel+"=martian" {
+			http.Error(w, "bad selector", http.StatusBadRequest)
+			return
+		}
+		var list kubernetesJobList
+		for _, job := range api.jobs {
+			list.Items = append(list.Items, *job)
+		}
+		json.NewEncoder(w).Encode(&list)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestKubernetesName(t *testing.T) {
+	check := func(t *testing.T, fqname, shell, expect string) {
+		t.Helper()
+		if n := kubernetesName(fqname, shell); n != expect {
+			t.Errorf("expected %q, got %q", expect, n)
+		} else if len(n) > 53 {
+			t.Errorf("name %q too long", n)
+		}
+	}
+	check(t, "ID.my_ps.PIPE.STAGE.fork0", "main",
+		"id-my-ps-pipe-stage-fork0-main-")
+	check(t,
+		"ID.pipestance.SOME_VERY_LONG_PIPELINE_NAME.ANOTHER_STAGE_NAME.fork0.chnk0",
+		"main",
+		"ng-pipeline-name-another-stage-name-fork0-chnk0-main-")
+}
+
+func TestKubernetesJobManager(t *testing.T) {
+	api := &fakeJobsApi{jobs: make(map[string]*kubernetesJob)}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "testKubernetesJobManager")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := dir + "/token"
+	if err := ioutil.WriteFile(tokenFile, []byte("sekrit\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	jm, err := newKubernetesJobManager(&KubernetesJobModeJson{
+		ApiServer: server.URL,
+		Namespace: "testns",
+		Image:     "example/martian:latest",
+		TokenFile: tokenFile,
+		Special: map[string]map[string]string{
+			"gpu": {"nvidia.com/gpu": "1"},
+		},
+	}, &JobManagerSettings{
+		ThreadsPerJob: 1,
+		MemGBPerJob:   2,
+		ThreadEnvs:    []string{"OMP_NUM_THREADS"},
+	}, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := NewMetadata("ID.ps.STAGE.fork0.chnk0", dir)
+	if err := md.mkdirs(); err != nil {
+		t.Fatal(err)
+	}
+	jm.execJob("/bin/mrjob", []string{"stage.py", "main"}, nil, md,
+		&JobResources{Threads: 2.5, MemGB: 3, Special: "gpu"},
+		JobPriority{}, md.fqname, "main", false)
+	if !md.exists(JobId) {
+		t.Fatal("jobid was not written")
+	}
+	id := md.readRaw(JobId)
+	job := api.jobs[id]
+	if job == nil {
+		t.Fatalf("job %q not created", id)
+	}
+	c := job.Spec.Template.Spec.Containers[0]
+	if c.Image != "example/martian:latest" {
+		t.Errorf("incorrect image %q", c.Image)
+	}
+	if r := c.Resources.Requests["cpu"]; r != "2500m" {
+		t.Errorf("incorrect cpu request %q", r)
+	}
+	if r := c.Resources.Requests["memory"]; r != "3072Mi" {
+		t.Errorf("incorrect memory request %q", r)
+	}
+	if r := c.Resources.Requests["nvidia.com/gpu"]; r != "1" {
+		t.Errorf("incorrect gpu request %q", r)
+	}
+	if c.WorkingDir != md.curFilesPath {
+		t.Errorf("incorrect working directory %q", c.WorkingDir)
+	}
+	if n := len(c.Command); n != 9 || c.Command[6] != "/bin/mrjob" ||
+		c.Command[8] != "main" {
+		t.Errorf("incorrect command %q", c.Command)
+	}
+	if len(c.Env) != 1 || c.Env[0].Name != "OMP_NUM_THREADS" ||
+		c.Env[0].Value != "3" {
+		t.Errorf("incorrect environment %v", c.Env)
+	}
+
+	ids := []string{id, "not-a-job"}
+	if alive, _ := jm.checkQueue(ids, context.Background()); len(alive) != 1 ||
+		alive[0] != id {
+		t.Errorf("expected only %s to be alive, got %v", id, alive)
+	}
+	api.lock.Lock()
+	job.Status.Failed = 1
+	api.lock.Unlock()
+	if alive, _ := jm.checkQueue(ids, context.Background()); len(alive) != 0 {
+		t.Errorf("expected no jobs alive, got %v", alive)
+	}
+
+	// If the query fails, all jobs are assumed to be alive.
+	server.Close()
+	if alive, _ := jm.checkQueue(ids, context.Background()); len(alive) != 2 {
+		t.Errorf("expected all jobs alive after failure, got %v", alive)
+	}
+}
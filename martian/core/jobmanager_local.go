@@ -58,6 +58,7 @@ type LocalJobManager struct {
 	limitLoad   bool
 	highMem     ObservedMemory
 	jobDone     chan struct{}
+	schedule    SchedulePolicy
 }
 
 func NewLocalJobManager(userMaxCores int,
@@ -247,6 +248,34 @@ func (self *LocalJobManager) setupSemaphores() {
 	}
 }
 
+// SetSchedulePolicy sets the order in which jobs waiting for resources are
+// started.
+func (self *LocalJobManager) SetSchedulePolicy(policy SchedulePolicy) {
+	VerifySchedulePolicy(policy)
+	self.schedule = policy
+	if policy == ScheduleBackfill {
+		// Jobs no larger than the default job size may start ahead of a
+		// larger job which is waiting for resources, but only as many of
+		// them as there are cores, so that the larger job cannot starve.
+		limit := self.maxCores
+		if limit < 1 {
+			limit = 1
+		}
+		threads := int64(self.jobSettings.ThreadsPerJob)
+		memMb := int64(self.jobSettings.MemGBPerJob) * 1024
+		self.centcoreSem.SetBackfill(threads*100, limit)
+		self.memMBSem.SetBackfill(memMb, limit)
+		if self.vmemMBSem != nil {
+			self.vmemMBSem.SetBackfill(
+				memMb+int64(self.jobSettings.ExtraVmemGB)*1024, limit)
+		}
+		if self.procsSem != nil {
+			self.procsSem.SetBackfill(procsPerJob+threads, limit)
+		}
+	}
+	util.LogInfo("jobmngr", "Using %s schedule policy for local jobs.", policy)
+}
+
 func (self *LocalJobManager) GetSettings() *JobManagerSettings {
 	return self.jobSettings
 }
@@ -461,6 +490,17 @@ func (self *LocalJobManager) queueCheckGrace() time.Duration {
 func (self *LocalJobManager) Enqueue(shellCmd string, argv []string,
 	envs map[string]string, metadata *Metadata, resRequest *JobResources,
 	fqname string, retries int, waitTime int, localpreflight bool) {
+	self.enqueue(shellCmd, argv, envs, metadata, resRequest, JobPriority{},
+		fqname, retries, waitTime, localpreflight)
+}
+
+func (self *LocalJobManager) enqueue(shellCmd string, argv []string,
+	envs map[string]string, metadata *Metadata, resRequest *JobResources,
+	priority JobPriority,
+	fqname string, retries int, waitTime int, localpreflight bool) {
+	if self.schedule == "" || self.schedule == ScheduleFifo {
+		priority = JobPriority{}
+	}
 
 	enc := func() {
 		r := trace.StartRegion(context.Background(), "queueLocal")
@@ -494,7 +534,7 @@ func (self *LocalJobManager) Enqueue(shellCmd string, argv []string,
 				util.PluralizeFloat(res.Threads))
 		}
 		centiCores := int64(math.Ceil(res.Threads * 100))
-		if err := self.centcoreSem.Acquire(centiCores); err != nil {
+		if err := self.centcoreSem.AcquirePriority(centiCores, priority); err != nil {
 			util.LogError(err, "jobmngr",
 				"%s requested %g threads, but the job manager was only configured to use %d.",
 				metadata.fqname, res.Threads, self.maxCores)
@@ -531,7 +571,7 @@ func (self *LocalJobManager) Enqueue(shellCmd string, argv []string,
 				res.MemGB)
 		}
 		memMb := int64(math.Ceil(res.MemGB * 1024))
-		if err := self.memMBSem.Acquire(memMb); err != nil {
+		if err := self.memMBSem.AcquirePriority(memMb, priority); err != nil {
 			util.LogError(err, "jobmngr",
 				"%s requested %g GB of memory, but the job manager was only configured to use %d.",
 				metadata.fqname, res.MemGB, self.maxMemGB)
@@ -558,7 +598,7 @@ func (self *LocalJobManager) Enqueue(shellCmd string, argv []string,
 		if sem := self.vmemMBSem; sem != nil {
 			// Acquire vmem
 			vmem := int64(res.VMemGB) * 1024
-			if err := sem.Acquire(vmem); err != nil {
+			if err := sem.AcquirePriority(vmem, priority); err != nil {
 				util.LogError(err, "jobmngr",
 					"%s requested %d GB of virtual memory, but the "+
 						"job manager was only configured to use %.1f.",
@@ -595,7 +635,7 @@ func (self *LocalJobManager) Enqueue(shellCmd string, argv []string,
 			if self.debug {
 				util.LogInfo("jobmngr", "Waiting for %d processes", procEstimate)
 			}
-			if err := self.procsSem.Acquire(procEstimate); err != nil {
+			if err := self.procsSem.AcquirePriority(procEstimate, priority); err != nil {
 				util.LogError(err, "jobmngr",
 					"%s estimated to require %d processes, but the process ulimit is %d.",
 					metadata.fqname, procEstimate, self.procsSem.CurrentSize())
@@ -643,8 +683,8 @@ func (self *LocalJobManager) Enqueue(shellCmd string, argv []string,
 				util.LogInfo("jobmngr",
 					"Job failed: %s. Retrying job %s in %d seconds",
 					err.Error(), fqname, waitTime)
-				self.Enqueue(shellCmd, argv, envs, metadata, resRequest,
-					fqname, retries,
+				self.enqueue(shellCmd, argv, envs, metadata, resRequest,
+					priority, fqname, retries,
 					waitTime, localpreflight)
 			}
 		} else {
@@ -728,8 +768,9 @@ func (self *LocalJobManager) GetMaxVMemGB() int {
 
 func (self *LocalJobManager) execJob(shellCmd string, argv []string,
 	envs map[string]string, metadata *Metadata, resRequest *JobResources,
-	fqname string, shellName string, preflight bool) {
-	self.Enqueue(shellCmd, argv, envs, metadata, resRequest, fqname, 0, 0, preflight)
+	priority JobPriority, fqname string, shellName string, preflight bool) {
+	self.enqueue(shellCmd, argv, envs, metadata, resRequest, priority,
+		fqname, 0, 0, preflight)
 }
 
 func (self *LocalJobManager) endJob(*Metadata) {}
@@ -129,7 +129,7 @@ func (self *RemoteJobManager) GetSystemReqs(resRequest *JobResources) JobResourc
 
 func (self *RemoteJobManager) execJob(shellCmd string, argv []string,
 	envs map[string]string, metadata *Metadata, resRequest *JobResources,
-	fqname string, shellName string, localpreflight bool) {
+	_ JobPriority, fqname string, shellName string, localpreflight bool) {
 	ctx, task := trace.NewTask(context.Background(), "queueRemote")
 
 	// no limit, send the job
@@ -0,0 +1,62 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Notification of new journal entries.
+
+import (
+	"fmt"
+)
+
+// A JournalWatcher reports when jobs write journal entries, so that the
+// runtime can process them immediately rather than waiting to poll the
+// journal directory.
+type JournalWatcher interface {
+	// Returns a channel which receives a value when new journal entries may
+	// be available.  The channel is closed if the watcher stops working, for
+	// example because the journal directory was removed.
+	Updates() <-chan struct{}
+
+	// Stop watching the journal.
+	Close() error
+}
+
+// Filesystems which do not reliably deliver change notifications for files
+// written by other hosts.
+var networkFsTypes = map[string]bool{
+	"afs":    true,
+	"ceph":   true,
+	"cifs":   true,
+	"coda":   true,
+	"fhgfs":  true,
+	"fuse":   true,
+	"gfs":    true,
+	"gpfs":   true,
+	"lustre": true,
+	"ncp":    true,
+	"nfs":    true,
+	"ocfs2":  true,
+	"panfs":  true,
+	"smb":    true,
+	"v9fs":   true,
+}
+
+// WatchJournal starts watching the journal directory for new entries.
+//
+// Returns an error if watching is not supported on this platform, or if jobs
+// may run on other hosts and the journal directory is on a network
+// filesystem, which would not notify us of their updates.  In either case,
+// the caller must fall back to polling.
+func (self *Pipestance) WatchJournal() (JournalWatcher, error) {
+	journal := self.node.top.journalPath
+	if rt := self.node.top.rt; rt != nil && rt.JobManager != rt.LocalJobManager {
+		if _, _, fstype, err := GetAvailableSpace(journal); err != nil {
+			return nil, err
+		} else if networkFsTypes[fstype] {
+			return nil, fmt.Errorf(
+				"%s filesystem does not deliver notifications for remote jobs",
+				fstype)
+		}
+	}
+	return newJournalWatcher(journal)
+}
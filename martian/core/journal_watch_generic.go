@@ -0,0 +1,13 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+// +build !linux
+
+// Stub for non-linux OS.
+
+package core
+
+import "errors"
+
+func newJournalWatcher(string) (JournalWatcher, error) {
+	return nil, errors.New("not supported")
+}
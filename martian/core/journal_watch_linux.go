@@ -0,0 +1,102 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+// Watch the journal directory using inotify.
+
+package core
+
+import (
+	"bytes"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+type inotifyJournalWatcher struct {
+	f       *os.File
+	updates chan struct{}
+}
+
+func newJournalWatcher(journal string) (JournalWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// Jobs write journal entries either by writing the file directly or by
+	// renaming it into place.  Removals are ignored, since those are done by
+	// the runtime itself.
+	if _, err := unix.InotifyAddWatch(fd, journal,
+		unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_ONLYDIR); err != nil {
+		unix.Close(fd)
+		return nil, &os.PathError{
+			Op:   "inotify_add_watch",
+			Path: journal,
+			Err:  err,
+		}
+	}
+	// Because the file descriptor is non-blocking, os.File will use the
+	// runtime poller, so that Close will interrupt a pending Read.
+	self := &inotifyJournalWatcher{
+		f:       os.NewFile(uintptr(fd), journal),
+		updates: make(chan struct{}, 1),
+	}
+	go self.run()
+	return self, nil
+}
+
+func (self *inotifyJournalWatcher) Updates() <-chan struct{} {
+	return self.updates
+}
+
+func (self *inotifyJournalWatcher) Close() error {
+	return self.f.Close()
+}
+
+func (self *inotifyJournalWatcher) run() {
+	defer close(self.updates)
+	var buf [4096]byte
+	for {
+		n, err := self.f.Read(buf[:])
+		if err != nil {
+			return
+		}
+		notify, ok := parseJournalEvents(buf[:n])
+		if notify {
+			select {
+			case self.updates <- struct{}{}:
+			default:
+				// An update is already pending.
+			}
+		}
+		if !ok {
+			self.f.Close()
+			return
+		}
+	}
+}
+
+// Returns true if the buffer contained any new journal entries, and false
+// for ok if the watch was removed.
+func parseJournalEvents(buf []byte) (notify, ok bool) {
+	ok = true
+	for len(buf) >= unix.SizeofInotifyEvent {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		end := unix.SizeofInotifyEvent + int(event.Len)
+		if end > len(buf) {
+			break
+		}
+		name := buf[unix.SizeofInotifyEvent:end]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		if event.Mask&unix.IN_IGNORED != 0 {
+			ok = false
+		} else if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+			notify = true
+		} else if len(name) > 0 && !bytes.HasSuffix(name, []byte(".tmp")) {
+			notify = true
+		}
+		buf = buf[end:]
+	}
+	return notify, ok
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestJournalWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestJournalWatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal := path.Join(dir, "journal")
+	if err := os.Mkdir(journal, 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := newJournalWatcher(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	expectUpdate := func(what string) bool {
+		t.Helper()
+		select {
+		case _, ok := <-w.Updates():
+			return ok
+		case <-time.After(5 * time.Second):
+			t.Errorf("No update after %s.", what)
+			return true
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(journal, "ID.ps.STAGE.fork0.u1.complete"),
+		nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !expectUpdate("write") {
+		t.Error("Watcher stopped unexpectedly.")
+	}
+	tmp := path.Join(journal, "ID.ps.STAGE.fork0.u1.outs.tmp")
+	if err := ioutil.WriteFile(tmp, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, tmp[:len(tmp)-len(".tmp")]); err != nil {
+		t.Fatal(err)
+	}
+	if !expectUpdate("rename") {
+		t.Error("Watcher stopped unexpectedly.")
+	}
+	if err := os.RemoveAll(journal); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if !expectUpdate("removal") {
+			return
+		}
+	}
+	t.Error("Expected watcher to stop after the journal was removed.")
+}
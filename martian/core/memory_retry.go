@@ -0,0 +1,180 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Escalation of memory reservations for jobs which failed because they ran
+// out of memory.
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// Policy for escalating the memory reservation of jobs which failed because
+// they ran out of memory, configured by the memory_retry section of
+// retry.json.
+type MemoryRetryPolicy struct {
+	// The multiplier applied to a job's mem_gb and vmem_gb each time it
+	// fails due to running out of memory.
+	Factor float64 `json:"factor"`
+
+	// The maximum escalated mem_gb.  Requests which were already larger
+	// than this are not reduced.  Zero means no limit.
+	MaxMemGB float64 `json:"max_mem_gb,omitempty"`
+
+	// The maximum escalated vmem_gb.  Requests which were already larger
+	// than this are not reduced.  Zero means no limit.
+	MaxVMemGB float64 `json:"max_vmem_gb,omitempty"`
+
+	// Regular expressions which, when matched against a line of a job's
+	// errors file, indicate that the job ran out of memory.
+	RetryOn []string `json:"retry_on"`
+
+	regexps []*regexp.Regexp
+}
+
+// Compile the policy's regular expressions.  Returns nil if the policy
+// would never escalate anything.
+func (self *MemoryRetryPolicy) compile() *MemoryRetryPolicy {
+	if self == nil || self.Factor <= 1 || len(self.RetryOn) == 0 {
+		return nil
+	}
+	self.regexps = make([]*regexp.Regexp, len(self.RetryOn))
+	for i, exp := range self.RetryOn {
+		self.regexps[i] = regexp.MustCompile(exp)
+	}
+	return self
+}
+
+// Returns the first line of the error log which indicates that the job ran
+// out of memory, or the empty string if there is none.
+func (self *MemoryRetryPolicy) match(errlog string) string {
+	if self == nil {
+		return ""
+	}
+	for _, line := range strings.Split(errlog, "\n") {
+		for _, re := range self.regexps {
+			if re.MatchString(line) {
+				return line
+			}
+		}
+	}
+	return ""
+}
+
+func scaleCapped(value, factor, max float64) float64 {
+	if value <= 0 {
+		return value
+	}
+	scaled := value * factor
+	if max > 0 && scaled > max {
+		if value > max {
+			return value
+		}
+		return max
+	}
+	return scaled
+}
+
+// Scale the memory and address space reservations by the given factor,
+// subject to the policy's limits.
+func (self *MemoryRetryPolicy) scale(res *JobResources, factor float64) {
+	res.MemGB = scaleCapped(res.MemGB, factor, self.MaxMemGB)
+	res.VMemGB = scaleCapped(res.VMemGB, factor, self.MaxVMemGB)
+}
+
+// A record of the memory escalations applied to a job.
+type MemoryEscalation struct {
+	// The cumulative multiplier applied to the job's memory reservation.
+	Factor float64 `json:"factor"`
+
+	// The number of times the job's reservation was escalated.
+	Count int `json:"count"`
+
+	// The error line which triggered the most recent escalation.
+	Reason string `json:"reason"`
+
+	// The time of the most recent escalation.
+	Timestamp string `json:"timestamp"`
+}
+
+// Get the key for the given job metadata in the fork's escalation record,
+// e.g. "split", "join", or "chnk0".
+func (self *Fork) jobKey(metadata *Metadata) string {
+	return strings.TrimPrefix(metadata.fqname, self.fqname+".")
+}
+
+func (self *Fork) getMemoryEscalations() map[string]*MemoryEscalation {
+	var escalations map[string]*MemoryEscalation
+	if err := self.metadata.ReadInto(MemEscalation, &escalations); err != nil {
+		return nil
+	}
+	return escalations
+}
+
+// Record memory escalations for any failed jobs in this fork which ran out
+// of memory.  This must be called before the failed job metadata is reset.
+// Returns all of the escalations recorded for the fork, so that they can be
+// restored if the fork directory is removed.
+func (self *Fork) escalateMemory() map[string]*MemoryEscalation {
+	policy := self.node.top.rt.memoryRetry
+	if policy == nil {
+		return nil
+	}
+	escalations := self.getMemoryEscalations()
+	changed := false
+	for _, metadata := range self.collectMetadatas()[1:] {
+		if state, _ := metadata.getState(); state != Failed || !metadata.exists(Errors) {
+			continue
+		}
+		reason := policy.match(metadata.readRaw(Errors))
+		if reason == "" {
+			continue
+		}
+		if escalations == nil {
+			escalations = make(map[string]*MemoryEscalation)
+		}
+		key := self.jobKey(metadata)
+		esc := escalations[key]
+		if esc == nil {
+			esc = &MemoryEscalation{Factor: 1}
+			escalations[key] = esc
+		}
+		esc.Factor *= policy.Factor
+		esc.Count++
+		esc.Reason = reason
+		esc.Timestamp = util.Timestamp()
+		changed = true
+		util.PrintInfo("runtime", "(mem-escalate)    %s by %gx",
+			metadata.fqname, esc.Factor)
+	}
+	if changed {
+		self.metadata.Write(MemEscalation, escalations)
+	}
+	return escalations
+}
+
+// Get the memory multiplier for the given job in this fork.
+func (self *Fork) memoryScale(metadata *Metadata) float64 {
+	if self.node.top.rt.memoryRetry == nil {
+		return 1
+	}
+	if esc := self.getMemoryEscalations()[self.jobKey(metadata)]; esc != nil &&
+		esc.Factor > 1 {
+		return esc.Factor
+	}
+	return 1
+}
+
+// Scale the memory reservations of the given job resources, and then
+// re-apply the job manager's limits.
+func (self *Node) escalateJobReqs(res JobResources, factor float64) JobResources {
+	self.top.rt.memoryRetry.scale(&res, factor)
+	if self.local {
+		return self.top.rt.LocalJobManager.GetSystemReqs(&res)
+	} else {
+		return self.top.rt.JobManager.GetSystemReqs(&res)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"testing"
+)
+
+func TestMemoryRetryPolicyCompile(t *testing.T) {
+	var nilPolicy *MemoryRetryPolicy
+	if p := nilPolicy.compile(); p != nil {
+		t.Error("Expected nil policy.")
+	}
+	if p := (&MemoryRetryPolicy{
+		Factor:  1,
+		RetryOn: []string{"memory"},
+	}).compile(); p != nil {
+		t.Error("Expected nil policy for factor 1.")
+	}
+	if p := (&MemoryRetryPolicy{Factor: 2}).compile(); p != nil {
+		t.Error("Expected nil policy with no patterns.")
+	}
+}
+
+func TestMemoryRetryPolicyMatch(t *testing.T) {
+	policy := (&MemoryRetryPolicy{
+		Factor: 2,
+		RetryOn: []string{
+			"Stage exceeded its (?:memory|address space) quota",
+			"killed by the out-of-memory killer",
+		},
+	}).compile()
+	if m := policy.match(
+		"foo\nstage code was killed by the out-of-memory killer\n"); m !=
+		"stage code was killed by the out-of-memory killer" {
+		t.Errorf("Expected OOM kill match, got %q", m)
+	}
+	if m := policy.match("signal: killed"); m != "" {
+		t.Errorf("Expected other kills not to match, got %q", m)
+	}
+	if m := policy.match(
+		"Stage exceeded its memory quota (using 5.2, allowed 4G)"); m == "" {
+		t.Error("Expected monitor kill to match.")
+	}
+	if m := policy.match("signal: terminated"); m != "" {
+		t.Errorf("Expected no match, got %q", m)
+	}
+	var nilPolicy *MemoryRetryPolicy
+	if m := nilPolicy.match("Stage exceeded its memory quota"); m != "" {
+		t.Errorf("Expected no match, got %q", m)
+	}
+}
+
+func TestMemoryRetryPolicyScale(t *testing.T) {
+	policy := MemoryRetryPolicy{
+		Factor:    2,
+		MaxMemGB:  10,
+		MaxVMemGB: 20,
+	}
+	check := func(t *testing.T, res, expect JobResources) {
+		t.Helper()
+		policy.scale(&res, 2)
+		if res != expect {
+			t.Errorf("Expected %v, got %v", expect, res)
+		}
+	}
+	check(t,
+		JobResources{Threads: 1, MemGB: 4, VMemGB: 6},
+		JobResources{Threads: 1, MemGB: 8, VMemGB: 12})
+	check(t,
+		JobResources{MemGB: 6, VMemGB: 12},
+		JobResources{MemGB: 10, VMemGB: 20})
+	check(t,
+		JobResources{MemGB: 16, VMemGB: 32},
+		JobResources{MemGB: 16, VMemGB: 32})
+}
+
+func TestEscalateMemory(t *testing.T) {
+	invokeTestWith(`
+stage SUM_SQUARES(
+    in  float[] values,
+    out float   sum,
+    src comp    "stages/sum_squares",
+)
+
+call SUM_SQUARES(
+    values = [1.0, 2.0, 3.0],
+)
+`, t, func(t *testing.T, ps *Pipestance) {
+		rt := ps.node.top.rt
+		rt.memoryRetry = (&MemoryRetryPolicy{
+			Factor:  2,
+			RetryOn: []string{"killed by the out-of-memory killer"},
+		}).compile()
+		node := ps.findNode("SUM_SQUARES")
+		if err := node.mkdirs(); err != nil {
+			t.Fatal(err)
+		}
+		fork := node.forks[0]
+		fail := func(msg string) {
+			t.Helper()
+			fork.join_metadata.WriteRaw(Errors, msg)
+			if state, _ := fork.join_metadata.getState(); state != Failed {
+				t.Fatalf("Expected join to be failed, got %v", state)
+			}
+		}
+		check := func(expect float64) {
+			t.Helper()
+			if s := fork.memoryScale(fork.join_metadata); s != expect {
+				t.Errorf("Expected join memory scale %g, got %g", expect, s)
+			}
+			if s := fork.memoryScale(fork.split_metadata); s != 1 {
+				t.Errorf("Expected split memory scale 1, got %g", s)
+			}
+		}
+		check(1)
+
+		// Other failures do not escalate.
+		fail("signal: killed")
+		if err := node.reset(); err != nil {
+			t.Fatal(err)
+		}
+		check(1)
+
+		fail("stage code was killed by the out-of-memory killer")
+		if err := node.reset(); err != nil {
+			t.Fatal(err)
+		}
+		check(2)
+		if fork.join_metadata.exists(Errors) {
+			t.Error("Expected the failed job to be reset.")
+		}
+
+		// The escalation must survive removal of the stage directory.
+		rt.Config.FullStageReset = true
+		defer func() { rt.Config.FullStageReset = false }()
+		fail("stage code was killed by the out-of-memory killer")
+		if err := node.reset(); err != nil {
+			t.Fatal(err)
+		}
+		check(4)
+		if esc := fork.getMemoryEscalations()["join"]; esc == nil {
+			t.Error("Expected a join escalation record.")
+		} else if esc.Count != 2 {
+			t.Errorf("Expected 2 escalations, got %d", esc.Count)
+		}
+	})
+}
@@ -7,7 +7,7 @@ package core
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -33,6 +33,7 @@ const (
 	ChunkOutsFile  MetadataFileName = "chunk_outs"
 	CompleteFile   MetadataFileName = "complete"
 	Errors         MetadataFileName = "errors"
+	EventsFile     MetadataFileName = "events"
 	FinalState     MetadataFileName = "finalstate"
 	Heartbeat      MetadataFileName = "heartbeat"
 	InvocationFile MetadataFileName = "invocation"
@@ -41,26 +42,37 @@ const (
 	JobModeFile    MetadataFileName = "jobmode"
 	Lock           MetadataFileName = "lock"
 	LogFile        MetadataFileName = "log"
+	MemEscalation  MetadataFileName = "mem_escalation"
 	MetadataZip    MetadataFileName = "metadata.zip"
 	MroSourceFile  MetadataFileName = "mrosource"
 	OutsFile       MetadataFileName = "outs"
+	OutsViolations MetadataFileName = "outs_violations"
 	Perf           MetadataFileName = "perf"
 	PerfData       MetadataFileName = "perf.data"
 	ProfileOut     MetadataFileName = "profile.out"
 	ProgressFile   MetadataFileName = "progress"
 	QueuedLocally  MetadataFileName = "queued_locally"
 	Stackvars      MetadataFileName = "stackvars"
+	StageCacheFile MetadataFileName = "stagecache"
 	StageDefsFile  MetadataFileName = "stage_defs"
 	StdErr         MetadataFileName = "stderr"
 	StdOut         MetadataFileName = "stdout"
 	TagsFile       MetadataFileName = "tags"
 	TimestampFile  MetadataFileName = "timestamp"
+	TraceFile      MetadataFileName = "trace.json"
 	UiPort         MetadataFileName = "uiport"
 	UuidFile       MetadataFileName = "uuid"
 	VdrKill        MetadataFileName = "vdrkill"
 	PartialVdr     MetadataFileName = "vdrkill.partial"
 	VersionsFile   MetadataFileName = "versions"
 	DisabledFile   MetadataFileName = "disabled"
+
+	// The key-value metadata store, if any, at the top of the pipestance.
+	MetadataStoreFile MetadataFileName = "metadata.kv"
+
+	// The absolute path to the pipestance directory when it was last run,
+	// used to detect when the pipestance has been moved.
+	PsdirFile MetadataFileName = "psdir"
 )
 
 const MetadataFilePrefix string = "_"
@@ -128,6 +140,10 @@ func makeUniquifier() string {
 // Manages interatction with the filesystem-based "database" of Martian
 // metadata for a pipeline node (pipeline, subpipeline, fork, stage, split,
 // chunk, join).
+//
+// The content of metadata files is read and written through a MetadataStore,
+// which for metadata that only the runtime uses may be something other than
+// the filesystem.
 type Metadata struct {
 	fqname        string
 	path          string
@@ -141,6 +157,7 @@ type Metadata struct {
 	lastHeartbeat time.Time
 	mutex         sync.Mutex
 	uniquifier    string
+	store         MetadataStore
 
 	// A prefix to attach when writing journal file name.
 	// Empty for chunks, or SplitPrefix or JoinPrefix.
@@ -150,6 +167,10 @@ type Metadata struct {
 	// the chunk will be failed out if the state seems like it's still running
 	// after the job manager's grace period has elapsed.
 	notRunningSince time.Time
+
+	// If non-nil, state transitions are recorded here.
+	events    *EventLog
+	eventKind string
 }
 
 // Basic exportable information from a metadata object.
@@ -170,6 +191,7 @@ func NewMetadata(fqname string, p string) *Metadata {
 		readCache:     make(map[MetadataFileName]LazyArgumentMap),
 		curFilesPath:  path.Join(p, "files"),
 		finalFilePath: path.Join(p, "files"),
+		store:         defaultMetadataStore,
 	}
 }
 
@@ -195,6 +217,12 @@ func (self *Metadata) glob() []string {
 	return paths
 }
 
+// Get the names of the metadata files in the store.
+func (self *Metadata) list() []MetadataFileName {
+	names, _ := self.store.List(self.path)
+	return names
+}
+
 // Gets the locations of the symlinks pointing to uniquified directories.
 func (self *Metadata) symlinks() []string {
 	var symlinks []string
@@ -347,6 +375,10 @@ func (self *Metadata) uniquify() error {
 func (self *Metadata) removeAll() error {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
+	if self.events.active() {
+		before, _ := self._peekStateNoLock()
+		defer self._notifyNoLock("", before)
+	}
 	if len(self.contents) > 0 {
 		self.contents = make(map[MetadataFileName]struct{})
 	}
@@ -358,7 +390,7 @@ func (self *Metadata) removeAll() error {
 	if err := os.RemoveAll(self.curFilesPath); err != nil {
 		return err
 	}
-	if err := os.RemoveAll(self.path); err != nil {
+	if err := self.store.RemoveAll(self.path); err != nil {
 		return err
 	}
 	// Remove final directories iff they're symlinks or empty.  If a
@@ -374,6 +406,15 @@ func (self *Metadata) removeAll() error {
 
 // Must be called within a lock.
 func (self *Metadata) _getStateNoLock() (MetadataState, bool) {
+	state, ok := self._peekStateNoLock()
+	if state == Complete && self._existsNoLock(JobId) {
+		self._removeNoLock(JobId)
+	}
+	return state, ok
+}
+
+// Compute the state without side effects.  Must be called within a lock.
+func (self *Metadata) _peekStateNoLock() (MetadataState, bool) {
 	if self._existsNoLock(Errors) {
 		return Failed, true
 	}
@@ -381,9 +422,6 @@ func (self *Metadata) _getStateNoLock() (MetadataState, bool) {
 		return Failed, true
 	}
 	if self._existsNoLock(CompleteFile) {
-		if self._existsNoLock(JobId) {
-			self._removeNoLock(JobId)
-		}
 		return Complete, true
 	}
 	if self._existsNoLock(DisabledFile) {
@@ -406,6 +444,10 @@ func (self *Metadata) getState() (MetadataState, bool) {
 }
 
 func (self *Metadata) _cacheNoLock(name MetadataFileName) {
+	if self.events.active() {
+		before, _ := self._peekStateNoLock()
+		defer self._notifyNoLock(name, before)
+	}
 	self.contents[name] = struct{}{}
 	// cache is usually called on write or update
 	delete(self.readCache, name)
@@ -425,6 +467,10 @@ func (self *Metadata) cache(name MetadataFileName, uniquifier string) {
 }
 
 func (self *Metadata) _uncacheNoLock(name MetadataFileName) {
+	if self.events.active() {
+		before, _ := self._peekStateNoLock()
+		defer self._notifyNoLock("", before)
+	}
 	delete(self.contents, name)
 	delete(self.readCache, name)
 }
@@ -459,7 +505,7 @@ func (self *Metadata) discoverUniquifier() string {
 
 func (self *Metadata) loadCache() {
 	self.discoverUniquify()
-	paths := self.glob()
+	names := self.list()
 	self.mutex.Lock()
 	if len(self.contents) > 0 {
 		self.contents = make(map[MetadataFileName]struct{})
@@ -467,8 +513,8 @@ func (self *Metadata) loadCache() {
 	if len(self.readCache) > 0 {
 		self.readCache = make(map[MetadataFileName]LazyArgumentMap)
 	}
-	for _, p := range paths {
-		self.contents[metadataFileNameFromPath(p)] = struct{}{}
+	for _, name := range names {
+		self.contents[name] = struct{}{}
 	}
 	self.notRunningSince = time.Time{}
 	self.lastRefresh = time.Time{}
@@ -479,12 +525,16 @@ func (self *Metadata) loadCache() {
 // accordingly.  It does not remove files from the cache, because for
 // example heartbeat files aren't expected to be seen there anyway.
 func (self *Metadata) poll() {
-	paths := self.glob()
+	names := self.list()
 	self.mutex.Lock()
-	for _, p := range paths {
-		self.contents[metadataFileNameFromPath(p)] = struct{}{}
+	defer self.mutex.Unlock()
+	if self.events.active() {
+		before, _ := self._peekStateNoLock()
+		defer self._notifyNoLock("", before)
+	}
+	for _, name := range names {
+		self.contents[name] = struct{}{}
 	}
-	self.mutex.Unlock()
 }
 
 // Get the absolute path to the named file in the stage's files path.
@@ -510,7 +560,7 @@ func (self *Metadata) exists(name MetadataFileName) bool {
 }
 
 func (self *Metadata) readRawBytes(name MetadataFileName) ([]byte, error) {
-	return ioutil.ReadFile(self.MetadataFilePath(name))
+	return self.store.ReadFile(self.path, name)
 }
 
 func (self *Metadata) readRawSafe(name MetadataFileName) (string, error) {
@@ -536,8 +586,9 @@ func (self *Metadata) saveToCache(name MetadataFileName, value LazyArgumentMap)
 	self.mutex.Unlock()
 }
 
-func (self *Metadata) openFile(name MetadataFileName) (*os.File, error) {
-	return os.Open(self.MetadataFilePath(name))
+func (self *Metadata) openFile(name MetadataFileName) (io.ReadCloser, error) {
+	f, _, err := self.store.Open(self.path, name)
+	return f, err
 }
 
 func (self *Metadata) read(name MetadataFileName, limit int64) (LazyArgumentMap, error) {
@@ -546,7 +597,7 @@ func (self *Metadata) read(name MetadataFileName, limit int64) (LazyArgumentMap,
 		return v, nil
 	}
 	p := self.MetadataFilePath(name)
-	if f, err := os.Open(p); err != nil {
+	if f, size, err := self.store.Open(self.path, name); err != nil {
 		if !os.IsNotExist(err) {
 			util.LogError(err, "runtime",
 				"Could not open %s",
@@ -554,17 +605,13 @@ func (self *Metadata) read(name MetadataFileName, limit int64) (LazyArgumentMap,
 		}
 		return nil, err
 	} else {
-		if err := func(p string, f *os.File, limit int64, v *LazyArgumentMap) error {
+		if err := func(p string, f io.ReadCloser, limit int64, v *LazyArgumentMap) error {
 			defer f.Close()
-			if limit > 0 {
-				if info, err := f.Stat(); err != nil {
-					return err
-				} else if info.Size() > limit {
-					return fmt.Errorf(
-						"Insufficient memory to read %s\n"+
-							"File is %d bytes, read size limited to %d bytes.",
-						p, info.Size(), limit)
-				}
+			if limit > 0 && size > limit {
+				return fmt.Errorf(
+					"Insufficient memory to read %s\n"+
+						"File is %d bytes, read size limited to %d bytes.",
+					p, size, limit)
 			}
 			dec := json.NewDecoder(f)
 			return dec.Decode(v)
@@ -588,7 +635,7 @@ func (self *Metadata) ReadInto(name MetadataFileName, target interface{}) error
 }
 
 func (self *Metadata) _writeRawNoLock(name MetadataFileName, text string) error {
-	err := ioutil.WriteFile(self.MetadataFilePath(name), []byte(text), 0644)
+	err := self.store.WriteFile(self.path, name, []byte(text))
 	self._cacheNoLock(name)
 	if err != nil {
 		msg := fmt.Sprintf("Could not write %s for %s: %s", name, self.fqname, err.Error())
@@ -606,7 +653,7 @@ func (self *Metadata) WriteRaw(name MetadataFileName, text string) error {
 
 // Writes the given raw data into the given metadata file.
 func (self *Metadata) WriteRawBytes(name MetadataFileName, text []byte) error {
-	err := ioutil.WriteFile(self.MetadataFilePath(name), text, 0644)
+	err := self.store.WriteFile(self.path, name, text)
 	self.cache(name, self.uniquifier)
 	if err != nil {
 		msg := fmt.Sprintf("Could not write %s for %s: %s", name, self.fqname, err.Error())
@@ -626,15 +673,7 @@ func (self *Metadata) WriteErrorString(msg string) {
 
 func (self *Metadata) appendRaw(name MetadataFileName, text string) error {
 	self.cache(name, self.uniquifier)
-	if f, err := os.OpenFile(self.MetadataFilePath(name),
-		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
-		return err
-	} else if _, err := f.Write([]byte(text)); err != nil {
-		f.Close()
-		return err
-	} else {
-		return f.Close()
-	}
+	return self.store.Append(self.path, name, []byte(text))
 }
 
 // Add text to the Alarm file for this node.
@@ -673,16 +712,7 @@ func (self *Metadata) WriteAtomic(name MetadataFileName, object interface{}) err
 	if err != nil {
 		return err
 	}
-	fname := self.MetadataFilePath(name)
-	tmpName := fname + ".tmp"
-	if err := ioutil.WriteFile(tmpName, bytes, 0644); err != nil {
-		return err
-	}
-	if err := os.Rename(tmpName, fname); err == nil || os.IsNotExist(err) {
-		return nil
-	} else {
-		return err
-	}
+	return self.store.WriteAtomic(self.path, name, bytes)
 }
 
 // Writes a journal file corresponding to the given metadata file.  This is
@@ -694,35 +724,18 @@ func (self *Metadata) WriteAtomic(name MetadataFileName, object interface{}) err
 // or modified (except by the runtime itself), the change won't be "noticed"
 // until the journal is updated.
 func (self *Metadata) UpdateJournal(name MetadataFileName) error {
-	fname := self.journalPath + "." + self.journalPrefix + string(name)
-	if err := ioutil.WriteFile(fname,
-		[]byte(util.Timestamp()), 0644); err != nil && !os.IsExist(err) {
-		return err
-	}
-	return nil
+	return self.store.WriteJournal(
+		self.journalPath+"."+self.journalPrefix+string(name),
+		[]byte(util.Timestamp()))
 }
 
 func (self *Metadata) remove(name MetadataFileName) error {
 	self.uncache(name)
-	err := os.Remove(self.MetadataFilePath(name))
-	if os.IsNotExist(err) {
-		// Workaround for an issue one heavily loaded NFS servers.  If a request
-		// is taking a long time, the client will re-send the request.  The
-		// server is supposed to note that the request is a duplicate and
-		// de-duplicate it, but if it's heavily loaded its duplicate request
-		// cache might have already been flushed, in which case the second
-		// request will see ENOENT and fail.
-		return nil
-	}
-	return err
+	return self.store.Remove(self.path, name)
 }
 func (self *Metadata) _removeNoLock(name MetadataFileName) error {
 	self._uncacheNoLock(name)
-	err := os.Remove(self.MetadataFilePath(name))
-	if os.IsNotExist(err) {
-		return nil
-	}
-	return err
+	return self.store.Remove(self.path, name)
 }
 
 func (self *Metadata) clearReadCache() {
@@ -827,11 +840,7 @@ func (self *Metadata) journalFile() string {
 func (self *Metadata) uncheckedReset() error {
 	// Remove all related files from journal directory.
 	if len(self.journalPath) > 0 {
-		if files, err := filepath.Glob(self.journalFile() + "*"); err == nil {
-			for _, file := range files {
-				os.Remove(file)
-			}
-		}
+		self.store.RemoveJournal(self.journalFile())
 	}
 	if err := self.removeAll(); err != nil {
 		util.PrintInfo("runtime",
@@ -908,7 +917,9 @@ func (self *Metadata) restartLocal() error {
 	return nil
 }
 
-func (self *Metadata) checkHeartbeat() {
+// Fails the job if it is running but has not sent a heartbeat recently.
+// Returns true if the job was failed.
+func (self *Metadata) checkHeartbeat() bool {
 	if state, _ := self.getState(); state == Running {
 		if self.lastHeartbeat.IsZero() || self.exists(Heartbeat) {
 			self.uncache(Heartbeat)
@@ -918,7 +929,7 @@ func (self *Metadata) checkHeartbeat() {
 			// Check if the state changed but we just missed the journal.
 			self.poll()
 			if state, _ := self.getState(); state != Running {
-				return
+				return false
 			}
 			self.WriteErrorString(fmt.Sprintf(
 				"%s: No heartbeat detected for %d minutes. "+
@@ -927,8 +938,10 @@ func (self *Metadata) checkHeartbeat() {
 					"or the operating system or cluster "+
 					"terminating it due to resource or time limits.",
 				util.Timestamp(), heartbeatTimeout))
+			return true
 		}
 	}
+	return false
 }
 
 func (self *Metadata) serializeState() *MetadataInfo {
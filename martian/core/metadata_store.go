@@ -0,0 +1,235 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Storage backends for metadata files.
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// A MetadataStore holds the content of metadata files.
+//
+// Files are identified by the path to the metadata directory and the
+// metadata file name.  Stage code, which runs in separate processes and
+// possibly on other hosts, exchanges metadata with the runtime through the
+// filesystem, so stores other than the default file store are only used for
+// metadata which is never read or written by jobs.
+type MetadataStore interface {
+	// Returns the names of the metadata files in the given directory.
+	List(dir string) ([]MetadataFileName, error)
+
+	// Returns the content of the given file.
+	ReadFile(dir string, name MetadataFileName) ([]byte, error)
+
+	// Opens the given file for reading, and returns its size.
+	Open(dir string, name MetadataFileName) (io.ReadCloser, int64, error)
+
+	// Replaces the content of the given file.
+	WriteFile(dir string, name MetadataFileName, data []byte) error
+
+	// Replaces the content of the given file in such a way that it will
+	// never be observed in a partially-written form.
+	WriteAtomic(dir string, name MetadataFileName, data []byte) error
+
+	// Adds data to the end of the given file, creating it if required.
+	Append(dir string, name MetadataFileName, data []byte) error
+
+	// Removes the given file.  It is not an error if it does not exist.
+	Remove(dir string, name MetadataFileName) error
+
+	// Removes the given directory along with everything in it, including
+	// any metadata in subdirectories.
+	RemoveAll(dir string) error
+
+	// Writes a journal entry, which notifies the runtime that a metadata
+	// file was created or updated.
+	WriteJournal(entry string, data []byte) error
+
+	// Removes all journal entries which start with the given prefix.
+	RemoveJournal(prefix string) error
+}
+
+// A MetadataStore which keeps metadata somewhere other than the metadata
+// directories.  Such stores are loaded when the pipestance is instantiated,
+// but may only be written to while the pipestance is locked.
+type externalMetadataStore interface {
+	MetadataStore
+
+	// Prepare the store for writing.  Called once the pipestance is locked.
+	openWrite() error
+
+	// Write all of the metadata out as files in the metadata directories,
+	// after which the store behaves like the file store.  This is used before
+	// metadata is archived in a zip file.
+	export() error
+
+	// Stop writing to the store.  Metadata can still be read.
+	Close() error
+}
+
+// MetadataStoreType selects the backend used for the metadata which is
+// private to the runtime.
+type MetadataStoreType string
+
+const (
+	// Keep all metadata in files.
+	FileMetadataStore MetadataStoreType = "files"
+
+	// Keep node and fork metadata in an embedded key-value store, which is
+	// saved in a single file at the top level of the pipestance.  This
+	// avoids creating, listing, and removing tens of thousands of small
+	// files for large pipestances.  Metadata for splits, chunks, and joins
+	// is still kept in files.
+	KVMetadataStore MetadataStoreType = "kv"
+)
+
+func VerifyMetadataStore(store MetadataStoreType) {
+	switch store {
+	case FileMetadataStore, KVMetadataStore:
+		return
+	}
+	util.PrintInfo("runtime",
+		"Invalid metadata store: %s. Valid stores: files, kv",
+		store)
+	os.Exit(1)
+}
+
+// Open the metadata store for the given pipestance.
+//
+// The key-value store is used if the pipestance already has one, regardless
+// of the configured store type, since otherwise the metadata it contains
+// would be lost.  Otherwise a key-value store is only created for new
+// pipestances.
+func (self *Runtime) openMetadataStore(pipestancePath string,
+	readOnly bool) (MetadataStore, error) {
+	fn := path.Join(pipestancePath, MetadataStoreFile.FileName())
+	if _, err := os.Stat(fn); err == nil {
+		if t := self.Config.MetadataStore; t != "" && t != KVMetadataStore {
+			util.LogInfo("runtime",
+				"Using the existing %s metadata store for %s.",
+				KVMetadataStore, pipestancePath)
+		}
+		return openKVStore(pipestancePath, fn)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if self.Config.MetadataStore != KVMetadataStore || readOnly {
+		return defaultMetadataStore, nil
+	}
+	if _, err := os.Stat(path.Join(pipestancePath,
+		InvocationFile.FileName())); err == nil {
+		util.LogInfo("runtime",
+			"Using the %s metadata store for existing pipestance %s.",
+			FileMetadataStore, pipestancePath)
+		return defaultMetadataStore, nil
+	}
+	return openKVStore(pipestancePath, fn)
+}
+
+// The store used for metadata outside of a pipestance, and for metadata which
+// jobs read or write.
+var defaultMetadataStore MetadataStore = fileStore{}
+
+// Keeps each piece of metadata in its own file, in the metadata directory.
+type fileStore struct{}
+
+func (fileStore) List(dir string) ([]MetadataFileName, error) {
+	paths, err := filepath.Glob(path.Join(dir, AnyFile.FileName()))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]MetadataFileName, 0, len(paths))
+	for _, p := range paths {
+		names = append(names, metadataFileNameFromPath(p))
+	}
+	return names, nil
+}
+
+func (fileStore) ReadFile(dir string, name MetadataFileName) ([]byte, error) {
+	return ioutil.ReadFile(path.Join(dir, name.FileName()))
+}
+
+func (fileStore) Open(dir string, name MetadataFileName) (io.ReadCloser, int64, error) {
+	f, err := os.Open(path.Join(dir, name.FileName()))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (fileStore) WriteFile(dir string, name MetadataFileName, data []byte) error {
+	return ioutil.WriteFile(path.Join(dir, name.FileName()), data, 0644)
+}
+
+func (fileStore) WriteAtomic(dir string, name MetadataFileName, data []byte) error {
+	fname := path.Join(dir, name.FileName())
+	tmpName := fname + ".tmp"
+	if err := ioutil.WriteFile(tmpName, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, fname); err == nil || os.IsNotExist(err) {
+		return nil
+	} else {
+		return err
+	}
+}
+
+func (fileStore) Append(dir string, name MetadataFileName, data []byte) error {
+	if f, err := os.OpenFile(path.Join(dir, name.FileName()),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return err
+	} else if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	} else {
+		return f.Close()
+	}
+}
+
+func (fileStore) Remove(dir string, name MetadataFileName) error {
+	err := os.Remove(path.Join(dir, name.FileName()))
+	if os.IsNotExist(err) {
+		// Workaround for an issue one heavily loaded NFS servers.  If a request
+		// is taking a long time, the client will re-send the request.  The
+		// server is supposed to note that the request is a duplicate and
+		// de-duplicate it, but if it's heavily loaded its duplicate request
+		// cache might have already been flushed, in which case the second
+		// request will see ENOENT and fail.
+		return nil
+	}
+	return err
+}
+
+func (fileStore) RemoveAll(dir string) error {
+	return os.RemoveAll(dir)
+}
+
+func (fileStore) WriteJournal(entry string, data []byte) error {
+	if err := ioutil.WriteFile(entry, data, 0644); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (fileStore) RemoveJournal(prefix string) error {
+	files, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		os.Remove(file)
+	}
+	return nil
+}
@@ -0,0 +1,482 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// An embedded key-value store for metadata which is private to the runtime.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// Record types in the key-value store log.
+const (
+	kvPut        byte = 'p'
+	kvAppend     byte = 'a'
+	kvDelete     byte = 'd'
+	kvDeleteTree byte = 'r'
+)
+
+// The size of the header on each record: the payload length and checksum.
+const kvHeaderSize = 8
+
+// The log is not compacted until it is at least this large.
+const kvCompactThreshold = 1 << 20
+
+var errKVReadOnly = errors.New("metadata store is not open for writing")
+
+// Keeps metadata in memory, persisted as an append-only log of updates in a
+// single file.
+//
+// Metadata is keyed by the directory, relative to the root of the store,
+// and the file name.  Metadata in directories outside of the root is kept in
+// files, as are journal entries.
+//
+// Each record in the log is the length of the payload as a little-endian
+// uint32, the CRC-32 of the payload, and then the payload, which consists
+// of the record type, the length of the key as a uvarint, the key, and the
+// value.  When the log is loaded, it stops at the first record which is
+// incomplete or corrupt, which can happen if mrp was killed while writing.
+type kvStore struct {
+	mutex sync.Mutex
+	root  string
+	fn    string
+	dirs  map[string]map[MetadataFileName][]byte
+
+	// The log, if it is open for writing.
+	log *os.File
+
+	// The length of the valid portion of the log.
+	size int64
+
+	// Set once the metadata has been exported to files.
+	exported bool
+
+	files fileStore
+}
+
+// Load the key-value store in the given file, if it exists, for metadata
+// in directories under root.
+func openKVStore(root, fn string) (*kvStore, error) {
+	self := &kvStore{
+		root: root,
+		fn:   fn,
+		dirs: make(map[string]map[MetadataFileName][]byte),
+	}
+	if err := self.load(); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+func (self *kvStore) load() error {
+	f, err := os.Open(self.fn)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	self.size = self.replay(bufio.NewReader(f))
+	return nil
+}
+
+// Apply records from the reader until the end, or the first record which
+// cannot be read.  Returns the number of bytes in the valid records.
+func (self *kvStore) replay(r io.Reader) int64 {
+	var size int64
+	var header [kvHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return size
+		}
+		n := binary.LittleEndian.Uint32(header[:4])
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return size
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+			return size
+		}
+		if len(payload) < 1 {
+			return size
+		}
+		klen, m := binary.Uvarint(payload[1:])
+		if m <= 0 || uint64(len(payload)-1-m) < klen {
+			return size
+		}
+		key := string(payload[1+m : 1+m+int(klen)])
+		self.apply(payload[0], key, payload[1+m+int(klen):])
+		size += kvHeaderSize + int64(n)
+	}
+}
+
+func kvFileKey(dir string, name MetadataFileName) string {
+	return dir + "\x00" + string(name)
+}
+
+func splitKVFileKey(key string) (string, MetadataFileName) {
+	i := strings.IndexByte(key, 0)
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], MetadataFileName(key[i+1:])
+}
+
+// Update the in-memory state for a record.  Must be called with the lock
+// held.
+func (self *kvStore) apply(op byte, key string, value []byte) {
+	switch op {
+	case kvPut, kvAppend:
+		dir, name := splitKVFileKey(key)
+		files := self.dirs[dir]
+		if files == nil {
+			files = make(map[MetadataFileName][]byte)
+			self.dirs[dir] = files
+		}
+		if old, ok := files[name]; ok && op == kvAppend {
+			// Never modify the old value in place, as it may have been
+			// returned to a reader.
+			files[name] = append(old[:len(old):len(old)], value...)
+		} else {
+			files[name] = append([]byte(nil), value...)
+		}
+	case kvDelete:
+		dir, name := splitKVFileKey(key)
+		if files := self.dirs[dir]; files != nil {
+			delete(files, name)
+			if len(files) == 0 {
+				delete(self.dirs, dir)
+			}
+		}
+	case kvDeleteTree:
+		for dir := range self.dirs {
+			if key == "." || dir == key || strings.HasPrefix(dir, key+"/") {
+				delete(self.dirs, dir)
+			}
+		}
+	}
+}
+
+func appendKVRecord(buf []byte, op byte, key string, value []byte) []byte {
+	var klen [binary.MaxVarintLen64]byte
+	k := binary.PutUvarint(klen[:], uint64(len(key)))
+	start := len(buf)
+	buf = append(buf, make([]byte, kvHeaderSize)...)
+	buf = append(buf, op)
+	buf = append(buf, klen[:k]...)
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	payload := buf[start+kvHeaderSize:]
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.ChecksumIEEE(payload))
+	return buf
+}
+
+// Add a record to the log and apply it.  Must be called with the lock held.
+func (self *kvStore) write(op byte, key string, value []byte) error {
+	if self.log == nil {
+		return errKVReadOnly
+	}
+	rec := appendKVRecord(nil, op, key, value)
+	if _, err := self.log.Write(rec); err != nil {
+		// Remove any partially written record, so that later records
+		// are not lost when the log is loaded.
+		self.log.Truncate(self.size)
+		return err
+	}
+	self.size += int64(len(rec))
+	self.apply(op, key, value)
+	return nil
+}
+
+// Get the key for the given directory.  Returns false if the metadata in
+// the directory is kept in files.  Must be called with the lock held.
+func (self *kvStore) dirKey(dir string) (string, bool) {
+	if self.exported {
+		return "", false
+	}
+	rel, err := filepath.Rel(self.root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
+func (self *kvStore) List(dir string) ([]MetadataFileName, error) {
+	self.mutex.Lock()
+	key, ok := self.dirKey(dir)
+	if !ok {
+		self.mutex.Unlock()
+		return self.files.List(dir)
+	}
+	defer self.mutex.Unlock()
+	files := self.dirs[key]
+	names := make([]MetadataFileName, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i] < names[j]
+	})
+	return names, nil
+}
+
+func (self *kvStore) ReadFile(dir string, name MetadataFileName) ([]byte, error) {
+	self.mutex.Lock()
+	key, ok := self.dirKey(dir)
+	if !ok {
+		self.mutex.Unlock()
+		return self.files.ReadFile(dir, name)
+	}
+	defer self.mutex.Unlock()
+	if b, ok := self.dirs[key][name]; ok {
+		return b, nil
+	}
+	return nil, &os.PathError{
+		Op:   "open",
+		Path: path.Join(dir, name.FileName()),
+		Err:  os.ErrNotExist,
+	}
+}
+
+func (self *kvStore) Open(dir string, name MetadataFileName) (io.ReadCloser, int64, error) {
+	b, err := self.ReadFile(dir, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+}
+
+func (self *kvStore) update(op byte, dir string, name MetadataFileName, data []byte,
+	fallback func(string, MetadataFileName, []byte) error) error {
+	self.mutex.Lock()
+	key, ok := self.dirKey(dir)
+	if !ok {
+		self.mutex.Unlock()
+		return fallback(dir, name, data)
+	}
+	defer self.mutex.Unlock()
+	return self.write(op, kvFileKey(key, name), data)
+}
+
+func (self *kvStore) WriteFile(dir string, name MetadataFileName, data []byte) error {
+	return self.update(kvPut, dir, name, data, self.files.WriteFile)
+}
+
+// Each record is written with a single write call, and is ignored when the
+// log is loaded if it was only partially written, so every write is atomic.
+func (self *kvStore) WriteAtomic(dir string, name MetadataFileName, data []byte) error {
+	return self.update(kvPut, dir, name, data, self.files.WriteAtomic)
+}
+
+func (self *kvStore) Append(dir string, name MetadataFileName, data []byte) error {
+	return self.update(kvAppend, dir, name, data, self.files.Append)
+}
+
+func (self *kvStore) Remove(dir string, name MetadataFileName) error {
+	self.mutex.Lock()
+	key, ok := self.dirKey(dir)
+	if !ok {
+		self.mutex.Unlock()
+		return self.files.Remove(dir, name)
+	}
+	defer self.mutex.Unlock()
+	if _, ok := self.dirs[key][name]; !ok {
+		return nil
+	}
+	return self.write(kvDelete, kvFileKey(key, name), nil)
+}
+
+func (self *kvStore) RemoveAll(dir string) error {
+	self.mutex.Lock()
+	if key, ok := self.dirKey(dir); ok {
+		if err := self.write(kvDeleteTree, key, nil); err != nil {
+			self.mutex.Unlock()
+			return err
+		}
+	}
+	self.mutex.Unlock()
+	return self.files.RemoveAll(dir)
+}
+
+func (self *kvStore) WriteJournal(entry string, data []byte) error {
+	return self.files.WriteJournal(entry, data)
+}
+
+func (self *kvStore) RemoveJournal(prefix string) error {
+	return self.files.RemoveJournal(prefix)
+}
+
+// The size the log would have if it only contained the current content.
+// Must be called with the lock held.
+func (self *kvStore) liveSize() int64 {
+	var size int64
+	for dir, files := range self.dirs {
+		for name, value := range files {
+			size += kvHeaderSize + 1 + binary.MaxVarintLen64 +
+				int64(len(dir)+1+len(name)+len(value))
+		}
+	}
+	return size
+}
+
+// Write the current content to a new log, replacing the old one.  Must be
+// called with the lock held.
+func (self *kvStore) compact() error {
+	var buf []byte
+	var size int64
+	dirs := make([]string, 0, len(self.dirs))
+	for dir := range self.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	tmp := self.fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		for name, value := range self.dirs[dir] {
+			buf = appendKVRecord(buf[:0], kvPut, kvFileKey(dir, name), value)
+			if _, err := f.Write(buf); err != nil {
+				f.Close()
+				os.Remove(tmp)
+				return err
+			}
+			size += int64(len(buf))
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, self.fn); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	self.size = size
+	return nil
+}
+
+func (self *kvStore) openWrite() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.log != nil || self.exported {
+		return nil
+	}
+	// Pick up anything written since the store was loaded, before the
+	// pipestance was locked.
+	self.dirs = make(map[string]map[MetadataFileName][]byte)
+	self.size = 0
+	if err := self.load(); err != nil {
+		return err
+	}
+	if self.size > kvCompactThreshold && self.size > 2*self.liveSize() {
+		if err := self.compact(); err != nil {
+			util.LogError(err, "runtime",
+				"Could not compact metadata store %s.", self.fn)
+		}
+	}
+	f, err := os.OpenFile(self.fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	// Remove any partially written record from the end of the log.
+	if info, err := f.Stat(); err != nil {
+		f.Close()
+		return err
+	} else if info.Size() > self.size {
+		util.LogInfo("runtime",
+			"Discarding %d bytes of incomplete records from %s.",
+			info.Size()-self.size, self.fn)
+		if err := f.Truncate(self.size); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	self.log = f
+	return nil
+}
+
+func (self *kvStore) export() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.exported {
+		return nil
+	}
+	if self.log == nil {
+		return errKVReadOnly
+	}
+	for dir, files := range self.dirs {
+		p := path.Join(self.root, dir)
+		if err := util.MkdirAll(p); err != nil {
+			return err
+		}
+		for name, value := range files {
+			if err := self.files.WriteFile(p, name, value); err != nil {
+				return err
+			}
+		}
+	}
+	self.log.Close()
+	self.log = nil
+	self.exported = true
+	self.dirs = nil
+	return os.Remove(self.fn)
+}
+
+func (self *kvStore) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.log == nil {
+		return nil
+	}
+	err := self.log.Close()
+	self.log = nil
+	return err
+}
+
+// Calls fn for each piece of metadata in the key-value metadata store for
+// the given pipestance, if it has one, in order by directory and name.  The
+// directory is relative to the pipestance directory.
+func WalkMetadataStore(pipestancePath string,
+	fn func(dir string, name MetadataFileName, data []byte) error) error {
+	store, err := openKVStore(pipestancePath,
+		path.Join(pipestancePath, MetadataStoreFile.FileName()))
+	if err != nil {
+		return err
+	}
+	dirs := make([]string, 0, len(store.dirs))
+	for dir := range store.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		names, _ := store.List(path.Join(pipestancePath, dir))
+		for _, name := range names {
+			if err := fn(dir, name, store.dirs[dir][name]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
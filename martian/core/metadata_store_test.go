@@ -0,0 +1,160 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestKVStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "TestKVStore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fn := path.Join(root, MetadataStoreFile.FileName())
+	fork := path.Join(root, "PIPE", "STAGE", "fork0")
+	if err := os.MkdirAll(fork, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := openKVStore(root, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteFile(fork, OutsFile, []byte("{}")); err != errKVReadOnly {
+		t.Errorf("Expected write to fail before opening, got %v", err)
+	}
+	if err := store.openWrite(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(store.WriteFile(fork, OutsFile, []byte(`{"a": 1}`)))
+	check(store.WriteAtomic(fork, CompleteFile, []byte("done")))
+	check(store.Append(fork, AlarmFile, []byte("one\n")))
+	check(store.Append(fork, AlarmFile, []byte("two\n")))
+	check(store.WriteFile(path.Join(fork, "chnk0"), JobId, []byte("1")))
+	check(store.Remove(fork, CompleteFile))
+	check(store.Remove(fork, Errors))
+	check(store.RemoveAll(path.Join(fork, "chnk0")))
+
+	// Metadata outside of the root is kept in files.
+	outside, err := ioutil.TempDir("", "TestKVStoreOutside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	check(store.WriteFile(outside, ArgsFile, []byte("{}")))
+	if _, err := os.Stat(path.Join(outside, ArgsFile.FileName())); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(path.Join(fork, OutsFile.FileName())); !os.IsNotExist(err) {
+		t.Error("Expected outs to not be written to a file.")
+	}
+	check(store.Close())
+
+	// Add a partially written record to the end of the log.
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0644)
+	check(err)
+	rec := appendKVRecord(nil, kvPut, kvFileKey("PIPE", Errors), []byte("x"))
+	_, err = f.Write(rec[:len(rec)-1])
+	check(err)
+	check(f.Close())
+
+	store, err = openKVStore(root, fn)
+	check(err)
+	checkContent := func(name MetadataFileName, expect string) {
+		t.Helper()
+		if b, err := store.ReadFile(fork, name); err != nil {
+			t.Errorf("Reading %s: %v", name, err)
+		} else if string(b) != expect {
+			t.Errorf("Expected %s to be %q, got %q", name, expect, b)
+		}
+	}
+	if names, err := store.List(fork); err != nil {
+		t.Error(err)
+	} else if len(names) != 2 || names[0] != AlarmFile || names[1] != OutsFile {
+		t.Errorf("Expected alarm and outs, got %v", names)
+	}
+	checkContent(OutsFile, `{"a": 1}`)
+	checkContent(AlarmFile, "one\ntwo\n")
+	if _, err := store.ReadFile(fork, CompleteFile); !os.IsNotExist(err) {
+		t.Errorf("Expected complete to not exist, got %v", err)
+	}
+	if names, _ := store.List(path.Join(fork, "chnk0")); len(names) != 0 {
+		t.Errorf("Expected chunk metadata to be removed, got %v", names)
+	}
+
+	check(store.openWrite())
+	if info, err := os.Stat(fn); err != nil {
+		t.Error(err)
+	} else if info.Size() != store.size {
+		t.Errorf("Expected incomplete record to be removed.")
+	}
+	check(store.compact())
+	check(store.Append(fork, AlarmFile, []byte("three\n")))
+	check(store.export())
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Error("Expected store to be removed after export.")
+	}
+	if b, err := ioutil.ReadFile(path.Join(fork, AlarmFile.FileName())); err != nil {
+		t.Error(err)
+	} else if s := string(b); s != "one\ntwo\nthree\n" {
+		t.Errorf("Incorrect exported alarm %q", s)
+	}
+	checkContent(OutsFile, `{"a": 1}`)
+}
+
+func TestMetadataKVStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "TestMetadataKVStore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	store, err := openKVStore(root, path.Join(root, MetadataStoreFile.FileName()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.openWrite(); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	md := NewMetadata("ID.ps.PIPE.STAGE.fork0", path.Join(root, "fork0"))
+	md.store = store
+	if err := md.mkForkDirs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := md.Write(OutsFile, map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	md.WriteTime(CompleteFile)
+	if st, _ := md.getState(); st != Complete {
+		t.Errorf("Expected complete, got %q", st)
+	}
+	md.loadCache()
+	if st, _ := md.getState(); st != Complete {
+		t.Errorf("Expected complete after reload, got %q", st)
+	}
+	if _, err := md.read(OutsFile, 1); err == nil {
+		t.Error("Expected read size limit to be enforced.")
+	}
+	if outs, err := md.read(OutsFile, 100); err != nil {
+		t.Error(err)
+	} else if string(outs["a"]) != "1" {
+		t.Errorf("Expected a=1, got %s", outs["a"])
+	}
+	if err := md.uncheckedReset(); err != nil {
+		t.Fatal(err)
+	}
+	if names := md.list(); len(names) != 0 {
+		t.Errorf("Expected no metadata after reset, got %v", names)
+	}
+}
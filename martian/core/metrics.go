@@ -0,0 +1,125 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Summary statistics for monitoring running pipestances.
+
+import (
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+// Counters which accumulate over the lifetime of a runtime.
+type runtimeCounters struct {
+	vdrBytes          uint64
+	vdrFiles          uint64
+	heartbeatFailures uint64
+}
+
+func (self *runtimeCounters) addVdr(report *VDRKillReport) {
+	if report != nil {
+		atomic.AddUint64(&self.vdrBytes, report.Size)
+		atomic.AddUint64(&self.vdrFiles, uint64(report.Count))
+	}
+}
+
+// Record a completed VDR kill report for a fork.
+func (self *Fork) recordVdr(report *VDRKillReport) {
+	if rt := self.node.top.rt; rt != nil {
+		rt.counters.addVdr(report)
+		rt.Events.emitVdr(self.fqname, report)
+	}
+}
+
+// Usage of one of the local job manager's resource semaphores.
+type SemaphoreUsage struct {
+	// The amount reserved by jobs.
+	Reserved int64
+
+	// The amount in use, including usage not accounted for by jobs.
+	InUse int64
+
+	// The current amount which can be reserved.
+	Size int64
+}
+
+func getSemaphoreUsage(sem *ResourceSemaphore) *SemaphoreUsage {
+	if sem == nil {
+		return nil
+	}
+	return &SemaphoreUsage{
+		Reserved: sem.Reserved(),
+		InUse:    sem.InUse(),
+		Size:     sem.CurrentSize(),
+	}
+}
+
+// A snapshot of monitoring statistics for a pipestance.
+type PipestanceMetrics struct {
+	// The number of nodes in each state.
+	Nodes map[MetadataState]int
+
+	// The number of queued or running jobs, by job mode and state.
+	Jobs map[string]map[MetadataState]int
+
+	// Local job manager semaphore usage.  Threads are in hundredths of a
+	// core, and memory in MB.  VMem is nil if address space is not being
+	// limited.
+	Threads, Mem, VMem *SemaphoreUsage
+
+	// Bytes and files removed by VDR since the runtime was started.
+	VdrBytes, VdrFiles uint64
+
+	// The number of jobs which were failed because they stopped
+	// sending heartbeats.
+	HeartbeatFailures uint64
+
+	// The number of times the pipestance was automatically retried.  This
+	// is not filled in by CollectMetrics, since retries are managed by the
+	// caller.
+	Retries int
+}
+
+// Collect monitoring statistics for the pipestance.
+func (self *Pipestance) CollectMetrics() *PipestanceMetrics {
+	rt := self.node.top.rt
+	metrics := PipestanceMetrics{
+		Nodes: make(map[MetadataState]int),
+		Jobs:  make(map[string]map[MetadataState]int),
+	}
+	jobMode := path.Base(strings.Replace(rt.Config.JobMode, ".template", "", -1))
+	for _, node := range self.allNodes() {
+		metrics.Nodes[node.state]++
+		if node.call.Kind() != syntax.KindStage {
+			continue
+		}
+		mode := jobMode
+		if node.local {
+			mode = localMode
+		}
+		for _, fork := range node.forks {
+			for _, md := range fork.collectMetadatas()[1:] {
+				if state, _ := md.getState(); state == Queued || state == Running {
+					jobs := metrics.Jobs[mode]
+					if jobs == nil {
+						jobs = make(map[MetadataState]int, 2)
+						metrics.Jobs[mode] = jobs
+					}
+					jobs[state]++
+				}
+			}
+		}
+	}
+	if jm := rt.LocalJobManager; jm != nil {
+		metrics.Threads = getSemaphoreUsage(jm.centcoreSem)
+		metrics.Mem = getSemaphoreUsage(jm.memMBSem)
+		metrics.VMem = getSemaphoreUsage(jm.vmemMBSem)
+	}
+	metrics.VdrBytes = atomic.LoadUint64(&rt.counters.vdrBytes)
+	metrics.VdrFiles = atomic.LoadUint64(&rt.counters.vdrFiles)
+	metrics.HeartbeatFailures = atomic.LoadUint64(&rt.counters.heartbeatFailures)
+	return &metrics
+}
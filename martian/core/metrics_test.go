@@ -0,0 +1,37 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"testing"
+)
+
+func TestRuntimeCountersAddVdr(t *testing.T) {
+	var counters runtimeCounters
+	counters.addVdr(&VDRKillReport{Size: 1024, Count: 3})
+	counters.addVdr(nil)
+	counters.addVdr(&VDRKillReport{Size: 10, Count: 1})
+	if counters.vdrBytes != 1034 {
+		t.Errorf("Expected 1034 bytes, got %d", counters.vdrBytes)
+	}
+	if counters.vdrFiles != 4 {
+		t.Errorf("Expected 4 files, got %d", counters.vdrFiles)
+	}
+}
+
+func TestGetSemaphoreUsage(t *testing.T) {
+	if u := getSemaphoreUsage(nil); u != nil {
+		t.Errorf("Expected nil usage, got %v", u)
+	}
+	sem := NewResourceSemaphore(100, "test")
+	if err := sem.Acquire(30); err != nil {
+		t.Fatal(err)
+	}
+	u := getSemaphoreUsage(sem)
+	if u.Reserved != 30 {
+		t.Errorf("Expected 30 reserved, got %d", u.Reserved)
+	}
+	if u.Size != 100 {
+		t.Errorf("Expected size 100, got %d", u.Size)
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/martian-lang/martian/martian/syntax"
@@ -71,6 +72,7 @@ type Node struct {
 	forkRoots      []syntax.MapCallSource
 	forkIds        ForkIdSet
 	resolvedCmd    string
+	criticalPath   int
 }
 
 // Represents an edge in the pipeline graph.
@@ -85,6 +87,9 @@ type NodeErrorInfo struct {
 	Path    string `json:"path"`
 	Summary string `json:"summary,omitempty"`
 	Log     string `json:"log,omitempty"`
+
+	// Problems with the stage outputs, if that is why the stage failed.
+	Violations OutputViolations `json:"violations,omitempty"`
 }
 
 type NodeInfo struct {
@@ -128,6 +133,7 @@ func NewNode(parent Nodable, call syntax.CallGraphNode) *Node {
 	self.top.allNodes[call.GetFqid()] = self
 	self.path = path.Join(parent.getNode().path, call.Call().Id)
 	self.metadata = NewMetadata(self.call.GetFqid(), self.path)
+	self.metadata.store = self.top.metadataStore()
 	if self.call.Call().Modifiers.Preflight || !self.top.rt.Config.NeverLocal {
 		self.local = call.Call().Modifiers.Local
 	}
@@ -667,8 +673,15 @@ func (self *Node) reset() error {
 	if self.top.rt.Config.FullStageReset {
 		util.PrintInfo("runtime", "(reset)           %s", self.call.GetFqid())
 
+		// Memory escalations are recorded in the fork directories, so
+		// they must be restored after the stage node is removed.
+		escalations := make([]map[string]*MemoryEscalation, len(self.forks))
+		for i, fork := range self.forks {
+			escalations[i] = fork.escalateMemory()
+		}
+
 		// Blow away the entire stage node.
-		if err := os.RemoveAll(self.path); err != nil {
+		if err := self.metadata.store.RemoveAll(self.path); err != nil {
 			util.PrintInfo("runtime", "Cannot reset the stage because its folder contents could not be deleted.\n\nPlease resolve this error in order to continue running the pipeline:")
 			return err
 		}
@@ -690,6 +703,11 @@ func (self *Node) reset() error {
 		if err := self.mkdirs(); err != nil {
 			return err
 		}
+		for i, fork := range self.forks {
+			if len(escalations[i]) > 0 {
+				fork.metadata.Write(MemEscalation, escalations[i])
+			}
+		}
 	} else {
 		for _, fork := range self.forks {
 			if err := fork.resetPartial(); err != nil {
@@ -731,7 +749,9 @@ func (self *Node) restartLocalJobs() error {
 
 func (self *Node) checkHeartbeats() {
 	for _, metadata := range self.collectMetadatas() {
-		metadata.checkHeartbeat()
+		if metadata.checkHeartbeat() {
+			atomic.AddUint64(&self.top.rt.counters.heartbeatFailures, 1)
+		}
 	}
 }
 
@@ -828,6 +848,10 @@ func (self *Node) isErrorTransient() (bool, string) {
 		}
 		if metadata.exists(Errors) {
 			errlog := metadata.readRaw(Errors)
+			if self.top.rt.memoryRetry.match(errlog) != "" {
+				// The memory reservation will be escalated on retry.
+				return true, errlog
+			}
 			for _, line := range strings.Split(errlog, "\n") {
 				for _, re := range passRegexp {
 					if re.MatchString(line) {
@@ -859,6 +883,15 @@ func (self *Node) step() bool {
 		}
 	}
 	self.state = newState
+	if newState != previousState {
+		self.top.events().Emit(&Event{
+			Type:     EventState,
+			Kind:     EventKindNode,
+			Fqname:   self.call.GetFqid(),
+			State:    newState,
+			Previous: previousState,
+		})
+	}
 	switch self.state {
 	case Failed:
 		self.addFrontierNode(self)
@@ -985,10 +1018,11 @@ func (self *Node) serializeState() *NodeInfo {
 			errpath = errpaths[0]
 		}
 		err = &NodeErrorInfo{
-			FQname:  fqname,
-			Path:    errpath,
-			Summary: summary,
-			Log:     log,
+			FQname:     fqname,
+			Path:       errpath,
+			Summary:    summary,
+			Log:        log,
+			Violations: self.getOutputViolations(fqname),
 		}
 	}
 	info := &NodeInfo{
@@ -1074,9 +1108,15 @@ func (self *Node) getProfileMode(stageType string) ProfileMode {
 		self.top.rt.Config.ProfileMode)
 }
 
-func (self *Node) setJobReqs(jobDef *JobResources, stageType string) JobResources {
+// Get the resources for a job, with the memory reservation scaled by the
+// given factor if it is greater than 1.
+func (self *Node) setJobReqs(jobDef *JobResources, stageType string,
+	memScale float64) JobResources {
 	// Get values and possibly modify them
 	res := self.getJobReqs(jobDef, stageType)
+	if memScale > 1 {
+		res = self.escalateJobReqs(res, memScale)
+	}
 
 	// Write modified values back
 	if jobDef != nil {
@@ -1086,20 +1126,20 @@ func (self *Node) setJobReqs(jobDef *JobResources, stageType string) JobResource
 	return res
 }
 
-func (self *Node) setSplitJobReqs() JobResources {
-	return self.setJobReqs(nil, STAGE_TYPE_SPLIT)
+func (self *Node) setSplitJobReqs(memScale float64) JobResources {
+	return self.setJobReqs(nil, STAGE_TYPE_SPLIT, memScale)
 }
 
-func (self *Node) setChunkJobReqs(jobDef *JobResources) JobResources {
-	return self.setJobReqs(jobDef, STAGE_TYPE_CHUNK)
+func (self *Node) setChunkJobReqs(jobDef *JobResources, memScale float64) JobResources {
+	return self.setJobReqs(jobDef, STAGE_TYPE_CHUNK, memScale)
 }
 
-func (self *Node) setJoinJobReqs(jobDef *JobResources) JobResources {
-	return self.setJobReqs(jobDef, STAGE_TYPE_JOIN)
+func (self *Node) setJoinJobReqs(jobDef *JobResources, memScale float64) JobResources {
+	return self.setJobReqs(jobDef, STAGE_TYPE_JOIN, memScale)
 }
 
-func (self *Node) runSplit(fqname string, metadata *Metadata) {
-	res := self.setSplitJobReqs()
+func (self *Node) runSplit(fqname string, metadata *Metadata, memScale float64) {
+	res := self.setSplitJobReqs(memScale)
 	self.runJob("split", fqname, STAGE_TYPE_SPLIT, metadata, &res)
 }
 
@@ -1111,65 +1151,83 @@ func (self *Node) runChunk(fqname string, metadata *Metadata, res *JobResources)
 	self.runJob("main", fqname, STAGE_TYPE_CHUNK, metadata, res)
 }
 
-func (self *Node) runJob(shellName string, fqname, stageType string, metadata *Metadata,
-	res *JobResources) {
-
-	// Configure local variable dumping.
-	stackVars := disable
-	if self.top.rt.Config.StackVars {
-		stackVars = "stackvars"
-	}
-
-	// Configure memory monitoring.
-	monitor := disable
-	if self.top.rt.Config.Monitor {
-		monitor = "monitor"
-	}
+// Get the command line and environment for running the given job of this
+// stage.
+func (self *Node) jobCommand(shellName string,
+	metadata *Metadata) (string, []string, map[string]string) {
+	return self.top.rt.JobCommand(self.stagecode, self.resolvedCmd,
+		shellName, metadata, self.top.envs)
+}
 
+// JobCommand returns the command line and environment for running the given
+// phase of a stage, where resolvedCmd is the resolved path to the stage code.
+// The given environment is not modified.
+func (self *Runtime) JobCommand(src *syntax.SrcParam, resolvedCmd string,
+	shellName string, metadata *Metadata,
+	envs map[string]string) (string, []string, map[string]string) {
 	// Construct path to the shell.
 	shellCmd := ""
 	var argv []string
 	runFile := metadata.journalFile()
-	version := &self.top.version
-	envs := self.top.envs
 	if td := metadata.TempDir(); td != "" {
-		envs = make(map[string]string, len(self.top.envs)+1)
-		for k, v := range self.top.envs {
-			envs[k] = v
+		tdEnvs := make(map[string]string, len(envs)+1)
+		for k, v := range envs {
+			tdEnvs[k] = v
 		}
-		envs["TMPDIR"] = td
+		tdEnvs["TMPDIR"] = td
+		envs = tdEnvs
 	}
-	switch self.stagecode.Type {
+	switch src.Type {
 	case syntax.PythonStage:
-		if len(self.stagecode.Args) != 0 {
+		if len(src.Args) != 0 {
 			panic(fmt.Sprintf(
 				"Invalid python stage module specification \"%s %s\"",
-				self.resolvedCmd, strings.Join(self.stagecode.Args, " ")))
+				resolvedCmd, strings.Join(src.Args, " ")))
 		}
-		shellCmd = self.top.rt.mrjob
+		shellCmd = self.mrjob
 		argv = []string{
-			path.Join(self.top.rt.adaptersPath, "python", "martian_shell.py"),
-			self.resolvedCmd,
+			path.Join(self.adaptersPath, "python", "martian_shell.py"),
+			resolvedCmd,
 			shellName,
 			metadata.path,
 			metadata.curFilesPath,
 			runFile,
 		}
 	case syntax.CompiledStage:
-		shellCmd = self.top.rt.mrjob
-		argv = make([]string, 1, len(self.stagecode.Args)+4)
-		argv[0] = self.resolvedCmd
-		argv = append(argv, self.stagecode.Args...)
+		shellCmd = self.mrjob
+		argv = make([]string, 1, len(src.Args)+4)
+		argv[0] = resolvedCmd
+		argv = append(argv, src.Args...)
 		argv = append(argv, shellName, metadata.path, metadata.curFilesPath, runFile)
 	case syntax.ExecStage:
-		shellCmd = self.resolvedCmd
+		shellCmd = resolvedCmd
 		argv = append(
-			self.stagecode.Args[:len(self.stagecode.Args):len(self.stagecode.Args)],
+			src.Args[:len(src.Args):len(src.Args)],
 			shellName, metadata.path, metadata.curFilesPath, runFile)
 	default:
-		panic(fmt.Sprint("Unknown stage code language: ", self.stagecode.Type))
+		panic(fmt.Sprint("Unknown stage code language: ", src.Type))
+	}
+	return shellCmd, argv, envs
+}
+
+func (self *Node) runJob(shellName string, fqname, stageType string, metadata *Metadata,
+	res *JobResources) {
+
+	// Configure local variable dumping.
+	stackVars := disable
+	if self.top.rt.Config.StackVars {
+		stackVars = "stackvars"
 	}
 
+	// Configure memory monitoring.
+	monitor := disable
+	if self.top.rt.Config.Monitor {
+		monitor = "monitor"
+	}
+
+	shellCmd, argv, envs := self.jobCommand(shellName, metadata)
+	version := &self.top.version
+
 	// Log the job run.
 	jobMode := self.top.rt.Config.JobMode
 	jobManager := self.top.rt.JobManager
@@ -1216,6 +1274,7 @@ func (self *Node) runJob(shellName string, fqname, stageType string, metadata *M
 			"Could not write jobinfo file, aborting.")
 		util.Suicide(false)
 	}
-	jobManager.execJob(shellCmd, argv, envs, metadata, res, fqname,
-		shellName, self.call.Call().Modifiers.Preflight && self.local)
+	jobManager.execJob(shellCmd, argv, envs, metadata, res,
+		self.jobPriority(stageType), fqname, shellName,
+		self.call.Call().Modifiers.Preflight && self.local)
 }
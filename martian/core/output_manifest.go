@@ -0,0 +1,316 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Checksums of the final outputs of a pipestance.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/martian-lang/martian/martian/syntax"
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// OutputHashType selects the checksum recorded for each file in the output
+// manifest.
+type OutputHashType string
+
+const (
+	OutputHashSha256 OutputHashType = "sha256"
+
+	// The 64-bit xxHash, which is much faster than sha256 for large files
+	// but is not a cryptographic hash.
+	OutputHashXXHash OutputHashType = "xxhash"
+
+	// Only record file sizes and modification times.
+	OutputHashNone OutputHashType = "none"
+)
+
+func VerifyOutputHash(alg OutputHashType) {
+	switch alg {
+	case OutputHashSha256, OutputHashXXHash, OutputHashNone:
+		return
+	}
+	util.PrintInfo("runtime",
+		"Invalid output hash: %s. Valid options: sha256, xxhash, none",
+		alg)
+	os.Exit(1)
+}
+
+// Returns nil for OutputHashNone.
+func (alg OutputHashType) newHash() (hash.Hash, error) {
+	switch alg {
+	case OutputHashSha256:
+		return sha256.New(), nil
+	case OutputHashXXHash:
+		return util.NewXXHash64(), nil
+	case OutputHashNone:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", alg)
+}
+
+// The name of the output manifest file in the pipestance outs directory.
+const OutputManifestName = "_manifest.json"
+
+// An OutputManifestEntry records the state of a pipestance output file at
+// the time the pipestance completed.
+type OutputManifestEntry struct {
+	// The path to the file, relative to the pipestance directory.
+	Path string `json:"path"`
+
+	// The size of the file, in bytes.
+	Size int64 `json:"size"`
+
+	// The modification time of the file.
+	Mtime time.Time `json:"mtime"`
+
+	// The hex-encoded checksum of the file content.
+	Hash string `json:"hash,omitempty"`
+}
+
+// An OutputManifest lists the files in the outs directory of a completed
+// pipestance, which includes all of the file-typed outputs of the top-level
+// pipeline.  Symlinks in outs are followed, so files outside of the
+// pipestance which are pipeline outputs are also included.
+type OutputManifest struct {
+	MartianVersion string `json:"martian_version"`
+
+	// The time at which the manifest was created.
+	Created string `json:"created"`
+
+	HashAlgorithm OutputHashType `json:"hash_algorithm"`
+
+	Files []OutputManifestEntry `json:"files"`
+}
+
+// Write the output manifest for the pipestance, if it has an outs
+// directory.
+func writeOutputManifest(pipestancePath string, alg OutputHashType) error {
+	if alg == "" {
+		alg = OutputHashXXHash
+	}
+	manifest, err := MakeOutputManifest(pipestancePath, alg)
+	if err != nil || manifest == nil {
+		return err
+	}
+	b, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(
+		path.Join(pipestancePath, "outs", OutputManifestName),
+		b, 0644)
+}
+
+// MakeOutputManifest computes the output manifest for the pipestance.
+// Returns nil if the pipestance has no outs directory.
+func MakeOutputManifest(pipestancePath string,
+	alg OutputHashType) (*OutputManifest, error) {
+	files, err := findOutputFiles(pipestancePath)
+	if err != nil || files == nil {
+		return nil, err
+	}
+	manifest := OutputManifest{
+		MartianVersion: util.GetVersion(),
+		Created:        util.Timestamp(),
+		HashAlgorithm:  alg,
+		Files:          make([]OutputManifestEntry, len(files)),
+	}
+	for i, f := range files {
+		manifest.Files[i].Path = f
+	}
+	var errs syntax.ErrorList
+	for _, err := range forEachOutput(len(files), func(i int) error {
+		return manifest.Files[i].compute(pipestancePath, alg)
+	}) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return &manifest, errs.If()
+}
+
+// VerifyOutputManifest checks the files in the output manifest of the
+// pipestance against their current content.  Modification times are only
+// checked if the manifest does not include checksums.
+func VerifyOutputManifest(pipestancePath string) (*OutputManifest, error) {
+	b, err := ioutil.ReadFile(path.Join(pipestancePath, "outs", OutputManifestName))
+	if err != nil {
+		return nil, err
+	}
+	var manifest OutputManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, err
+	}
+	if _, err := manifest.HashAlgorithm.newHash(); err != nil {
+		return &manifest, err
+	}
+	var errs syntax.ErrorList
+	for _, err := range forEachOutput(len(manifest.Files), func(i int) error {
+		return manifest.Files[i].verify(pipestancePath, manifest.HashAlgorithm)
+	}) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return &manifest, errs.If()
+}
+
+// Find the files under the pipestance outs directory, following symlinks,
+// and excluding the manifest itself.  Returns nil if there is no outs
+// directory.
+func findOutputFiles(pipestancePath string) ([]string, error) {
+	outsPath := path.Join(pipestancePath, "outs")
+	info, err := os.Stat(outsPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, nil
+	}
+	files := make([]string, 0, 16)
+	var walk func(p string, info os.FileInfo, parents []os.FileInfo) error
+	walk = func(p string, info os.FileInfo, parents []os.FileInfo) error {
+		if info.Mode().IsRegular() {
+			rel, err := filepath.Rel(pipestancePath, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+			return nil
+		} else if !info.IsDir() {
+			return nil
+		}
+		for _, parent := range parents {
+			if os.SameFile(info, parent) {
+				// Symlink cycle.
+				return nil
+			}
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+		parents = append(parents, info)
+		for _, name := range names {
+			if len(parents) == 1 && name == OutputManifestName {
+				continue
+			}
+			child := path.Join(p, name)
+			childInfo, err := os.Stat(child)
+			if os.IsNotExist(err) {
+				// Broken symlink.
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := walk(child, childInfo, parents); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(outsPath, info, nil); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Run f for each index in [0, n), in parallel, and return the errors.
+func forEachOutput(n int, f func(int) error) []error {
+	errs := make([]error, n)
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return errs
+}
+
+// Fill in the size, modification time, and checksum for the entry's file.
+func (self *OutputManifestEntry) compute(pipestancePath string,
+	alg OutputHashType) error {
+	h, err := alg.newHash()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path.Join(pipestancePath, self.Path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	self.Size = info.Size()
+	self.Mtime = info.ModTime()
+	if h == nil {
+		return nil
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	self.Hash = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+func (self *OutputManifestEntry) verify(pipestancePath string,
+	alg OutputHashType) error {
+	current := OutputManifestEntry{Path: self.Path}
+	if err := current.compute(pipestancePath, alg); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s: missing", self.Path)
+		}
+		return err
+	}
+	if current.Size != self.Size {
+		return fmt.Errorf("%s: expected %d bytes, found %d",
+			self.Path, self.Size, current.Size)
+	}
+	if current.Hash != self.Hash {
+		return fmt.Errorf("%s: %s checksum mismatch",
+			self.Path, alg)
+	}
+	if self.Hash == "" && !current.Mtime.Equal(self.Mtime) {
+		return fmt.Errorf("%s: modified at %s",
+			self.Path, current.Mtime.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestOutputManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestOutputManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ps := path.Join(dir, "ps")
+	write := func(p, content string) {
+		t.Helper()
+		check(os.MkdirAll(path.Dir(p), 0755))
+		check(ioutil.WriteFile(p, []byte(content), 0644))
+	}
+	if m, err := MakeOutputManifest(ps, OutputHashSha256); err != nil {
+		t.Error(err)
+	} else if m != nil {
+		t.Error("Expected no manifest without an outs directory.")
+	}
+	write(path.Join(ps, "outs", "a.txt"), "a")
+	write(path.Join(ps, "outs", "dir", "b.txt"), "b")
+	write(path.Join(dir, "external", "c.txt"), "c")
+	check(os.Symlink(path.Join(dir, "external"), path.Join(ps, "outs", "ext")))
+	check(os.Symlink(path.Join(ps, "outs"), path.Join(ps, "outs", "dir", "loop")))
+	check(os.Symlink("missing", path.Join(ps, "outs", "broken")))
+
+	for _, alg := range []OutputHashType{
+		OutputHashSha256,
+		OutputHashXXHash,
+		OutputHashNone,
+	} {
+		t.Run(string(alg), func(t *testing.T) {
+			m, err := MakeOutputManifest(ps, alg)
+			check(err)
+			expect := []string{
+				"outs/a.txt",
+				"outs/dir/b.txt",
+				"outs/ext/c.txt",
+			}
+			if len(m.Files) != len(expect) {
+				t.Fatalf("Expected %d files, got %d", len(expect), len(m.Files))
+			}
+			for i, e := range expect {
+				if f := m.Files[i]; f.Path != e {
+					t.Errorf("Expected %s, got %s", e, f.Path)
+				} else if f.Size != 1 {
+					t.Errorf("Expected 1 byte for %s, got %d", e, f.Size)
+				} else if (f.Hash == "") != (alg == OutputHashNone) {
+					t.Errorf("Incorrect hash %q for %s", f.Hash, e)
+				}
+			}
+			if alg == OutputHashSha256 {
+				// sha256 of "a"
+				if h := m.Files[0].Hash; h != "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb" {
+					t.Errorf("Incorrect hash %s", h)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyOutputManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestVerifyOutputManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	outs := path.Join(dir, "outs")
+	check(os.Mkdir(outs, 0755))
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		check(ioutil.WriteFile(path.Join(outs, name), []byte(name), 0644))
+	}
+	writeManifest := func(alg OutputHashType) {
+		t.Helper()
+		check(writeOutputManifest(dir, alg))
+	}
+	writeManifest(OutputHashXXHash)
+	if m, err := VerifyOutputManifest(dir); err != nil {
+		t.Error(err)
+	} else if len(m.Files) != 3 {
+		t.Errorf("Expected 3 files, got %d", len(m.Files))
+	} else if m.HashAlgorithm != OutputHashXXHash {
+		t.Errorf("Expected xxhash, got %s", m.HashAlgorithm)
+	}
+
+	// Same size, different content.
+	check(ioutil.WriteFile(path.Join(outs, "a.txt"), []byte("A.txt"), 0644))
+	check(os.Remove(path.Join(outs, "b.txt")))
+	if m, err := VerifyOutputManifest(dir); m == nil {
+		t.Error(err)
+	} else if err == nil {
+		t.Error("Expected verification to fail.")
+	} else if s := err.Error(); s != "\n\touts/a.txt: xxhash checksum mismatch"+
+		"\n\touts/b.txt: missing" {
+		t.Errorf("Incorrect errors: %s", s)
+	}
+
+	writeManifest(OutputHashNone)
+	if _, err := VerifyOutputManifest(dir); err != nil {
+		t.Error(err)
+	}
+	future := time.Now().Add(time.Hour)
+	check(os.Chtimes(path.Join(outs, "c.txt"), future, future))
+	if _, err := VerifyOutputManifest(dir); err == nil {
+		t.Error("Expected a modification time mismatch.")
+	}
+}
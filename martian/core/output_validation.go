@@ -0,0 +1,402 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Structured validation of stage outputs.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/martian-lang/martian/martian/syntax"
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// Kinds of json values, as reported in OutputViolation.Actual.
+const (
+	jsonKindMissing = "missing"
+	jsonKindNull    = "null"
+	jsonKindString  = "string"
+	jsonKindNumber  = "number"
+	jsonKindBool    = "boolean"
+	jsonKindArray   = "array"
+	jsonKindObject  = "object"
+)
+
+// A problem with a value in the outputs of a stage.
+type OutputViolation struct {
+	// The location of the value, for example $.reads[2] for an element of
+	// an array, $.samples["a"] for a value in a typed map, or $.summary.json
+	// for a member of a struct.
+	Path string `json:"path"`
+
+	// The declared type of the value.
+	Expected string `json:"expected"`
+
+	// The kind of json value which was found: one of null, string, number,
+	// boolean, array, object, or missing.
+	Actual string `json:"actual"`
+
+	// Additional detail, if any.
+	Message string `json:"message,omitempty"`
+
+	// Fatal violations always cause the stage to fail.  Others, such as
+	// unexpected outputs, are handled according to the language enforcement
+	// level.
+	Fatal bool `json:"fatal,omitempty"`
+
+	// The value names a file which does not exist.  Stages may leave
+	// declared output files unwritten, so this is reported for diagnosis
+	// only, and never causes the stage to fail.
+	Missing bool `json:"missing,omitempty"`
+}
+
+func (self *OutputViolation) String() string {
+	var buf strings.Builder
+	buf.WriteString(self.Path)
+	if self.Expected == "" {
+		buf.WriteString(": unexpected output")
+	} else {
+		buf.WriteString(": expected ")
+		buf.WriteString(self.Expected)
+		buf.WriteString(", got ")
+		buf.WriteString(self.Actual)
+	}
+	if self.Message != "" {
+		buf.WriteString(": ")
+		buf.WriteString(self.Message)
+	}
+	return buf.String()
+}
+
+type OutputViolations []*OutputViolation
+
+// Returns true if any of the violations are fatal.
+func (self OutputViolations) Fatal() bool {
+	for _, v := range self {
+		if v.Fatal {
+			return true
+		}
+	}
+	return false
+}
+
+// Format the violations, one per line.
+func (self OutputViolations) String() string {
+	var buf strings.Builder
+	for _, v := range self {
+		buf.WriteString(v.String())
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// Split the violations into hard errors and "soft" error messages, in the
+// same form as returned by LazyArgumentMap.ValidateOutputs.  Missing files
+// are not included in either.
+func (self OutputViolations) split() (error, string) {
+	var result, alarms strings.Builder
+	for _, v := range self {
+		if v.Missing {
+			continue
+		} else if v.Fatal {
+			result.WriteString(v.String())
+			result.WriteByte('\n')
+		} else {
+			alarms.WriteString(v.String())
+			alarms.WriteByte('\n')
+		}
+	}
+	if result.Len() == 0 {
+		return nil, alarms.String()
+	}
+	return errors.New(result.String()), alarms.String()
+}
+
+// Get the kind of json value in the given message.
+func jsonKind(val json.RawMessage) string {
+	val = bytes.TrimSpace(val)
+	if len(val) == 0 {
+		return jsonKindNull
+	}
+	switch val[0] {
+	case '"':
+		return jsonKindString
+	case '{':
+		return jsonKindObject
+	case '[':
+		return jsonKindArray
+	case 't', 'f':
+		return jsonKindBool
+	case 'n':
+		return jsonKindNull
+	default:
+		return jsonKindNumber
+	}
+}
+
+type outputChecker struct {
+	types *syntax.TypeLookup
+
+	// Relative file names are resolved relative to this path.  If it is
+	// empty, relative file names are not checked.
+	filesPath string
+
+	// If set, files are not checked for existence.
+	skipFiles bool
+
+	violations OutputViolations
+}
+
+func (self *outputChecker) add(path string, t syntax.Type, actual string,
+	fatal bool, msg string) *OutputViolation {
+	v := &OutputViolation{
+		Path:    path,
+		Actual:  actual,
+		Message: msg,
+		Fatal:   fatal,
+	}
+	if t != nil {
+		id := t.TypeId()
+		v.Expected = id.String()
+	}
+	self.violations = append(self.violations, v)
+	return v
+}
+
+// Check that the file named by the given value exists.
+func (self *outputChecker) checkFile(path string, t syntax.Type,
+	val json.RawMessage) {
+	var fn string
+	if err := json.Unmarshal(val, &fn); err != nil {
+		self.add(path, t, jsonKindString, true, err.Error())
+		return
+	}
+	if fn == "" || self.skipFiles {
+		return
+	}
+	if !filepath.IsAbs(fn) {
+		if self.filesPath == "" {
+			return
+		}
+		fn = filepath.Join(self.filesPath, fn)
+	}
+	if _, err := os.Stat(fn); err != nil {
+		if os.IsNotExist(err) {
+			self.add(path, t, jsonKindString, false,
+				"file does not exist: "+fn).Missing = true
+		} else {
+			self.add(path, t, jsonKindString, false, err.Error())
+		}
+	}
+}
+
+func (self *outputChecker) check(path string, t syntax.Type,
+	val json.RawMessage) {
+	kind := jsonKind(val)
+	if kind == jsonKindNull {
+		return
+	}
+	switch t := t.(type) {
+	case *syntax.BuiltinType:
+		self.checkBuiltin(path, t, kind, val)
+	case *syntax.UserType:
+		if kind != jsonKindString {
+			// For backwards compatibility this is not fatal.
+			self.add(path, t, kind, false, "")
+		} else {
+			self.checkFile(path, t, val)
+		}
+	case *syntax.ArrayType:
+		var arr []json.RawMessage
+		if kind != jsonKindArray {
+			self.add(path, t, kind, true, "")
+			return
+		} else if err := json.Unmarshal(val, &arr); err != nil {
+			self.add(path, t, kind, true, err.Error())
+			return
+		}
+		elem := t.Elem
+		if t.Dim > 1 {
+			id := t.TypeId()
+			id.ArrayDim--
+			elem = self.types.Get(id)
+		}
+		for i, v := range arr {
+			self.check(path+"["+strconv.Itoa(i)+"]", elem, v)
+		}
+	case *syntax.TypedMapType:
+		var m map[string]json.RawMessage
+		if kind != jsonKindObject {
+			self.add(path, t, kind, true, "")
+			return
+		} else if err := json.Unmarshal(val, &m); err != nil {
+			self.add(path, t, kind, true, err.Error())
+			return
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		isDir := t.IsFile() == syntax.KindIsDirectory
+		for _, k := range keys {
+			p := path + "[" + strconv.Quote(k) + "]"
+			if isDir {
+				if err := syntax.IsLegalUnixFilename(k); err != nil {
+					self.add(p, t.Elem, jsonKind(m[k]), true, err.Error())
+				}
+			}
+			self.check(p, t.Elem, m[k])
+		}
+	case *syntax.StructType:
+		var m map[string]json.RawMessage
+		if kind != jsonKindObject {
+			self.add(path, t, kind, true, "")
+			return
+		} else if err := json.Unmarshal(val, &m); err != nil {
+			self.add(path, t, kind, true, err.Error())
+			return
+		}
+		for _, member := range t.Members {
+			self.checkMember(path+"."+member.Id, member.Tname, m, member.Id)
+		}
+	default:
+		var alarms strings.Builder
+		if err := t.IsValidJson(val, &alarms, self.types); err != nil {
+			self.add(path, t, kind, true, err.Error())
+		} else if alarms.Len() > 0 {
+			self.add(path, t, kind, false,
+				strings.TrimSpace(alarms.String()))
+		}
+	}
+}
+
+func (self *outputChecker) checkBuiltin(path string, t *syntax.BuiltinType,
+	kind string, val json.RawMessage) {
+	switch t.Id {
+	case syntax.KindString, syntax.KindPath, syntax.KindFile:
+		if kind != jsonKindString {
+			self.add(path, t, kind, true, "")
+		} else if t.Id != syntax.KindString {
+			self.checkFile(path, t, val)
+		}
+	case syntax.KindInt:
+		var i int64
+		if kind != jsonKindNumber {
+			self.add(path, t, kind, true, "")
+		} else if err := json.Unmarshal(val, &i); err != nil {
+			self.add(path, t, kind, true,
+				"value "+string(val)+" is not an integer")
+		}
+	case syntax.KindFloat:
+		if kind != jsonKindNumber {
+			self.add(path, t, kind, true, "")
+		}
+	case syntax.KindBool:
+		if kind != jsonKindBool {
+			self.add(path, t, kind, true, "")
+		}
+	case syntax.KindMap:
+		if kind != jsonKindObject {
+			self.add(path, t, kind, true, "")
+		}
+	}
+}
+
+// Check a member of a struct or a top-level output.
+func (self *outputChecker) checkMember(path string, tid syntax.TypeId,
+	m map[string]json.RawMessage, id string) {
+	t := self.types.Get(tid)
+	if t == nil {
+		panic("unknown type " + tid.String())
+	}
+	if val, ok := m[id]; !ok {
+		self.add(path, t, jsonKindMissing, true, "")
+	} else {
+		self.check(path, t, val)
+	}
+}
+
+// CheckOutputs validates the outputs of a stage, in the same way as
+// ValidateOutputs, but returns every problem found, including values nested
+// inside of structs, maps, and arrays.  Every file-typed value is also checked
+// for existence, except for those of the optional parameters, which the
+// runtime may have pre-populated, for example with join-level outputs in the
+// outputs of a chunk.  Relative file names are resolved relative to filesPath.
+func (self LazyArgumentMap) CheckOutputs(types *syntax.TypeLookup,
+	filesPath string,
+	expected *syntax.OutParams,
+	optional ...*syntax.OutParams) OutputViolations {
+	checker := outputChecker{
+		types:     types,
+		filesPath: filesPath,
+	}
+	for _, param := range expected.List {
+		checker.checkMember("$."+param.GetId(), param.GetTname(),
+			self, param.GetId())
+	}
+	keys := make([]string, 0, len(self))
+	for key := range self {
+		if _, ok := expected.Table[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		isOptional := false
+		for _, params := range optional {
+			if param, ok := params.Table[key]; ok {
+				isOptional = true
+				checker.skipFiles = true
+				checker.checkMember("$."+key, param.GetTname(), self, key)
+				checker.skipFiles = false
+				break
+			}
+		}
+		if !isOptional {
+			checker.add("$."+key, nil, jsonKind(self[key]), false, "")
+		}
+	}
+	return checker.violations
+}
+
+// Record the violations, if any, for the given metadata if its outputs were
+// rejected.  Otherwise, any missing files are only logged.
+func writeOutputViolations(m *Metadata, violations OutputViolations, ok bool) {
+	if !ok && len(violations) > 0 {
+		m.Write(OutsViolations, violations)
+		return
+	} else if m.exists(OutsViolations) {
+		m.remove(OutsViolations)
+	}
+	for _, v := range violations {
+		if v.Missing {
+			util.LogInfo("runtime", "(outputs)         %s: %s",
+				m.fqname, v.String())
+		}
+	}
+}
+
+// Get the output violations recorded for the metadata with the given name.
+func (self *Node) getOutputViolations(fqname string) OutputViolations {
+	for _, metadata := range self.collectMetadatas() {
+		if metadata.fqname != fqname || !metadata.exists(OutsViolations) {
+			continue
+		}
+		var violations OutputViolations
+		if err := metadata.ReadInto(OutsViolations, &violations); err != nil {
+			util.LogError(err, "runtime",
+				"Could not read output violations for %s", fqname)
+			return nil
+		}
+		return violations
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+func TestCheckOutputs(t *testing.T) {
+	_, _, ast, err := syntax.ParseSourceBytes([]byte(`
+filetype txt;
+
+struct SAMPLE(
+    string name,
+    txt    reads,
+)
+
+stage STAGE(
+    out int         count,
+    out txt[]       logs,
+    out map<SAMPLE> samples,
+    out SAMPLE      first,
+    src py          "stage",
+)
+`), "example.mro", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage := ast.Callables.Table["STAGE"].(*syntax.Stage)
+
+	dir, err := ioutil.TempDir("", "TestCheckOutputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exists := filepath.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(exists, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.txt")
+
+	var outs LazyArgumentMap
+	if err := json.Unmarshal([]byte(`{
+		"count": 1.5,
+		"logs": [`+
+		strings.Join([]string{
+			jsonQuote(exists),
+			jsonQuote(missing),
+			"3",
+		}, ",")+`],
+		"samples": {
+			"x": {"name": "x", "reads": `+jsonQuote(exists)+`},
+			"y": {"reads": "missing.txt"}
+		},
+		"first": null,
+		"extra": true
+	}`), &outs); err != nil {
+		t.Fatal(err)
+	}
+	violations := outs.CheckOutputs(&ast.TypeTable, dir, stage.OutParams)
+	expect := []OutputViolation{
+		{
+			Path:     "$.count",
+			Expected: "int",
+			Actual:   "number",
+			Message:  "value 1.5 is not an integer",
+			Fatal:    true,
+		},
+		{
+			Path:     "$.logs[1]",
+			Expected: "txt",
+			Actual:   "string",
+			Message:  "file does not exist: " + missing,
+			Missing:  true,
+		},
+		{
+			Path:     "$.logs[2]",
+			Expected: "txt",
+			Actual:   "number",
+		},
+		{
+			Path:     `$.samples["y"].name`,
+			Expected: "string",
+			Actual:   "missing",
+			Fatal:    true,
+		},
+		{
+			Path:     `$.samples["y"].reads`,
+			Expected: "txt",
+			Actual:   "string",
+			Message:  "file does not exist: " + missing,
+			Missing:  true,
+		},
+		{
+			Path:   "$.extra",
+			Actual: "boolean",
+		},
+	}
+	if len(violations) != len(expect) {
+		t.Fatalf("Expected %d violations, got\n%s",
+			len(expect), violations.String())
+	}
+	for i, e := range expect {
+		if *violations[i] != e {
+			t.Errorf("Expected\n%s\ngot\n%s",
+				e.String(), violations[i].String())
+		}
+	}
+	if !violations.Fatal() {
+		t.Error("Expected fatal violations.")
+	}
+	err, alarms := violations.split()
+	if err == nil {
+		t.Error("Expected an error.")
+	} else if e := "$.count: expected int, got number: " +
+		"value 1.5 is not an integer\n" +
+		"$.samples[\"y\"].name: expected string, got missing\n"; err.Error() != e {
+		t.Errorf("Expected errors\n%s\ngot\n%s", e, err.Error())
+	}
+	// Missing files are not alarms.
+	if n := strings.Count(alarms, "\n"); n != 2 {
+		t.Errorf("Expected 2 alarms, got\n%s", alarms)
+	}
+
+	// Files for optional outputs are not checked.
+	violations = LazyArgumentMap{
+		"count": json.RawMessage(`1`),
+		"logs":  json.RawMessage(`[` + jsonQuote(missing) + `]`),
+	}.CheckOutputs(&ast.TypeTable, dir, &syntax.OutParams{
+		Table: map[string]*syntax.OutParam{
+			"count": stage.OutParams.Table["count"],
+		},
+		List: []*syntax.OutParam{stage.OutParams.Table["count"]},
+	}, stage.OutParams)
+	if len(violations) != 0 {
+		t.Errorf("Expected no violations, got\n%s", violations.String())
+	}
+}
+
+func jsonQuote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func TestVerifyOutputMissingFile(t *testing.T) {
+	invokeTestWith(`
+filetype txt;
+
+stage REPORT(
+    in  int[] values,
+    out txt   report,
+    src comp  "stages/report",
+) split (
+    in  int   value,
+    out int   double,
+)
+
+call REPORT(
+    values = [1],
+)
+`, t, func(t *testing.T, ps *Pipestance) {
+		node := ps.findNode("REPORT.REPORT")
+		if err := node.mkdirs(); err != nil {
+			t.Fatal(err)
+		}
+		fork := node.forks[0]
+		chunk := NewChunk(fork, 0, &ChunkDef{}, 1)
+		if err := chunk.mkdirs(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The join-level output pre-populated in the chunk outs.
+		if !chunk.verifyOutput(LazyArgumentMap{
+			"report": json.RawMessage(jsonQuote(
+				filepath.Join(chunk.metadata.FilesPath(), "report.txt"))),
+			"double": json.RawMessage(`2`),
+		}) {
+			t.Error("Expected chunk outputs to be accepted.")
+		}
+		if chunk.metadata.exists(OutsViolations) || chunk.metadata.exists(Errors) {
+			t.Error("Expected no violations for the chunk.")
+		}
+
+		// A declared output file which the stage did not write.
+		outs := LazyArgumentMap{
+			"report": json.RawMessage(jsonQuote(
+				filepath.Join(fork.metadata.FilesPath(), "report.txt"))),
+		}
+		if ok, msg := fork.verifyOutput(outs); !ok || msg != "" {
+			t.Errorf("Expected outputs to be accepted, got %q", msg)
+		}
+		if fork.metadata.exists(OutsViolations) {
+			t.Error("Expected no violations for a successful fork.")
+		}
+
+		// Violations are recorded for rejected outputs.
+		outs["report"] = json.RawMessage(`1`)
+		if ok, _ := fork.verifyOutput(outs); ok {
+			t.Error("Expected outputs to be rejected.")
+		}
+		if v := node.getOutputViolations(fork.metadata.fqname); len(v) != 1 {
+			t.Errorf("Expected 1 violation, got\n%s", v.String())
+		}
+	})
+}
@@ -37,7 +37,7 @@ import (
 // (ID.pipestance.pipe.pipe.pipe.....stage) with the initial ID and pipestance
 // trimmed off. This allows for comparisons between different pipestances with
 // the same (or similar) shapes.
-func partiallyQualifiedName(n string) string {
+func PartiallyQualifiedName(n string) string {
 	for count := 0; count < 2 && len(n) > 0; n = n[1:] {
 		if n[0] == '.' {
 			count++
@@ -51,6 +51,11 @@ func partiallyQualifiedName(n string) string {
 type StageOverride struct {
 	ForceVolatile *bool `json:"force_volatile,omitempty"`
 
+	// The scheduling priority for the stage's jobs, when the local job
+	// manager is not using the fifo schedule policy.  Higher values
+	// start first.
+	Priority *int `json:"priority,omitempty"`
+
 	JoinThreads *float64     `json:"join.threads,omitempty"`
 	JoinMem     *float64     `json:"join.mem_gb,omitempty"`
 	JoinVMem    *float64     `json:"join.vmem_gb,omitempty"`
@@ -134,7 +139,7 @@ func getParent(n string) string {
 //
 // def  is the default value to use if the value is not overridden
 func (pse *PipestanceOverrides) GetForceVolatile(node string, def bool) bool {
-	pqn := partiallyQualifiedName(node)
+	pqn := PartiallyQualifiedName(node)
 	for pqn != "" {
 		so := pse.overridesbystage[pqn]
 		if so == nil || so.ForceVolatile == nil {
@@ -151,10 +156,28 @@ func (pse *PipestanceOverrides) GetForceVolatile(node string, def bool) bool {
 	return def
 }
 
+// Compute the scheduling priority for a stage, which might be overridden.
+//
+// node is the fully qualified node name
+//
+// def  is the default value to use if the value is not overridden
+func (pse *PipestanceOverrides) GetPriority(node string, def int) int {
+	pqn := PartiallyQualifiedName(node)
+	for pqn != "" {
+		so := pse.overridesbystage[pqn]
+		if so == nil || so.Priority == nil {
+			pqn = getParent(pqn)
+		} else {
+			return *so.Priority
+		}
+	}
+	return def
+}
+
 // GetResources applies any resource overrides for the given node/phase to
 // the given resource object.
 func (pse *PipestanceOverrides) GetResources(node string, phase string, res *JobResources) {
-	pqn := partiallyQualifiedName(node)
+	pqn := PartiallyQualifiedName(node)
 	res.Threads = pse.getThreads(pqn, phase, res.Threads)
 	res.MemGB = pse.getMem(pqn, phase, res.MemGB)
 	res.VMemGB = pse.getVMem(pqn, phase, res.VMemGB)
@@ -233,7 +256,7 @@ func (pse *PipestanceOverrides) getVMem(pqn string, phase string, def float64) f
 //
 // |def|  is the default value to use if the value is not overridden
 func (pse *PipestanceOverrides) GetProfile(node string, phase string, def ProfileMode) ProfileMode {
-	pqn := partiallyQualifiedName(node)
+	pqn := PartiallyQualifiedName(node)
 	for pqn != "" {
 		val := pse.overridesbystage[pqn].GetProfile(phase)
 		if val == nil {
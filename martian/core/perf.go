@@ -173,7 +173,17 @@ type PerfInfo struct {
 	// For split/main/join nodes, Duration * NumThreads.
 	// For other nodes, it is the sum of the CoreHours for
 	// child nodes.
-	CoreHours       float64 `json:"core_hours"`
+	CoreHours float64 `json:"core_hours"`
+
+	// The memory reservation for split/main/join nodes, in GB.
+	// For other nodes, the largest reservation of any child node.
+	MemGB float64 `json:"mem_gb"`
+
+	// For split/main/join nodes, Duration * MemGB, in GB-hours.
+	// For other nodes, it is the sum of the MemGBHours for
+	// child nodes.
+	MemGBHours float64 `json:"mem_gb_hours"`
+
 	MaxRss          int     `json:"maxrss"`
 	MaxVmem         int     `json:"maxvmem"`
 	InBlocks        int     `json:"in_blocks"`
@@ -269,6 +279,8 @@ func reduceJobInfo(jobInfo *JobInfo, outputPaths []string, numThreads float64) *
 		perfInfo.Duration = jobInfo.WallClockInfo.Duration
 		perfInfo.WallTime = perfInfo.End.Sub(perfInfo.Start).Seconds()
 	}
+	perfInfo.MemGB = jobInfo.MemGB
+	perfInfo.MemGBHours = jobInfo.MemGB * perfInfo.Duration / 3600.0
 	if jobInfo.RusageInfo != nil {
 		self := jobInfo.RusageInfo.Self
 		children := jobInfo.RusageInfo.Children
@@ -336,6 +348,8 @@ func ComputeStats(perfInfos []*PerfInfo, outputPaths []string, vdrKillReport *VD
 		aggPerfInfo.NumThreads += perfInfo.NumThreads
 		aggPerfInfo.Duration += perfInfo.Duration
 		aggPerfInfo.CoreHours += perfInfo.CoreHours
+		aggPerfInfo.MemGB = fmax(aggPerfInfo.MemGB, perfInfo.MemGB)
+		aggPerfInfo.MemGBHours += perfInfo.MemGBHours
 		aggPerfInfo.MaxRss = max(aggPerfInfo.MaxRss, perfInfo.MaxRss)
 		aggPerfInfo.MaxVmem = max(aggPerfInfo.MaxVmem, perfInfo.MaxVmem)
 		aggPerfInfo.OutBlocks += perfInfo.OutBlocks
@@ -9,11 +9,13 @@ package core
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime/trace"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -597,6 +599,9 @@ func (self *Pipestance) StepNodes(ctx context.Context) bool {
 				"Error refreshing cluster resources: %s", err.Error())
 		}
 	}
+	if top := self.node.top; top.maxJobs > 0 {
+		top.jobSlots = top.maxJobs - self.jobsInFlight()
+	}
 	hadProgress := false
 	for _, node := range self.node.getFrontierNodes() {
 		hadProgress = node.step() || hadProgress
@@ -609,6 +614,31 @@ func (self *Pipestance) StepNodes(ctx context.Context) bool {
 	return hadProgress
 }
 
+// Limit the number of jobs the pipestance may have queued or running at
+// once, so that pipestances sharing a runtime share its job managers.  Zero
+// means no limit.
+func (self *Pipestance) SetMaxJobs(n int) {
+	self.node.top.maxJobs = n
+}
+
+// Count the jobs of the pipestance which are queued or running.
+func (self *Pipestance) jobsInFlight() int {
+	count := 0
+	for _, node := range self.allNodes() {
+		if node.call.Kind() != syntax.KindStage {
+			continue
+		}
+		for _, fork := range node.forks {
+			for _, md := range fork.collectMetadatas()[1:] {
+				if state, _ := md.getState(); state == Queued || state == Running {
+					count++
+				}
+			}
+		}
+	}
+	return count
+}
+
 func (self *Pipestance) Reset() error {
 	if self.readOnly() {
 		return &RuntimeError{"Pipestance is in read only mode."}
@@ -654,6 +684,8 @@ func (self *Pipestance) Serialize(name MetadataFileName) interface{} {
 		return self.SerializeState()
 	case Perf:
 		return self.SerializePerf()
+	case TraceFile:
+		return self.SerializeTrace()
 	default:
 		panic(fmt.Sprintf("Unsupported serialization type: %v", name))
 	}
@@ -707,6 +739,13 @@ func (self *Pipestance) ZipMetadata(zipPath string) error {
 	for _, node := range nodes {
 		metadatas = append(metadatas, node.collectMetadatas()...)
 	}
+	if store, ok := self.node.top.metadataStore().(externalMetadataStore); ok {
+		// Move the metadata into files, so that it is included in the zip.
+		if err := store.export(); err != nil {
+			util.LogError(err, "runtime", "Failed to export metadata")
+			return err
+		}
+	}
 	filePaths := make([]string, 0, 7*len(metadatas))
 	removePaths := make([]string, 0, len(metadatas))
 	for _, metadata := range metadatas {
@@ -742,6 +781,25 @@ func (self *Pipestance) GetPath() string {
 	return self.node.parent.getNode().path
 }
 
+// Get the content of a metadata file, given either its absolute path or its
+// path relative to the pipestance directory.  Unlike Runtime.GetMetadata,
+// this also finds metadata which is not kept in files.
+func (self *Pipestance) GetMetadata(metadataPath string) (io.ReadCloser, error) {
+	if store := self.node.top.metadataStore(); store != defaultMetadataStore {
+		p := metadataPath
+		if !filepath.IsAbs(p) {
+			p = path.Join(self.GetPath(), p)
+		}
+		if base := path.Base(p); strings.HasPrefix(base, MetadataFilePrefix) {
+			if f, _, err := store.Open(path.Dir(p),
+				metadataFileNameFromPath(base)); err == nil {
+				return f, nil
+			}
+		}
+	}
+	return self.node.top.rt.GetMetadata(self.GetPath(), metadataPath)
+}
+
 func (self *Pipestance) GetInvocation() interface{} {
 	return self.node.parent.getNode().top.invocation
 }
@@ -769,6 +827,10 @@ func (self *Pipestance) GetVersions() (string, string, error) {
 
 func (self *Pipestance) PostProcess() {
 	self.node.postProcess()
+	if err := writeOutputManifest(self.GetPath(),
+		self.node.top.rt.Config.OutputHash); err != nil {
+		util.PrintError(err, "runtime", "Could not write output manifest")
+	}
 	self.metadata.WriteRaw(TimestampFile, self.metadata.readRaw(TimestampFile)+"\nend: "+util.Timestamp())
 	self.Immortalize(false)
 }
@@ -788,6 +850,9 @@ func (self *Pipestance) Immortalize(force bool) error {
 	if !self.metadata.exists(FinalState) {
 		self.metadata.Write(FinalState, self.SerializeState())
 	}
+	if !self.metadata.exists(TraceFile) {
+		self.metadata.Write(TraceFile, self.SerializeTrace())
+	}
 	if !self.metadata.exists(MetadataZip) {
 		zipPath := self.metadata.MetadataFilePath(MetadataZip)
 		if err := self.ZipMetadata(zipPath); err != nil {
@@ -832,6 +897,12 @@ func (self *Pipestance) Lock() error {
 	}
 	util.RegisterSignalHandler(self)
 	self.metadata.WriteTime(Lock)
+	if store, ok := self.node.top.metadataStore().(externalMetadataStore); ok {
+		if err := store.openWrite(); err != nil {
+			self.Unlock()
+			return err
+		}
+	}
 	return nil
 }
 
@@ -840,6 +911,11 @@ func (self *Pipestance) unlock() {
 }
 
 func (self *Pipestance) Unlock() {
+	if store, ok := self.node.top.metadataStore().(externalMetadataStore); ok {
+		if err := store.Close(); err != nil {
+			util.LogError(err, "runtime", "Failed to close metadata store")
+		}
+	}
 	self.unlock()
 	util.UnregisterSignalHandler(self)
 }
@@ -893,10 +969,50 @@ type TopNode struct {
 	invocation  *InvocationData
 	version     VersionInfo
 	allNodes    map[string]*Node
+
+	// The store for node and fork metadata.
+	store MetadataStore
+
+	// The maximum number of jobs the pipestance may have queued or running
+	// at once, or 0 for no limit.
+	maxJobs int
+
+	// The number of jobs which may still be started during the current
+	// step, if maxJobs is set.
+	jobSlots int
 }
 
 func (self *TopNode) getNode() *Node { return &self.node }
 
+// Reserve a slot for starting a job, if the pipestance is not already
+// running its maximum number of jobs.
+func (self *TopNode) takeJobSlot() bool {
+	if self.maxJobs <= 0 {
+		return true
+	}
+	if self.jobSlots <= 0 {
+		return false
+	}
+	self.jobSlots--
+	return true
+}
+
+// Get the store for node and fork metadata.
+func (self *TopNode) metadataStore() MetadataStore {
+	if self.store == nil {
+		return defaultMetadataStore
+	}
+	return self.store
+}
+
+// Get the event log for the runtime, if any.
+func (self *TopNode) events() *EventLog {
+	if self.rt == nil {
+		return nil
+	}
+	return self.rt.Events
+}
+
 func (self *TopNode) GetFQName() string {
 	return self.fqname
 }
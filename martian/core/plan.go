@@ -0,0 +1,170 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Planning of the jobs which would be run for a pipestance, without running
+// any of them.
+
+import (
+	"encoding/json"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+// The planned resource reservation for one job of a stage.
+type JobPlan struct {
+	// The job type, e.g. split, main, or join.
+	Type string `json:"type"`
+
+	// The resources which would be requested, after applying overrides and
+	// the job manager's limits.
+	Resources JobResources `json:"resources"`
+
+	// The job script which would be submitted for the first fork of the
+	// stage, for job managers which render one.
+	Script string `json:"script,omitempty"`
+}
+
+// The planned state of one fork of a stage.
+type ForkPlan struct {
+	// The fork ID, or "fork0" for unforked stages.
+	Id string `json:"id"`
+
+	// Whether the fork would be disabled, or nil if that depends on the
+	// outputs of stages which have not run.
+	Disabled *bool `json:"disabled"`
+
+	// True if the set of forks depends on the outputs of stages which have
+	// not run.
+	Undetermined bool `json:"undetermined,omitempty"`
+
+	// An error evaluating the disabled modifiers, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// The planned jobs for a stage.
+type StagePlan struct {
+	Fqname    string      `json:"fqname"`
+	JobMode   string      `json:"jobmode"`
+	Preflight bool        `json:"preflight,omitempty"`
+	Skipped   bool        `json:"skipped,omitempty"`
+	Forks     []*ForkPlan `json:"forks"`
+	Jobs      []*JobPlan  `json:"jobs"`
+}
+
+// The planned jobs for a pipestance.
+type PipestancePlan struct {
+	Pipeline string       `json:"pipeline"`
+	JobMode  string       `json:"jobmode"`
+	Stages   []*StagePlan `json:"stages"`
+}
+
+// Returns the job script which the given job manager would submit, or an
+// empty string if the job manager does not use one.
+func renderJobScript(jobManager JobManager, shellCmd string, argv []string,
+	envs map[string]string, metadata *Metadata, res *JobResources,
+	fqname, shellName string) string {
+	switch jm := jobManager.(type) {
+	case *RemoteJobManager:
+		return jm.jobScript(shellCmd, argv, envs, metadata, res, fqname, shellName)
+	case *KubernetesJobManager:
+		if b, err := json.MarshalIndent(jm.jobSpec(shellCmd, argv, envs,
+			metadata, res, fqname, shellName), "", "    "); err == nil {
+			return string(b)
+		}
+	}
+	return ""
+}
+
+func (self *Fork) plan() *ForkPlan {
+	p := ForkPlan{Id: self.id}
+	if src := self.node.call.MapSource(); src != nil && !src.KnownLength() {
+		p.Undetermined = true
+	}
+	for _, part := range self.forkId {
+		if part.Id.IndexSource() != nil {
+			p.Undetermined = true
+		}
+	}
+	disabled, ready, err := self.evalDisabled()
+	if err != nil {
+		p.Error = err.Error()
+	}
+	if disabled || (ready && err == nil) {
+		p.Disabled = &disabled
+	}
+	return &p
+}
+
+// Get the planned job for a stage, rendering the job script using the
+// given metadata.
+func (self *Node) planJob(shellName, stageType string,
+	metadata *Metadata, fqname string) *JobPlan {
+	job := JobPlan{
+		Type:      shellName,
+		Resources: self.getJobReqs(nil, stageType),
+	}
+	jobManager := self.top.rt.JobManager
+	if self.local {
+		jobManager = self.top.rt.LocalJobManager
+	}
+	shellCmd, argv, envs := self.jobCommand(shellName, metadata)
+	job.Script = renderJobScript(jobManager, shellCmd, argv, envs,
+		metadata, &job.Resources, fqname, shellName)
+	return &job
+}
+
+func (self *Node) plan() *StagePlan {
+	p := StagePlan{
+		Fqname:    self.GetFQName(),
+		JobMode:   self.top.rt.Config.JobMode,
+		Preflight: self.call.Call().Modifiers.Preflight,
+		Forks:     make([]*ForkPlan, 0, len(self.forks)),
+	}
+	if self.local {
+		p.JobMode = localMode
+	}
+	p.Skipped = p.Preflight && self.top.rt.Config.SkipPreflight
+	for _, fork := range self.forks {
+		p.Forks = append(p.Forks, fork.plan())
+	}
+	if len(self.forks) == 0 {
+		return &p
+	}
+	fork := self.forks[0]
+	if fork.Split() {
+		p.Jobs = []*JobPlan{
+			self.planJob("split", STAGE_TYPE_SPLIT,
+				fork.split_metadata, fork.fqname),
+			self.planJob("join", STAGE_TYPE_JOIN,
+				fork.join_metadata, fork.fqname),
+		}
+	} else {
+		chunk := NewChunk(fork, 0, new(ChunkDef), 1)
+		p.Jobs = []*JobPlan{
+			self.planJob("main", STAGE_TYPE_CHUNK,
+				chunk.metadata, chunk.fqname),
+		}
+	}
+	return &p
+}
+
+// Compute the jobs which would be run for this pipestance, without running
+// any of them.  Disabled modifiers and forks are only evaluated to the extent
+// that they do not depend on the outputs of stages which have not yet run.
+//
+// Invoking a pipestance creates its directory structure, so for a dry run the
+// pipestance should be invoked in a scratch location.  The rendered job
+// scripts will refer to paths in that location.
+func (self *Pipestance) Plan() *PipestancePlan {
+	p := PipestancePlan{
+		Pipeline: self.GetPname(),
+		JobMode:  self.node.top.rt.Config.JobMode,
+	}
+	for _, node := range self.allNodes() {
+		if node.call.Kind() == syntax.KindStage {
+			p.Stages = append(p.Stages, node.plan())
+		}
+	}
+	return &p
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	invokeTestWith(`
+stage SUM_SQUARES(
+    in  float[] values,
+    out float   sum,
+    out bool    skip_report,
+    src comp    "stages/sum_squares",
+) split (
+    in  float   value,
+) using (
+    mem_gb = 3,
+)
+
+stage REPORT(
+    in  float   sum,
+    src exec    "stages/report",
+)
+
+stage SKIPPED(
+    in  float[] values,
+    src exec    "stages/skipped",
+)
+
+pipeline SUM_SQUARE_PIPELINE(
+    in  float[] values,
+    in  bool    skip,
+    out float   sum,
+)
+{
+    call SUM_SQUARES(
+        values = self.values,
+    )
+    call REPORT(
+        sum = SUM_SQUARES.sum,
+    ) using (
+        disabled = SUM_SQUARES.skip_report,
+    )
+    call SKIPPED(
+        values = self.values,
+    ) using (
+        disabled = self.skip,
+    )
+
+    return (
+        sum = SUM_SQUARES.sum,
+    )
+}
+
+call SUM_SQUARE_PIPELINE(
+    values = [1.0, 2.0, 3.0],
+    skip   = true,
+)
+`, t, func(t *testing.T, ps *Pipestance) {
+		plan := ps.Plan()
+		if plan.Pipeline != "SUM_SQUARE_PIPELINE" {
+			t.Errorf("Expected pipeline name, got %q", plan.Pipeline)
+		}
+		stages := make(map[string]*StagePlan, len(plan.Stages))
+		for _, stage := range plan.Stages {
+			stages[PartiallyQualifiedName(stage.Fqname)] = stage
+		}
+		if len(stages) != 3 {
+			t.Fatalf("Expected 3 stages, got %d", len(stages))
+		}
+		sum := stages["SUM_SQUARE_PIPELINE.SUM_SQUARES"]
+		if sum == nil {
+			t.Fatal("Missing SUM_SQUARES")
+		}
+		if len(sum.Jobs) != 2 ||
+			sum.Jobs[0].Type != "split" || sum.Jobs[1].Type != "join" {
+			t.Errorf("Expected split and join jobs, got %d", len(sum.Jobs))
+		} else if sum.Jobs[0].Resources.MemGB != 3 {
+			t.Errorf("Expected 3 GB for split, got %g",
+				sum.Jobs[0].Resources.MemGB)
+		}
+		if len(sum.Forks) != 1 || sum.Forks[0].Disabled == nil ||
+			*sum.Forks[0].Disabled {
+			t.Error("Expected SUM_SQUARES to be enabled.")
+		}
+		if report := stages["SUM_SQUARE_PIPELINE.REPORT"]; report == nil {
+			t.Error("Missing REPORT")
+		} else if len(report.Jobs) != 1 || report.Jobs[0].Type != "main" {
+			t.Error("Expected a single main job for REPORT")
+		} else if len(report.Forks) != 1 || report.Forks[0].Disabled != nil {
+			t.Error("Expected REPORT disabled state to be unknown.")
+		}
+		if skipped := stages["SUM_SQUARE_PIPELINE.SKIPPED"]; skipped == nil {
+			t.Error("Missing SKIPPED")
+		} else if len(skipped.Forks) != 1 || skipped.Forks[0].Disabled == nil ||
+			!*skipped.Forks[0].Disabled {
+			t.Error("Expected SKIPPED to be disabled.")
+		}
+	})
+}
@@ -0,0 +1,367 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Support for moving pipestances to a different directory.
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// Metadata files which may contain absolute paths to files in the
+// pipestance.
+var relocatedMetadata = map[MetadataFileName]bool{
+	ArgsFile:       true,
+	ChunkDefsFile:  true,
+	ChunkOutsFile:  true,
+	FinalState:     true,
+	JobInfoFile:    true,
+	OutsFile:       true,
+	OutsViolations: true,
+	Perf:           true,
+	StageCacheFile: true,
+	StageDefsFile:  true,
+	VdrKill:        true,
+	PartialVdr:     true,
+}
+
+// RelocatePipestance moves a pipestance from oldPath to newPath, and updates
+// the absolute paths embedded in its metadata, as well as absolute symlinks,
+// which referred to locations under oldPath.
+//
+// If oldPath does not exist but newPath does, the pipestance is assumed to
+// have already been moved, for example by copying it to another filesystem,
+// and only the embedded paths are updated.
+func RelocatePipestance(oldPath, newPath string) error {
+	oldPath, err := filepath.Abs(oldPath)
+	if err != nil {
+		return err
+	}
+	newPath, err = filepath.Abs(newPath)
+	if err != nil {
+		return err
+	}
+	if oldPath == newPath {
+		return &RuntimeError{"the new pipestance path is the same as the old one"}
+	}
+	if _, err := os.Lstat(oldPath); err == nil {
+		if _, err := os.Lstat(newPath); err == nil {
+			return &RuntimeError{newPath + " already exists"}
+		}
+		if err := os.Rename(oldPath, newPath); err != nil {
+			if le, ok := err.(*os.LinkError); ok && le.Err == syscall.EXDEV {
+				return &RuntimeError{
+					"cannot move a pipestance to a different filesystem.  " +
+						"Copy it to " + newPath + " first, and then relocate it again",
+				}
+			}
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return relocatePipestancePaths(oldPath, newPath)
+}
+
+// Update the absolute paths embedded in the metadata of the pipestance at
+// newPath, as well as absolute symlinks, which referred to locations under
+// oldPath.
+func relocatePipestancePaths(oldPath, newPath string) error {
+	metadata := NewMetadata("", newPath)
+	metadata.loadCache()
+	if !metadata.exists(InvocationFile) {
+		return &PipestancePathError{newPath}
+	}
+	if metadata.exists(Lock) {
+		return &PipestanceLockedError{path.Base(newPath), newPath}
+	}
+	var store MetadataStore = defaultMetadataStore
+	if metadata.exists(MetadataStoreFile) {
+		kv, err := openKVStore(newPath, metadata.MetadataFilePath(MetadataStoreFile))
+		if err != nil {
+			return err
+		}
+		if err := kv.openWrite(); err != nil {
+			return err
+		}
+		defer kv.Close()
+		store = kv
+	}
+	if err := relocateMetadata(newPath, oldPath, store); err != nil {
+		return err
+	}
+	return metadata.WriteRaw(PsdirFile, newPath)
+}
+
+// Check whether the pipestance was moved since it last ran, and if so
+// update the paths embedded in its metadata to refer to the new location.
+// The current location is then recorded for next time.
+//
+// In read-only mode, the metadata is left as it is, so paths in the
+// metadata may refer to the old location.
+func (self *Pipestance) checkRelocated(readOnly bool) error {
+	p, err := filepath.Abs(self.GetPath())
+	if err != nil {
+		return err
+	}
+	old, err := self.metadata.readRawSafe(PsdirFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if old == p {
+		return nil
+	}
+	if old != "" {
+		if oldInfo, err := os.Stat(old); err == nil {
+			if info, err := os.Stat(p); err == nil && os.SameFile(info, oldInfo) {
+				// Same directory, through a different path.
+				return nil
+			}
+		}
+	}
+	if readOnly {
+		if old != "" {
+			util.LogInfo("runtime",
+				"Pipestance was moved from %s.  "+
+					"Metadata may still refer to the old location.",
+				old)
+		}
+		return nil
+	}
+	if old != "" {
+		util.LogInfo("runtime",
+			"Pipestance was moved from %s.  Updating paths in metadata.",
+			old)
+		if err := relocateMetadata(p, old, self.node.top.metadataStore()); err != nil {
+			return err
+		}
+	}
+	return self.metadata.WriteRaw(PsdirFile, p)
+}
+
+// Rewrite paths under oldPath in metadata files and symlinks in the
+// pipestance at root, including those in zipped metadata.  Metadata in the
+// given store is also updated, if it is not the file store.
+func relocateMetadata(root, oldPath string, store MetadataStore) error {
+	r := newPathRelocator(oldPath, root)
+	if err := r.relocateZip(path.Join(root,
+		MetadataZip.FileName())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path.Dir(p) == root && info.IsDir() {
+			switch info.Name() {
+			case "journal", "tmp":
+				return filepath.SkipDir
+			}
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return r.relocateSymlink(p)
+		}
+		if !info.Mode().IsRegular() ||
+			!strings.HasPrefix(info.Name(), MetadataFilePrefix) {
+			return nil
+		}
+		name := metadataFileNameFromPath(p)
+		if !relocatedMetadata[name] {
+			return nil
+		}
+		dir := path.Dir(p)
+		b, err := defaultMetadataStore.ReadFile(dir, name)
+		if err != nil {
+			return err
+		}
+		if b, ok := r.rewrite(b); ok {
+			return defaultMetadataStore.WriteAtomic(dir, name, b)
+		}
+		return nil
+	})
+	if err != nil || store == defaultMetadataStore {
+		return err
+	}
+	return WalkMetadataStore(root, func(dir string,
+		name MetadataFileName, data []byte) error {
+		if !relocatedMetadata[name] {
+			return nil
+		}
+		if b, ok := r.rewrite(data); ok {
+			return store.WriteAtomic(path.Join(root, dir), name, b)
+		}
+		return nil
+	})
+}
+
+// Replaces paths under one directory with the corresponding path under
+// another.
+type pathRelocator struct {
+	oldPath, newPath string
+
+	// The json-encoded paths, without the closing quote.
+	oldJson, newJson []byte
+}
+
+func newPathRelocator(oldPath, newPath string) *pathRelocator {
+	return &pathRelocator{
+		oldPath: oldPath,
+		newPath: newPath,
+		oldJson: jsonPathPrefix(oldPath),
+		newJson: jsonPathPrefix(newPath),
+	}
+}
+
+func jsonPathPrefix(p string) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(p); err != nil {
+		panic(err)
+	}
+	// Remove the closing quote and newline.
+	return buf.Bytes()[:buf.Len()-2]
+}
+
+// Rewrite json strings which are equal to the old path, or start with the
+// old path followed by a path separator.  Returns false if nothing changed.
+func (self *pathRelocator) rewrite(b []byte) ([]byte, bool) {
+	var result []byte
+	start := 0
+	for i := bytes.Index(b, self.oldJson); i >= 0; {
+		end := i + len(self.oldJson)
+		if end < len(b) && (b[end] == '/' || b[end] == '"') {
+			if result == nil {
+				result = make([]byte, 0, len(b)+len(self.newJson)-len(self.oldJson))
+			}
+			result = append(result, b[start:i]...)
+			result = append(result, self.newJson...)
+			start = end
+		}
+		if j := bytes.Index(b[end:], self.oldJson); j >= 0 {
+			i = end + j
+		} else {
+			i = -1
+		}
+	}
+	if result == nil {
+		return b, false
+	}
+	return append(result, b[start:]...), true
+}
+
+// Returns the location under the new path corresponding to a symlink target
+// under the old path.  Returns false if the target is not under the old path.
+func (self *pathRelocator) relocateTarget(target string) (string, bool) {
+	if !filepath.IsAbs(target) || !pathIsInside(target, self.oldPath) {
+		return target, false
+	}
+	rel, err := filepath.Rel(self.oldPath, target)
+	if err != nil {
+		return target, false
+	}
+	return path.Join(self.newPath, rel), true
+}
+
+// Re-target a symlink to a location under the old path.
+func (self *pathRelocator) relocateSymlink(p string) error {
+	target, err := os.Readlink(p)
+	if err != nil {
+		return err
+	}
+	target, ok := self.relocateTarget(target)
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	return os.Symlink(target, p)
+}
+
+// Rewrite the metadata files and symlinks in a metadata zip file.  The zip
+// is replaced only if something changed, so that pipestances finished with
+// --zip remain zipped after they are moved.
+func (self *pathRelocator) relocateZip(zipPath string) error {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	f, err := ioutil.TempFile(path.Dir(zipPath), path.Base(zipPath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if info, err := os.Stat(zipPath); err != nil {
+		return err
+	} else if err := f.Chmod(info.Mode()); err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	changed := false
+	for _, zf := range zr.File {
+		b, err := readZipEntry(zf)
+		if err != nil {
+			return err
+		}
+		if zf.Mode()&os.ModeSymlink != 0 {
+			if target, ok := self.relocateTarget(string(b)); ok {
+				b, changed = []byte(target), true
+			}
+		} else if strings.HasPrefix(path.Base(zf.Name), MetadataFilePrefix) &&
+			relocatedMetadata[metadataFileNameFromPath(zf.Name)] {
+			var ok bool
+			if b, ok = self.rewrite(b); ok {
+				changed = true
+			}
+		}
+		header := zip.FileHeader{
+			Name:     zf.Name,
+			Method:   zf.Method,
+			Modified: zf.Modified,
+		}
+		header.SetMode(zf.Mode())
+		out, err := zw.CreateHeader(&header)
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(b); err != nil {
+			return err
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), zipPath)
+}
+
+func readZipEntry(zf *zip.File) ([]byte, error) {
+	in, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	var buf bytes.Buffer
+	buf.Grow(int(zf.UncompressedSize64))
+	_, err = io.Copy(&buf, in)
+	return buf.Bytes(), err
+}
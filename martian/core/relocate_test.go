@@ -0,0 +1,171 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/martian-lang/martian/martian/util"
+)
+
+func TestPathRelocatorRewrite(t *testing.T) {
+	r := newPathRelocator("/old/ps", "/new/location/ps")
+	check := func(in, expect string) {
+		t.Helper()
+		out, changed := r.rewrite([]byte(in))
+		if string(out) != expect {
+			t.Errorf("Expected\n%s\ngot\n%s", expect, out)
+		}
+		if changed != (in != expect) {
+			t.Errorf("Incorrect change flag for %s", in)
+		}
+	}
+	check(`{"a": "/old/ps/PIPE/fork0/files/a.txt"}`,
+		`{"a": "/new/location/ps/PIPE/fork0/files/a.txt"}`)
+	check(`["/old/ps", "/old/ps/x", "/old/ps2/x", "/other/old/ps/x"]`,
+		`["/new/location/ps", "/new/location/ps/x", "/old/ps2/x", "/other/old/ps/x"]`)
+	check(`"/old/ps`, `"/old/ps`)
+	check(`{}`, `{}`)
+}
+
+func TestRelocatePipestance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRelocatePipestance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldPath := path.Join(dir, "old")
+	newPath := path.Join(dir, "new")
+	fork := path.Join(oldPath, "PIPE", "STAGE", "fork0")
+	check(os.MkdirAll(path.Join(fork, "files"), 0755))
+	check(os.MkdirAll(path.Join(oldPath, "outs"), 0755))
+	write := func(p, content string) {
+		t.Helper()
+		check(ioutil.WriteFile(p, []byte(content), 0644))
+	}
+	write(path.Join(oldPath, InvocationFile.FileName()), "call PIPE()")
+	write(path.Join(oldPath, PsdirFile.FileName()), oldPath)
+	outFile := path.Join(fork, "files", "out.txt")
+	write(outFile, "output")
+	write(path.Join(fork, OutsFile.FileName()),
+		`{"out": "`+outFile+`"}`)
+	write(path.Join(fork, LogFile.FileName()), outFile)
+	check(os.Symlink(outFile, path.Join(oldPath, "outs", "out.txt")))
+	check(os.Symlink("/dev/null", path.Join(oldPath, "outs", "null")))
+
+	// Node metadata in the key-value store.
+	store, err := openKVStore(oldPath, path.Join(oldPath, MetadataStoreFile.FileName()))
+	check(err)
+	check(store.openWrite())
+	check(store.WriteFile(path.Join(oldPath, "PIPE"), OutsFile,
+		[]byte(`{"out": "`+outFile+`"}`)))
+	check(store.Close())
+
+	check(RelocatePipestance(oldPath, newPath))
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Error("Expected the pipestance to be moved.")
+	}
+	newFork := path.Join(newPath, "PIPE", "STAGE", "fork0")
+	newOut := path.Join(newFork, "files", "out.txt")
+	readFile := func(p string) string {
+		t.Helper()
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Error(err)
+		}
+		return string(b)
+	}
+	if s := readFile(path.Join(newFork, OutsFile.FileName())); s != `{"out": "`+newOut+`"}` {
+		t.Errorf("Incorrect relocated outs %s", s)
+	}
+	if s := readFile(path.Join(newFork, LogFile.FileName())); s != outFile {
+		t.Errorf("Expected the log to be left unchanged, got %s", s)
+	}
+	if s := readFile(path.Join(newPath, PsdirFile.FileName())); s != newPath {
+		t.Errorf("Expected the new path to be recorded, got %s", s)
+	}
+	if link, err := os.Readlink(path.Join(newPath, "outs", "out.txt")); err != nil {
+		t.Error(err)
+	} else if link != newOut {
+		t.Errorf("Expected symlink to %s, got %s", newOut, link)
+	}
+	if link, err := os.Readlink(path.Join(newPath, "outs", "null")); err != nil {
+		t.Error(err)
+	} else if link != "/dev/null" {
+		t.Errorf("Expected symlink outside of the pipestance to be unchanged, got %s",
+			link)
+	}
+	store, err = openKVStore(newPath, path.Join(newPath, MetadataStoreFile.FileName()))
+	check(err)
+	if b, err := store.ReadFile(path.Join(newPath, "PIPE"), OutsFile); err != nil {
+		t.Error(err)
+	} else if s := string(b); s != `{"out": "`+newOut+`"}` {
+		t.Errorf("Incorrect relocated node outs %s", s)
+	}
+
+	// Relocating again after the pipestance was moved by other means.
+	check(os.Rename(newPath, oldPath))
+	check(RelocatePipestance(newPath, oldPath))
+	if s := readFile(path.Join(fork, OutsFile.FileName())); s != `{"out": "`+outFile+`"}` {
+		t.Errorf("Incorrect relocated outs %s", s)
+	}
+}
+
+func TestRelocateZippedPipestance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRelocateZippedPipestance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldPath := path.Join(dir, "old")
+	newPath := path.Join(dir, "new")
+	fork := path.Join(oldPath, "PIPE", "STAGE", "fork0")
+	check(os.MkdirAll(path.Join(fork, "files"), 0755))
+	check(ioutil.WriteFile(path.Join(oldPath, InvocationFile.FileName()),
+		[]byte("call PIPE()"), 0644))
+	outFile := path.Join(fork, "files", "out.txt")
+	outs := path.Join(fork, OutsFile.FileName())
+	check(ioutil.WriteFile(outs, []byte(`{"out": "`+outFile+`"}`), 0644))
+	link := path.Join(oldPath, "PIPE", "STAGE", "fork1")
+	check(os.Symlink(fork, link))
+	zipPath := path.Join(oldPath, MetadataZip.FileName())
+	check(util.CreateZip(zipPath, []string{outs, link}))
+	check(os.Remove(outs))
+	check(os.Remove(link))
+
+	check(RelocatePipestance(oldPath, newPath))
+	zipPath = path.Join(newPath, MetadataZip.FileName())
+	newFork := path.Join(newPath, "PIPE", "STAGE", "fork0")
+	if _, err := os.Stat(path.Join(newFork, OutsFile.FileName())); !os.IsNotExist(err) {
+		t.Error("Expected metadata to remain zipped.")
+	}
+	rel := path.Join("PIPE", "STAGE", "fork0", OutsFile.FileName())
+	if b, err := util.ReadZip(zipPath, rel); err != nil {
+		t.Error(err)
+	} else if s, expect := string(b),
+		`{"out": "`+path.Join(newFork, "files", "out.txt")+`"}`; s != expect {
+		t.Errorf("Expected zipped outs %s, got %s", expect, s)
+	}
+	check(util.Unzip(zipPath))
+	if target, err := os.Readlink(path.Join(newPath,
+		"PIPE", "STAGE", "fork1")); err != nil {
+		t.Error(err)
+	} else if target != newFork {
+		t.Errorf("Expected zipped symlink to %s, got %s", newFork, target)
+	}
+}
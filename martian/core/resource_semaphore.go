@@ -13,8 +13,9 @@ import (
 )
 
 type waiter struct {
-	amount int64
-	ready  chan<- struct{} // Closed when semaphore acquired.
+	amount   int64
+	priority JobPriority
+	ready    chan<- struct{} // Closed when semaphore acquired.
 }
 
 // A semaphore type which allows for the maxium size of things entering the
@@ -33,7 +34,22 @@ type ResourceSemaphore struct {
 	// maxSize.
 	reserved int64
 	mu       sync.Mutex
-	waiters  []waiter
+
+	// Waiters, in descending priority order.  Waiters with equal priority
+	// are in the order in which they arrived.
+	waiters []waiter
+
+	// Waiters requesting at most this amount may be started ahead of the
+	// first waiter if they fit in the available resources.
+	backfillMax int64
+
+	// The number of waiters which may be started ahead of the first waiter
+	// before it must be started.
+	backfillLimit int
+
+	// The number of waiters which have been started ahead of the current
+	// first waiter.
+	bypassed int
 }
 
 // Create a new semaphore with the given capactiy.
@@ -45,11 +61,27 @@ func NewResourceSemaphore(size int64, name string) *ResourceSemaphore {
 	}
 }
 
+// Allow up to limit requests for at most maxAmount to be served ahead of the
+// first waiter, if they fit in the available resources while it waits.
+func (self *ResourceSemaphore) SetBackfill(maxAmount int64, limit int) {
+	self.mu.Lock()
+	self.backfillMax = maxAmount
+	self.backfillLimit = limit
+	self.mu.Unlock()
+}
+
 // Reserve n of the resource.  Block until it is available.  Returns an error
 // if more was requested than is possible to serve.
 func (self *ResourceSemaphore) Acquire(n int64) error {
+	return self.AcquirePriority(n, JobPriority{})
+}
+
+// Reserve n of the resource.  Block until it is available, and no waiters
+// with a higher priority remain, except as allowed by backfill.  Returns an
+// error if more was requested than is possible to serve.
+func (self *ResourceSemaphore) AcquirePriority(n int64, priority JobPriority) error {
 	self.mu.Lock()
-	if self.curSize-self.reserved >= n && len(self.waiters) == 0 {
+	if self.curSize-self.reserved >= n && self.canJump(n, priority) {
 		// return immediately.
 		self.reserved += n
 		self.mu.Unlock()
@@ -68,16 +100,41 @@ func (self *ResourceSemaphore) Acquire(n int64) error {
 			n, self.Name, self.curSize-self.reserved)
 	}
 
-	// Enqueue.
+	// Enqueue after any waiters with the same or higher priority.
 	ready := make(chan struct{})
-	w := waiter{amount: n, ready: ready}
+	w := waiter{amount: n, priority: priority, ready: ready}
+	i := len(self.waiters)
+	for j, other := range self.waiters {
+		if other.priority.Less(priority) {
+			i = j
+			break
+		}
+	}
+	if i == 0 {
+		self.bypassed = 0
+	}
 	self.waiters = append(self.waiters, w)
+	copy(self.waiters[i+1:], self.waiters[i:])
+	self.waiters[i] = w
 	self.mu.Unlock()
 
 	<-ready
 	return nil
 }
 
+// Returns true if a request for n with the given priority, which fits in the
+// available resources, should be served ahead of the current waiters.
+func (self *ResourceSemaphore) canJump(n int64, priority JobPriority) bool {
+	if len(self.waiters) == 0 || self.waiters[0].priority.Less(priority) {
+		return true
+	}
+	if n <= self.backfillMax && self.bypassed < self.backfillLimit {
+		self.bypassed++
+		return true
+	}
+	return false
+}
+
 // Release n of the resource.
 func (self *ResourceSemaphore) Release(n int64) {
 	self.mu.Lock()
@@ -97,7 +154,13 @@ func (self *ResourceSemaphore) runJobs() {
 				util.LogInfo("jobmngr", "Need %d %s to start the next job (%d available).  Waiting for jobs to complete.",
 					waiter.amount, self.Name, self.curSize-self.reserved)
 			}
+			if i > 0 {
+				self.bypassed = 0
+			}
 			self.waiters = self.waiters[i:]
+			if self.backfillMax > 0 {
+				self.backfill()
+			}
 			return
 		}
 		self.reserved += waiter.amount
@@ -106,6 +169,28 @@ func (self *ResourceSemaphore) runJobs() {
 	self.waiters = nil
 }
 
+// Serve small waiters which fit in the available resources while the first
+// waiter does not.
+func (self *ResourceSemaphore) backfill() {
+	j := 1
+	for _, waiter := range self.waiters[1:] {
+		if self.bypassed < self.backfillLimit &&
+			waiter.amount <= self.backfillMax &&
+			self.curSize-self.reserved >= waiter.amount {
+			self.reserved += waiter.amount
+			self.bypassed++
+			close(waiter.ready)
+		} else {
+			self.waiters[j] = waiter
+			j++
+		}
+	}
+	for i := j; i < len(self.waiters); i++ {
+		self.waiters[i] = waiter{}
+	}
+	self.waiters = self.waiters[:j]
+}
+
 // Get the current amount of resources in use.  This includes both reserved
 // resources and resources for which their usage is unaccounted for.
 func (self *ResourceSemaphore) InUse() int64 {
@@ -266,3 +266,120 @@ func TestResourceSemaphoreActualRelease(t *testing.T) {
 		t.Errorf("Timed out.")
 	}
 }
+
+// Start a goroutine which acquires amount with the given priority and then
+// sends id, and wait for it to be queued.
+func acquireQueued(t *testing.T, sem *ResourceSemaphore, id int, amount int64,
+	priority JobPriority, acquired chan<- int) {
+	t.Helper()
+	queued := sem.QueueLength()
+	go func() {
+		if err := sem.AcquirePriority(amount, priority); err != nil {
+			t.Error(err)
+		}
+		acquired <- id
+	}()
+	for sem.QueueLength() != queued+1 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Wait for the given ids to be sent on acquired, in any order.
+func expectAcquired(t *testing.T, acquired <-chan int, ids ...int) {
+	t.Helper()
+	expect := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		expect[id] = true
+	}
+	for range ids {
+		select {
+		case id := <-acquired:
+			if !expect[id] {
+				t.Errorf("Unexpected acquire %d", id)
+			}
+			delete(expect, id)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out.")
+		}
+	}
+}
+
+func TestResourceSemaphorePriority(t *testing.T) {
+	sem := NewResourceSemaphore(10, "test")
+	if err := sem.Acquire(10); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan int)
+	acquireQueued(t, sem, 0, 10, JobPriority{}, acquired)
+	acquireQueued(t, sem, 1, 10, JobPriority{CriticalPath: 3}, acquired)
+	acquireQueued(t, sem, 2, 10, JobPriority{CriticalPath: 3, Phase: 2}, acquired)
+	acquireQueued(t, sem, 3, 10, JobPriority{CriticalPath: 3}, acquired)
+	acquireQueued(t, sem, 4, 10, JobPriority{Override: 1}, acquired)
+	for _, expect := range []int{4, 2, 1, 3, 0} {
+		sem.Release(10)
+		expectAcquired(t, acquired, expect)
+	}
+	if sem.QueueLength() != 0 {
+		t.Errorf("Expected empty queue, got %d", sem.QueueLength())
+	}
+}
+
+func TestResourceSemaphorePriorityJump(t *testing.T) {
+	sem := NewResourceSemaphore(10, "test")
+	if err := sem.Acquire(6); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan int)
+	acquireQueued(t, sem, 0, 5, JobPriority{CriticalPath: 2}, acquired)
+	// Fits, and has higher priority than the waiter.
+	if err := sem.AcquirePriority(2, JobPriority{CriticalPath: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// Fits, but has lower priority than the waiter.
+	acquireQueued(t, sem, 1, 1, JobPriority{CriticalPath: 1}, acquired)
+	if sem.QueueLength() != 2 {
+		t.Errorf("Expected 2 waiting, got %d", sem.QueueLength())
+	}
+	sem.Release(8)
+	expectAcquired(t, acquired, 0, 1)
+	if sem.Reserved() != 6 {
+		t.Errorf("Expected 6 reserved, got %d", sem.Reserved())
+	}
+}
+
+func TestResourceSemaphoreBackfill(t *testing.T) {
+	sem := NewResourceSemaphore(10, "test")
+	sem.SetBackfill(2, 2)
+	if err := sem.Acquire(10); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan int)
+	acquireQueued(t, sem, 0, 8, JobPriority{CriticalPath: 2}, acquired)
+	acquireQueued(t, sem, 1, 2, JobPriority{}, acquired)
+	acquireQueued(t, sem, 2, 3, JobPriority{}, acquired)
+	// 1 is small enough to start ahead of 0, but 2 is not.
+	sem.Release(3)
+	expectAcquired(t, acquired, 1)
+	if sem.QueueLength() != 2 {
+		t.Errorf("Expected 2 waiting, got %d", sem.QueueLength())
+	}
+	// Small enough and fits, so can start ahead of 0 without queueing.
+	if err := sem.Acquire(1); err != nil {
+		t.Fatal(err)
+	}
+	// Small enough and fits, but 0 has been bypassed too many times.
+	sem.Release(1)
+	acquireQueued(t, sem, 3, 1, JobPriority{}, acquired)
+	// Once 0 starts, 2 is first, and 3 can be backfilled ahead of it.
+	sem.Release(8)
+	expectAcquired(t, acquired, 0, 3)
+	sem.Release(2)
+	if sem.QueueLength() != 1 {
+		t.Errorf("Expected 1 waiting, got %d", sem.QueueLength())
+	}
+	sem.Release(8)
+	expectAcquired(t, acquired, 2)
+	if sem.Reserved() != 3 {
+		t.Errorf("Expected 3 reserved, got %d", sem.Reserved())
+	}
+}
@@ -73,19 +73,18 @@ func VerifyOnFinish(onfinish string) {
 	}
 }
 
-// Reads config file for regexps which, when matched, indicate that
-// an error is likely transient.
-func getRetryRegexps() (retryOn []*regexp.Regexp, defaultRetries int) {
+type retryJson struct {
+	DefaultRetries int                `json:"default_retries"`
+	RetryOn        []string           `json:"retry_on"`
+	MemoryRetry    *MemoryRetryPolicy `json:"memory_retry,omitempty"`
+}
+
+// Reads the retry config file, or returns nil if there is none.
+func readRetryConfig() *retryJson {
 	retryfile := util.RelPath(path.Join("..", "jobmanagers", "retry.json"))
 
 	if _, err := os.Stat(retryfile); os.IsNotExist(err) {
-		return []*regexp.Regexp{
-			regexp.MustCompile("^signal: "),
-		}, 0
-	}
-	type retryJson struct {
-		DefaultRetries int      `json:"default_retries"`
-		RetryOn        []string `json:"retry_on"`
+		return nil
 	}
 	bytes, err := ioutil.ReadFile(retryfile)
 	if err != nil {
@@ -97,6 +96,18 @@ func getRetryRegexps() (retryOn []*regexp.Regexp, defaultRetries int) {
 		util.PrintInfo("runtime", "Retry config file could not be parsed:\n%v\n", err)
 		os.Exit(1)
 	}
+	return retryInfo
+}
+
+// Reads config file for regexps which, when matched, indicate that
+// an error is likely transient.
+func getRetryRegexps() (retryOn []*regexp.Regexp, defaultRetries int) {
+	retryInfo := readRetryConfig()
+	if retryInfo == nil {
+		return []*regexp.Regexp{
+			regexp.MustCompile("^signal: "),
+		}, 0
+	}
 	regexps := make([]*regexp.Regexp, len(retryInfo.RetryOn))
 	for i, exp := range retryInfo.RetryOn {
 		regexps[i] = regexp.MustCompile(exp)
@@ -136,7 +147,22 @@ type RuntimeOptions struct {
 
 	// The profiling mode (required): "disable" or one of the available
 	// constants.
-	ProfileMode     ProfileMode
+	ProfileMode ProfileMode
+
+	// The order in which local jobs waiting for resources are started:
+	// either "fifo", "priority", or "backfill".  Defaults to fifo if unset.
+	SchedulePolicy SchedulePolicy
+
+	// Where to keep node and fork metadata for new pipestances: either
+	// "files" or "kv".  Defaults to files if unset.
+	MetadataStore MetadataStoreType
+
+	// The checksum recorded for each file in the output manifest written
+	// when a pipestance completes: either "sha256", "xxhash", or "none".
+	// Defaults to xxhash if unset, which is much cheaper than sha256 for
+	// large outputs.
+	OutputHash OutputHashType
+
 	MartianVersion  string
 	LocalMem        int
 	LocalVMem       int
@@ -156,6 +182,10 @@ type RuntimeOptions struct {
 	Overrides       *PipestanceOverrides
 	LimitLoadavg    bool
 	NeverLocal      bool
+
+	// If set, the directory in which to cache stage outputs for reuse
+	// between pipestances.
+	CacheDir string
 }
 
 const localMode = "local"
@@ -182,6 +212,15 @@ func (config *RuntimeOptions) ToFlags() []string {
 		flags = append(flags, fmt.Sprintf("--profile=%v",
 			config.ProfileMode))
 	}
+	if config.SchedulePolicy != "" && config.SchedulePolicy != ScheduleFifo {
+		flags = append(flags, "--schedule="+string(config.SchedulePolicy))
+	}
+	if config.MetadataStore != "" && config.MetadataStore != FileMetadataStore {
+		flags = append(flags, "--metadata-store="+string(config.MetadataStore))
+	}
+	if config.OutputHash != "" && config.OutputHash != OutputHashXXHash {
+		flags = append(flags, "--output-hash="+string(config.OutputHash))
+	}
 	if config.LocalMem != 0 {
 		flags = append(flags, fmt.Sprintf("--localmem=%d",
 			config.LocalMem))
@@ -243,6 +282,9 @@ func (config *RuntimeOptions) ToFlags() []string {
 	if config.NeverLocal {
 		flags = append(flags, "--never-local")
 	}
+	if config.CacheDir != "" {
+		flags = append(flags, "--cache-dir="+config.CacheDir)
+	}
 	return flags
 }
 
@@ -256,6 +298,15 @@ type Runtime struct {
 	LocalJobManager *LocalJobManager
 	overrides       *PipestanceOverrides
 	jobConfig       *JobManagerJson
+	stageCache      *StageCache
+	memoryRetry     *MemoryRetryPolicy
+
+	// Structured log of state transitions for all pipestances using this
+	// runtime.  Nothing is recorded until an output is set or a client
+	// subscribes.
+	Events *EventLog
+
+	counters runtimeCounters
 }
 
 func (c *RuntimeOptions) NewRuntime() *Runtime {
@@ -263,6 +314,7 @@ func (c *RuntimeOptions) NewRuntime() *Runtime {
 		Config:       c,
 		adaptersPath: util.RelPath(path.Join("..", "adapters")),
 		mrjob:        util.RelPath("mrjob"),
+		Events:       NewEventLog(),
 	}
 
 	self.jobConfig = getJobConfig(c.ProfileMode)
@@ -272,8 +324,14 @@ func (c *RuntimeOptions) NewRuntime() *Runtime {
 		c.LimitLoadavg,
 		c.JobMode != localMode,
 		self.jobConfig)
+	if c.SchedulePolicy != "" {
+		self.LocalJobManager.SetSchedulePolicy(c.SchedulePolicy)
+	}
 	if c.JobMode == localMode {
 		self.JobManager = self.LocalJobManager
+	} else if c.JobMode == kubernetesMode {
+		self.JobManager = NewKubernetesJobManager(c.MaxJobs,
+			c.JobFreqMillis, self.jobConfig, c.Debug)
 	} else {
 		self.JobManager = NewRemoteJobManager(c.JobMode, c.MemPerCore, c.MaxJobs,
 			c.JobFreqMillis, c.ResourceSpecial, self.jobConfig, c.Debug)
@@ -286,6 +344,21 @@ func (c *RuntimeOptions) NewRuntime() *Runtime {
 		self.overrides = c.Overrides
 	}
 
+	if retryInfo := readRetryConfig(); retryInfo != nil {
+		self.memoryRetry = retryInfo.MemoryRetry.compile()
+	}
+
+	if c.CacheDir != "" {
+		if cache, err := NewStageCache(c.CacheDir); err != nil {
+			util.PrintError(err, "runtime",
+				"Could not open stage cache directory %s", c.CacheDir)
+			os.Exit(1)
+		} else {
+			self.stageCache = cache
+			util.LogInfo("runtime", "Stage cache = %s", cache.Path())
+		}
+	}
+
 	return self
 }
 
@@ -330,15 +403,18 @@ func (self *Runtime) instantiatePipeline(src string, srcPath string, psid string
 		srcPaths = append(mroPaths,
 			filepath.SplitList(os.Getenv("PATH"))...)
 	}
-	pipestance, err := NewPipestance(
-		NewTopNode(self, callGraph.GetFqid()[:3+len(psid)], pipestancePath,
-			mroPaths, mroVersion,
-			envs, invocationData,
-			&ast.TypeTable),
-		callGraph, srcPaths)
+	top := NewTopNode(self, callGraph.GetFqid()[:3+len(psid)], pipestancePath,
+		mroPaths, mroVersion,
+		envs, invocationData,
+		&ast.TypeTable)
+	if top.store, err = self.openMetadataStore(pipestancePath, readOnly); err != nil {
+		return "", nil, nil, err
+	}
+	pipestance, err := NewPipestance(top, callGraph, srcPaths)
 	if err != nil {
 		return "", nil, nil, err
 	}
+	pipestance.computeCriticalPaths()
 
 	// Lock the pipestance if not in read-only mode.
 	if !readOnly {
@@ -408,6 +484,10 @@ func (self *Runtime) InvokePipeline(src string, srcPath string, psid string,
 		os.RemoveAll(pipestancePath)
 		return pipestance, err
 	}
+	if err := pipestance.checkRelocated(readOnly); err != nil {
+		os.RemoveAll(pipestancePath)
+		return pipestance, err
+	}
 	if uid := os.Getenv("MRO_FORCE_UUID"); uid == "" {
 		if err := pipestance.SetUuid(NewUUID().String()); err != nil {
 			os.RemoveAll(pipestancePath)
@@ -518,6 +598,14 @@ func (self *Runtime) reattachToPipestance(psid string, pipestancePath string,
 		os.Remove(metadataPath)
 	}
 
+	// If the pipestance was moved, update paths in its metadata.
+	if err := pipestance.checkRelocated(readOnly); err != nil {
+		if !readOnly {
+			pipestance.Unlock()
+		}
+		return nil, err
+	}
+
 	// If we're reattaching in local mode, restart any stages that were
 	// left in a running state from last mrp run. The actual job would
 	// have been killed by the CTRL-C or, if not, by SIGTERM when the
@@ -644,8 +732,12 @@ func GetCallableFrom(pName, incPath string, mroPaths []string) (syntax.Callable,
 // populated.
 func GetCallable(mroPaths []string, name string, compile bool) (syntax.Callable, *syntax.TypeLookup, error) {
 	var parser syntax.Parser
-	parse := parser.UncheckedParse
+	parse := func(data []byte, fpath string) (*syntax.Ast, error) {
+		return parser.UncheckedParse(data, path.Base(fpath))
+	}
 	if compile {
+		// Stage code is searched for relative to the mro file, so the
+		// parser needs the full path.
 		parse = func(data []byte, fpath string) (*syntax.Ast, error) {
 			_, _, ast, err := parser.ParseSourceBytes(
 				data, fpath, mroPaths, true)
@@ -656,7 +748,7 @@ func GetCallable(mroPaths []string, name string, compile bool) (syntax.Callable,
 		if fpaths, err := filepath.Glob(mroPath + "/[^_]*.mro"); err == nil {
 			for _, fpath := range fpaths {
 				if data, err := ioutil.ReadFile(fpath); err == nil {
-					if ast, err := parse(data, path.Base(fpath)); err == nil {
+					if ast, err := parse(data, fpath); err == nil {
 						for _, callable := range ast.Callables.List {
 							if callable.GetId() == name {
 								return callable, &ast.TypeTable, nil
@@ -7,6 +7,7 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -140,6 +141,13 @@ call SUM_SQUARE_PIPELINE(
 }
 
 func invokeTest(src string, t *testing.T) {
+	t.Helper()
+	invokeTestWith(src, t, nil)
+}
+
+// Invoke the given source, and then run the given check on the
+// resulting pipestance, if it is not nil.
+func invokeTestWith(src string, t *testing.T, check func(*testing.T, *Pipestance)) {
 	t.Helper()
 	if d, err := ioutil.TempDir("", "pipestance"); err != nil {
 		t.Error(err)
@@ -201,6 +209,9 @@ func invokeTest(src string, t *testing.T) {
 		} else if _, err := os.Stat(path.Join(d, "test")); err != nil {
 			t.Error(err)
 		} else {
+			if check != nil {
+				check(t, ps)
+			}
 			ps.Unlock()
 		}
 	}
@@ -247,6 +258,78 @@ call MAP_FOO(
 `, t)
 }
 
+// A job manager which records jobs without running them.
+type holdJobManager struct {
+	*LocalJobManager
+	jobs []*Metadata
+}
+
+func (self *holdJobManager) execJob(shellCmd string, argv []string,
+	envs map[string]string, md *Metadata, res *JobResources,
+	priority JobPriority, fqname, shellName string, preflight bool) {
+	self.jobs = append(self.jobs, md)
+}
+
+func TestMaxJobs(t *testing.T) {
+	invokeTestWith(`
+stage FOO (
+    in  int  val,
+    out int  val,
+    src comp "foo",
+)
+
+pipeline MAP_FOO(
+    in  int[] vals,
+    out int[] vals,
+)
+{
+    map call FOO(
+        val = split self.vals,
+    )
+
+    return (
+        vals = FOO.val,
+    )
+}
+
+call MAP_FOO(
+    vals = [1, 2, 3, 4],
+)
+`, t, func(t *testing.T, ps *Pipestance) {
+		jm := &holdJobManager{LocalJobManager: ps.node.top.rt.LocalJobManager}
+		ps.node.top.rt.JobManager = jm
+		ctx := context.Background()
+		ps.LoadMetadata(ctx)
+		step := func() {
+			for i := 0; i < 5; i++ {
+				ps.RefreshState(ctx)
+				ps.StepNodes(ctx)
+			}
+		}
+		ps.SetMaxJobs(2)
+		step()
+		if len(jm.jobs) != 2 {
+			t.Errorf("Expected 2 jobs to start, got %d", len(jm.jobs))
+		}
+		if n := ps.jobsInFlight(); n != 2 {
+			t.Errorf("Expected 2 jobs in flight, got %d", n)
+		}
+		// Another job may start once one finishes.
+		if err := jm.jobs[0].WriteTime(CompleteFile); err != nil {
+			t.Fatal(err)
+		}
+		step()
+		if len(jm.jobs) != 3 {
+			t.Errorf("Expected 3 jobs to start, got %d", len(jm.jobs))
+		}
+		ps.SetMaxJobs(0)
+		step()
+		if len(jm.jobs) != 4 {
+			t.Errorf("Expected 4 jobs to start, got %d", len(jm.jobs))
+		}
+	})
+}
+
 func TestGetCallableFrom(t *testing.T) {
 	callable, _, err := GetCallableFrom("MY_STAGE",
 		path.Join("stages.mro"), []string{"testdata"})
@@ -0,0 +1,114 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Policies for ordering jobs waiting for local resources.
+
+import (
+	"os"
+
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// SchedulePolicy determines the order in which the local job manager starts
+// jobs which are waiting for resources.
+type SchedulePolicy string
+
+const (
+	// Start jobs in the order in which they were queued.
+	ScheduleFifo SchedulePolicy = "fifo"
+
+	// Start jobs in priority order.  A job which is waiting for resources
+	// blocks all jobs with lower priority.
+	SchedulePriority SchedulePolicy = "priority"
+
+	// Start jobs in priority order, but allow small jobs to start ahead of
+	// a higher-priority job which is waiting for resources, if they fit in
+	// the resources which are available.
+	ScheduleBackfill SchedulePolicy = "backfill"
+)
+
+func VerifySchedulePolicy(policy SchedulePolicy) {
+	switch policy {
+	case ScheduleFifo, SchedulePriority, ScheduleBackfill:
+		return
+	}
+	util.PrintInfo("runtime",
+		"Invalid schedule policy: %s. Valid policies: fifo, priority, backfill",
+		policy)
+	os.Exit(1)
+}
+
+// JobPriority determines the order in which jobs are started when the
+// schedule policy is not fifo.
+type JobPriority struct {
+	// The priority set for the stage in the overrides file.
+	Override int
+
+	// The number of stages in the longest chain of dependencies starting
+	// at the stage.
+	CriticalPath int
+
+	// The rank of the job's phase: join, then chunk, then split.
+	Phase int
+}
+
+// Returns true if jobs with this priority should start after jobs with the
+// other priority.
+func (self JobPriority) Less(other JobPriority) bool {
+	if self.Override != other.Override {
+		return self.Override < other.Override
+	}
+	if self.CriticalPath != other.CriticalPath {
+		return self.CriticalPath < other.CriticalPath
+	}
+	return self.Phase < other.Phase
+}
+
+// Get the rank of a stage phase for scheduling purposes.  Joins are preferred
+// because they usually gate the rest of the pipeline, and splits are
+// deferred because they create more jobs.
+func phaseRank(stageType string) int {
+	switch stageType {
+	case STAGE_TYPE_JOIN:
+		return 2
+	case STAGE_TYPE_CHUNK:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Compute the critical path length of every stage in the pipestance.
+func (self *Pipestance) computeCriticalPaths() {
+	for _, node := range self.allNodes() {
+		node.getCriticalPath()
+	}
+}
+
+// Get the number of stages in the longest chain of stages which depend on
+// this one, including itself.
+func (self *Node) getCriticalPath() int {
+	if self.criticalPath > 0 {
+		return self.criticalPath
+	}
+	longest := 0
+	for _, post := range self.postnodes {
+		if node := post.getNode(); len(node.subnodes) == 0 {
+			if length := node.getCriticalPath(); length > longest {
+				longest = length
+			}
+		}
+	}
+	self.criticalPath = longest + 1
+	return self.criticalPath
+}
+
+// Get the scheduling priority for a job of this stage in the given phase.
+func (self *Node) jobPriority(stageType string) JobPriority {
+	return JobPriority{
+		Override:     self.top.rt.overrides.GetPriority(self.GetFQName(), 0),
+		CriticalPath: self.criticalPath,
+		Phase:        phaseRank(stageType),
+	}
+}
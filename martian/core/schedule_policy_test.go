@@ -0,0 +1,72 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import "testing"
+
+func TestJobPriorityLess(t *testing.T) {
+	check := func(t *testing.T, low, high JobPriority) {
+		t.Helper()
+		if !low.Less(high) {
+			t.Errorf("Expected %v < %v", low, high)
+		}
+		if high.Less(low) {
+			t.Errorf("Expected not %v < %v", high, low)
+		}
+	}
+	check(t,
+		JobPriority{Phase: phaseRank(STAGE_TYPE_SPLIT)},
+		JobPriority{Phase: phaseRank(STAGE_TYPE_CHUNK)})
+	check(t,
+		JobPriority{Phase: phaseRank(STAGE_TYPE_CHUNK)},
+		JobPriority{Phase: phaseRank(STAGE_TYPE_JOIN)})
+	check(t,
+		JobPriority{CriticalPath: 1, Phase: phaseRank(STAGE_TYPE_JOIN)},
+		JobPriority{CriticalPath: 2, Phase: phaseRank(STAGE_TYPE_SPLIT)})
+	check(t,
+		JobPriority{CriticalPath: 5},
+		JobPriority{Override: 1, CriticalPath: 1})
+	check(t,
+		JobPriority{Override: -1, CriticalPath: 5},
+		JobPriority{CriticalPath: 1})
+	if p := (JobPriority{CriticalPath: 1}); p.Less(p) {
+		t.Error("Expected equal priorities to be unordered.")
+	}
+}
+
+func TestCriticalPath(t *testing.T) {
+	// A -> B -> C
+	//   \         \
+	//    D ------> P (pipeline containing E)
+	nodes := make(map[string]*Node)
+	for _, id := range []string{"A", "B", "C", "D", "E", "P"} {
+		nodes[id] = new(Node)
+	}
+	link := func(from, to string) {
+		n := nodes[from]
+		if n.postnodes == nil {
+			n.postnodes = make(map[string]Nodable)
+		}
+		n.postnodes[to] = nodes[to]
+	}
+	nodes["P"].subnodes = map[string]Nodable{"E": nodes["E"]}
+	link("A", "B")
+	link("B", "C")
+	link("A", "D")
+	link("C", "P")
+	link("C", "E")
+	link("D", "P")
+	link("D", "E")
+	for id, expect := range map[string]int{
+		"A": 4,
+		"B": 3,
+		"C": 2,
+		"D": 2,
+		"E": 1,
+	} {
+		if length := nodes[id].getCriticalPath(); length != expect {
+			t.Errorf("Expected critical path %d for %s, got %d",
+				expect, id, length)
+		}
+	}
+}
@@ -50,7 +50,10 @@ func makeOutArg(field *syntax.StructMember, filesPath string, lookup *syntax.Typ
 	return nil
 }
 
-func makeOutArgs(outParams *syntax.OutParams, filesPath string, nullAll bool, lookup *syntax.TypeLookup) MarshalerMap {
+// MakeOutArgs generates the initial contents of the _outs json file for a job
+// with the given output parameters, as described for makeOutArg.  If nullAll
+// is true, every output is set to null.
+func MakeOutArgs(outParams *syntax.OutParams, filesPath string, nullAll bool, lookup *syntax.TypeLookup) MarshalerMap {
 	args := make(MarshalerMap, len(outParams.List))
 	for _, param := range outParams.List {
 		if nullAll {
@@ -103,6 +106,7 @@ func NewChunk(fork *Fork, index int,
 	journalName := strings.TrimPrefix(strings.TrimPrefix(self.fqname, self.fork.node.top.fqname), ".")
 	self.metadata = newMetadataWithJournalPath(self.fqname, journalName,
 		chunkPath, self.fork.node.top.journalPath)
+	self.metadata.setEvents(self.fork.node.top.events(), EventKindChunk)
 	self.metadata.discoverUniquify()
 	// HACK: Sometimes we need to load older pipestances with newer martian
 	// versions.  Because of this, we may sometimes encounter chunks which
@@ -186,10 +190,12 @@ func (self *Chunk) verifyOutput(output LazyArgumentMap) bool {
 		self.metadata.WriteErrorString("Output not found.")
 	} else {
 		outParams := self.Stage().ChunkOuts
-		err, alarms := output.ValidateOutputs(self.fork.node.top.types,
-			outParams, self.fork.OutParams())
+		violations := output.CheckOutputs(self.fork.node.top.types,
+			self.metadata.FilesPath(), outParams, self.fork.OutParams())
+		err, alarms := violations.split()
 		if err != nil {
 			if level >= syntax.EnforceError {
+				writeOutputViolations(self.metadata, violations, false)
 				self.metadata.WriteErrorString(err.Error() + alarms)
 				return false
 			}
@@ -202,6 +208,7 @@ func (self *Chunk) verifyOutput(output LazyArgumentMap) bool {
 		if alarms != "" {
 			switch syntax.GetEnforcementLevel() {
 			case syntax.EnforceError:
+				writeOutputViolations(self.metadata, violations, false)
 				self.metadata.WriteErrorString(alarms)
 				return false
 			case syntax.EnforceAlarm:
@@ -212,6 +219,7 @@ func (self *Chunk) verifyOutput(output LazyArgumentMap) bool {
 					self.fork.fqname, alarms)
 			}
 		}
+		writeOutputViolations(self.metadata, violations, true)
 	}
 	return true
 }
@@ -263,6 +271,9 @@ func (self *Chunk) step(bindings MarshalerMap) {
 	// Belt and suspenders for not double-submitting a job.
 	if self.hasBeenRun {
 		return
+	} else if !self.fork.node.top.takeJobSlot() {
+		// Try again on the next step.
+		return
 	} else {
 		self.hasBeenRun = true
 	}
@@ -270,16 +281,17 @@ func (self *Chunk) step(bindings MarshalerMap) {
 	if self.chunkDef.Resources == nil {
 		self.chunkDef.Resources = &JobResources{}
 	}
-	res := self.fork.node.setChunkJobReqs(self.chunkDef.Resources)
+	res := self.fork.node.setChunkJobReqs(self.chunkDef.Resources,
+		self.fork.memoryScale(self.metadata))
 
 	// Resolve input argument bindings and merge in the chunk defs.
 	resolvedBindings := self.chunkDef.Merge(bindings)
 
 	// Write out input and output args for the chunk.
 	self.metadata.Write(ArgsFile, resolvedBindings)
-	outs := makeOutArgs(self.fork.OutParams(), self.metadata.curFilesPath, false, self.fork.node.top.types)
+	outs := MakeOutArgs(self.fork.OutParams(), self.metadata.curFilesPath, false, self.fork.node.top.types)
 	if self.fork.Split() {
-		for k, v := range makeOutArgs(self.Stage().ChunkOuts,
+		for k, v := range MakeOutArgs(self.Stage().ChunkOuts,
 			self.metadata.curFilesPath, false, self.fork.node.top.types) {
 			outs[k] = v
 		}
@@ -334,12 +346,16 @@ type Fork struct {
 	chunks         []*Chunk
 	split_has_run  bool
 	join_has_run   bool
+	cacheChecked   bool
 	args           map[string]*syntax.ResolvedBinding
 	stageDefs      *StageDefs
 	perfCache      *ForkPerfCache
 	lastPrint      time.Time
 	metadatasCache []*Metadata // cache for collectMetadata
 
+	// The state last reported to the event log.
+	eventState MetadataState
+
 	// Caches the set of strict-mode VDR-able files and the
 	// arguments which are keeping them alive.
 	fileParamMap map[string]*vdrFileCache
@@ -420,6 +436,7 @@ func (self *Fork) updateId(id ForkId) {
 	self.path = path.Join(self.node.path, self.id)
 	self.fqname = self.node.call.GetFqid() + "." + encodeJournalName.Replace(self.id)
 	self.metadata = NewMetadata(self.fqname, self.path)
+	self.metadata.store = self.node.top.metadataStore()
 	self.split_metadata = NewMetadata(self.fqname+".split",
 		path.Join(self.path, "split"))
 	self.split_metadata.journalPath = path.Join(self.node.top.journalPath,
@@ -428,6 +445,10 @@ func (self *Fork) updateId(id ForkId) {
 	self.join_metadata = NewMetadata(self.fqname+".join",
 		path.Join(self.path, "join"))
 	self.join_metadata.journalPath = self.split_metadata.journalPath
+	if events := self.node.top.events(); events != nil {
+		self.split_metadata.setEvents(events, EventKindSplit)
+		self.join_metadata.setEvents(events, EventKindJoin)
+	}
 	if self.Split() {
 		self.split_metadata.discoverUniquify()
 		self.join_metadata.finalFilePath = self.metadata.finalFilePath
@@ -478,6 +499,7 @@ func (self *Fork) reset() {
 	self.metadatasCache = nil
 	self.split_has_run = false
 	self.join_has_run = false
+	self.cacheChecked = false
 	self.split_metadata.notRunningSince = time.Time{}
 	self.split_metadata.lastRefresh = time.Time{}
 	self.join_metadata.notRunningSince = time.Time{}
@@ -486,6 +508,7 @@ func (self *Fork) reset() {
 
 func (self *Fork) resetPartial() error {
 	self.lastPrint = time.Now()
+	self.escalateMemory()
 	if err := self.split_metadata.checkedReset(); err != nil {
 		return err
 	}
@@ -688,23 +711,25 @@ func (self *Fork) removeEmptyFileArgs(outs LazyArgumentMap) {
 func (self *Fork) verifyOutput(outs LazyArgumentMap) (bool, string) {
 	outparams := self.OutParams()
 	if len(outparams.List) > 0 {
-		if err, alarms := outs.ValidateOutputs(self.node.top.types, outparams); err != nil {
-			return false, err.Error() + alarms
+		violations := outs.CheckOutputs(self.node.top.types,
+			self.metadata.FilesPath(), outparams)
+		ok, msg := true, ""
+		if err, alarms := violations.split(); err != nil {
+			ok, msg = false, err.Error()+alarms
 		} else if alarms != "" {
 			switch syntax.GetEnforcementLevel() {
 			case syntax.EnforceError:
-				return false, alarms
+				ok, msg = false, alarms
 			case syntax.EnforceAlarm:
-				return true, alarms
+				msg = alarms
 			case syntax.EnforceLog:
 				util.PrintInfo("runtime",
 					"(outputs)         %s: WARNING: invalid output\n%s",
 					self.fqname, alarms)
-				fallthrough
-			default:
-				return true, ""
 			}
 		}
+		writeOutputViolations(self.metadata, violations, ok)
+		return ok, msg
 	}
 	return true, ""
 }
@@ -805,48 +830,57 @@ func (self *Fork) getState() MetadataState {
 }
 
 func (self *Fork) disabled() (bool, error) {
+	disabled, _, err := self.evalDisabled()
+	return disabled, err
+}
+
+// Evaluate the disabled modifiers for this fork.  Also returns whether all
+// of the modifiers could be resolved.  If any could not, the fork is not
+// considered disabled.
+func (self *Fork) evalDisabled() (bool, bool, error) {
 	top := self.node.top
 	var errs syntax.ErrorList
+	allReady := true
 	for _, bind := range self.node.call.Disabled() {
 		if ready, res, err := top.resolve(bind,
 			top.types.Get(syntax.TypeId{
 				Tname: syntax.KindBool,
 			}), self.forkId, top.rt.FreeMemBytes()/2); err != nil {
 			errs = append(errs, err)
-		} else if ready {
-			if res != nil {
-				switch d := res.(type) {
-				case *syntax.BoolExp:
-					if d.Value {
-						return true, nil
-					}
-				case *syntax.NullExp:
-					errs = append(errs, fmt.Errorf(
-						"disabled is bound to a null value, which the compiler should not allow"))
-				case json.RawMessage:
-					var v bool
-					if err := json.Unmarshal(d, &v); err == nil && v {
-						return true, nil
-					} else if err != nil {
-						if bytes.Equal(d, nullBytes) {
-							errs = append(errs, fmt.Errorf(
-								"disabled is bound to a null value, which is not permitted"))
-						} else {
-							errs = append(errs, err)
-						}
-					}
+		} else if !ready {
+			allReady = false
+		} else if res != nil {
+			switch d := res.(type) {
+			case *syntax.BoolExp:
+				if d.Value {
+					return true, true, nil
 				}
-			} else {
+			case *syntax.NullExp:
 				errs = append(errs, fmt.Errorf(
 					"disabled is bound to a null value, which the compiler should not allow"))
+			case json.RawMessage:
+				var v bool
+				if err := json.Unmarshal(d, &v); err == nil && v {
+					return true, true, nil
+				} else if err != nil {
+					if bytes.Equal(d, nullBytes) {
+						errs = append(errs, fmt.Errorf(
+							"disabled is bound to a null value, which is not permitted"))
+					} else {
+						errs = append(errs, err)
+					}
+				}
 			}
+		} else {
+			errs = append(errs, fmt.Errorf(
+				"disabled is bound to a null value, which the compiler should not allow"))
 		}
 	}
-	return false, errs.If()
+	return false, allReady, errs.If()
 }
 
 func (self *Fork) writeDisable() {
-	self.metadata.Write(OutsFile, makeOutArgs(
+	self.metadata.Write(OutsFile, MakeOutArgs(
 		self.OutParams(), self.metadata.curFilesPath, true, nil))
 	self.skip()
 	self.printState(DisabledState)
@@ -945,11 +979,15 @@ func (self *Fork) doSplit(getBindings func() MarshalerMap) MetadataState {
 	}
 	self.writeInvocation()
 	self.split_metadata.Write(ArgsFile, getBindings())
+	if self.hydrateFromCache() {
+		return Complete.Prefixed(JoinPrefix)
+	}
 	if self.Split() {
-		if !self.split_has_run {
+		if !self.split_has_run && self.node.top.takeJobSlot() {
 			self.split_has_run = true
 			self.lastPrint = time.Now()
-			self.node.runSplit(self.fqname, self.split_metadata)
+			self.node.runSplit(self.fqname, self.split_metadata,
+				self.memoryScale(self.split_metadata))
 		}
 	} else {
 		self.split_metadata.Write(StageDefsFile, self.stageDefs)
@@ -1030,11 +1068,16 @@ func (self *Fork) doChunks(state MetadataState, getBindings func() MarshalerMap)
 }
 
 func (self *Fork) doJoin(state MetadataState, getBindings func() MarshalerMap) MetadataState {
+	if self.Split() && !self.join_has_run && !self.node.top.takeJobSlot() {
+		// Try again on the next step.
+		return state
+	}
 	go self.partialVdrKill()
 	if self.stageDefs.JoinDef == nil {
 		self.stageDefs.JoinDef = &JobResources{}
 	}
-	res := self.node.setJoinJobReqs(self.stageDefs.JoinDef)
+	res := self.node.setJoinJobReqs(self.stageDefs.JoinDef,
+		self.memoryScale(self.join_metadata))
 	args, err := getBindings().ToLazyArgumentMap()
 	if err != nil {
 		panic(err)
@@ -1084,7 +1127,7 @@ func (self *Fork) doJoin(state MetadataState, getBindings func() MarshalerMap) M
 		}
 		self.join_metadata.Write(
 			OutsFile,
-			makeOutArgs(self.OutParams(),
+			MakeOutArgs(self.OutParams(),
 				self.join_metadata.curFilesPath, false, self.node.top.types))
 		if !self.join_has_run {
 			self.join_has_run = true
@@ -1134,6 +1177,7 @@ func (self *Fork) doComplete() {
 		if msg != "" {
 			self.metadata.AppendAlarm("Incorrect _outs: " + msg)
 		}
+		self.storeInCache(joinOut)
 		self.metadata.WriteTime(CompleteFile)
 		// Print alerts
 		var alarms strings.Builder
@@ -1195,6 +1239,9 @@ func (self *Fork) stepPipeline() {
 }
 
 func (self *Fork) step() {
+	if events := self.node.top.events(); events.active() {
+		defer self.emitStateChange(events)
+	}
 	if self.node.call.Kind() == syntax.KindStage {
 		state := self.getState()
 		if !state.IsRunning() && !state.IsQueued() && state != DisabledState {
@@ -1242,6 +1289,19 @@ func (self *Fork) step() {
 	}
 }
 
+func (self *Fork) emitStateChange(events *EventLog) {
+	if state := self.getState(); state != self.eventState {
+		events.Emit(&Event{
+			Type:     EventState,
+			Kind:     EventKindFork,
+			Fqname:   self.fqname,
+			State:    state,
+			Previous: self.eventState,
+		})
+		self.eventState = state
+	}
+}
+
 func (self *Fork) printUpdateIfNeeded() {
 	if time.Since(self.lastPrint) > forkPrintInterval {
 		if state := self.getState(); state.IsRunning() {
@@ -0,0 +1,372 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Content-addressed cache of completed stage outputs, which can be shared
+// between pipestances.
+//
+// Entries are keyed on a hash of the callable, its source code parameters,
+// the resolved arguments, and the version information.  Each entry contains
+// the stage's _outs and hard links (or copies, if linking is not possible) of
+// any files referenced by the outs which were inside the fork directory.
+// Because the cache keeps its own links to the file data, volatile data
+// removal in either the pipestance which populated the entry or one which
+// was hydrated from it only ever removes that pipestance's links.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/martian-lang/martian/martian/syntax"
+	"github.com/martian-lang/martian/martian/util"
+)
+
+const (
+	stageCacheInfoFile = "_cacheinfo"
+	stageCacheOutsFile = "_outs"
+	stageCacheFilesDir = "files"
+)
+
+// A directory containing cached stage outputs.
+type StageCache struct {
+	path string
+}
+
+// Information about the origin of a cache entry.
+type StageCacheInfo struct {
+	Key string `json:"key"`
+
+	// The fully-qualified name of the fork which populated the entry.
+	Fqname string `json:"fqname"`
+
+	// The path which was replaced in the outs when the entry was stored.
+	Root string `json:"root"`
+
+	// The files included in the entry, relative to Root.
+	Files []string `json:"files"`
+
+	Timestamp string `json:"timestamp"`
+}
+
+// Opens the stage cache at the given directory, creating it if required.
+func NewStageCache(dir string) (*StageCache, error) {
+	p, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(p, 0777); err != nil {
+		return nil, err
+	}
+	return &StageCache{path: p}, nil
+}
+
+// Get the path to the cache directory.
+func (self *StageCache) Path() string {
+	return self.path
+}
+
+func (self *StageCache) entryPath(key string) string {
+	return path.Join(self.path, key[:2], key)
+}
+
+// Get the info for the given key, if it is present and all of its
+// files are intact.
+func (self *StageCache) Lookup(key string) (*StageCacheInfo, bool) {
+	entry := self.entryPath(key)
+	b, err := ioutil.ReadFile(path.Join(entry, stageCacheInfoFile))
+	if err != nil {
+		return nil, false
+	}
+	var info StageCacheInfo
+	if err := json.Unmarshal(b, &info); err != nil || info.Key != key {
+		return nil, false
+	}
+	for _, f := range info.Files {
+		if _, err := os.Lstat(path.Join(entry, stageCacheFilesDir, f)); err != nil {
+			return nil, false
+		}
+	}
+	return &info, true
+}
+
+// Add an entry to the cache.
+//
+// Files must be inside root.  References to root in outs will be replaced
+// with the hydration destination when the entry is later used.  If the entry
+// already exists it is left unchanged.
+func (self *StageCache) Store(key, fqname, root string,
+	outs []byte, files []string) error {
+	entry := self.entryPath(key)
+	if _, ok := self.Lookup(key); ok {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(entry), 0777); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(path.Dir(entry), "."+key+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	info := StageCacheInfo{
+		Key:       key,
+		Fqname:    fqname,
+		Root:      root,
+		Files:     make([]string, 0, len(files)),
+		Timestamp: util.Timestamp(),
+	}
+	for _, f := range files {
+		rel, err := filepath.Rel(root, f)
+		if err != nil {
+			return err
+		}
+		if err := linkOrCopy(f, path.Join(tmp, stageCacheFilesDir, rel)); err != nil {
+			return err
+		}
+		info.Files = append(info.Files, rel)
+	}
+	if err := ioutil.WriteFile(path.Join(tmp, stageCacheOutsFile),
+		outs, 0644); err != nil {
+		return err
+	}
+	if b, err := json.MarshalIndent(&info, "", "    "); err != nil {
+		return err
+	} else if err := ioutil.WriteFile(path.Join(tmp, stageCacheInfoFile),
+		b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, entry); err != nil {
+		// Another pipestance may have populated the entry concurrently.
+		if _, ok := self.Lookup(key); ok {
+			return nil
+		}
+		// Replace a corrupt entry.
+		os.RemoveAll(entry)
+		return os.Rename(tmp, entry)
+	}
+	return nil
+}
+
+// Link the files for the given entry into dest, which should be the files
+// directory of the hydrated fork's join, and return the outs with references
+// to the cached files replaced with their new locations.
+func (self *StageCache) Hydrate(info *StageCacheInfo, dest string) ([]byte, error) {
+	entry := self.entryPath(info.Key)
+	outs, err := ioutil.ReadFile(path.Join(entry, stageCacheOutsFile))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range info.Files {
+		target := path.Join(dest, hydratedPath(f))
+		if err := linkOrCopy(path.Join(entry, stageCacheFilesDir, f),
+			target); err != nil {
+			return nil, err
+		}
+		if info.Root != "" {
+			outs, _ = newPathRelocator(path.Join(info.Root, f),
+				target).rewrite(outs)
+		}
+	}
+	return outs, nil
+}
+
+// Returns the location, relative to the join files directory of a hydrated
+// fork, for a file cached at the given path relative to the original fork.
+// Files from the original join's files directory go directly in the
+// destination.  Files from chunks go in a subdirectory named for the chunk,
+// without the uniquifier of the original pipestance.
+func hydratedPath(rel string) string {
+	parts := strings.SplitN(rel, "/", 3)
+	if len(parts) < 3 || parts[1] != "files" {
+		return rel
+	}
+	dir := parts[0]
+	if i := strings.LastIndex(dir, "-u"); i > 0 {
+		dir = dir[:i]
+	}
+	if dir == "join" {
+		return parts[2]
+	}
+	return path.Join(dir, parts[2])
+}
+
+// Hard link src to dst, recursively for directories, falling back to a copy
+// if the link fails, e.g. because they are on different filesystems.
+func linkOrCopy(src, dst string) error {
+	return util.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := dst
+		if p != src {
+			rel, err := filepath.Rel(src, p)
+			if err != nil {
+				return err
+			}
+			target = path.Join(dst, rel)
+		}
+		if err := os.MkdirAll(path.Dir(target), 0777); err != nil {
+			return err
+		}
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			return os.MkdirAll(target, mode.Perm()|0700)
+		case mode&os.ModeSymlink != 0:
+			if link, err := os.Readlink(p); err != nil {
+				return err
+			} else {
+				return os.Symlink(link, target)
+			}
+		case mode.IsRegular():
+			if os.Link(p, target) == nil {
+				return nil
+			}
+			return copyFile(p, target, mode.Perm())
+		default:
+			return nil
+		}
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Returns true if this fork's results may be taken from the stage cache.
+func (self *Fork) cacheable() bool {
+	if self.node.top.rt.stageCache == nil ||
+		self.node.call.Kind() != syntax.KindStage ||
+		self.node.stagecode == nil {
+		return false
+	}
+	return !self.node.call.Call().Modifiers.Preflight
+}
+
+// Compute the cache key for this fork.  Requires the split _args to have
+// been written.
+func (self *Fork) stageCacheKey() (string, error) {
+	args, err := self.split_metadata.readRawBytes(ArgsFile)
+	if err != nil {
+		return "", err
+	}
+	versions, err := json.Marshal(&self.node.top.version)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	write := func(b []byte) {
+		h.Write(b)
+		h.Write([]byte{0})
+	}
+	write([]byte(self.node.call.Callable().GetId()))
+	write([]byte(strconv.Itoa(int(self.node.stagecode.Type))))
+	write([]byte(self.node.resolvedCmd))
+	for _, arg := range self.node.stagecode.Args {
+		write([]byte(arg))
+	}
+	write(bytes.TrimSpace(args))
+	write(versions)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Attempt to populate the join outs for this fork from the stage cache.
+// Returns true if the fork was hydrated.  A miss is remembered until the fork
+// is reset, so the cache is only checked once for each attempt.
+func (self *Fork) hydrateFromCache() bool {
+	if self.cacheChecked || !self.cacheable() {
+		return false
+	}
+	self.cacheChecked = true
+	key, err := self.stageCacheKey()
+	if err != nil {
+		util.LogError(err, "runtime",
+			"Could not compute cache key for %s", self.fqname)
+		return false
+	}
+	cache := self.node.top.rt.stageCache
+	info, ok := cache.Lookup(key)
+	if !ok {
+		return false
+	}
+	// Files are placed in the join's files directory, so that they are
+	// accounted for and removed by VDR along with the rest of its files.
+	outs, err := cache.Hydrate(info, self.join_metadata.FilesPath())
+	if err != nil {
+		util.LogError(err, "runtime",
+			"Could not hydrate %s from cache entry %s", self.fqname, key)
+		return false
+	}
+	self.metadata.Write(StageCacheFile, info)
+	self.join_metadata.WriteRawBytes(OutsFile, outs)
+	self.join_metadata.WriteTime(CompleteFile)
+	util.PrintInfo("runtime", "(cached)          %s", self.fqname)
+	return true
+}
+
+// Store the outputs of this fork in the stage cache.
+func (self *Fork) storeInCache(outs LazyArgumentMap) {
+	if !self.cacheable() || self.metadata.exists(StageCacheFile) {
+		return
+	}
+	key, err := self.stageCacheKey()
+	if err != nil {
+		util.LogError(err, "runtime",
+			"Could not compute cache key for %s", self.fqname)
+		return
+	}
+	outsBytes, err := json.Marshal(outs)
+	if err != nil {
+		util.LogError(err, "runtime",
+			"Could not serialize outs of %s for cache", self.fqname)
+		return
+	}
+	root := self.path
+	var files []string
+	for _, name := range getMaybeFileNames(outs) {
+		name = path.Clean(name)
+		if pathIsInside(name, root) {
+			if _, err := os.Lstat(name); err == nil {
+				files = append(files, name)
+			}
+		}
+	}
+	// Remove duplicates and files contained in other files.
+	sort.Strings(files)
+	unique := files[:0]
+	for _, f := range files {
+		if len(unique) == 0 || !pathIsInside(f, unique[len(unique)-1]) {
+			unique = append(unique, f)
+		}
+	}
+	if err := self.node.top.rt.stageCache.Store(key, self.fqname,
+		root, outsBytes, unique); err != nil {
+		util.LogError(err, "runtime",
+			"Could not store outputs of %s in cache", self.fqname)
+	} else if self.node.top.rt.Config.Debug {
+		util.LogInfo("runtime", "Stored %s in cache as %s",
+			self.fqname, key)
+	}
+}
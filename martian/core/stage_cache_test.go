@@ -0,0 +1,241 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStageCacheRoundTrip(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "testStageCache")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewStageCache(path.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := path.Join(dir, "ps1", "STAGE", "fork0")
+	files := []string{
+		path.Join(src, "join-u0123", "files", "out.txt"),
+		path.Join(src, "join-u0123", "files", "dir"),
+		path.Join(src, "chnk0-u4567", "files", "out.txt"),
+	}
+	if err := os.MkdirAll(path.Join(files[1], "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(files[0], []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Dir(files[2]), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(files[2], []byte("chunk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(files[1], "sub", "nested"),
+		[]byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outs, err := json.Marshal(map[string]interface{}{
+		"txt":    files[0],
+		"dir":    files[1],
+		"chunk":  files[2],
+		"nested": path.Join(files[1], "sub", "nested"),
+		"count":  2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "0123456789abcdef"
+	if _, ok := cache.Lookup(key); ok {
+		t.Fatal("found entry in empty cache")
+	}
+	if err := cache.Store(key, "ID.PS.STAGE.fork0", src, outs, files); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate VDR of the original pipestance.
+	if err := os.RemoveAll(src); err != nil {
+		t.Fatal(err)
+	}
+	info, ok := cache.Lookup(key)
+	if !ok {
+		t.Fatal("entry not found")
+	}
+	dest := path.Join(dir, "ps2", "STAGE", "fork0", "join-u89ab", "files")
+	hydrated, err := cache.Hydrate(info, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		Txt    string `json:"txt"`
+		Dir    string `json:"dir"`
+		Chunk  string `json:"chunk"`
+		Nested string `json:"nested"`
+		Count  int    `json:"count"`
+	}
+	if err := json.Unmarshal(hydrated, &result); err != nil {
+		t.Fatal(err)
+	}
+	if expect := path.Join(dest, "out.txt"); result.Txt != expect {
+		t.Errorf("expected %q, got %q", expect, result.Txt)
+	}
+	if expect := path.Join(dest, "chnk0", "out.txt"); result.Chunk != expect {
+		t.Errorf("expected %q, got %q", expect, result.Chunk)
+	}
+	if expect := path.Join(dest, "dir", "sub", "nested"); result.Nested != expect {
+		t.Errorf("expected %q, got %q", expect, result.Nested)
+	}
+	if result.Count != 2 {
+		t.Errorf("expected 2, got %d", result.Count)
+	}
+	if b, err := ioutil.ReadFile(result.Txt); err != nil {
+		t.Error(err)
+	} else if string(b) != "hello" {
+		t.Errorf("expected hello, got %q", b)
+	}
+	if b, err := ioutil.ReadFile(result.Chunk); err != nil {
+		t.Error(err)
+	} else if string(b) != "chunk" {
+		t.Errorf("expected chunk, got %q", b)
+	}
+	if b, err := ioutil.ReadFile(result.Nested); err != nil {
+		t.Error(err)
+	} else if string(b) != "world" {
+		t.Errorf("expected world, got %q", b)
+	}
+
+	// Deleting the hydrated files must not invalidate the cache entry.
+	if err := os.RemoveAll(path.Join(dir, "ps2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Lookup(key); !ok {
+		t.Error("entry was removed along with hydrated files")
+	}
+}
+
+func TestStageCacheMissingFile(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "testStageCacheMissing")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewStageCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := path.Join(dir, "fork0")
+	f := path.Join(src, "out.txt")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const key = "fedcba9876543210"
+	if err := cache.Store(key, "fork0", src, []byte("{}"), []string{f}); err != nil {
+		t.Fatal(err)
+	}
+	info, ok := cache.Lookup(key)
+	if !ok {
+		t.Fatal("entry not found")
+	}
+	if err := os.Remove(path.Join(cache.entryPath(key),
+		stageCacheFilesDir, info.Files[0])); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Lookup(key); ok {
+		t.Error("incomplete entry should not be returned")
+	}
+}
+
+func TestForkHydrateFromCache(t *testing.T) {
+	invokeTestWith(`
+filetype txt;
+
+stage REPORT(
+    in  int   value,
+    out txt   report,
+    src comp  "stages/report",
+) split (
+)
+
+call REPORT(
+    value = 1,
+)
+`, t, func(t *testing.T, ps *Pipestance) {
+		dir, err := ioutil.TempDir("", "testForkHydrate")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		cache, err := NewStageCache(path.Join(dir, "cache"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps.node.top.rt.stageCache = cache
+		defer func() { ps.node.top.rt.stageCache = nil }()
+		node := ps.findNode("REPORT.REPORT")
+		if err := node.mkdirs(); err != nil {
+			t.Fatal(err)
+		}
+		fork := node.forks[0]
+		fork.split_metadata.Write(ArgsFile, map[string]int{"value": 1})
+		if fork.hydrateFromCache() {
+			t.Fatal("Expected a cache miss.")
+		}
+
+		// Populate the cache from another pipestance.
+		key, err := fork.stageCacheKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := path.Join(dir, "other", "REPORT", "fork0")
+		report := path.Join(src, "join-u0123", "files", "report.txt")
+		if err := os.MkdirAll(path.Dir(report), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(report, []byte("report"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		outs, err := json.Marshal(map[string]string{"report": report})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Store(key, "ID.other.REPORT.fork0", src,
+			outs, []string{report}); err != nil {
+			t.Fatal(err)
+		}
+		if fork.hydrateFromCache() {
+			t.Error("Expected the miss to be remembered until reset.")
+		}
+		fork.reset()
+		if !fork.hydrateFromCache() {
+			t.Fatal("Expected a cache hit.")
+		}
+		var result struct {
+			Report string `json:"report"`
+		}
+		if err := fork.join_metadata.ReadInto(OutsFile, &result); err != nil {
+			t.Fatal(err)
+		}
+		expect := path.Join(fork.join_metadata.FilesPath(), "report.txt")
+		if result.Report != expect {
+			t.Errorf("Expected %q, got %q", expect, result.Report)
+		}
+		if b, err := ioutil.ReadFile(expect); err != nil {
+			t.Error(err)
+		} else if string(b) != "report" {
+			t.Errorf("Expected report, got %q", b)
+		}
+	})
+}
@@ -254,6 +254,7 @@ func (self *Fork) vdrKillSome(partial *PartialVdrKillReport, done bool) (*VDRKil
 			if partial != nil {
 				partial.VDRKillReport.mergeEvents()
 				self.metadata.Write(VdrKill, &partial.VDRKillReport)
+				self.recordVdr(&partial.VDRKillReport)
 			} else {
 				self.metadata.Write(VdrKill,
 					VDRKillReport{Timestamp: util.Timestamp()})
@@ -304,6 +305,7 @@ func (self *Fork) vdrKillSome(partial *PartialVdrKillReport, done bool) (*VDRKil
 		partial.VDRKillReport.mergeEvents()
 		self.metadata.Write(VdrKill, &partial.VDRKillReport)
 		self.deletePartialKill()
+		self.recordVdr(&partial.VDRKillReport)
 		if self.node.top.rt.Config.Debug {
 			util.LogInfo("storage", "VDR of %s complete",
 				self.node.GetFQName())
@@ -1003,6 +1005,7 @@ func (self *Fork) vdrKill(partialKill *PartialVdrKillReport) *VDRKillReport {
 		}
 	}
 	self.metadata.Write(VdrKill, killReport)
+	self.recordVdr(killReport)
 	return killReport
 }
 
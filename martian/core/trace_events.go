@@ -0,0 +1,405 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+// Export of stage execution timing in the Chrome trace event format, which
+// can be loaded in Perfetto (https://ui.perfetto.dev) or chrome://tracing.
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// A single entry in a trace event file.
+type TraceEvent struct {
+	Name  string `json:"name"`
+	Cat   string `json:"cat,omitempty"`
+	Phase string `json:"ph"`
+
+	// Microseconds since the unix epoch.
+	Ts  int64 `json:"ts"`
+	Dur int64 `json:"dur,omitempty"`
+
+	Pid int `json:"pid"`
+	Tid int `json:"tid"`
+
+	// The scope of instant events.
+	Scope string                 `json:"s,omitempty"`
+	Args  map[string]interface{} `json:"args,omitempty"`
+}
+
+// The content of a trace event file.
+type Trace struct {
+	TraceEvents     []*TraceEvent `json:"traceEvents"`
+	DisplayTimeUnit string        `json:"displayTimeUnit"`
+}
+
+// Trace phases used by martian.
+const (
+	tracePhaseComplete = "X"
+	tracePhaseInstant  = "i"
+	tracePhaseMetadata = "M"
+)
+
+// The pid used for all events.  The tid 0 track is used for events which
+// are not associated with a job, and the remaining tracks are job slots.
+const tracePid = 1
+
+// One attempt at running a split, chunk, or join.
+type traceJob struct {
+	fqname  string
+	kind    string
+	attempt int
+	state   string
+	jobId   string
+	threads float64
+	memGB   float64
+
+	queued time.Time
+	start  time.Time
+	end    time.Time
+}
+
+// Assembles a trace from the event log and job info files.
+type traceBuilder struct {
+	jobs []*traceJob
+
+	// The most recent attempt for each job, by fully qualified name.
+	current  map[string]*traceJob
+	instants []*TraceEvent
+
+	// The timestamp of the last event seen.
+	last time.Time
+}
+
+func traceTimestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+func (self *traceBuilder) newAttempt(fqname, kind string) *traceJob {
+	if self.current == nil {
+		self.current = make(map[string]*traceJob)
+	}
+	job := &traceJob{
+		fqname:  fqname,
+		kind:    kind,
+		attempt: 1,
+	}
+	if prev := self.current[fqname]; prev != nil {
+		job.attempt = prev.attempt + 1
+	}
+	self.current[fqname] = job
+	self.jobs = append(self.jobs, job)
+	return job
+}
+
+// Read events from a JSON-lines event log, stopping at the first event
+// which cannot be parsed, for example because it was only partially written.
+func (self *traceBuilder) readEvents(r io.Reader) {
+	dec := json.NewDecoder(r)
+	for {
+		var ev Event
+		if err := dec.Decode(&ev); err != nil {
+			if err != io.EOF {
+				util.LogError(err, "trace", "Could not read event log.")
+			}
+			return
+		}
+		self.addEvent(&ev)
+	}
+}
+
+func (self *traceBuilder) addEvent(ev *Event) {
+	if self.last.Before(ev.Timestamp) {
+		self.last = ev.Timestamp
+	}
+	switch ev.Type {
+	case EventVdr:
+		if ev.VdrFiles == 0 {
+			return
+		}
+		self.instants = append(self.instants, &TraceEvent{
+			Name:  "VDR " + PartiallyQualifiedName(ev.Fqname),
+			Cat:   "vdr",
+			Phase: tracePhaseInstant,
+			Ts:    traceTimestamp(ev.Timestamp),
+			Pid:   tracePid,
+			Scope: "t",
+			Args: map[string]interface{}{
+				"files": ev.VdrFiles,
+				"bytes": ev.VdrBytes,
+			},
+		})
+	case EventRetry:
+		self.instants = append(self.instants, &TraceEvent{
+			Name:  "retry",
+			Cat:   "retry",
+			Phase: tracePhaseInstant,
+			Ts:    traceTimestamp(ev.Timestamp),
+			Pid:   tracePid,
+			Scope: "g",
+			Args: map[string]interface{}{
+				"message": ev.Message,
+			},
+		})
+	case EventJob:
+		if job := self.current[ev.Fqname]; job != nil && job.end.IsZero() {
+			job.jobId = ev.JobId
+		}
+	case EventState:
+		switch ev.Kind {
+		case EventKindSplit, EventKindChunk, EventKindJoin:
+			self.addStateEvent(ev)
+		}
+	}
+}
+
+func (self *traceBuilder) addStateEvent(ev *Event) {
+	job := self.current[ev.Fqname]
+	switch ev.State {
+	case Queued, Running:
+		if job != nil && job.end.IsZero() &&
+			ev.State == Queued && !job.start.IsZero() {
+			// The job was restarted without going through a reset, for
+			// example because mrp was restarted.
+			job.end = ev.Timestamp
+			job.state = "reset"
+		}
+		if job == nil || !job.end.IsZero() {
+			job = self.newAttempt(ev.Fqname, ev.Kind)
+		}
+		if ev.State == Queued {
+			if job.queued.IsZero() {
+				job.queued = ev.Timestamp
+			}
+		} else if job.start.IsZero() {
+			job.start = ev.Timestamp
+		}
+		if ev.JobId != "" {
+			job.jobId = ev.JobId
+		}
+	case Complete, Failed:
+		if job == nil || !job.end.IsZero() {
+			job = self.newAttempt(ev.Fqname, ev.Kind)
+		}
+		job.end = ev.Timestamp
+		job.state = string(ev.State)
+	default:
+		// The metadata was removed, which happens when failed or running
+		// jobs are reset.
+		if job != nil && job.end.IsZero() {
+			job.end = ev.Timestamp
+			job.state = "reset"
+		}
+	}
+}
+
+// Update the most recent attempt at the given job with the timing and
+// resource reservation recorded in its job info.
+func (self *traceBuilder) setJobInfo(fqname, kind string, info *JobInfo) {
+	job := self.current[fqname]
+	if job == nil {
+		job = self.newAttempt(fqname, kind)
+		job.state = string(Complete)
+	}
+	job.threads = info.Threads
+	job.memGB = info.MemGB
+	if wc := info.WallClockInfo; wc != nil {
+		job.start = refineTime(job.start, wc.Start)
+		job.end = refineTime(job.end, wc.End)
+	}
+}
+
+// The job info only records times to the second, while event timestamps
+// are only late by however long it took mrp to notice a change.  Use the
+// event timestamp unless it is inconsistent with the job info.
+func refineTime(t time.Time, info string) time.Time {
+	if info == "" {
+		return t
+	}
+	it, err := time.ParseInLocation(util.TIMEFMT, info, time.Local)
+	if err != nil {
+		return t
+	}
+	if d := t.Sub(it); t.IsZero() || d < 0 || d >= time.Second {
+		return it
+	}
+	return t
+}
+
+func (self *traceBuilder) addMetadata(m *Metadata, kind string) {
+	if m == nil || !m.exists(JobInfoFile) {
+		return
+	}
+	var info JobInfo
+	if err := m.ReadInto(JobInfoFile, &info); err != nil {
+		util.LogError(err, "trace", "Could not read job info for %s",
+			m.fqname)
+		return
+	}
+	self.setJobInfo(m.fqname, kind, &info)
+}
+
+// Fill in missing or inconsistent times.  Jobs which never finished are
+// assumed to have run until the last event.
+func (self *traceJob) normalize(last time.Time) {
+	if self.end.IsZero() {
+		self.end = last
+		if self.state == "" {
+			self.state = "incomplete"
+		}
+	}
+	if self.start.IsZero() {
+		if self.queued.IsZero() {
+			self.start = self.end
+		} else {
+			self.start = self.queued
+		}
+	}
+	if self.queued.IsZero() {
+		self.queued = self.start
+	} else if self.start.Before(self.queued) {
+		// Job info times are truncated to the second.
+		self.start = self.queued
+	}
+	if self.end.Before(self.start) {
+		self.end = self.start
+	}
+}
+
+func traceDuration(start, end time.Time) int64 {
+	if d := end.Sub(start).Nanoseconds() / int64(time.Microsecond); d > 0 {
+		return d
+	}
+	return 1
+}
+
+// Lay out the jobs in as few tracks as possible, such that no two jobs
+// overlap in the same track, including the time they spent queued.
+func (self *traceBuilder) build(name string) *Trace {
+	jobs := make([]*traceJob, 0, len(self.jobs))
+	for _, job := range self.jobs {
+		if job.queued.IsZero() && job.start.IsZero() && job.end.IsZero() {
+			continue
+		}
+		job.normalize(self.last)
+		jobs = append(jobs, job)
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].queued.Before(jobs[j].queued)
+	})
+	events := make([]*TraceEvent, 0, 2+2*len(jobs)+len(self.instants))
+	events = append(events,
+		&TraceEvent{
+			Name:  "process_name",
+			Phase: tracePhaseMetadata,
+			Pid:   tracePid,
+			Args:  map[string]interface{}{"name": name},
+		},
+		&TraceEvent{
+			Name:  "thread_name",
+			Phase: tracePhaseMetadata,
+			Pid:   tracePid,
+			Args:  map[string]interface{}{"name": "pipestance"},
+		})
+	var slots []time.Time
+	for _, job := range jobs {
+		slot := -1
+		for i, free := range slots {
+			if !free.After(job.queued) {
+				slot = i
+				break
+			}
+		}
+		if slot < 0 {
+			slot = len(slots)
+			slots = append(slots, time.Time{})
+			events = append(events, &TraceEvent{
+				Name:  "thread_name",
+				Phase: tracePhaseMetadata,
+				Pid:   tracePid,
+				Tid:   slot + 1,
+				Args: map[string]interface{}{
+					"name": "slot " + strconv.Itoa(slot+1),
+				},
+			})
+		}
+		slots[slot] = job.end
+		if job.start.After(job.queued) {
+			events = append(events, &TraceEvent{
+				Name:  "queued",
+				Cat:   "queue",
+				Phase: tracePhaseComplete,
+				Ts:    traceTimestamp(job.queued),
+				Dur:   traceDuration(job.queued, job.start),
+				Pid:   tracePid,
+				Tid:   slot + 1,
+				Args: map[string]interface{}{
+					"job": PartiallyQualifiedName(job.fqname),
+				},
+			})
+		}
+		args := map[string]interface{}{
+			"state":   job.state,
+			"attempt": job.attempt,
+		}
+		if job.jobId != "" {
+			args["jobid"] = job.jobId
+		}
+		if job.threads > 0 {
+			args["threads"] = job.threads
+		}
+		if job.memGB > 0 {
+			args["mem_gb"] = job.memGB
+		}
+		events = append(events, &TraceEvent{
+			Name:  PartiallyQualifiedName(job.fqname),
+			Cat:   job.kind,
+			Phase: tracePhaseComplete,
+			Ts:    traceTimestamp(job.start),
+			Dur:   traceDuration(job.start, job.end),
+			Pid:   tracePid,
+			Tid:   slot + 1,
+			Args:  args,
+		})
+	}
+	events = append(events, self.instants...)
+	return &Trace{
+		TraceEvents:     events,
+		DisplayTimeUnit: "ms",
+	}
+}
+
+// Add the job info for each job of this fork to the trace.
+func (self *Fork) addTraceJobs(tb *traceBuilder) {
+	tb.addMetadata(self.split_metadata, EventKindSplit)
+	for _, chunk := range self.chunks {
+		tb.addMetadata(chunk.metadata, EventKindChunk)
+	}
+	tb.addMetadata(self.join_metadata, EventKindJoin)
+}
+
+// Build a trace of the execution of every split, chunk, and join in the
+// pipestance, including queue waits, retries, and VDR, from the event log
+// and job info files.  Each job is placed on a track such that the jobs on
+// a track do not overlap, so gaps in the tracks show where the job slots
+// were idle.
+func (self *Pipestance) SerializeTrace() *Trace {
+	var tb traceBuilder
+	if f, err := os.Open(self.metadata.MetadataFilePath(EventsFile)); err == nil {
+		tb.readEvents(f)
+		f.Close()
+	}
+	for _, node := range self.allNodes() {
+		for _, fork := range node.forks {
+			fork.addTraceJobs(&tb)
+		}
+	}
+	return tb.build(self.GetFQName())
+}
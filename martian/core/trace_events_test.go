@@ -0,0 +1,139 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTraceBuilder(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	at := func(s int) time.Time {
+		return start.Add(time.Duration(s) * time.Second)
+	}
+	const (
+		split = "ID.ps.PIPE.A.fork0.split"
+		chunk = "ID.ps.PIPE.A.fork0.chnk0"
+		other = "ID.ps.PIPE.B.fork0.chnk0"
+	)
+	events := []*Event{
+		{Timestamp: at(0), Type: EventState, Kind: EventKindSplit,
+			Fqname: split, State: Queued},
+		{Timestamp: at(2), Type: EventState, Kind: EventKindSplit,
+			Fqname: split, State: Running},
+		{Timestamp: at(10), Type: EventState, Kind: EventKindSplit,
+			Fqname: split, State: Complete},
+		{Timestamp: at(10), Type: EventState, Kind: EventKindChunk,
+			Fqname: chunk, State: Queued},
+		{Timestamp: at(10), Type: EventState, Kind: EventKindChunk,
+			Fqname: other, State: Queued},
+		{Timestamp: at(11), Type: EventState, Kind: EventKindChunk,
+			Fqname: other, State: Running},
+		{Timestamp: at(15), Type: EventState, Kind: EventKindChunk,
+			Fqname: chunk, State: Running},
+		{Timestamp: at(20), Type: EventState, Kind: EventKindChunk,
+			Fqname: chunk, State: Failed},
+		{Timestamp: at(21), Type: EventRetry, Kind: EventKindPipestance,
+			Fqname: "ID.ps", Message: "heartbeat"},
+		{Timestamp: at(22), Type: EventState, Kind: EventKindChunk,
+			Fqname: chunk, State: Waiting, Previous: Failed},
+		{Timestamp: at(25), Type: EventState, Kind: EventKindChunk,
+			Fqname: chunk, State: Queued},
+		{Timestamp: at(30), Type: EventState, Kind: EventKindChunk,
+			Fqname: other, State: Complete},
+		{Timestamp: at(40), Type: EventState, Kind: EventKindChunk,
+			Fqname: chunk, State: Complete},
+		{Timestamp: at(41), Type: EventVdr, Kind: EventKindFork,
+			Fqname: "ID.ps.PIPE.A.fork0", VdrFiles: 2, VdrBytes: 100},
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A partially written event at the end should be ignored.
+	buf.WriteString(`{"seq": 15, "ts":`)
+
+	var tb traceBuilder
+	tb.readEvents(&buf)
+	tb.setJobInfo(chunk, EventKindChunk, &JobInfo{
+		Threads: 4,
+		MemGB:   8,
+		WallClockInfo: &WallClockInfo{
+			Start: at(27).Format("2006-01-02 15:04:05"),
+			End:   at(39).Format("2006-01-02 15:04:05"),
+		},
+	})
+	trace := tb.build("ID.ps")
+
+	type span struct {
+		name     string
+		tid      int
+		start    int
+		duration int
+	}
+	var spans []span
+	var instants []string
+	slots := make(map[int]string)
+	for _, ev := range trace.TraceEvents {
+		switch ev.Phase {
+		case tracePhaseComplete:
+			spans = append(spans, span{
+				name:     ev.Name,
+				tid:      ev.Tid,
+				start:    int((ev.Ts - traceTimestamp(start)) / 1000000),
+				duration: int(ev.Dur / 1000000),
+			})
+			if ev.Name == "PIPE.A.fork0.chnk0" {
+				if ev.Args["state"] == string(Failed) {
+					if ev.Args["attempt"] != 1 {
+						t.Errorf("Expected first attempt to fail, got %v",
+							ev.Args["attempt"])
+					}
+				} else if ev.Args["attempt"] != 2 {
+					t.Errorf("Expected second attempt to succeed, got %v",
+						ev.Args["attempt"])
+				} else if ev.Args["threads"] != 4.0 {
+					t.Errorf("Expected 4 threads, got %v", ev.Args["threads"])
+				}
+			}
+		case tracePhaseInstant:
+			instants = append(instants, ev.Name)
+		case tracePhaseMetadata:
+			if ev.Name == "thread_name" {
+				slots[ev.Tid] = ev.Args["name"].(string)
+			}
+		}
+	}
+	expect := []span{
+		{"queued", 1, 0, 2},
+		{"PIPE.A.fork0.split", 1, 2, 8},
+		{"queued", 1, 10, 5},
+		{"PIPE.A.fork0.chnk0", 1, 15, 5},
+		{"queued", 2, 10, 1},
+		{"PIPE.B.fork0.chnk0", 2, 11, 19},
+		{"queued", 1, 25, 2},
+		{"PIPE.A.fork0.chnk0", 1, 27, 12},
+	}
+	if len(spans) != len(expect) {
+		t.Fatalf("Expected %d spans, got %v", len(expect), spans)
+	}
+	for i, e := range expect {
+		if spans[i] != e {
+			t.Errorf("Expected %v, got %v", e, spans[i])
+		}
+	}
+	if len(slots) != 3 || slots[0] != "pipestance" || slots[2] != "slot 2" {
+		t.Errorf("Unexpected tracks %v", slots)
+	}
+	if len(instants) != 2 ||
+		instants[0] != "retry" ||
+		instants[1] != "VDR PIPE.A.fork0" {
+		t.Errorf("Unexpected instant events %v", instants)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package stagetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/martian-lang/martian/martian/core"
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+var nullBytes = []byte("null")
+
+// CompareOutputs checks the outputs of a stage against expected values.
+//
+// Only outputs which are present in the expected values are checked.  Values
+// of file types, including those in arrays, maps, or structs, are compared by
+// the content of the files rather than by path.  Relative paths in the
+// expected values are relative to expectedDir.
+//
+// All differences found are returned as a syntax.ErrorList.
+func (self *Harness) CompareOutputs(actual, expected core.LazyArgumentMap,
+	expectedDir string) error {
+	var errs syntax.ErrorList
+	keys := make([]string, 0, len(expected))
+	for k := range expected {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		param := self.Stage.OutParams.Table[k]
+		if param == nil {
+			errs = append(errs, fmt.Errorf("%s is not an output of %s",
+				k, self.Stage.Id))
+			continue
+		}
+		t := self.Types.Get(param.Tname)
+		if t == nil {
+			errs = append(errs, fmt.Errorf("unknown type %s for output %s",
+				param.Tname.String(), k))
+			continue
+		}
+		errs = self.compareValue(errs, k, t,
+			actual[k], expected[k], expectedDir)
+	}
+	return errs.If()
+}
+
+func isNull(b json.RawMessage) bool {
+	return len(b) == 0 || bytes.Equal(b, nullBytes)
+}
+
+func (self *Harness) compareValue(errs syntax.ErrorList, name string,
+	t syntax.Type, actual, expected json.RawMessage,
+	expectedDir string) syntax.ErrorList {
+	if isNull(actual) || isNull(expected) {
+		if isNull(actual) != isNull(expected) {
+			errs = append(errs, fmt.Errorf("%s: expected %s, got %s",
+				name, string(expected), string(actual)))
+		}
+		return errs
+	}
+	switch t := t.(type) {
+	case *syntax.ArrayType:
+		var a, e []json.RawMessage
+		if err := json.Unmarshal(actual, &a); err != nil {
+			return append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+		if err := json.Unmarshal(expected, &e); err != nil {
+			return append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+		if len(a) != len(e) {
+			return append(errs, fmt.Errorf("%s: expected %d elements, got %d",
+				name, len(e), len(a)))
+		}
+		elem := t.ElementType()
+		for i := range e {
+			errs = self.compareValue(errs, fmt.Sprintf("%s[%d]", name, i),
+				elem, a[i], e[i], expectedDir)
+		}
+		return errs
+	case *syntax.TypedMapType:
+		return self.compareMap(errs, name, func(string) syntax.Type {
+			return t.Elem
+		}, actual, expected, expectedDir)
+	case *syntax.StructType:
+		return self.compareMap(errs, name, func(key string) syntax.Type {
+			if member := t.Table[key]; member != nil {
+				return self.Types.Get(member.Tname)
+			}
+			return nil
+		}, actual, expected, expectedDir)
+	}
+	if t.IsFile() == syntax.KindIsFile {
+		var a, e string
+		if err := json.Unmarshal(actual, &a); err != nil {
+			return append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+		if err := json.Unmarshal(expected, &e); err != nil {
+			return append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+		if !filepath.IsAbs(e) {
+			e = filepath.Join(expectedDir, e)
+		}
+		if err := compareFiles(a, e); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+		return errs
+	}
+	var a, e interface{}
+	if err := json.Unmarshal(actual, &a); err != nil {
+		return append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	if err := json.Unmarshal(expected, &e); err != nil {
+		return append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	if !reflect.DeepEqual(a, e) {
+		errs = append(errs, fmt.Errorf("%s: expected %s, got %s",
+			name, string(expected), string(actual)))
+	}
+	return errs
+}
+
+// Compare the values of a map or struct.  For structs, keys which are not
+// members of the struct are compared as untyped json.
+func (self *Harness) compareMap(errs syntax.ErrorList, name string,
+	elemType func(string) syntax.Type,
+	actual, expected json.RawMessage, expectedDir string) syntax.ErrorList {
+	var a, e map[string]json.RawMessage
+	if err := json.Unmarshal(actual, &a); err != nil {
+		return append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	if err := json.Unmarshal(expected, &e); err != nil {
+		return append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	keys := make([]string, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		n := name + "." + k
+		av, ok := a[k]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: missing", n))
+			continue
+		}
+		t := elemType(k)
+		if t == nil {
+			t = self.Types.Get(syntax.TypeId{Tname: syntax.KindMap})
+		}
+		errs = self.compareValue(errs, n, t, av, e[k], expectedDir)
+	}
+	keys = keys[:0]
+	for k := range a {
+		if _, ok := e[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		errs = append(errs, fmt.Errorf("%s.%s: unexpected", name, k))
+	}
+	return errs
+}
+
+// Compare the content of two files.
+func compareFiles(actual, expected string) error {
+	a, err := ioutil.ReadFile(actual)
+	if err != nil {
+		return err
+	}
+	e, err := ioutil.ReadFile(expected)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(a, e) {
+		return fmt.Errorf("content of %s differs from %s", actual, expected)
+	}
+	return nil
+}
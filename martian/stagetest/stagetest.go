@@ -0,0 +1,392 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+// Package stagetest runs a single stage outside of a pipestance, for unit
+// testing stage code.
+//
+// The stage's split, chunks, and join are run through the same job command
+// and local job manager as mrp would use, in a metadata directory layout
+// similar to the one mrp would create:
+//
+//	<dir>/
+//	    _outs
+//	    files/
+//	    journal/
+//	    split/
+//	    chnk0/
+//	    ...
+//	    join/
+//
+// Stages which do not split run only chnk0, whose files directory is the
+// top-level files directory.
+package stagetest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/martian-lang/martian/martian/core"
+	"github.com/martian-lang/martian/martian/syntax"
+	"github.com/martian-lang/martian/martian/util"
+)
+
+// How often to check whether a job has finished.
+const pollInterval = 100 * time.Millisecond
+
+// A Harness runs a stage.
+type Harness struct {
+	Stage *syntax.Stage
+	Types *syntax.TypeLookup
+
+	// The runtime which provides the local job manager and the locations of
+	// mrjob and the language adapters.
+	Runtime *core.Runtime
+
+	// The resolved path to the stage code.
+	StageCode string
+
+	// Environment variables to set for each job, in addition to the
+	// current environment.
+	Envs map[string]string
+
+	// If non-zero, the maximum time to wait for any one job to finish.
+	Timeout time.Duration
+}
+
+// NewHarness creates a harness for the given stage, searching for the stage
+// code in the given paths.
+func NewHarness(rt *core.Runtime, stage *syntax.Stage,
+	types *syntax.TypeLookup, srcPaths []string) (*Harness, error) {
+	if stage.Src == nil {
+		return nil, fmt.Errorf("stage %s has no stage code", stage.Id)
+	}
+	cmd, err := stage.Src.FindPath(srcPaths)
+	if err != nil {
+		return nil, err
+	}
+	// Jobs run in their files directory, so relative paths will not work.
+	if cmd, err = filepath.Abs(cmd); err != nil {
+		return nil, err
+	}
+	return &Harness{
+		Stage:     stage,
+		Types:     types,
+		Runtime:   rt,
+		StageCode: cmd,
+		Envs:      make(map[string]string),
+	}, nil
+}
+
+// Load finds the named stage in the given mro search paths and creates a
+// harness for it.  The stage code is searched for in the mro paths and then
+// in $PATH, as it is by mrp.
+func Load(rt *core.Runtime, name string, mroPaths []string) (*Harness, error) {
+	callable, types, err := core.GetCallable(mroPaths, name, true)
+	if err != nil {
+		return nil, err
+	}
+	stage, ok := callable.(*syntax.Stage)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a stage", name)
+	}
+	srcPaths := append(mroPaths[:len(mroPaths):len(mroPaths)],
+		filepath.SplitList(os.Getenv("PATH"))...)
+	return NewHarness(rt, stage, types, srcPaths)
+}
+
+// Run runs the stage with the given arguments in the given directory, which
+// must not already contain a run of the stage, and returns the outputs.
+//
+// The arguments and the outputs of each job are validated against the
+// parameters declared for the stage.
+func (self *Harness) Run(dir string, args core.LazyArgumentMap) (core.LazyArgumentMap, error) {
+	if err, alarms := args.ValidateInputs(self.Types, self.Stage.InParams); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v%s", err, alarms)
+	}
+	filesPath := path.Join(dir, "files")
+	for _, p := range []string{dir, filesPath, self.journalPath(dir)} {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	stageDefs := &core.StageDefs{
+		ChunkDefs: []*core.ChunkDef{{}},
+	}
+	if self.Stage.Split {
+		split, err := self.metadata(dir, "split", "split", "")
+		if err != nil {
+			return nil, err
+		}
+		if err := split.Write(core.ArgsFile, args); err != nil {
+			return nil, err
+		}
+		if err := self.runJob(split, "split", args, nil); err != nil {
+			return nil, err
+		}
+		stageDefs = new(core.StageDefs)
+		if err := split.ReadInto(core.StageDefsFile, stageDefs); err != nil {
+			return nil, fmt.Errorf("reading stage defs: %w", err)
+		}
+	}
+
+	chunkOuts, err := self.runChunks(dir, args, stageDefs.ChunkDefs)
+	if err != nil {
+		return nil, err
+	}
+
+	var outs core.LazyArgumentMap
+	if self.Stage.Split {
+		if outs, err = self.runJoin(dir, args, stageDefs, chunkOuts); err != nil {
+			return nil, err
+		}
+	} else {
+		outs = chunkOuts[0]
+	}
+	if outs == nil {
+		outs = make(core.LazyArgumentMap)
+	}
+	if err, alarms := outs.ValidateOutputs(self.Types,
+		self.Stage.OutParams); err != nil {
+		return outs, fmt.Errorf("invalid outputs: %v%s", err, alarms)
+	}
+	return outs, core.NewMetadata(self.Stage.Id, dir).Write(core.OutsFile, outs)
+}
+
+func (self *Harness) journalPath(dir string) string {
+	return path.Join(dir, "journal")
+}
+
+// Create the metadata directory for a job.  If filesPath is empty, the job
+// gets its own files directory.
+func (self *Harness) metadata(dir, name, runType, filesPath string) (*core.Metadata, error) {
+	p := path.Join(dir, name)
+	if filesPath == "" {
+		filesPath = path.Join(p, "files")
+	}
+	for _, d := range []string{p, filesPath, path.Join(p, "tmp")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return core.NewMetadataRunWithJournalPath(
+		self.Stage.Id+"."+name, p, filesPath,
+		self.journalPath(dir), runType), nil
+}
+
+func (self *Harness) runChunks(dir string, args core.LazyArgumentMap,
+	defs []*core.ChunkDef) ([]core.LazyArgumentMap, error) {
+	width := util.WidthForInt(len(defs))
+	metadatas := make([]*core.Metadata, len(defs))
+	for i, def := range defs {
+		var filesPath string
+		if !self.Stage.Split {
+			filesPath = path.Join(dir, "files")
+		}
+		md, err := self.metadata(dir, fmt.Sprintf("chnk%0*d", width, i),
+			"main", filesPath)
+		if err != nil {
+			return nil, err
+		}
+		if def == nil {
+			def = new(core.ChunkDef)
+		}
+		if err := md.Write(core.ArgsFile, def.Merge(args)); err != nil {
+			return nil, err
+		}
+		outs := core.MakeOutArgs(self.Stage.OutParams,
+			md.FilesPath(), false, self.Types)
+		if self.Stage.Split {
+			for k, v := range core.MakeOutArgs(self.Stage.ChunkOuts,
+				md.FilesPath(), false, self.Types) {
+				outs[k] = v
+			}
+		}
+		if err := md.Write(core.OutsFile, outs); err != nil {
+			return nil, err
+		}
+		self.startJob(md, "main", args, def.Resources)
+		metadatas[i] = md
+	}
+	chunkOuts := make([]core.LazyArgumentMap, len(metadatas))
+	for i, md := range metadatas {
+		if err := self.waitJob(md); err != nil {
+			return nil, err
+		}
+		if err := md.ReadInto(core.OutsFile, &chunkOuts[i]); err != nil {
+			return nil, fmt.Errorf("reading outputs of chunk %d: %w", i, err)
+		}
+		var err error
+		var alarms string
+		if self.Stage.Split {
+			err, alarms = chunkOuts[i].ValidateOutputs(self.Types,
+				self.Stage.ChunkOuts, self.Stage.OutParams)
+		} else {
+			err, alarms = chunkOuts[i].ValidateOutputs(self.Types,
+				self.Stage.OutParams)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid outputs from chunk %d: %v%s",
+				i, err, alarms)
+		}
+	}
+	return chunkOuts, nil
+}
+
+func (self *Harness) runJoin(dir string, args core.LazyArgumentMap,
+	stageDefs *core.StageDefs,
+	chunkOuts []core.LazyArgumentMap) (core.LazyArgumentMap, error) {
+	md, err := self.metadata(dir, "join", "join", path.Join(dir, "files"))
+	if err != nil {
+		return nil, err
+	}
+	if err := md.Write(core.ArgsFile, &core.ChunkDef{
+		Resources: stageDefs.JoinDef,
+		Args:      args,
+	}); err != nil {
+		return nil, err
+	}
+	if err := md.Write(core.ChunkDefsFile, stageDefs.ChunkDefs); err != nil {
+		return nil, err
+	}
+	if chunkOuts == nil {
+		chunkOuts = []core.LazyArgumentMap{}
+	}
+	if err := md.Write(core.ChunkOutsFile, chunkOuts); err != nil {
+		return nil, err
+	}
+	if err := md.Write(core.OutsFile, core.MakeOutArgs(self.Stage.OutParams,
+		md.FilesPath(), false, self.Types)); err != nil {
+		return nil, err
+	}
+	if err := self.runJob(md, "join", args, stageDefs.JoinDef); err != nil {
+		return nil, err
+	}
+	var outs core.LazyArgumentMap
+	if err := md.ReadInto(core.OutsFile, &outs); err != nil {
+		return nil, fmt.Errorf("reading outputs of join: %w", err)
+	}
+	return outs, nil
+}
+
+func (self *Harness) runJob(md *core.Metadata, shellName string,
+	args core.LazyArgumentMap, jobDef *core.JobResources) error {
+	self.startJob(md, shellName, args, jobDef)
+	return self.waitJob(md)
+}
+
+// Get the resources for a job, from the stage definition and the resources
+// requested by the split, if any.
+func (self *Harness) jobResources(jobDef *core.JobResources) core.JobResources {
+	var res core.JobResources
+	if r := self.Stage.Resources; r != nil {
+		res.Threads = float64(r.Threads)
+		res.MemGB = float64(r.MemGB)
+		res.VMemGB = float64(r.VMemGB)
+		res.Special = r.Special
+	}
+	if jobDef != nil {
+		if jobDef.Threads != 0 {
+			res.Threads = jobDef.Threads
+		}
+		if jobDef.MemGB != 0 {
+			res.MemGB = jobDef.MemGB
+		}
+		if jobDef.VMemGB != 0 {
+			res.VMemGB = jobDef.VMemGB
+		}
+		if jobDef.Special != "" {
+			res.Special = jobDef.Special
+		}
+	}
+	return self.Runtime.LocalJobManager.GetSystemReqs(&res)
+}
+
+// Queue a job with the local job manager.
+func (self *Harness) startJob(md *core.Metadata, shellName string,
+	args core.LazyArgumentMap, jobDef *core.JobResources) {
+	res := self.jobResources(jobDef)
+	fqname := self.Stage.Id
+	if err := md.Write(core.JobInfoFile, &core.JobInfo{
+		Name:        fqname,
+		Type:        "local",
+		Threads:     res.Threads,
+		MemGB:       res.MemGB,
+		VMemGB:      res.VMemGB,
+		ProfileMode: core.DisableProfile,
+		Stackvars:   "disable",
+		Monitor:     "disable",
+		// The python adapter requires the invocation.
+		Invocation: &core.InvocationData{
+			Call:    self.Stage.Id,
+			Args:    args,
+			Include: self.Stage.File().FileName,
+		},
+		Version: &core.VersionInfo{
+			Martian: util.GetVersion(),
+		},
+	}); err != nil {
+		md.WriteErrorString(err.Error())
+		return
+	}
+	shellCmd, argv, envs := self.Runtime.JobCommand(self.Stage.Src,
+		self.StageCode, shellName, md, self.Envs)
+	self.Runtime.LocalJobManager.Enqueue(shellCmd, argv, envs, md, &res,
+		fqname, 0, 0, false)
+}
+
+// Wait for a job to either complete or fail.
+func (self *Harness) waitJob(md *core.Metadata) error {
+	var deadline <-chan time.Time
+	if self.Timeout > 0 {
+		timer := time.NewTimer(self.Timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := os.Stat(md.MetadataFilePath(core.CompleteFile)); err == nil {
+			return nil
+		}
+		for _, name := range []core.MetadataFileName{core.Errors, core.Assert} {
+			if b, err := ioutil.ReadFile(md.MetadataFilePath(name)); err == nil {
+				return &JobError{
+					Path:    path.Dir(md.MetadataFilePath(name)),
+					Assert:  name == core.Assert,
+					Message: strings.TrimSpace(string(b)),
+				}
+			}
+		}
+		select {
+		case <-self.Runtime.LocalJobManager.Done():
+		case <-ticker.C:
+		case <-deadline:
+			return fmt.Errorf("timed out waiting for job in %s",
+				path.Dir(md.MetadataFilePath(core.CompleteFile)))
+		}
+	}
+}
+
+// JobError is returned when a job fails.
+type JobError struct {
+	// The metadata directory of the failed job.
+	Path string
+
+	// True if the job failed with an assertion.
+	Assert bool
+
+	// The content of the _errors or _assert file.
+	Message string
+}
+
+func (err *JobError) Error() string {
+	if err.Assert {
+		return "assertion failed in " + err.Path + ": " + err.Message
+	}
+	return "job failed in " + err.Path + ": " + err.Message
+}
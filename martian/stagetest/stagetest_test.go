@@ -0,0 +1,196 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package stagetest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/martian-lang/martian/martian/core"
+	"github.com/martian-lang/martian/martian/syntax"
+	"github.com/martian-lang/martian/martian/util"
+)
+
+func TestMain(m *testing.M) {
+	util.SetupSignalHandlers()
+	os.Exit(m.Run())
+}
+
+func testRuntime() *core.Runtime {
+	return &core.Runtime{
+		LocalJobManager: core.NewLocalJobManager(1, 1, 0,
+			false, false, false,
+			&core.JobManagerJson{
+				JobSettings: &core.JobManagerSettings{
+					ThreadsPerJob: 1,
+					MemGBPerJob:   1,
+				},
+			}),
+	}
+}
+
+// Runtime for stages which run through mrjob, such as python stages.
+//
+// The runtime finds mrjob, the adapters, and the job manager configuration
+// relative to the executable, so this builds mrjob next to the test binary
+// and links in the adapters and job manager configuration from the source
+// tree.
+func installedRuntime(t *testing.T) (*core.Runtime, func()) {
+	t.Helper()
+	var cleanup []string
+	done := func() {
+		for _, p := range cleanup {
+			os.RemoveAll(p)
+		}
+	}
+	for _, dir := range []string{"adapters", "jobmanagers"} {
+		dest := util.RelPath(path.Join("..", dir))
+		if _, err := os.Stat(dest); os.IsNotExist(err) {
+			src, err := filepath.Abs(path.Join("..", "..", dir))
+			if err != nil {
+				done()
+				t.Skip(err)
+			}
+			if err := os.Symlink(src, dest); err != nil {
+				done()
+				t.Skip(err)
+			}
+			cleanup = append(cleanup, dest)
+		}
+	}
+	mrjob := util.RelPath("mrjob")
+	if _, err := os.Stat(mrjob); os.IsNotExist(err) {
+		cmd := exec.Command("go", "build", "-o", mrjob,
+			"github.com/martian-lang/martian/cmd/mrjob")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			done()
+			t.Skipf("Could not build mrjob: %v\n%s", err, out)
+		}
+		cleanup = append(cleanup, mrjob)
+	}
+	if _, err := exec.LookPath("python"); err != nil {
+		done()
+		t.Skip(err)
+	}
+	opts := core.DefaultRuntimeOptions()
+	opts.LocalCores = 1
+	opts.LocalMem = 1
+	return opts.NewRuntime(), done
+}
+
+func loadHarness(t *testing.T, name string) *Harness {
+	t.Helper()
+	return loadHarnessWith(t, testRuntime(), name)
+}
+
+func loadHarnessWith(t *testing.T, rt *core.Runtime, name string) *Harness {
+	t.Helper()
+	h, err := Load(rt, name, []string{"testdata"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Timeout = time.Minute
+	return h
+}
+
+func runHarness(t *testing.T, h *Harness, dir, args string) core.LazyArgumentMap {
+	t.Helper()
+	var a core.LazyArgumentMap
+	if err := json.Unmarshal([]byte(args), &a); err != nil {
+		t.Fatal(err)
+	}
+	outs, err := h.Run(dir, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outs
+}
+
+func TestRunMain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stagetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h := loadHarness(t, "GREET")
+	outs := runHarness(t, h, dir, `{"name":"world"}`)
+	if _, err := os.Stat(path.Join(dir, "chnk0", "_complete")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(path.Join(dir, "_outs")); err != nil {
+		t.Error(err)
+	}
+	if err := h.CompareOutputs(outs, core.LazyArgumentMap{
+		"greeting": json.RawMessage(`"greeting.txt"`),
+	}, path.Join("testdata", "expected")); err != nil {
+		t.Error(err)
+	}
+	if err := h.CompareOutputs(outs, core.LazyArgumentMap{
+		"greeting": json.RawMessage(`"report.txt"`),
+	}, path.Join("testdata", "expected")); err == nil {
+		t.Error("expected file content mismatch")
+	}
+}
+
+func TestRunPython(t *testing.T) {
+	rt, cleanup := installedRuntime(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "stagetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h := loadHarnessWith(t, rt, "GREET_PY")
+	outs := runHarness(t, h, dir, `{"name":"world"}`)
+	if _, err := os.Stat(path.Join(dir, "chnk0", "_complete")); err != nil {
+		t.Error(err)
+	}
+	if err := h.CompareOutputs(outs, core.LazyArgumentMap{
+		"greeting": json.RawMessage(`"greeting.txt"`),
+	}, path.Join("testdata", "expected")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunSplit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stagetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h := loadHarness(t, "COUNT")
+	outs := runHarness(t, h, dir, `{"values":[1,2,3]}`)
+	for _, d := range []string{"split", "chnk0", "chnk1", "chnk2", "join"} {
+		if _, err := os.Stat(path.Join(dir, d, "_complete")); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := h.CompareOutputs(outs, core.LazyArgumentMap{
+		"total":  json.RawMessage(`12`),
+		"report": json.RawMessage(`"report.txt"`),
+	}, path.Join("testdata", "expected")); err != nil {
+		t.Error(err)
+	}
+	err = h.CompareOutputs(outs, core.LazyArgumentMap{
+		"total": json.RawMessage(`13`),
+		"bogus": json.RawMessage(`1`),
+	}, "")
+	if errs, ok := err.(syntax.ErrorList); !ok || len(errs) != 2 {
+		t.Errorf("expected 2 errors, got %v", err)
+	}
+}
+
+func TestRunInvalidArgs(t *testing.T) {
+	h := loadHarness(t, "GREET")
+	if _, err := h.Run(path.Join(os.TempDir(), "stagetest_invalid"), core.LazyArgumentMap{
+		"name": json.RawMessage(`1`),
+	}); err == nil {
+		t.Error("expected an error for an int name")
+	}
+}
@@ -0,0 +1,18 @@
+#
+# Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+#
+# Minimal python stage implementation for testing the harness.
+#
+
+__MRO__ = """
+stage GREET_PY(
+    in  string name,
+    out txt    greeting,
+    src py     "greet_py",
+)
+"""
+
+
+def main(args, outs):
+    with open(outs.greeting, 'w') as f:
+        f.write('Hello, %s!\n' % args.name)
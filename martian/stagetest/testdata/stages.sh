@@ -0,0 +1,40 @@
+#!/bin/sh
+# Minimal exec stage implementations for testing the harness.
+# Usage: stages.sh <split|main|join> <metadata_path> <files_path> <journal>
+
+set -e
+
+phase="$1"
+md="$2"
+files="$3"
+
+case "$phase" in
+split)
+    echo '{"chunks":[{"value":1},{"value":2},{"value":3}],"join":{"__threads":1}}' \
+        > "$md/_stage_defs"
+    ;;
+main)
+    if grep -q '"value"' "$md/_args"; then
+        value=$(sed -n 's/.*"value": *\([0-9]*\).*/\1/p' "$md/_args")
+        echo "{\"total\":null,\"report\":null,\"double\":$((value * 2))}" \
+            > "$md/_outs"
+    else
+        name=$(sed -n 's/.*"name": *"\([^"]*\)".*/\1/p' "$md/_args")
+        echo "Hello, $name!" > "$files/greeting.txt"
+        echo "{\"greeting\":\"$files/greeting.txt\"}" > "$md/_outs"
+    fi
+    ;;
+join)
+    total=0
+    for d in $(tr -d ' ' < "$md/_chunk_outs" | grep -o '"double":[0-9]*' | cut -d: -f2); do
+        total=$((total + d))
+    done
+    echo "total $total" > "$files/report.txt"
+    echo "{\"total\":$total,\"report\":\"$files/report.txt\"}" > "$md/_outs"
+    ;;
+*)
+    echo "unknown phase $phase" > "$md/_errors"
+    exit 0
+    ;;
+esac
+touch "$md/_complete"
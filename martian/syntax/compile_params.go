@@ -179,6 +179,15 @@ func (params *OutParams) CheckFilenames() error {
 	return errs.If()
 }
 
+// ResolveType returns the type of the value referred to by the expression,
+// within the given pipeline.
+//
+// The pipeline and AST must have been compiled.
+func (exp *RefExp) ResolveType(global *Ast, pipeline *Pipeline) (TypeId, error) {
+	t, _, err := exp.resolveType(global, pipeline)
+	return t, err
+}
+
 func (exp *RefExp) resolveType(global *Ast, pipeline *Pipeline) (TypeId, MapCallSource, error) {
 	if pipeline == nil {
 		return TypeId{}, nil, global.err(exp,
@@ -0,0 +1,84 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package syntax
+
+import (
+	"os"
+	"strings"
+)
+
+// A Diagnostic is a single error found while parsing or compiling mro source,
+// along with the location at which it was found.
+type Diagnostic struct {
+	// The location of the error.  File will be nil if the location is not
+	// known.
+	Loc SourceLoc
+
+	// The error message, without location information.
+	Msg string
+}
+
+// Diagnostics flattens an error returned from parsing or compiling mro
+// source into a list of errors with their locations.
+func Diagnostics(err error) []Diagnostic {
+	var result []Diagnostic
+	return appendDiagnostics(result, err)
+}
+
+func appendDiagnostics(result []Diagnostic, err error) []Diagnostic {
+	switch err := err.(type) {
+	case nil:
+		return result
+	case ErrorList:
+		for _, e := range err {
+			result = appendDiagnostics(result, e)
+		}
+		return result
+	case *AstError:
+		return append(result, Diagnostic{Loc: err.Node.Loc, Msg: err.Msg})
+	case *wrapError:
+		if inner, ok := err.innerError.(*wrapError); ok {
+			return appendDiagnostics(result, inner)
+		}
+		return append(result, Diagnostic{
+			Loc: err.loc,
+			Msg: err.innerError.Error(),
+		})
+	case *FileNotFoundError:
+		msg := "File '" + err.name + "' not found"
+		if err.inner != nil && !os.IsNotExist(err.inner) {
+			msg = "File '" + err.name + "' could not be resolved: " +
+				err.inner.Error()
+		} else if err.paths != "" {
+			msg += " in " + err.paths
+		}
+		return append(result, Diagnostic{Loc: err.loc, Msg: msg})
+	case *DuplicateCallError:
+		return append(result, Diagnostic{
+			Loc: err.Second.Node.Loc,
+			Msg: "Cannot have more than one top-level call.",
+		})
+	case *ParseError:
+		return append(result, Diagnostic{
+			Loc: err.loc,
+			Msg: "ParseError: unexpected token '" + err.token + "'",
+		})
+	case *mmLexError:
+		var msg strings.Builder
+		msg.WriteString("ParseError: unexpected token '")
+		msg.Write(err.info.token)
+		msg.WriteByte('\'')
+		if err.info.err != "" {
+			msg.WriteString(" (")
+			msg.WriteString(err.info.err)
+			msg.WriteByte(')')
+		}
+		if len(err.info.previous) > 0 {
+			msg.WriteString(" after '")
+			msg.Write(err.info.previous)
+			msg.WriteByte('\'')
+		}
+		return append(result, Diagnostic{Loc: err.info.Loc(), Msg: msg.String()})
+	}
+	return append(result, Diagnostic{Msg: err.Error()})
+}
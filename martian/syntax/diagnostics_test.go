@@ -0,0 +1,58 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package syntax
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiagnosticsParseError(t *testing.T) {
+	t.Parallel()
+	_, err := yaccParse([]byte(`
+stage SUM_SQUARES(
+    in  float[] values,
+    out float   sum
+    src py      "stages/sum_squares",
+)
+`), new(SourceFile), makeStringIntern())
+	diags := Diagnostics(err)
+	if len(diags) != 1 {
+		t.Fatalf("Expected 1 diagnostic, got %d", len(diags))
+	}
+	if diags[0].Loc.Line != 5 {
+		t.Errorf("Expected error on line 5, got %d", diags[0].Loc.Line)
+	}
+	if !strings.HasPrefix(diags[0].Msg, "ParseError: unexpected token 'src'") {
+		t.Errorf("Unexpected message %q", diags[0].Msg)
+	}
+}
+
+func TestDiagnosticsCompileError(t *testing.T) {
+	t.Parallel()
+	ast, err := yaccParse([]byte(`
+stage SUM_SQUARES(
+    in  float[] values,
+    out float   sum,
+    src py      "stages/sum_squares",
+)
+
+call SUM_SQUARES(
+    values = [1.0, 2.0],
+    extra  = 1,
+)
+`), new(SourceFile), makeStringIntern())
+	if err != nil {
+		t.Fatal(err)
+	}
+	diags := Diagnostics(ast.compile())
+	if len(diags) != 1 {
+		t.Fatalf("Expected 1 diagnostic, got %d", len(diags))
+	}
+	if diags[0].Loc.Line < 8 {
+		t.Errorf("Expected error in call, got line %d", diags[0].Loc.Line)
+	}
+	if strings.Contains(diags[0].Msg, "\n    at ") {
+		t.Errorf("Expected message without location, got %q", diags[0].Msg)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package refactoring
+
+import (
+	"fmt"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+type (
+	// addCallableInput is an Edit which adds an input parameter to a stage
+	// or pipeline.
+	addCallableInput struct {
+		Callable syntax.Callable
+		Param    string
+		Tname    syntax.TypeId
+	}
+
+	// addCallableOutput is an Edit which adds an output parameter to a stage
+	// or pipeline.  For pipelines, the output is also bound in the return
+	// statement.
+	addCallableOutput struct {
+		Callable syntax.Callable
+		Param    string
+		Tname    syntax.TypeId
+		Exp      syntax.Exp
+	}
+
+	// addCallInput is an Edit which adds a parameter binding to a call.
+	addCallInput struct {
+		Pipeline *syntax.Pipeline
+		File     string
+		Id       string
+		Param    string
+		Tname    syntax.TypeId
+		Exp      syntax.Exp
+	}
+)
+
+// AddInput creates an Edit which adds an input parameter to a stage or
+// pipeline, and binds it in every call to that stage or pipeline.
+//
+// If the pipeline making a call has an input of the same name and type,
+// the new parameter is bound to that input.  Otherwise it is bound to the
+// given default expression, which is required in that case.
+//
+// The asts must be fully compiled.
+func AddInput(callable syntax.Callable, param string, tname syntax.TypeId,
+	def syntax.Exp, asts []*syntax.Ast) (Edit, error) {
+	if callable.GetInParams().Table[param] != nil {
+		return nil, fmt.Errorf("%s already has an input %s",
+			callable.GetId(), param)
+	}
+	if err := checkParamType(callable, param, tname, asts); err != nil {
+		return nil, err
+	}
+	edits := editSet{addCallableInput{
+		Callable: callable,
+		Param:    param,
+		Tname:    tname,
+	}}
+	modified := make(map[decId]struct{}, 2*len(asts))
+	for _, ast := range asts {
+		if c := ast.Callables.Table[callable.GetId()]; c == nil ||
+			c.File().FullPath != callable.File().FullPath {
+			continue
+		}
+		for _, pipe := range ast.Pipelines {
+			dec := makeDecId(pipe)
+			if _, ok := modified[dec]; ok {
+				continue
+			}
+			modified[dec] = struct{}{}
+			for _, call := range pipe.Calls {
+				if call.DecId != callable.GetId() {
+					continue
+				}
+				exp := def
+				if in := pipe.InParams.Table[param]; in != nil && in.Tname == tname {
+					exp = &syntax.RefExp{
+						Node: syntax.NewAstNode(call.Node.Loc),
+						Kind: syntax.KindSelf,
+						Id:   param,
+					}
+				} else if exp == nil {
+					return nil, fmt.Errorf(
+						"a default value is required for %s in call %s of %s",
+						param, call.Id, pipe.Id)
+				}
+				edits = append(edits, addCallInput{
+					Pipeline: pipe,
+					File:     syntax.DefiningFile(call),
+					Id:       call.Id,
+					Param:    param,
+					Tname:    tname,
+					Exp:      exp,
+				})
+			}
+		}
+		// Fix up top-level call if needed.
+		if ast.Call != nil && ast.Call.DecId == callable.GetId() {
+			dec := makeDecId(ast.Call)
+			if _, ok := modified[dec]; ok {
+				continue
+			}
+			modified[dec] = struct{}{}
+			if def == nil {
+				return nil, fmt.Errorf(
+					"a default value is required for %s in call %s",
+					param, ast.Call.Id)
+			}
+			edits = append(edits, addCallInput{
+				File:  syntax.DefiningFile(ast.Call),
+				Id:    ast.Call.Id,
+				Param: param,
+				Tname: tname,
+				Exp:   def,
+			})
+		}
+	}
+	return edits, nil
+}
+
+// AddOutput creates an Edit which adds an output parameter to a stage or
+// pipeline.
+//
+// Pipelines must bind every output, so for a pipeline the new output is
+// returned from the pipeline's input of the same name and type if there is
+// one, or otherwise the given default expression, which is required in that
+// case.  The default is ignored for stages.
+//
+// The asts must be fully compiled.
+func AddOutput(callable syntax.Callable, param string, tname syntax.TypeId,
+	def syntax.Exp, asts []*syntax.Ast) (Edit, error) {
+	if callable.GetOutParams().Table[param] != nil {
+		return nil, fmt.Errorf("%s already has an output %s",
+			callable.GetId(), param)
+	}
+	if err := checkParamType(callable, param, tname, asts); err != nil {
+		return nil, err
+	}
+	edit := addCallableOutput{
+		Callable: callable,
+		Param:    param,
+		Tname:    tname,
+	}
+	if pipe, ok := callable.(*syntax.Pipeline); ok {
+		if in := pipe.InParams.Table[param]; in != nil && in.Tname == tname {
+			edit.Exp = &syntax.RefExp{
+				Node: syntax.NewAstNode(pipe.Node.Loc),
+				Kind: syntax.KindSelf,
+				Id:   param,
+			}
+		} else if def == nil {
+			return nil, fmt.Errorf(
+				"a value is required for output %s of pipeline %s",
+				param, pipe.Id)
+		} else {
+			edit.Exp = def
+		}
+	}
+	return edit, nil
+}
+
+// Verify that the type of a new parameter is known in the AST which defines
+// the callable.
+func checkParamType(callable syntax.Callable, param string,
+	tname syntax.TypeId, asts []*syntax.Ast) error {
+	for _, ast := range asts {
+		if c := ast.Callables.Table[callable.GetId()]; c != nil &&
+			syntax.DefiningFile(c) == syntax.DefiningFile(callable) {
+			if ast.TypeTable.Get(tname) == nil {
+				return fmt.Errorf("unknown type %s for parameter %s of %s",
+					tname.String(), param, callable.GetId())
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("callable %s not found", callable.GetId())
+}
+
+// Apply adds an input parameter to a callable in the given AST object.
+//
+// The first return value indicates the number places where a change was
+// made.
+//
+// The AST is not required to have been compiled.
+func (e addCallableInput) Apply(ast *syntax.Ast) (int, error) {
+	count := 0
+	for _, target := range ast.Callables.List {
+		if target.GetId() == e.Callable.GetId() &&
+			syntax.DefiningFile(target) == syntax.DefiningFile(e.Callable) {
+			params := target.GetInParams()
+			if params.Table != nil && params.Table[e.Param] != nil {
+				continue
+			}
+			param := &syntax.InParam{
+				Node:  syntax.NewAstNode(callableLoc(target)),
+				Tname: e.Tname,
+				Id:    e.Param,
+			}
+			params.List = append(params.List, param)
+			if params.Table != nil {
+				params.Table[e.Param] = param
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Apply adds an output parameter to a callable in the given AST object.
+//
+// The first return value indicates the number places where a change was
+// made.
+//
+// The AST is not required to have been compiled.
+func (e addCallableOutput) Apply(ast *syntax.Ast) (int, error) {
+	count := 0
+	for _, target := range ast.Callables.List {
+		if target.GetId() != e.Callable.GetId() ||
+			syntax.DefiningFile(target) != syntax.DefiningFile(e.Callable) {
+			continue
+		}
+		params := target.GetOutParams()
+		if params.Table != nil && params.Table[e.Param] != nil {
+			continue
+		}
+		loc := callableLoc(target)
+		param := &syntax.OutParam{
+			StructMember: syntax.StructMember{
+				Node:  syntax.NewAstNode(loc),
+				Tname: e.Tname,
+				Id:    e.Param,
+			},
+		}
+		params.List = append(params.List, param)
+		if params.Table != nil {
+			params.Table[e.Param] = param
+		}
+		if pipe, ok := target.(*syntax.Pipeline); ok && e.Exp != nil {
+			addBinding(pipe.Ret.Bindings, &syntax.BindStm{
+				Node:  syntax.NewAstNode(loc),
+				Id:    e.Param,
+				Exp:   relocateExp(e.Exp, loc),
+				Tname: e.Tname,
+			})
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Apply adds a parameter binding to a call in the given AST object.
+//
+// The first return value indicates the number places where a change was
+// made.
+//
+// The AST is not required to have been compiled.
+func (e addCallInput) Apply(ast *syntax.Ast) (int, error) {
+	if e.Pipeline == nil {
+		if ast.Call == nil || ast.Call.Id != e.Id ||
+			syntax.DefiningFile(ast.Call) != e.File {
+			return 0, nil
+		}
+		return e.apply(ast.Call), nil
+	}
+	count := 0
+	for _, p := range ast.Pipelines {
+		if p.Id != e.Pipeline.Id ||
+			syntax.DefiningFile(p) != syntax.DefiningFile(e.Pipeline) {
+			continue
+		}
+		for _, call := range p.Calls {
+			if call.Id == e.Id {
+				count += e.apply(call)
+			}
+		}
+	}
+	return count, nil
+}
+
+func (e addCallInput) apply(call *syntax.CallStm) int {
+	for _, b := range call.Bindings.List {
+		if b.Id == e.Param {
+			return 0
+		}
+	}
+	addBinding(call.Bindings, &syntax.BindStm{
+		Node:  syntax.NewAstNode(call.Node.Loc),
+		Id:    e.Param,
+		Exp:   relocateExp(e.Exp, call.Node.Loc),
+		Tname: e.Tname,
+	})
+	return 1
+}
+
+func callableLoc(callable syntax.Callable) syntax.SourceLoc {
+	return syntax.SourceLoc{
+		Line: callable.Line(),
+		File: callable.File(),
+	}
+}
+
+func addBinding(bindings *syntax.BindStms, binding *syntax.BindStm) {
+	bindings.List = append(bindings.List, binding)
+	if bindings.Table != nil {
+		bindings.Table[binding.Id] = binding
+	}
+}
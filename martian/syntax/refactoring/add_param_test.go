@@ -0,0 +1,165 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package refactoring
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+func TestAddParams(t *testing.T) {
+	var parser syntax.Parser
+	_, file, _, _ := runtime.Caller(0)
+	const src = `
+stage FOO(
+    in  int x,
+    out int y,
+    src comp "none",
+)
+
+pipeline INNER(
+    in  int x,
+    in  int threads,
+    out int y,
+)
+{
+    call FOO(
+        x = self.x,
+    )
+
+    call FOO as FOO2(
+        x = self.threads,
+    )
+
+    return (
+        y = FOO.y,
+    )
+}
+
+pipeline OUTER(
+    in  int x,
+    out int y,
+)
+{
+    call FOO(
+        x = self.x,
+    )
+
+    call INNER(
+        x       = FOO.y,
+        threads = 1,
+    )
+
+    return (
+        y = INNER.y,
+    )
+}
+
+call OUTER(
+    x = 1,
+)
+`
+	srcBytes := []byte(src)
+	_, _, ast, err := parser.ParseSourceBytes(srcBytes, file,
+		nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := parser.ParseValExp([]byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	asts := []*syntax.Ast{ast}
+	intType := syntax.TypeId{Tname: syntax.KindInt}
+	if _, err := AddInput(ast.Callables.Table["FOO"], "x",
+		intType, def, asts); err == nil {
+		t.Error("expected an error adding an existing parameter")
+	}
+	if _, err := AddInput(ast.Callables.Table["FOO"], "threads",
+		intType, nil, asts); err == nil {
+		t.Error("expected an error adding an input without a default")
+	}
+	edit, err := AddInput(ast.Callables.Table["FOO"], "threads",
+		intType, def, asts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outEdit, err := AddOutput(ast.Callables.Table["INNER"], "threads",
+		intType, nil, asts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmtAst, err := parser.UncheckedParse(srcBytes, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := edit.Apply(fmtAst); err != nil {
+		t.Fatal(err)
+	} else if c != 4 {
+		t.Errorf("%d != 4", c)
+	}
+	if c, err := outEdit.Apply(fmtAst); err != nil {
+		t.Fatal(err)
+	} else if c != 1 {
+		t.Errorf("%d != 1", c)
+	}
+	const expected = `stage FOO(
+    in  int x,
+    in  int threads,
+    out int y,
+    src comp "none",
+)
+
+pipeline INNER(
+    in  int x,
+    in  int threads,
+    out int y,
+    out int threads,
+)
+{
+    call FOO(
+        x       = self.x,
+        threads = self.threads,
+    )
+
+    call FOO as FOO2(
+        x       = self.threads,
+        threads = self.threads,
+    )
+
+    return (
+        y       = FOO.y,
+        threads = self.threads,
+    )
+}
+
+pipeline OUTER(
+    in  int x,
+    out int y,
+)
+{
+    call FOO(
+        x       = self.x,
+        threads = 2,
+    )
+
+    call INNER(
+        x       = FOO.y,
+        threads = 1,
+    )
+
+    return (
+        y = INNER.y,
+    )
+}
+
+call OUTER(
+    x = 1,
+)
+`
+	if s := fmtAst.Format(); s != expected {
+		diff(t, expected, s)
+	}
+}
@@ -0,0 +1,599 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package refactoring
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+// Identifies a value which crosses the boundary of an extracted pipeline,
+// either a pipeline input (Kind is KindSelf) or a top-level output of a call
+// (Kind is KindCall).  Output is empty if the entire call is referenced.
+type boundaryRef struct {
+	Kind   syntax.ExpKind
+	Id     string
+	Output string
+}
+
+func refBoundary(ref *syntax.RefExp) (boundaryRef, string) {
+	if ref.Kind == syntax.KindSelf {
+		return boundaryRef{Kind: ref.Kind, Id: ref.Id}, ref.OutputId
+	}
+	root, rest := splitOutputId(ref.OutputId)
+	return boundaryRef{Kind: ref.Kind, Id: ref.Id, Output: root}, rest
+}
+
+func (ref boundaryRef) exp(loc syntax.SourceLoc) *syntax.RefExp {
+	return &syntax.RefExp{
+		Node:     syntax.NewAstNode(loc),
+		Kind:     ref.Kind,
+		Id:       ref.Id,
+		OutputId: ref.Output,
+	}
+}
+
+// A parameter of an extracted pipeline, along with the value it is bound to
+// by the caller or which it returns.
+type extractedParam struct {
+	Ref   boundaryRef
+	Id    string
+	Tname syntax.TypeId
+	Help  string
+}
+
+func joinPath(id, path string) string {
+	if path == "" {
+		return id
+	}
+	return id + "." + path
+}
+
+// ExtractPipeline creates an edit which moves the given calls out of a
+// pipeline and into a new pipeline, which is then called in their place.
+//
+// Inputs of the new pipeline are inferred from references in the moved calls
+// to inputs of the original pipeline or to calls which were not moved.  Outputs
+// are inferred from references to the moved calls from the rest of the
+// original pipeline.  Inputs keep the name of the pipeline input or call
+// output they are bound to where possible.
+//
+// The pipeline and asts must be fully compiled.
+func ExtractPipeline(pipe *syntax.Pipeline, calls []string,
+	newName string, asts []*syntax.Ast) (Edit, error) {
+	if pipe.Callables == nil {
+		panic("pipeline was not fully compiled")
+	}
+	if len(calls) == 0 {
+		return nil, fmt.Errorf("no calls to extract from %s", pipe.Id)
+	}
+	if getCallable(newName, asts) != nil {
+		return nil, fmt.Errorf("callable %s already exists", newName)
+	}
+	global := findPipelineAst(pipe, asts)
+	if global == nil {
+		return nil, fmt.Errorf("pipeline %s not found", pipe.Id)
+	}
+	moved := make(StringSet, len(calls))
+	for _, id := range calls {
+		if pipe.Callables.Table[id] == nil {
+			return nil, fmt.Errorf("%s does not call %s", pipe.Id, id)
+		}
+		moved.Add(id)
+	}
+	for _, call := range pipe.Calls {
+		if call.Id == newName && !moved.Contains(call.Id) {
+			return nil, fmt.Errorf("%s already has a call named %s",
+				pipe.Id, newName)
+		}
+	}
+	if err := checkExtractCycle(pipe, moved); err != nil {
+		return nil, err
+	}
+	edit := extractPipelineEdit{
+		Pipeline: pipe,
+		Calls:    moved,
+		NewName:  newName,
+	}
+	var err error
+	if edit.InParams, err = extractInputs(pipe, moved, global); err != nil {
+		return nil, err
+	}
+	if edit.OutParams, err = extractOutputs(pipe, moved, global); err != nil {
+		return nil, err
+	}
+	return &edit, nil
+}
+
+// Returns the ids of the calls referenced in the call's bindings.
+func callDeps(call *syntax.CallStm) StringSet {
+	deps := make(StringSet)
+	addRefs := func(bindings *syntax.BindStms) {
+		if bindings == nil {
+			return
+		}
+		for _, binding := range bindings.List {
+			for _, ref := range binding.Exp.FindRefs() {
+				if ref.Kind == syntax.KindCall {
+					deps.Add(ref.Id)
+				}
+			}
+		}
+	}
+	addRefs(call.Bindings)
+	if call.Modifiers != nil {
+		addRefs(call.Modifiers.Bindings)
+	}
+	return deps
+}
+
+// Extracting the calls is not possible if a call which is not being moved
+// depends on one of the moved calls and is in turn depended on by another
+// moved call, since the new pipeline would then depend on itself.
+func checkExtractCycle(pipe *syntax.Pipeline, moved StringSet) error {
+	deps := make(map[string]StringSet, len(pipe.Calls))
+	for _, call := range pipe.Calls {
+		deps[call.Id] = callDeps(call)
+	}
+	downstream := make(StringSet)
+	for changed := true; changed; {
+		changed = false
+		for _, call := range pipe.Calls {
+			if moved.Contains(call.Id) || downstream.Contains(call.Id) {
+				continue
+			}
+			for dep := range deps[call.Id] {
+				if moved.Contains(dep) || downstream.Contains(dep) {
+					downstream.Add(call.Id)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	for _, call := range pipe.Calls {
+		if !moved.Contains(call.Id) {
+			continue
+		}
+		for dep := range deps[call.Id] {
+			if downstream.Contains(dep) {
+				return fmt.Errorf(
+					"cannot extract calls from %s: %s depends on %s, "+
+						"which depends on the extracted calls",
+					pipe.Id, call.Id, dep)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the index of each call in the pipeline.
+func callOrder(pipe *syntax.Pipeline) map[string]int {
+	order := make(map[string]int, len(pipe.Calls))
+	for i, call := range pipe.Calls {
+		order[call.Id] = i
+	}
+	return order
+}
+
+// Sort references to calls by the order of the calls in the pipeline, and
+// then by output name.
+func sortCallRefs(refs []boundaryRef, order map[string]int) {
+	sort.Slice(refs, func(i, j int) bool {
+		if oi, oj := order[refs[i].Id], order[refs[j].Id]; oi != oj {
+			return oi < oj
+		}
+		return refs[i].Output < refs[j].Output
+	})
+}
+
+// Returns a name which is not already in use, preferring the given name and
+// otherwise qualifying it with the given prefix.
+func uniqueName(names StringSet, name, prefix string) string {
+	if names.Contains(name) {
+		qualified := prefix + "_" + name
+		name = qualified
+		for i := 2; names.Contains(name); i++ {
+			name = qualified + strconv.Itoa(i)
+		}
+	}
+	names.Add(name)
+	return name
+}
+
+func resolveRefType(ref boundaryRef, global *syntax.Ast,
+	pipe *syntax.Pipeline) (syntax.TypeId, error) {
+	return ref.exp(pipe.Node.Loc).ResolveType(global, pipe)
+}
+
+// Determine the inputs for the extracted pipeline.  Pipeline inputs referred
+// to by the moved calls come first, in the order they were declared, followed
+// by outputs of other calls.
+func extractInputs(pipe *syntax.Pipeline, moved StringSet,
+	global *syntax.Ast) ([]extractedParam, error) {
+	seen := make(map[boundaryRef]struct{})
+	var selfRefs, callRefs []boundaryRef
+	for _, call := range pipe.Calls {
+		if !moved.Contains(call.Id) {
+			continue
+		}
+		check := func(bindings *syntax.BindStms) {
+			if bindings == nil {
+				return
+			}
+			for _, binding := range bindings.List {
+				for _, ref := range binding.Exp.FindRefs() {
+					if ref.Kind == syntax.KindCall && moved.Contains(ref.Id) {
+						continue
+					}
+					key, _ := refBoundary(ref)
+					if _, ok := seen[key]; ok {
+						continue
+					}
+					seen[key] = struct{}{}
+					if key.Kind == syntax.KindSelf {
+						selfRefs = append(selfRefs, key)
+					} else {
+						callRefs = append(callRefs, key)
+					}
+				}
+			}
+		}
+		check(call.Bindings)
+		if call.Modifiers != nil {
+			check(call.Modifiers.Bindings)
+		}
+	}
+	paramOrder := make(map[string]int, len(pipe.InParams.List))
+	for i, param := range pipe.InParams.List {
+		paramOrder[param.Id] = i
+	}
+	sort.Slice(selfRefs, func(i, j int) bool {
+		return paramOrder[selfRefs[i].Id] < paramOrder[selfRefs[j].Id]
+	})
+	sortCallRefs(callRefs, callOrder(pipe))
+
+	names := make(StringSet, len(selfRefs)+len(callRefs))
+	params := make([]extractedParam, 0, len(selfRefs)+len(callRefs))
+	for _, ref := range selfRefs {
+		param := pipe.InParams.Table[ref.Id]
+		if param == nil {
+			return nil, fmt.Errorf("%s has no input %s", pipe.Id, ref.Id)
+		}
+		names.Add(ref.Id)
+		params = append(params, extractedParam{
+			Ref:   ref,
+			Id:    ref.Id,
+			Tname: param.Tname,
+			Help:  param.Help,
+		})
+	}
+	for _, ref := range callRefs {
+		t, err := resolveRefType(ref, global, pipe)
+		if err != nil {
+			return nil, err
+		}
+		prefix := strings.ToLower(ref.Id)
+		name := ref.Output
+		if name == "" {
+			name = prefix
+		}
+		params = append(params, extractedParam{
+			Ref:   ref,
+			Id:    uniqueName(names, name, prefix),
+			Tname: t,
+		})
+	}
+	return params, nil
+}
+
+// Determine the outputs for the extracted pipeline, which are the outputs of
+// moved calls which are referred to from the rest of the pipeline.
+func extractOutputs(pipe *syntax.Pipeline, moved StringSet,
+	global *syntax.Ast) ([]extractedParam, error) {
+	seen := make(map[boundaryRef]struct{})
+	var refs []boundaryRef
+	check := func(bindings *syntax.BindStms) {
+		if bindings == nil {
+			return
+		}
+		for _, binding := range bindings.List {
+			for _, ref := range binding.Exp.FindRefs() {
+				if ref.Kind != syntax.KindCall || !moved.Contains(ref.Id) {
+					continue
+				}
+				key, _ := refBoundary(ref)
+				if _, ok := seen[key]; !ok {
+					seen[key] = struct{}{}
+					refs = append(refs, key)
+				}
+			}
+		}
+	}
+	for _, call := range pipe.Calls {
+		if moved.Contains(call.Id) {
+			continue
+		}
+		check(call.Bindings)
+		if call.Modifiers != nil {
+			check(call.Modifiers.Bindings)
+		}
+	}
+	if pipe.Ret != nil {
+		check(pipe.Ret.Bindings)
+	}
+	sortCallRefs(refs, callOrder(pipe))
+
+	names := make(StringSet, len(refs))
+	params := make([]extractedParam, 0, len(refs))
+	for _, ref := range refs {
+		t, err := resolveRefType(ref, global, pipe)
+		if err != nil {
+			return nil, err
+		}
+		prefix := strings.ToLower(ref.Id)
+		name := ref.Output
+		if name == "" {
+			name = prefix
+		}
+		params = append(params, extractedParam{
+			Ref:   ref,
+			Id:    uniqueName(names, name, prefix),
+			Tname: t,
+		})
+	}
+	return params, nil
+}
+
+type extractPipelineEdit struct {
+	Pipeline *syntax.Pipeline
+	Calls    StringSet
+	NewName  string
+
+	// The inputs of the new pipeline, along with the values they are bound
+	// to in the original pipeline.
+	InParams []extractedParam
+
+	// The outputs of the new pipeline, along with the output of the moved
+	// call which each one returns.
+	OutParams []extractedParam
+}
+
+func (self *extractPipelineEdit) Apply(ast *syntax.Ast) (int, error) {
+	pipe := findMatchingPipeline(self.Pipeline, ast)
+	if pipe == nil {
+		return 0, nil
+	}
+	moved := make([]*syntax.CallStm, 0, len(self.Calls))
+	calls := make([]*syntax.CallStm, 0, len(pipe.Calls)+1-len(self.Calls))
+	index := -1
+	for _, call := range pipe.Calls {
+		if self.Calls.Contains(call.Id) {
+			if index < 0 {
+				index = len(calls)
+				calls = append(calls, nil)
+			}
+			moved = append(moved, call)
+		} else {
+			calls = append(calls, call)
+		}
+	}
+	if len(moved) == 0 {
+		return 0, nil
+	} else if len(moved) != len(self.Calls) {
+		return 0, fmt.Errorf("expected %d calls to extract from %s, found %d",
+			len(self.Calls), pipe.Id, len(moved))
+	}
+	inputs := make(map[boundaryRef]string, len(self.InParams))
+	for _, param := range self.InParams {
+		inputs[param.Ref] = param.Id
+	}
+	for _, call := range moved {
+		if err := replaceCallRefs(call, func(ref *syntax.RefExp) (syntax.Exp, error) {
+			if ref.Kind == syntax.KindCall && self.Calls.Contains(ref.Id) {
+				return nil, nil
+			}
+			key, rest := refBoundary(ref)
+			id, ok := inputs[key]
+			if !ok {
+				return nil, fmt.Errorf("no input for reference to %s.%s",
+					key.Id, key.Output)
+			}
+			return &syntax.RefExp{
+				Node:     ref.Node,
+				Kind:     syntax.KindSelf,
+				Id:       id,
+				OutputId: rest,
+			}, nil
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	outputs := make(map[boundaryRef]string, len(self.OutParams))
+	for _, param := range self.OutParams {
+		outputs[param.Ref] = param.Id
+	}
+	replaceOutputs := func(ref *syntax.RefExp) (syntax.Exp, error) {
+		if ref.Kind != syntax.KindCall || !self.Calls.Contains(ref.Id) {
+			return nil, nil
+		}
+		key, rest := refBoundary(ref)
+		id, ok := outputs[key]
+		if !ok {
+			return nil, fmt.Errorf("no output for reference to %s.%s",
+				key.Id, key.Output)
+		}
+		return &syntax.RefExp{
+			Node:     ref.Node,
+			Kind:     syntax.KindCall,
+			Id:       self.NewName,
+			OutputId: joinPath(id, rest),
+		}, nil
+	}
+	for _, call := range calls {
+		if call != nil {
+			if err := replaceCallRefs(call, replaceOutputs); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if pipe.Ret != nil {
+		if err := replaceBindingRefs(pipe.Ret.Bindings, replaceOutputs); err != nil {
+			return 0, err
+		}
+	}
+	newPipe := self.makePipeline(pipe, moved)
+	calls[index] = self.makeCall(moved[0].Node.Loc)
+	pipe.Calls = calls
+	if pipe.Callables != nil && pipe.Callables.Table != nil {
+		for _, call := range moved {
+			delete(pipe.Callables.Table, call.Id)
+		}
+		pipe.Callables.Table[self.NewName] = newPipe
+	}
+	insertPipeline(ast, newPipe, pipe)
+	return len(moved) + 1, nil
+}
+
+// Create the new pipeline for the moved calls, and move retained references
+// to those calls into it.
+func (self *extractPipelineEdit) makePipeline(pipe *syntax.Pipeline,
+	moved []*syntax.CallStm) *syntax.Pipeline {
+	loc := pipe.Node.Loc
+	newPipe := &syntax.Pipeline{
+		Node: syntax.NewAstNode(loc),
+		Id:   self.NewName,
+		InParams: &syntax.InParams{
+			List:  make([]*syntax.InParam, 0, len(self.InParams)),
+			Table: make(map[string]*syntax.InParam, len(self.InParams)),
+		},
+		OutParams: &syntax.OutParams{
+			List:  make([]*syntax.OutParam, 0, len(self.OutParams)),
+			Table: make(map[string]*syntax.OutParam, len(self.OutParams)),
+		},
+		Calls: moved,
+		Ret: &syntax.ReturnStm{
+			Node: syntax.NewAstNode(loc),
+			Bindings: &syntax.BindStms{
+				Node:  syntax.NewAstNode(loc),
+				List:  make([]*syntax.BindStm, 0, len(self.OutParams)),
+				Table: make(map[string]*syntax.BindStm, len(self.OutParams)),
+			},
+		},
+	}
+	for _, p := range self.InParams {
+		param := &syntax.InParam{
+			Node:  syntax.NewAstNode(loc),
+			Tname: p.Tname,
+			Id:    p.Id,
+			Help:  p.Help,
+		}
+		newPipe.InParams.List = append(newPipe.InParams.List, param)
+		newPipe.InParams.Table[param.Id] = param
+	}
+	for _, p := range self.OutParams {
+		param := &syntax.OutParam{
+			StructMember: syntax.StructMember{
+				Node:  syntax.NewAstNode(loc),
+				Tname: p.Tname,
+				Id:    p.Id,
+			},
+		}
+		newPipe.OutParams.List = append(newPipe.OutParams.List, param)
+		newPipe.OutParams.Table[param.Id] = param
+		binding := &syntax.BindStm{
+			Node:  syntax.NewAstNode(loc),
+			Id:    p.Id,
+			Exp:   p.Ref.exp(loc),
+			Tname: p.Tname,
+		}
+		newPipe.Ret.Bindings.List = append(newPipe.Ret.Bindings.List, binding)
+		newPipe.Ret.Bindings.Table[binding.Id] = binding
+	}
+	if pipe.Retain != nil {
+		refs := pipe.Retain.Refs[:0]
+		for _, ref := range pipe.Retain.Refs {
+			if ref.Kind == syntax.KindCall && self.Calls.Contains(ref.Id) {
+				if newPipe.Retain == nil {
+					newPipe.Retain = &syntax.PipelineRetains{
+						Node: syntax.NewAstNode(pipe.Retain.Node.Loc),
+					}
+				}
+				newPipe.Retain.Refs = append(newPipe.Retain.Refs, ref)
+			} else {
+				refs = append(refs, ref)
+			}
+		}
+		if len(refs) == 0 {
+			pipe.Retain = nil
+		} else {
+			pipe.Retain.Refs = refs
+		}
+	}
+	if pipe.Callables != nil && pipe.Callables.Table != nil {
+		newPipe.Callables = &syntax.Callables{
+			Table: make(map[string]syntax.Callable, len(moved)),
+		}
+		for _, call := range moved {
+			newPipe.Callables.Table[call.Id] = pipe.Callables.Table[call.Id]
+		}
+	}
+	return newPipe
+}
+
+// Create the call to the new pipeline.
+func (self *extractPipelineEdit) makeCall(loc syntax.SourceLoc) *syntax.CallStm {
+	bindings := &syntax.BindStms{
+		Node:  syntax.NewAstNode(loc),
+		List:  make([]*syntax.BindStm, 0, len(self.InParams)),
+		Table: make(map[string]*syntax.BindStm, len(self.InParams)),
+	}
+	for _, p := range self.InParams {
+		binding := &syntax.BindStm{
+			Node:  syntax.NewAstNode(loc),
+			Id:    p.Id,
+			Exp:   p.Ref.exp(loc),
+			Tname: p.Tname,
+		}
+		bindings.List = append(bindings.List, binding)
+		bindings.Table[binding.Id] = binding
+	}
+	return &syntax.CallStm{
+		Node:      syntax.NewAstNode(loc),
+		Modifiers: new(syntax.Modifiers),
+		Id:        self.NewName,
+		DecId:     self.NewName,
+		Bindings:  bindings,
+	}
+}
+
+// Add a pipeline to the AST immediately before another pipeline.
+func insertPipeline(ast *syntax.Ast, pipe, before *syntax.Pipeline) {
+	for i, p := range ast.Pipelines {
+		if p == before {
+			ast.Pipelines = append(ast.Pipelines, nil)
+			copy(ast.Pipelines[i+1:], ast.Pipelines[i:])
+			ast.Pipelines[i] = pipe
+			break
+		}
+	}
+	if ast.Callables == nil {
+		return
+	}
+	for i, c := range ast.Callables.List {
+		if c == before {
+			ast.Callables.List = append(ast.Callables.List, nil)
+			copy(ast.Callables.List[i+1:], ast.Callables.List[i:])
+			ast.Callables.List[i] = pipe
+			break
+		}
+	}
+	if ast.Callables.Table != nil {
+		ast.Callables.Table[pipe.Id] = pipe
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package refactoring
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+const extractTestSrc = `
+filetype txt;
+
+struct POINT(
+    int x,
+    int y,
+)
+
+stage MAKE(
+    in  int   seed,
+    out POINT point,
+    out int   count,
+    src comp  "none",
+)
+
+stage SCALE(
+    in  POINT point,
+    in  int   factor,
+    out POINT point,
+    out txt   log,
+    src comp  "none",
+)
+
+stage SUM(
+    in  int x,
+    in  int y,
+    out int sum,
+    src comp "none",
+)
+
+pipeline PIPE(
+    in  int seed,
+    in  int factor,
+    out int sum,
+    out int count,
+)
+{
+    call MAKE(
+        seed = self.seed,
+    )
+
+    call SCALE(
+        point  = MAKE.point,
+        factor = self.factor,
+    )
+
+    call SUM(
+        x = SCALE.point.x,
+        y = SCALE.point.y,
+    ) using (
+        volatile = true,
+    )
+
+    return (
+        sum   = SUM.sum,
+        count = MAKE.count,
+    )
+
+    retain (
+        SCALE.log,
+    )
+}
+`
+
+func TestExtractPipeline(t *testing.T) {
+	var parser syntax.Parser
+	_, file, _, _ := runtime.Caller(0)
+	srcBytes := []byte(extractTestSrc)
+	_, _, ast, err := parser.ParseSourceBytes(srcBytes, file,
+		nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipe := ast.Callables.Table["PIPE"].(*syntax.Pipeline)
+	edit, err := ExtractPipeline(pipe, []string{"SCALE", "SUM"},
+		"SCALE_SUM", []*syntax.Ast{ast})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := edit.Apply(ast); err != nil {
+		t.Error(err)
+	}
+	if ast.Callables.Table["SCALE_SUM"] == nil {
+		t.Error("expected SCALE_SUM to be added to the callables table")
+	}
+	fmtAst, err := parser.UncheckedParse(srcBytes, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := edit.Apply(fmtAst); err != nil {
+		t.Fatal(err)
+	} else if c != 3 {
+		t.Errorf("%d != 3", c)
+	}
+	const expected = `filetype txt;
+
+struct POINT(
+    int x,
+    int y,
+)
+
+stage MAKE(
+    in  int   seed,
+    out POINT point,
+    out int   count,
+    src comp  "none",
+)
+
+stage SCALE(
+    in  POINT point,
+    in  int   factor,
+    out POINT point,
+    out txt   log,
+    src comp  "none",
+)
+
+stage SUM(
+    in  int x,
+    in  int y,
+    out int sum,
+    src comp "none",
+)
+
+pipeline SCALE_SUM(
+    in  int   factor,
+    in  POINT point,
+    out int   sum,
+)
+{
+    call SCALE(
+        point  = self.point,
+        factor = self.factor,
+    )
+
+    call SUM(
+        x = SCALE.point.x,
+        y = SCALE.point.y,
+    ) using (
+        volatile = true,
+    )
+
+    return (
+        sum = SUM.sum,
+    )
+
+    retain (
+        SCALE.log,
+    )
+}
+
+pipeline PIPE(
+    in  int seed,
+    in  int factor,
+    out int sum,
+    out int count,
+)
+{
+    call MAKE(
+        seed = self.seed,
+    )
+
+    call SCALE_SUM(
+        factor = self.factor,
+        point  = MAKE.point,
+    )
+
+    return (
+        sum   = SCALE_SUM.sum,
+        count = MAKE.count,
+    )
+}
+`
+	if s := fmtAst.Format(); s != expected {
+		diff(t, expected, s)
+	}
+}
+
+func TestExtractPipelineCycle(t *testing.T) {
+	var parser syntax.Parser
+	_, file, _, _ := runtime.Caller(0)
+	_, _, ast, err := parser.ParseSourceBytes([]byte(extractTestSrc), file,
+		nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipe := ast.Callables.Table["PIPE"].(*syntax.Pipeline)
+	if _, err := ExtractPipeline(pipe, []string{"MAKE", "SUM"},
+		"MAKE_SUM", []*syntax.Ast{ast}); err == nil {
+		t.Error("expected an error extracting calls around SCALE")
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package refactoring
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+// InlineCall creates an edit which replaces a call to a sub-pipeline with the
+// calls made by that sub-pipeline.
+//
+// References to the sub-pipeline's inputs are replaced with the expressions
+// bound to them by the call, and references to the call's outputs are replaced
+// with the expressions returned by the sub-pipeline.  Inlined calls keep their
+// ids unless that would collide with another call in the pipeline, in which
+// case they are prefixed with the id of the replaced call.
+//
+// The pipeline and asts must be fully compiled.
+func InlineCall(pipe *syntax.Pipeline, callId string,
+	asts []*syntax.Ast) (Edit, error) {
+	if pipe.Callables == nil {
+		panic("pipeline was not fully compiled")
+	}
+	var call *syntax.CallStm
+	ids := make(StringSet, len(pipe.Calls))
+	for _, c := range pipe.Calls {
+		if c.Id == callId {
+			call = c
+		} else {
+			ids.Add(c.Id)
+		}
+	}
+	if call == nil {
+		return nil, fmt.Errorf("%s does not call %s", pipe.Id, callId)
+	}
+	sub, ok := pipe.Callables.Table[callId].(*syntax.Pipeline)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a call to a pipeline", callId)
+	}
+	if call.CallMode() != syntax.ModeSingleCall {
+		return nil, fmt.Errorf("cannot inline mapped call %s", callId)
+	}
+	for _, binding := range call.Bindings.List {
+		if binding.Exp.HasSplit() {
+			return nil, fmt.Errorf("cannot inline mapped call %s", callId)
+		}
+	}
+	if mods := call.Modifiers; mods != nil && (mods.Local || mods.Preflight ||
+		mods.Volatile || mods.Bindings != nil && len(mods.Bindings.List) > 0) {
+		return nil, fmt.Errorf("cannot inline %s because it has modifiers",
+			callId)
+	}
+
+	edit := inlineCallEdit{
+		Pipeline:  pipe,
+		CallId:    callId,
+		Returns:   make(map[string]syntax.Exp, len(sub.OutParams.List)),
+		Callables: make(map[string]syntax.Callable, len(sub.Calls)),
+	}
+	newIds := make(map[string]string, len(sub.Calls))
+	for _, c := range sub.Calls {
+		id := c.Id
+		if ids.Contains(id) {
+			prefixed := callId + "_" + c.Id
+			id = prefixed
+			for i := 2; ids.Contains(id); i++ {
+				id = prefixed + strconv.Itoa(i)
+			}
+		}
+		ids.Add(id)
+		newIds[c.Id] = id
+		edit.Callables[id] = sub.Callables.Table[c.Id]
+	}
+	args := make(map[string]syntax.Exp, len(call.Bindings.List))
+	for _, binding := range call.Bindings.List {
+		args[binding.Id] = binding.Exp
+	}
+	replaceInner := func(ref *syntax.RefExp) (syntax.Exp, error) {
+		switch ref.Kind {
+		case syntax.KindSelf:
+			arg := args[ref.Id]
+			if arg == nil {
+				return nil, fmt.Errorf("input %s of %s is not bound",
+					ref.Id, callId)
+			}
+			return refPath(arg, ref.OutputId)
+		case syntax.KindCall:
+			r := *ref
+			r.Id = newIds[ref.Id]
+			return &r, nil
+		}
+		return nil, nil
+	}
+
+	loc := call.Node.Loc
+	edit.Calls = make([]*syntax.CallStm, 0, len(sub.Calls))
+	for _, c := range sub.Calls {
+		newCall, err := copyCall(c, replaceInner)
+		if err != nil {
+			return nil, err
+		}
+		newCall.Node = relocateNode(c.Node, loc)
+		newCall.Id = newIds[c.Id]
+		relocateBindings(newCall.Bindings, loc)
+		if newCall.Modifiers != nil {
+			relocateBindings(newCall.Modifiers.Bindings, loc)
+		}
+		edit.Calls = append(edit.Calls, newCall)
+	}
+	if sub.Ret != nil && sub.Ret.Bindings != nil {
+		for _, binding := range sub.Ret.Bindings.List {
+			exp, err := replaceRefs(binding.Exp, replaceInner)
+			if err != nil {
+				return nil, err
+			}
+			edit.Returns[binding.Id] = relocateExp(exp, loc)
+		}
+	}
+	if sub.Retain != nil {
+		for _, ref := range sub.Retain.Refs {
+			if ref.Kind == syntax.KindCall {
+				r := *ref
+				r.Node = relocateNode(ref.Node, loc)
+				r.Id = newIds[ref.Id]
+				edit.Retains = append(edit.Retains, &r)
+			}
+		}
+	}
+
+	// Check that the references to the call can all be replaced.
+	for _, c := range pipe.Calls {
+		if c != call {
+			if _, err := copyCall(c, edit.replaceOutputs); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if pipe.Ret != nil {
+		if _, err := copyBindings(pipe.Ret.Bindings, edit.replaceOutputs); err != nil {
+			return nil, err
+		}
+	}
+	return &edit, nil
+}
+
+type inlineCallEdit struct {
+	Pipeline *syntax.Pipeline
+	CallId   string
+
+	// The calls to insert in place of the inlined call.
+	Calls []*syntax.CallStm
+
+	// The expressions to substitute for references to each output of the
+	// inlined call.
+	Returns map[string]syntax.Exp
+
+	// References to inlined calls which were retained by the sub-pipeline.
+	Retains []*syntax.RefExp
+
+	// The callables for the inlined calls, by call id.
+	Callables map[string]syntax.Callable
+}
+
+func (self *inlineCallEdit) replaceOutputs(ref *syntax.RefExp) (syntax.Exp, error) {
+	if ref.Kind != syntax.KindCall || ref.Id != self.CallId {
+		return nil, nil
+	}
+	root, rest := splitOutputId(ref.OutputId)
+	if root == "" {
+		return nil, fmt.Errorf(
+			"cannot inline %s because its entire output is referenced",
+			self.CallId)
+	}
+	exp := self.Returns[root]
+	if exp == nil {
+		return nil, fmt.Errorf("%s has no output %s", self.CallId, root)
+	}
+	return refPath(exp, rest)
+}
+
+func (self *inlineCallEdit) Apply(ast *syntax.Ast) (int, error) {
+	pipe := findMatchingPipeline(self.Pipeline, ast)
+	if pipe == nil {
+		return 0, nil
+	}
+	index := -1
+	for i, call := range pipe.Calls {
+		if call.Id == self.CallId {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return 0, nil
+	}
+	call := pipe.Calls[index]
+	calls := make([]*syntax.CallStm, 0, len(pipe.Calls)+len(self.Calls)-1)
+	calls = append(calls, pipe.Calls[:index]...)
+	for i, c := range self.Calls {
+		newCall, err := copyCall(c, func(*syntax.RefExp) (syntax.Exp, error) {
+			return nil, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 && len(call.Node.Comments) > 0 {
+			// Keep the comments from the replaced call.
+			comments := make([]string, 0,
+				len(call.Node.Comments)+len(c.Node.Comments))
+			comments = append(comments, call.Node.Comments...)
+			newCall.Node.Comments = append(comments, c.Node.Comments...)
+		}
+		calls = append(calls, newCall)
+	}
+	calls = append(calls, pipe.Calls[index+1:]...)
+	for _, c := range calls {
+		if err := replaceCallRefs(c, self.replaceOutputs); err != nil {
+			return 0, err
+		}
+	}
+	if pipe.Ret != nil {
+		if err := replaceBindingRefs(pipe.Ret.Bindings, self.replaceOutputs); err != nil {
+			return 0, err
+		}
+	}
+	pipe.Calls = calls
+	self.updateRetains(pipe)
+	if pipe.Callables != nil && pipe.Callables.Table != nil {
+		delete(pipe.Callables.Table, self.CallId)
+		for id, callable := range self.Callables {
+			pipe.Callables.Table[id] = callable
+		}
+	}
+	return 1, nil
+}
+
+// Replace retained references to the inlined call with references to the
+// calls which produced the retained values, and add any references retained
+// by the sub-pipeline.
+func (self *inlineCallEdit) updateRetains(pipe *syntax.Pipeline) {
+	var refs []*syntax.RefExp
+	if pipe.Retain != nil {
+		refs = make([]*syntax.RefExp, 0, len(pipe.Retain.Refs)+len(self.Retains))
+		for _, ref := range pipe.Retain.Refs {
+			if ref.Kind != syntax.KindCall || ref.Id != self.CallId {
+				refs = append(refs, ref)
+			} else if exp, err := self.replaceOutputs(ref); err == nil {
+				// Retains can only refer to call outputs, so retained
+				// outputs which were bound to inputs or literal values
+				// are dropped.
+				if r, ok := exp.(*syntax.RefExp); ok && r.Kind == syntax.KindCall {
+					refs = append(refs, r)
+				}
+			}
+		}
+	}
+	for _, ref := range self.Retains {
+		r := *ref
+		refs = append(refs, &r)
+	}
+	if len(refs) == 0 {
+		pipe.Retain = nil
+		return
+	}
+	if pipe.Retain == nil {
+		pipe.Retain = &syntax.PipelineRetains{
+			Node: syntax.NewAstNode(pipe.Node.Loc),
+		}
+	}
+	pipe.Retain.Refs = refs
+}
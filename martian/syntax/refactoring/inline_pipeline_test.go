@@ -0,0 +1,174 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package refactoring
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+func TestInlineCall(t *testing.T) {
+	var parser syntax.Parser
+	_, file, _, _ := runtime.Caller(0)
+	const src = `
+filetype txt;
+
+stage ADD(
+    in  int x,
+    in  int y,
+    out int sum,
+    out txt log,
+    src comp "none",
+)
+
+pipeline SUB(
+    in  int a,
+    in  int b,
+    out int total,
+)
+{
+    # Add them up.
+    call ADD(
+        x = self.a,
+        y = self.b,
+    )
+
+    call ADD as DOUBLE(
+        x = ADD.sum,
+        y = ADD.sum,
+    )
+
+    return (
+        total = DOUBLE.sum,
+    )
+
+    retain (
+        ADD.log,
+    )
+}
+
+pipeline PIPE(
+    in  int a,
+    out int total,
+    out int sum,
+)
+{
+    call ADD(
+        x = self.a,
+        y = 1,
+    )
+
+    call SUB(
+        a = ADD.sum,
+        b = 2,
+    )
+
+    return (
+        total = SUB.total,
+        sum   = ADD.sum,
+    )
+}
+`
+	srcBytes := []byte(src)
+	_, _, ast, err := parser.ParseSourceBytes(srcBytes, file,
+		nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipe := ast.Callables.Table["PIPE"].(*syntax.Pipeline)
+	if _, err := InlineCall(pipe, "ADD", []*syntax.Ast{ast}); err == nil {
+		t.Error("expected an error inlining a stage")
+	}
+	edit, err := InlineCall(pipe, "SUB", []*syntax.Ast{ast})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := edit.Apply(ast); err != nil {
+		t.Error(err)
+	}
+	if pipe.Callables.Table["SUB_ADD"] == nil {
+		t.Error("expected SUB_ADD in the pipeline's callables")
+	}
+	fmtAst, err := parser.UncheckedParse(srcBytes, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := edit.Apply(fmtAst); err != nil {
+		t.Fatal(err)
+	} else if c != 1 {
+		t.Errorf("%d != 1", c)
+	}
+	const expected = `filetype txt;
+
+stage ADD(
+    in  int x,
+    in  int y,
+    out int sum,
+    out txt log,
+    src comp "none",
+)
+
+pipeline SUB(
+    in  int a,
+    in  int b,
+    out int total,
+)
+{
+    # Add them up.
+    call ADD(
+        x = self.a,
+        y = self.b,
+    )
+
+    call ADD as DOUBLE(
+        x = ADD.sum,
+        y = ADD.sum,
+    )
+
+    return (
+        total = DOUBLE.sum,
+    )
+
+    retain (
+        ADD.log,
+    )
+}
+
+pipeline PIPE(
+    in  int a,
+    out int total,
+    out int sum,
+)
+{
+    call ADD(
+        x = self.a,
+        y = 1,
+    )
+
+    # Add them up.
+    call ADD as SUB_ADD(
+        x = ADD.sum,
+        y = 2,
+    )
+
+    call ADD as DOUBLE(
+        x = SUB_ADD.sum,
+        y = SUB_ADD.sum,
+    )
+
+    return (
+        total = DOUBLE.sum,
+        sum   = ADD.sum,
+    )
+
+    retain (
+        SUB_ADD.log,
+    )
+}
+`
+	if s := fmtAst.Format(); s != expected {
+		diff(t, expected, s)
+	}
+}
@@ -35,6 +35,28 @@ type RenameParam struct {
 	NewName string
 }
 
+// AddParam specifies a new parameter for a callable, along with the default
+// value to bind it to.
+type AddParam struct {
+	CallableParam
+	Type    syntax.TypeId
+	Default syntax.Exp
+}
+
+// ExtractCalls specifies a set of calls to move from a pipeline into a new
+// pipeline.
+type ExtractCalls struct {
+	Pipeline string
+	Calls    []string
+	NewName  string
+}
+
+// PipelineCall identifies a call within a pipeline.
+type PipelineCall struct {
+	Pipeline string
+	Call     string
+}
+
 // RefactorConfig contains options to be passed to Refactor.
 type RefactorConfig struct {
 	// If topCalls is non-empty, the RemoveUnusedOutputs will be applied repeatedly
@@ -60,6 +82,31 @@ type RefactorConfig struct {
 
 	// Rename the given output parameters.
 	RenameOutParam []RenameParam
+
+	// Add the given input parameters.
+	AddInParam []AddParam
+
+	// Add the given output parameters.
+	AddOutParam []AddParam
+
+	// Move the given calls into new pipelines.
+	Extract []ExtractCalls
+
+	// Replace the given calls to pipelines with the calls those pipelines
+	// make.
+	Inline []PipelineCall
+}
+
+func findPipeline(id string, asts []*syntax.Ast) (*syntax.Pipeline, error) {
+	callable := getCallable(id, asts)
+	if callable == nil {
+		return nil, fmt.Errorf("callable %s not found", id)
+	}
+	pipe, ok := callable.(*syntax.Pipeline)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a pipeline", id)
+	}
+	return pipe, nil
 }
 
 // Refactor modifies a set of ASTs.
@@ -119,6 +166,74 @@ func Refactor(asts []*syntax.Ast,
 			}
 		}
 	}
+	for _, extract := range opt.Extract {
+		pipe, err := findPipeline(extract.Pipeline, asts)
+		if err != nil {
+			return edits, err
+		}
+		edit, err := ExtractPipeline(pipe, extract.Calls, extract.NewName, asts)
+		if err != nil {
+			return edits, err
+		}
+		edits = append(edits, edit)
+		for _, ast := range asts {
+			// Run this on the compiled ASTs so that later edits see the
+			// new pipeline.
+			if _, err := edit.Apply(ast); err != nil {
+				return edits, fmt.Errorf("applying edit: %w", err)
+			}
+		}
+	}
+	for _, inline := range opt.Inline {
+		pipe, err := findPipeline(inline.Pipeline, asts)
+		if err != nil {
+			return edits, err
+		}
+		edit, err := InlineCall(pipe, inline.Call, asts)
+		if err != nil {
+			return edits, err
+		}
+		edits = append(edits, edit)
+		for _, ast := range asts {
+			// Run this on the compiled ASTs so that later edits see the
+			// inlined calls.
+			if _, err := edit.Apply(ast); err != nil {
+				return edits, fmt.Errorf("applying edit: %w", err)
+			}
+		}
+	}
+	for _, add := range opt.AddInParam {
+		callable := getCallable(add.Callable, asts)
+		if callable == nil {
+			return edits, fmt.Errorf("callable %s not found", add.Callable)
+		}
+		edit, err := AddInput(callable, add.Param, add.Type, add.Default, asts)
+		if err != nil {
+			return edits, err
+		}
+		edits = append(edits, edit)
+		for _, ast := range asts {
+			if _, err := edit.Apply(ast); err != nil {
+				return edits, fmt.Errorf("applying edit: %w", err)
+			}
+		}
+	}
+	for _, add := range opt.AddOutParam {
+		callable := getCallable(add.Callable, asts)
+		if callable == nil {
+			return edits, fmt.Errorf("callable %s not found", add.Callable)
+		}
+		edit, err := AddOutput(callable, add.Param, add.Type, add.Default, asts)
+		if err != nil {
+			return edits, err
+		}
+		edits = append(edits, edit)
+		for _, ast := range asts {
+			if _, err := edit.Apply(ast); err != nil {
+				return edits, fmt.Errorf("applying edit: %w", err)
+			}
+		}
+	}
 	for _, removeParam := range opt.RemoveInParams {
 		cname := removeParam.Callable
 		param := removeParam.Param
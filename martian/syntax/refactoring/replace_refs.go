@@ -0,0 +1,272 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package refactoring
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/martian-lang/martian/martian/syntax"
+)
+
+// A refReplacer returns the expression which should replace a reference, or
+// nil if the reference should be left alone.
+type refReplacer func(*syntax.RefExp) (syntax.Exp, error)
+
+// Returns an expression with each reference replaced according to the given
+// function.  Parts of the expression which do not change are shared with the
+// original, which is not modified.
+func replaceRefs(exp syntax.Exp, f refReplacer) (syntax.Exp, error) {
+	if exp == nil || !exp.HasRef() {
+		return exp, nil
+	}
+	switch exp := exp.(type) {
+	case *syntax.RefExp:
+		if e, err := f(exp); err != nil || e == nil {
+			return exp, err
+		} else {
+			return e, nil
+		}
+	case *syntax.SplitExp:
+		e, err := replaceRefs(exp.Value, f)
+		if err != nil || e == exp.Value {
+			return exp, err
+		}
+		ee := *exp
+		ee.Value = e
+		return &ee, nil
+	case *syntax.ArrayExp:
+		arr := make([]syntax.Exp, 0, len(exp.Value))
+		change := false
+		for _, v := range exp.Value {
+			e, err := replaceRefs(v, f)
+			if err != nil {
+				return exp, err
+			}
+			arr = append(arr, e)
+			if e != v {
+				change = true
+			}
+		}
+		if !change {
+			return exp, nil
+		}
+		ee := *exp
+		ee.Value = arr
+		return &ee, nil
+	case *syntax.MapExp:
+		m := make(map[string]syntax.Exp, len(exp.Value))
+		change := false
+		for k, v := range exp.Value {
+			e, err := replaceRefs(v, f)
+			if err != nil {
+				return exp, err
+			}
+			m[k] = e
+			if e != v {
+				change = true
+			}
+		}
+		if !change {
+			return exp, nil
+		}
+		ee := *exp
+		ee.Value = m
+		return &ee, nil
+	}
+	return exp, nil
+}
+
+// Replace references in each of the given bindings.
+func replaceBindingRefs(bindings *syntax.BindStms, f refReplacer) error {
+	if bindings == nil {
+		return nil
+	}
+	for _, binding := range bindings.List {
+		if exp, err := replaceRefs(binding.Exp, f); err != nil {
+			return err
+		} else {
+			binding.Exp = exp
+		}
+	}
+	return nil
+}
+
+// Replace references in the bindings and modifiers of a call.
+func replaceCallRefs(call *syntax.CallStm, f refReplacer) error {
+	if err := replaceBindingRefs(call.Bindings, f); err != nil {
+		return err
+	}
+	if call.Modifiers != nil {
+		return replaceBindingRefs(call.Modifiers.Bindings, f)
+	}
+	return nil
+}
+
+// Returns a copy of the given bindings, with references replaced.
+func copyBindings(bindings *syntax.BindStms, f refReplacer) (*syntax.BindStms, error) {
+	if bindings == nil {
+		return nil, nil
+	}
+	result := &syntax.BindStms{
+		Node:  bindings.Node,
+		List:  make([]*syntax.BindStm, len(bindings.List)),
+		Table: make(map[string]*syntax.BindStm, len(bindings.List)),
+	}
+	for i, binding := range bindings.List {
+		b := *binding
+		if exp, err := replaceRefs(binding.Exp, f); err != nil {
+			return nil, err
+		} else {
+			b.Exp = exp
+		}
+		result.List[i] = &b
+		result.Table[b.Id] = &b
+	}
+	return result, nil
+}
+
+// Returns a copy of the given call with references replaced.
+func copyCall(call *syntax.CallStm, f refReplacer) (*syntax.CallStm, error) {
+	c := *call
+	var err error
+	if c.Bindings, err = copyBindings(call.Bindings, f); err != nil {
+		return nil, err
+	}
+	if call.Modifiers != nil {
+		mods := *call.Modifiers
+		if mods.Bindings, err = copyBindings(call.Modifiers.Bindings, f); err != nil {
+			return nil, err
+		}
+		c.Modifiers = &mods
+	}
+	return &c, nil
+}
+
+// Split a reference's output path into the top-level output and the path
+// within that output.
+func splitOutputId(outputId string) (string, string) {
+	if i := strings.IndexByte(outputId, '.'); i >= 0 {
+		return outputId[:i], outputId[i+1:]
+	}
+	return outputId, ""
+}
+
+// Returns a reference to the given path within the value of an expression.
+// This is only possible if the expression is itself a reference.
+func refPath(exp syntax.Exp, path string) (syntax.Exp, error) {
+	if path == "" {
+		return exp, nil
+	}
+	ref, ok := exp.(*syntax.RefExp)
+	if !ok {
+		return nil, fmt.Errorf(
+			"cannot refer to %s within an expression which is not a reference",
+			path)
+	}
+	r := *ref
+	if r.OutputId == "" {
+		r.OutputId = path
+	} else {
+		r.OutputId += "." + path
+	}
+	return &r, nil
+}
+
+// Returns a deep copy of the expression with every node moved to the given
+// location, keeping comments.  The formatter uses node locations to detect
+// transitions between included files, so expressions copied from another file
+// must be moved.
+func relocateExp(exp syntax.Exp, loc syntax.SourceLoc) syntax.Exp {
+	switch exp := exp.(type) {
+	case *syntax.RefExp:
+		e := *exp
+		e.Node.Loc = loc
+		return &e
+	case *syntax.SplitExp:
+		e := *exp
+		e.Node.Loc = loc
+		e.Value = relocateExp(exp.Value, loc)
+		return &e
+	case *syntax.ArrayExp:
+		e := *exp
+		e.Node.Loc = loc
+		e.Value = make([]syntax.Exp, len(exp.Value))
+		for i, v := range exp.Value {
+			e.Value[i] = relocateExp(v, loc)
+		}
+		return &e
+	case *syntax.MapExp:
+		e := *exp
+		e.Node.Loc = loc
+		e.Value = make(map[string]syntax.Exp, len(exp.Value))
+		for k, v := range exp.Value {
+			e.Value[k] = relocateExp(v, loc)
+		}
+		return &e
+	case *syntax.StringExp:
+		e := *exp
+		e.Node.Loc = loc
+		return &e
+	case *syntax.IntExp:
+		e := *exp
+		e.Node.Loc = loc
+		return &e
+	case *syntax.FloatExp:
+		e := *exp
+		e.Node.Loc = loc
+		return &e
+	case *syntax.BoolExp:
+		e := *exp
+		e.Node.Loc = loc
+		return &e
+	case *syntax.NullExp:
+		e := *exp
+		e.Node.Loc = loc
+		return &e
+	}
+	return exp
+}
+
+// Move the nodes of a set of bindings to the given location.  The bindings
+// must already be a copy.
+func relocateBindings(bindings *syntax.BindStms, loc syntax.SourceLoc) {
+	if bindings == nil {
+		return
+	}
+	bindings.Node = relocateNode(bindings.Node, loc)
+	for _, binding := range bindings.List {
+		binding.Node = relocateNode(binding.Node, loc)
+		binding.Exp = relocateExp(binding.Exp, loc)
+	}
+}
+
+// Returns a node at the given location with the same comments as the
+// original.
+func relocateNode(node syntax.AstNode, loc syntax.SourceLoc) syntax.AstNode {
+	n := syntax.NewAstNode(loc)
+	n.Comments = node.Comments
+	return n
+}
+
+// Find the compiled AST which defines the given pipeline.
+func findPipelineAst(pipe *syntax.Pipeline, asts []*syntax.Ast) *syntax.Ast {
+	for _, ast := range asts {
+		if ast != nil && ast.Callables != nil &&
+			ast.Callables.Table[pipe.Id] == pipe {
+			return ast
+		}
+	}
+	return nil
+}
+
+// Find the pipeline in the given ast with the same name and defining file as
+// the given pipeline.
+func findMatchingPipeline(pipe *syntax.Pipeline, ast *syntax.Ast) *syntax.Pipeline {
+	for _, p := range ast.Pipelines {
+		if p.Id == pipe.Id && syntax.DefiningFile(p) == syntax.DefiningFile(pipe) {
+			return p
+		}
+	}
+	return nil
+}
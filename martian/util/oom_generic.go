@@ -0,0 +1,12 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+// +build !linux
+
+// Stub for out-of-memory kill detection on non-linux systems.
+
+package util
+
+// Returns -1.
+func GetOOMKillCount() int64 {
+	return -1
+}
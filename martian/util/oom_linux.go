@@ -0,0 +1,30 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+// Detection of processes killed by the kernel's out-of-memory killer.
+
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+)
+
+// Get the number of processes which have been killed by the kernel's
+// out-of-memory killer since boot, including kills due to cgroup memory
+// limits.  Returns -1 if the count is not available.
+func GetOOMKillCount() int64 {
+	f, err := os.Open("/proc/vmstat")
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	prefix := []byte("oom_kill ")
+	for scanner.Scan() {
+		if line := scanner.Bytes(); bytes.HasPrefix(line, prefix) {
+			return parseCgroupInt(line[len(prefix):])
+		}
+	}
+	return -1
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package util
+
+// Implementation of the 64-bit xxHash algorithm, which is much faster than
+// cryptographic hashes for checking the integrity of large files.
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// These are variables rather than constants so that arithmetic on them is
+// allowed to overflow.
+var (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+type xxHash64 struct {
+	v1, v2, v3, v4 uint64
+
+	// The total number of bytes written.
+	total uint64
+
+	// Bytes which have not yet been consumed into a full 32-byte stripe.
+	buf [32]byte
+	n   int
+}
+
+// NewXXHash64 returns a new hash.Hash64 computing the xxHash64 checksum
+// with a seed of 0.  The Sum method appends the checksum in big-endian
+// order, matching the canonical hex representation.
+func NewXXHash64() hash.Hash64 {
+	var h xxHash64
+	h.Reset()
+	return &h
+}
+
+func (self *xxHash64) Reset() {
+	self.v1 = xxPrime1 + xxPrime2
+	self.v2 = xxPrime2
+	self.v3 = 0
+	self.v4 = -xxPrime1
+	self.total = 0
+	self.n = 0
+}
+
+func (self *xxHash64) Size() int {
+	return 8
+}
+
+func (self *xxHash64) BlockSize() int {
+	return 32
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func (self *xxHash64) stripe(b []byte) {
+	self.v1 = xxRound(self.v1, binary.LittleEndian.Uint64(b[0:8]))
+	self.v2 = xxRound(self.v2, binary.LittleEndian.Uint64(b[8:16]))
+	self.v3 = xxRound(self.v3, binary.LittleEndian.Uint64(b[16:24]))
+	self.v4 = xxRound(self.v4, binary.LittleEndian.Uint64(b[24:32]))
+}
+
+func (self *xxHash64) Write(b []byte) (int, error) {
+	n := len(b)
+	self.total += uint64(n)
+	if self.n > 0 {
+		c := copy(self.buf[self.n:], b)
+		self.n += c
+		b = b[c:]
+		if self.n < len(self.buf) {
+			return n, nil
+		}
+		self.stripe(self.buf[:])
+		self.n = 0
+	}
+	for ; len(b) >= 32; b = b[32:] {
+		self.stripe(b)
+	}
+	self.n = copy(self.buf[:], b)
+	return n, nil
+}
+
+func (self *xxHash64) Sum64() uint64 {
+	var h uint64
+	if self.total >= 32 {
+		h = bits.RotateLeft64(self.v1, 1) +
+			bits.RotateLeft64(self.v2, 7) +
+			bits.RotateLeft64(self.v3, 12) +
+			bits.RotateLeft64(self.v4, 18)
+		h = xxMergeRound(h, self.v1)
+		h = xxMergeRound(h, self.v2)
+		h = xxMergeRound(h, self.v3)
+		h = xxMergeRound(h, self.v4)
+	} else {
+		h = self.v3 + xxPrime5
+	}
+	h += self.total
+	b := self.buf[:self.n]
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func (self *xxHash64) Sum(b []byte) []byte {
+	var s [8]byte
+	binary.BigEndian.PutUint64(s[:], self.Sum64())
+	return append(b, s[:]...)
+}
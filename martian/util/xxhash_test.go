@@ -0,0 +1,55 @@
+// Copyright (c) 2020 10X Genomics, Inc. All rights reserved.
+
+package util
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestXXHash64(t *testing.T) {
+	for _, c := range []struct {
+		input  string
+		expect string
+	}{
+		{"", "ef46db3751d8e999"},
+		{"a", "d24ec4f1a98c6e5b"},
+		{"abc", "44bc2cf5ad770999"},
+		{"Nobody inspects the spammish repetition", "fbcea83c8a378bf1"},
+	} {
+		h := NewXXHash64()
+		if _, err := h.Write([]byte(c.input)); err != nil {
+			t.Error(err)
+		}
+		if s := hex.EncodeToString(h.Sum(nil)); s != c.expect {
+			t.Errorf("Expected %s for %q, got %s", c.expect, c.input, s)
+		}
+	}
+}
+
+func TestXXHash64Streaming(t *testing.T) {
+	input := []byte(strings.Repeat("0123456789abcdefghijklmnopqrstuvwxyz", 10))
+	h := NewXXHash64()
+	if _, err := h.Write(input); err != nil {
+		t.Fatal(err)
+	}
+	expect := h.Sum64()
+	for _, size := range []int{1, 3, 7, 31, 32, 33, 100} {
+		h.Reset()
+		for b := input; len(b) > 0; {
+			n := size
+			if n > len(b) {
+				n = len(b)
+			}
+			if _, err := h.Write(b[:n]); err != nil {
+				t.Fatal(err)
+			}
+			b = b[n:]
+		}
+		if s := h.Sum64(); s != expect {
+			t.Errorf("Expected %x writing %d bytes at a time, got %x",
+				expect, size, s)
+		}
+	}
+}
@@ -323,6 +323,48 @@ def compare_vdrkill(output, expect, filename):
     return True
 
 
+_TRACE_CATEGORIES = frozenset(['split', 'chunk', 'join'])
+
+
+def trace_jobs(trace):
+    """Get the sorted category, name, and final state of each split, chunk,
+    and join in a trace.
+
+    Only the last attempt of each job is considered, so that pipestances
+    which were retried can be compared with ones which were not."""
+    last = {}
+    for event in trace.get('traceEvents', []):
+        if event.get('ph') != 'X' or event.get('cat') not in _TRACE_CATEGORIES:
+            continue
+        key = (event.get('cat'), event.get('name'))
+        if key not in last or event.get('ts', 0) >= last[key].get('ts', 0):
+            last[key] = event
+    return sorted(key + (event.get('args', {}).get('state'),)
+                  for key, event in last.items())
+
+
+def compare_trace(output, expect, filename):
+    """Compare two _trace.json files.
+
+    Only the set of split, chunk, and join events and their final states are
+    compared, since retries, timestamps, queue times, and the assignment of
+    jobs to slots vary between runs.
+    """
+    actual, expected, loaded = load_json(output, expect, filename)
+    if not loaded:
+        return False
+    actual, expected = trace_jobs(actual), trace_jobs(expected)
+    if not actual:
+        sys.stderr.write('%s has no job events\n' % filename)
+        return False
+    if actual != expected:
+        sys.stderr.write('Expected:\n%s\nActual:\n%s\n' %
+                         ('\n'.join(str(job) for job in expected),
+                          '\n'.join(str(job) for job in actual)))
+        return False
+    return True
+
+
 _TIMESTAMP_REGEX = re.compile(
     '[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{1,2}:[0-9]{2}:[0-9]{2}')
 
@@ -417,7 +459,10 @@ def _compare_true(*_):
 
 
 _SPECIAL_FILES = {
+    '_events': _compare_true,
+    '_manifest.json': _compare_true,
     '_perf': _compare_true,
+    '_psdir': _compare_true,
     '_uuid': _compare_true,
     '_versions': _compare_true,
     '_log': _compare_true,
@@ -426,6 +471,7 @@ _SPECIAL_FILES = {
     '_jobinfo': compare_jobinfo,
     '_finalstate': compare_finalstate,
     '_vdrkill': compare_vdrkill,
+    '_trace.json': compare_trace,
     '_outs': compare_json,
     '_args': compare_json,
     '_stage_defs': compare_json,